@@ -222,7 +222,8 @@ class ApiClient {
     // Prøv at parse error message fra response
     String message = 'HTTP Error: $statusCode';
     if (data is Map<String, dynamic>) {
-      message = data['message'] ?? data['error'] ?? message;
+      // Problem details (RFC 7807) bruger 'detail'
+      message = data['detail'] ?? data['message'] ?? data['error'] ?? message;
     }
 
     if (statusCode >= 500) {
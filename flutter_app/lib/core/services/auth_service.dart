@@ -1,36 +1,15 @@
-import 'package:flutter/foundation.dart' show kIsWeb;
-import 'package:google_sign_in/google_sign_in.dart';
 import 'package:flutter_web_auth_2/flutter_web_auth_2.dart';
 import '../../data/models/auth_response_model.dart';
 import '../../data/repositories/auth_repository.dart';
 
 class AuthService {
   final AuthRepository _authRepository;
-  GoogleSignIn? _googleSignIn;
-  bool _googleSignInInitialized = false;
-
-  // OAuth configuration
-  static const String googleClientId =
-      '8318618298-6pnp9073pprc7f9lihjief5gb53u3p5h.apps.googleusercontent.com';
-  static const String githubClientId = '';
-  static const String githubRedirectUri = '';
-  static const String githubAuthUrl =
-      'https://github.com/login/oauth/authorize';
-
-  AuthService({AuthRepository? authRepository, GoogleSignIn? googleSignIn})
-    : _authRepository = authRepository ?? AuthRepository();
 
-  // Lazy initialize Google Sign-In to prevent crashes
-  void _initializeGoogleSignIn() {
-    if (!kIsWeb && !_googleSignInInitialized) {
-      try {
-        _googleSignIn = GoogleSignIn(scopes: ['email', 'profile']);
-        _googleSignInInitialized = true;
-      } catch (e) {
-        print('Failed to initialize Google Sign-In: $e');
-      }
-    }
-  }
+  // Must be listed in the backend's SSO_REDIRECT_URIS
+  static const String ssoRedirectUri = 'officeas://auth';
+
+  AuthService({AuthRepository? authRepository})
+    : _authRepository = authRepository ?? AuthRepository();
 
   // Regular email/password login
   Future<AuthResponseModel> login(String email, String password) async {
@@ -54,46 +33,11 @@ class AuthService {
 
   // Google Sign-In
   Future<AuthResponseModel> signInWithGoogle() async {
-    // Google Sign-In on web requires additional setup
-    // throws helpful error on web
-    if (kIsWeb) {
-      throw 'Google Sign-In is not supported on web yet. Please use email/password login or run on mobile/desktop.';
-    }
-
-    // Initialize Google Sign-In if not already done
-    _initializeGoogleSignIn();
-
-    if (_googleSignIn == null) {
-      throw 'Google Sign-In could not be initialized. This feature requires additional platform configuration.';
-    }
-
     try {
-      // Sign out first to ensure account selection dialog appears
-      await _googleSignIn!.signOut();
-
-      final GoogleSignInAccount? googleUser = await _googleSignIn!.signIn();
-
-      if (googleUser == null) {
-        throw 'Google sign-in was cancelled by user';
-      }
-
-      final GoogleSignInAuthentication googleAuth =
-          await googleUser.authentication;
-
-      if (googleAuth.idToken == null || googleAuth.idToken!.isEmpty) {
-        throw 'Failed to get Google ID token';
-      }
-
-      // Use the ID token to authenticate with backend
-      return await _authRepository.ssoLogin(
-        provider: 'google',
-        idToken: googleAuth.idToken!,
-        email: googleUser.email,
-        name: googleUser.displayName ?? googleUser.email,
-      );
+      return await _signInWithProvider('google');
     } catch (e) {
-      if (e.toString().contains('cancelled')) {
-        throw e; // Rethrow cancellation as-is
+      if (e.toString().contains('CANCELED')) {
+        throw 'Google sign-in was cancelled by user';
       }
       throw 'Google sign-in failed: $e';
     }
@@ -102,34 +46,39 @@ class AuthService {
   // GitHub Sign-In
   Future<AuthResponseModel> signInWithGitHub() async {
     try {
-      // Build the authorization URL
-      final url = Uri.https('github.com', '/login/oauth/authorize', {
-        'client_id': githubClientId,
-        'redirect_uri': githubRedirectUri,
-        'scope': 'user:email',
-      });
-
-      // Perform the authentication
-      final result = await FlutterWebAuth2.authenticate(
-        url: url.toString(),
-        callbackUrlScheme: 'officeas',
-      );
-
-      // Extract the code from the redirect URL
-      final code = Uri.parse(result).queryParameters['code'];
-
-      if (code == null) {
-        throw 'No authorization code received';
-      }
-
-      // Call backend to exchange code for user info and get JWT
-      // The backend will handle the token exchange with GitHub
-      return await _authRepository.githubCallback(code);
+      return await _signInWithProvider('github');
     } catch (e) {
       throw 'GitHub sign-in failed: $e';
     }
   }
 
+  // Browser sign-in through the backend, which adds state, nonce and PKCE
+  Future<AuthResponseModel> _signInWithProvider(String provider) async {
+    final start = await _authRepository.ssoAuthorize(provider, ssoRedirectUri);
+
+    // Perform the authentication
+    final result = await FlutterWebAuth2.authenticate(
+      url: start['authorization_url'] as String,
+      callbackUrlScheme: 'officeas',
+    );
+
+    // Extract the code and state from the redirect URL
+    final params = Uri.parse(result).queryParameters;
+    final code = params['code'];
+    final state = params['state'];
+
+    if (code == null || state == null) {
+      throw 'No authorization code received';
+    }
+
+    if (state != start['state']) {
+      throw 'Login response did not match the request';
+    }
+
+    // The backend exchanges the code with the provider and returns our JWT
+    return await _authRepository.ssoCallback(provider, code, state);
+  }
+
   // Check if user is logged in
   Future<bool> isLoggedIn() async {
     return await _authRepository.isLoggedIn();
@@ -142,13 +91,6 @@ class AuthService {
 
   // Logout
   Future<void> logout() async {
-    try {
-      if (!kIsWeb && _googleSignIn != null) {
-        await _googleSignIn!.signOut();
-      }
-    } catch (e) {
-      // Ignore Google sign-out errors
-    }
     await _authRepository.logout();
   }
 }
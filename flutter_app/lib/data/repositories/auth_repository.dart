@@ -63,10 +63,20 @@ class AuthRepository {
     }
   }
 
+  // Nonce for ssoLogin; send it in the provider sign-in request first
+  Future<String> ssoNonce() async {
+    try {
+      final response = await _dio.post('/auth/sso/nonce');
+      return response.data['nonce'] as String;
+    } on DioException catch (e) {
+      throw _handleError(e);
+    }
+  }
+
   Future<AuthResponseModel> ssoLogin({
     required String provider,
     required String idToken,
-    required String email,
+    required String nonce,
     required String name,
     String? departmentId,
   }) async {
@@ -76,7 +86,7 @@ class AuthRepository {
         data: {
           'provider': provider,
           'id_token': idToken,
-          'email': email,
+          'nonce': nonce,
           'name': name,
           if (departmentId != null) 'department_id': departmentId,
         },
@@ -90,11 +100,31 @@ class AuthRepository {
     }
   }
 
-  Future<AuthResponseModel> githubCallback(String code) async {
+  Future<Map<String, dynamic>> ssoAuthorize(
+    String provider,
+    String redirectUri,
+  ) async {
+    try {
+      final response = await _dio.get(
+        '/auth/sso/$provider/authorize',
+        queryParameters: {'redirect_uri': redirectUri},
+      );
+
+      return Map<String, dynamic>.from(response.data);
+    } on DioException catch (e) {
+      throw _handleError(e);
+    }
+  }
+
+  Future<AuthResponseModel> ssoCallback(
+    String provider,
+    String code,
+    String state,
+  ) async {
     try {
       final response = await _dio.get(
-        '/auth/github/callback',
-        queryParameters: {'code': code},
+        '/auth/sso/$provider/callback',
+        queryParameters: {'code': code, 'state': state},
       );
 
       final authResponse = AuthResponseModel.fromJson(response.data);
@@ -133,6 +163,8 @@ class AuthRepository {
       final data = error.response?.data;
       if (data is String) {
         return data;
+      } else if (data is Map && data['detail'] != null) {
+        return data['detail'];
       } else if (data is Map && data['message'] != null) {
         return data['message'];
       }
@@ -23,6 +23,32 @@ func runMigrations(db *gorm.DB) error {
 		&models.AbsenceRequest{},
 		&models.AbsenceRequestComment{},
 		&models.Notification{},
+		&models.RefreshToken{},
+		&models.RevokedToken{},
+		&models.PasswordResetToken{},
+		&models.MfaRecoveryCode{},
+		&models.LoginAttempt{},
+		&models.OAuthState{},
+		&models.Identity{},
+		&models.SSOSettings{},
+		&models.SSOSignup{},
+		&models.APIToken{},
+		&models.NotificationPreference{},
+		&models.NotificationSettings{},
+		&models.Announcement{},
+		&models.AnnouncementReceipt{},
+		&models.TicketCategory{},
+		&models.BusinessCalendar{},
+		&models.BusinessHoliday{},
+		&models.SLAPolicy{},
+		&models.TicketEvent{},
+		&models.Attachment{},
+		&models.TicketWatcher{},
+		&models.AssignmentGroup{},
+		&models.AssignmentGroupMember{},
+		&models.RoutingRule{},
+		&models.InboundEmail{},
+		&models.TicketLink{},
 	)
 }
 
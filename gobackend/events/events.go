@@ -0,0 +1,168 @@
+// Package events is an in-process bus for domain events.
+//
+// Handlers publish an event with the transaction that made the change. Subscribers
+// run synchronously inside that transaction, so their writes commit or roll back
+// together with the change that caused them.
+package events
+
+import (
+	"sync"
+
+	"stuff/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Event names
+const (
+	TicketCreated         = "ticket.created"
+	TicketUpdated         = "ticket.updated"
+	TicketCommented       = "ticket.commented"
+	AbsenceReviewed       = "absence.reviewed"
+	ShiftCreated          = "shift.created"
+	ShiftCancelled        = "shift.cancelled"
+	FeedbackReceived      = "feedback.received"
+	AnnouncementPublished = "announcement.published"
+	TicketSLABreached     = "ticket.sla_breached"
+	TicketMerged          = "ticket.merged"
+)
+
+// Event is something that happened in the domain
+type Event interface {
+	Name() string
+}
+
+// Handler reacts to an event inside the publisher's transaction.
+// Returning an error rolls the whole transaction back.
+type Handler func(tx *gorm.DB, e Event) error
+
+// Bus dispatches events to their subscribers
+type Bus struct {
+	mu       sync.RWMutex
+	handlers map[string][]Handler
+}
+
+// NewBus returns an empty bus
+func NewBus() *Bus {
+	return &Bus{handlers: make(map[string][]Handler)}
+}
+
+// Subscribe registers a handler for the named event
+func (b *Bus) Subscribe(name string, h Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers[name] = append(b.handlers[name], h)
+}
+
+// Publish runs every subscriber of the event in order, stopping at the first error.
+// A nil bus discards events.
+func (b *Bus) Publish(tx *gorm.DB, e Event) error {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.RLock()
+	handlers := b.handlers[e.Name()]
+	b.mu.RUnlock()
+
+	for _, h := range handlers {
+		if err := h(tx, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TicketCreatedEvent is published after a ticket is opened
+type TicketCreatedEvent struct {
+	ActorID uuid.UUID
+	Ticket  models.Ticket
+	Reason  string // optional, e.g. the routing rule that assigned the ticket
+}
+
+func (TicketCreatedEvent) Name() string { return TicketCreated }
+
+// TicketUpdatedEvent is published after a ticket is edited or changes status
+type TicketUpdatedEvent struct {
+	ActorID uuid.UUID
+	Before  models.Ticket
+	After   models.Ticket
+	Reason  string // optional, given with status transitions and re-routing
+}
+
+func (TicketUpdatedEvent) Name() string { return TicketUpdated }
+
+// TicketCommentedEvent is published after a comment is added to a ticket
+type TicketCommentedEvent struct {
+	ActorID uuid.UUID
+	Ticket  models.Ticket
+	Comment models.TicketComment
+}
+
+func (TicketCommentedEvent) Name() string { return TicketCommented }
+
+// AbsenceReviewedEvent is published after an absence request is approved or rejected
+type AbsenceReviewedEvent struct {
+	ActorID uuid.UUID
+	Request models.AbsenceRequest
+}
+
+func (AbsenceReviewedEvent) Name() string { return AbsenceReviewed }
+
+// ShiftCreatedEvent is published after a shift is planned
+type ShiftCreatedEvent struct {
+	ActorID uuid.UUID
+	Shift   models.Shift
+}
+
+func (ShiftCreatedEvent) Name() string { return ShiftCreated }
+
+// ShiftCancelledEvent is published after a shift is deleted
+type ShiftCancelledEvent struct {
+	ActorID uuid.UUID
+	Shift   models.Shift
+}
+
+func (ShiftCancelledEvent) Name() string { return ShiftCancelled }
+
+// FeedbackReceivedEvent is published after feedback is given to a department.
+// Feedback is anonymous, so there is no actor.
+type FeedbackReceivedEvent struct {
+	Feedback models.Feedback
+}
+
+func (FeedbackReceivedEvent) Name() string { return FeedbackReceived }
+
+// AnnouncementPublishedEvent is published when an announcement goes out to its audience
+type AnnouncementPublishedEvent struct {
+	Announcement models.Announcement
+	Recipients   []uuid.UUID
+}
+
+func (AnnouncementPublishedEvent) Name() string { return AnnouncementPublished }
+
+// SLA targets a ticket can breach
+const (
+	SLATargetFirstResponse = "first_response"
+	SLATargetResolution    = "resolution"
+)
+
+// TicketSLABreachedEvent is published once when a ticket misses an SLA target.
+// Breaches are found by a background job, so there is no actor.
+type TicketSLABreachedEvent struct {
+	Ticket models.Ticket
+	Target string // SLATargetFirstResponse or SLATargetResolution
+}
+
+func (TicketSLABreachedEvent) Name() string { return TicketSLABreached }
+
+// TicketMergedEvent is published after duplicates are merged into a primary ticket
+type TicketMergedEvent struct {
+	ActorID    uuid.UUID
+	Primary    models.Ticket
+	Duplicates []models.Ticket // as they were before the merge
+	Reason     string          // optional
+}
+
+func (TicketMergedEvent) Name() string { return TicketMerged }
@@ -0,0 +1,143 @@
+package events
+
+import (
+	"fmt"
+
+	"stuff/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// SubscribeHistory makes the bus record ticket changes in ticket_events
+func SubscribeHistory(b *Bus) {
+	b.Subscribe(TicketCreated, recordTicketCreated)
+	b.Subscribe(TicketUpdated, recordTicketUpdated)
+	b.Subscribe(TicketSLABreached, recordTicketSLABreached)
+	b.Subscribe(TicketMerged, recordTicketMerged)
+}
+
+// ticketFields are the fields whose changes are recorded, with how to read them
+var ticketFields = []struct {
+	name  string
+	value func(t models.Ticket) *string
+}{
+	{"title", func(t models.Ticket) *string { return &t.Title }},
+	{"description", func(t models.Ticket) *string { return &t.Description }},
+	{"priority", func(t models.Ticket) *string { return text(t.Priority) }},
+	{"category_id", func(t models.Ticket) *string { return idText(t.CategoryId) }},
+	{"assigned_to_user_id", func(t models.Ticket) *string { return idText(t.AssignedToUserId) }},
+}
+
+func recordTicketCreated(tx *gorm.DB, e Event) error {
+	ev := e.(TicketCreatedEvent)
+	return tx.Create(&models.TicketEvent{
+		Id:          uuid.New(),
+		TicketId:    ev.Ticket.Id,
+		ActorUserId: actor(ev.ActorID),
+		Type:        models.TicketEventCreated,
+		Field:       "status",
+		NewValue:    text(ev.Ticket.Status),
+		Reason:      ev.Reason,
+	}).Error
+}
+
+// recordTicketUpdated writes one entry per changed field, the status change first
+func recordTicketUpdated(tx *gorm.DB, e Event) error {
+	ev := e.(TicketUpdatedEvent)
+	var rows []models.TicketEvent
+
+	if ev.Before.Status != ev.After.Status {
+		rows = append(rows, models.TicketEvent{
+			Type:     models.TicketEventStatusChanged,
+			Field:    "status",
+			OldValue: text(ev.Before.Status),
+			NewValue: text(ev.After.Status),
+			Reason:   ev.Reason,
+		})
+	}
+
+	for _, f := range ticketFields {
+		before, after := f.value(ev.Before), f.value(ev.After)
+		if equalText(before, after) {
+			continue
+		}
+		rows = append(rows, models.TicketEvent{
+			Type:     models.TicketEventFieldChanged,
+			Field:    f.name,
+			OldValue: before,
+			NewValue: after,
+			Reason:   ev.Reason,
+		})
+	}
+
+	if len(rows) == 0 {
+		return nil
+	}
+	for i := range rows {
+		rows[i].Id = uuid.New()
+		rows[i].TicketId = ev.After.Id
+		rows[i].ActorUserId = actor(ev.ActorID)
+	}
+	return tx.Create(&rows).Error
+}
+
+func recordTicketSLABreached(tx *gorm.DB, e Event) error {
+	ev := e.(TicketSLABreachedEvent)
+	return tx.Create(&models.TicketEvent{
+		Id:       uuid.New(),
+		TicketId: ev.Ticket.Id,
+		Type:     models.TicketEventSLABreached,
+		Field:    ev.Target,
+	}).Error
+}
+
+// recordTicketMerged writes one entry on the primary ticket per merged duplicate
+func recordTicketMerged(tx *gorm.DB, e Event) error {
+	ev := e.(TicketMergedEvent)
+	if len(ev.Duplicates) == 0 {
+		return nil
+	}
+
+	rows := make([]models.TicketEvent, len(ev.Duplicates))
+	for i, d := range ev.Duplicates {
+		rows[i] = models.TicketEvent{
+			Id:          uuid.New(),
+			TicketId:    ev.Primary.Id,
+			ActorUserId: actor(ev.ActorID),
+			Type:        models.TicketEventMerged,
+			Field:       "ticket_id",
+			OldValue:    text(d.Id),
+			NewValue:    text(ev.Primary.Id),
+			Reason:      ev.Reason,
+		}
+	}
+	return tx.Create(&rows).Error
+}
+
+// actor is nil for events without one
+func actor(id uuid.UUID) *uuid.UUID {
+	if id == uuid.Nil {
+		return nil
+	}
+	return &id
+}
+
+func text(v fmt.Stringer) *string {
+	s := v.String()
+	return &s
+}
+
+func idText(id *uuid.UUID) *string {
+	if id == nil {
+		return nil
+	}
+	return text(id)
+}
+
+func equalText(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
@@ -0,0 +1,435 @@
+package events
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"stuff/models"
+	"stuff/realtime"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Related entity types stored on notifications
+const (
+	EntityTicket         = "ticket"
+	EntityAbsenceRequest = "absence_request"
+	EntityShift          = "shift"
+	EntityFeedback       = "feedback"
+	EntityAnnouncement   = "announcement"
+)
+
+// notifyBatchSize bounds the recipients handled per query for large audiences
+const notifyBatchSize = 1000
+
+// SubscribeNotifications makes the bus write notifications for the people an event concerns.
+// Nobody is notified about their own actions.
+func SubscribeNotifications(b *Bus) {
+	b.Subscribe(TicketCreated, notifyTicketCreated)
+	b.Subscribe(TicketUpdated, notifyTicketUpdated)
+	b.Subscribe(TicketCommented, notifyTicketCommented)
+	b.Subscribe(AbsenceReviewed, notifyAbsenceReviewed)
+	b.Subscribe(ShiftCreated, notifyShiftCreated)
+	b.Subscribe(ShiftCancelled, notifyShiftCancelled)
+	b.Subscribe(FeedbackReceived, notifyFeedbackReceived)
+	b.Subscribe(AnnouncementPublished, notifyAnnouncementPublished)
+	b.Subscribe(TicketSLABreached, notifyTicketSLABreached)
+	b.Subscribe(TicketMerged, notifyTicketMerged)
+}
+
+// notification is a message waiting to be written for a set of recipients
+type notification struct {
+	Type       models.NotificationType
+	Title      string
+	Message    string
+	EntityID   uuid.UUID
+	EntityType string
+}
+
+// notify writes one notification per recipient, skipping the actor, nil IDs, duplicates
+// and recipients who muted the type
+func notify(tx *gorm.DB, actorID uuid.UUID, n notification, recipients ...*uuid.UUID) error {
+	seen := map[uuid.UUID]bool{actorID: true, uuid.Nil: true}
+	var userIDs []uuid.UUID
+
+	for _, id := range recipients {
+		if id == nil || seen[*id] {
+			continue
+		}
+		seen[*id] = true
+		userIDs = append(userIDs, *id)
+	}
+
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	plan, err := deliveries(tx, userIDs, n.Type, time.Now())
+	if err != nil {
+		return err
+	}
+
+	var rows []models.Notification
+	for _, id := range userIDs {
+		if !plan[id].Store {
+			continue
+		}
+
+		entityID, entityType := n.EntityID, n.EntityType
+		rows = append(rows, models.Notification{
+			Id:                uuid.New(),
+			UserId:            id,
+			Title:             n.Title,
+			Message:           n.Message,
+			Type:              n.Type,
+			RelatedEntityId:   &entityID,
+			RelatedEntityType: &entityType,
+		})
+	}
+
+	if len(rows) == 0 {
+		return nil
+	}
+	if err := tx.Create(&rows).Error; err != nil {
+		return err
+	}
+
+	// Push to connected clients once the transaction commits
+	for _, row := range rows {
+		if !plan[row.UserId].Push {
+			continue
+		}
+		if err := realtime.Announce(tx, row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func notifyTicketCreated(tx *gorm.DB, e Event) error {
+	ev := e.(TicketCreatedEvent)
+	t := ev.Ticket
+
+	return notify(tx, ev.ActorID, notification{
+		Type:       models.NotificationTypeTicketAssigned,
+		Title:      "Ticket assigned",
+		Message:    fmt.Sprintf("You have been assigned to the ticket %q.", t.Title),
+		EntityID:   t.Id,
+		EntityType: EntityTicket,
+	}, t.AssignedToUserId)
+}
+
+func notifyTicketUpdated(tx *gorm.DB, e Event) error {
+	ev := e.(TicketUpdatedEvent)
+	t := ev.After
+
+	var assignee *uuid.UUID
+	if t.AssignedToUserId != nil && (ev.Before.AssignedToUserId == nil || *ev.Before.AssignedToUserId != *t.AssignedToUserId) {
+		assignee = t.AssignedToUserId
+		err := notify(tx, ev.ActorID, notification{
+			Type:       models.NotificationTypeTicketAssigned,
+			Title:      "Ticket assigned",
+			Message:    fmt.Sprintf("You have been assigned to the ticket %q.", t.Title),
+			EntityID:   t.Id,
+			EntityType: EntityTicket,
+		}, assignee)
+		if err != nil {
+			return err
+		}
+	}
+
+	message := fmt.Sprintf("The ticket %q was updated.", t.Title)
+	if t.Status != ev.Before.Status {
+		message = fmt.Sprintf("The ticket %q is now %s.", t.Title, humanize(t.Status.String()))
+		if ev.Reason != "" {
+			message += " Reason: " + summarize(ev.Reason, 200)
+		}
+	}
+
+	// A new assignee already got the assignment notification
+	recipients := []*uuid.UUID{&t.CreatedByUserId}
+	if assignee == nil {
+		recipients = append(recipients, t.AssignedToUserId)
+	}
+
+	watchers, err := ticketWatchers(tx, t.Id)
+	if err != nil {
+		return err
+	}
+	recipients = append(recipients, without(watchers, assignee)...)
+
+	return notify(tx, ev.ActorID, notification{
+		Type:       models.NotificationTypeTicketUpdated,
+		Title:      "Ticket updated",
+		Message:    message,
+		EntityID:   t.Id,
+		EntityType: EntityTicket,
+	}, recipients...)
+}
+
+// notifyTicketMerged tells the primary ticket's creator and assignee what was merged into it.
+// The duplicates' people hear about it through their tickets being closed.
+func notifyTicketMerged(tx *gorm.DB, e Event) error {
+	ev := e.(TicketMergedEvent)
+	t := ev.Primary
+
+	message := fmt.Sprintf("%d tickets were merged into the ticket %q.", len(ev.Duplicates), t.Title)
+	if len(ev.Duplicates) == 1 {
+		message = fmt.Sprintf("The ticket %q was merged into the ticket %q.", ev.Duplicates[0].Title, t.Title)
+	}
+
+	return notify(tx, ev.ActorID, notification{
+		Type:       models.NotificationTypeTicketUpdated,
+		Title:      "Tickets merged",
+		Message:    message,
+		EntityID:   t.Id,
+		EntityType: EntityTicket,
+	}, &t.CreatedByUserId, t.AssignedToUserId)
+}
+
+// notifyTicketCommented tells the users mentioned in the comment that they were mentioned,
+// and the creator, assignee and watchers that there is a new comment. Internal notes only
+// reach those who may read them.
+func notifyTicketCommented(tx *gorm.DB, e Event) error {
+	ev := e.(TicketCommentedEvent)
+	t := ev.Ticket
+
+	mentioned, err := resolveMentions(tx, ev.Comment.Content)
+	if err != nil {
+		return err
+	}
+
+	watchers, err := ticketWatchers(tx, t.Id)
+	if err != nil {
+		return err
+	}
+	recipients := append([]*uuid.UUID{&t.CreatedByUserId, t.AssignedToUserId}, watchers...)
+
+	if ev.Comment.Visibility == models.CommentVisibilityInternal {
+		if mentioned, err = internalReaders(tx, t, mentioned); err != nil {
+			return err
+		}
+		if recipients, err = internalReaders(tx, t, recipients); err != nil {
+			return err
+		}
+	}
+
+	err = notify(tx, ev.ActorID, notification{
+		Type:       models.NotificationTypeTicketMentioned,
+		Title:      "You were mentioned",
+		Message:    fmt.Sprintf("You were mentioned in a comment on the ticket %q: %s", t.Title, summarize(ev.Comment.Content, 200)),
+		EntityID:   t.Id,
+		EntityType: EntityTicket,
+	}, mentioned...)
+	if err != nil {
+		return err
+	}
+
+	// Mentioned users already got a notification about this comment
+	return notify(tx, ev.ActorID, notification{
+		Type:       models.NotificationTypeTicketCommented,
+		Title:      "New comment",
+		Message:    fmt.Sprintf("There is a new comment on the ticket %q.", t.Title),
+		EntityID:   t.Id,
+		EntityType: EntityTicket,
+	}, without(recipients, mentioned...)...)
+}
+
+// internalReaders keeps the recipients who may read internal notes on t
+func internalReaders(tx *gorm.DB, t models.Ticket, recipients []*uuid.UUID) ([]*uuid.UUID, error) {
+	var ids []uuid.UUID
+	for _, id := range recipients {
+		if id != nil {
+			ids = append(ids, *id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	var users []models.User
+	if err := tx.Select("id", "role").Where("id IN ?", ids).Find(&users).Error; err != nil {
+		return nil, err
+	}
+
+	var readers []*uuid.UUID
+	for i, u := range users {
+		if t.InternalNotesVisibleTo(u.Id, u.Role) {
+			readers = append(readers, &users[i].Id)
+		}
+	}
+	return readers, nil
+}
+
+// without returns the recipients that are not in excluded
+func without(recipients []*uuid.UUID, excluded ...*uuid.UUID) []*uuid.UUID {
+	var kept []*uuid.UUID
+	for _, id := range recipients {
+		if id != nil && !slices.ContainsFunc(excluded, func(x *uuid.UUID) bool { return x != nil && *x == *id }) {
+			kept = append(kept, id)
+		}
+	}
+	return kept
+}
+
+func notifyAbsenceReviewed(tx *gorm.DB, e Event) error {
+	ev := e.(AbsenceReviewedEvent)
+	a := ev.Request
+
+	n := notification{
+		EntityID:   a.Id,
+		EntityType: EntityAbsenceRequest,
+	}
+	period := fmt.Sprintf("%s absence from %s to %s", humanize(a.Type.String()), a.StartDate.Format("2006-01-02"), a.EndDate.Format("2006-01-02"))
+
+	switch a.Status {
+	case models.RequestStatusApproved:
+		n.Type = models.NotificationTypeAbsenceApproved
+		n.Title = "Absence approved"
+		n.Message = fmt.Sprintf("Your %s was approved.", period)
+	case models.RequestStatusRejected:
+		n.Type = models.NotificationTypeAbsenceRejected
+		n.Title = "Absence rejected"
+		n.Message = fmt.Sprintf("Your %s was rejected.", period)
+	default:
+		return nil
+	}
+
+	return notify(tx, ev.ActorID, n, &a.UserId)
+}
+
+func notifyShiftCreated(tx *gorm.DB, e Event) error {
+	ev := e.(ShiftCreatedEvent)
+	s := ev.Shift
+
+	return notify(tx, ev.ActorID, notification{
+		Type:       models.NotificationTypeShiftCreated,
+		Title:      "New shift",
+		Message:    fmt.Sprintf("You have a new shift %s.", shiftPeriod(s)),
+		EntityID:   s.Id,
+		EntityType: EntityShift,
+	}, &s.UserId)
+}
+
+func notifyShiftCancelled(tx *gorm.DB, e Event) error {
+	ev := e.(ShiftCancelledEvent)
+	s := ev.Shift
+
+	return notify(tx, ev.ActorID, notification{
+		Type:       models.NotificationTypeShiftCancelled,
+		Title:      "Shift cancelled",
+		Message:    fmt.Sprintf("Your shift %s was cancelled.", shiftPeriod(s)),
+		EntityID:   s.Id,
+		EntityType: EntityShift,
+	}, &s.UserId)
+}
+
+// notifyFeedbackReceived tells the managers of the department
+func notifyFeedbackReceived(tx *gorm.DB, e Event) error {
+	ev := e.(FeedbackReceivedEvent)
+	f := ev.Feedback
+
+	var managers []uuid.UUID
+	err := tx.Model(&models.User{}).
+		Where("department_id = ? AND role = ?", f.DepartmentId, models.RoleManager).
+		Pluck("id", &managers).Error
+	if err != nil {
+		return err
+	}
+
+	recipients := make([]*uuid.UUID, len(managers))
+	for i := range managers {
+		recipients[i] = &managers[i]
+	}
+
+	return notify(tx, uuid.Nil, notification{
+		Type:       models.NotificationTypeFeedbackReceived,
+		Title:      "New feedback",
+		Message:    fmt.Sprintf("Your department received feedback rated %d.", f.Rating),
+		EntityID:   f.Id,
+		EntityType: EntityFeedback,
+	}, recipients...)
+}
+
+// notifyAnnouncementPublished delivers an announcement to its audience, except its author
+func notifyAnnouncementPublished(tx *gorm.DB, e Event) error {
+	ev := e.(AnnouncementPublishedEvent)
+	a := ev.Announcement
+
+	n := notification{
+		Type:       models.NotificationTypeSystemAnnouncement,
+		Title:      a.Title,
+		Message:    summarize(a.Body, 200),
+		EntityID:   a.Id,
+		EntityType: EntityAnnouncement,
+	}
+
+	for batch := range slices.Chunk(ev.Recipients, notifyBatchSize) {
+		recipients := make([]*uuid.UUID, len(batch))
+		for i := range batch {
+			recipients[i] = &batch[i]
+		}
+		if err := notify(tx, a.CreatedByUserId, n, recipients...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notifyTicketSLABreached tells the assignee, or the managers of the creator's department
+// when nobody has picked the ticket up yet
+func notifyTicketSLABreached(tx *gorm.DB, e Event) error {
+	ev := e.(TicketSLABreachedEvent)
+	t := ev.Ticket
+
+	recipients := []*uuid.UUID{t.AssignedToUserId}
+	if t.AssignedToUserId == nil {
+		var managers []uuid.UUID
+		err := tx.Model(&models.User{}).
+			Where("role = ? AND department_id = (?)", models.RoleManager,
+				tx.Model(&models.User{}).Select("department_id").Where("id = ?", t.CreatedByUserId)).
+			Pluck("id", &managers).Error
+		if err != nil {
+			return err
+		}
+		for i := range managers {
+			recipients = append(recipients, &managers[i])
+		}
+	}
+
+	return notify(tx, uuid.Nil, notification{
+		Type:       models.NotificationTypeTicketSLABreached,
+		Title:      "SLA breached",
+		Message:    fmt.Sprintf("The ticket %q missed its %s target.", t.Title, humanize(ev.Target)),
+		EntityID:   t.Id,
+		EntityType: EntityTicket,
+	}, recipients...)
+}
+
+// summarize shortens text to at most max runes on a word boundary
+func summarize(text string, max int) string {
+	text = strings.Join(strings.Fields(text), " ")
+	runes := []rune(text)
+	if len(runes) <= max {
+		return text
+	}
+
+	cut := string(runes[:max])
+	if i := strings.LastIndex(cut, " "); i > 0 {
+		cut = cut[:i]
+	}
+	return cut + "…"
+}
+
+// shiftPeriod formats a shift like "on 2024-03-01 from 08:00 to 16:00"
+func shiftPeriod(s models.Shift) string {
+	return fmt.Sprintf("on %s from %s to %s", s.StartTime.Format("2006-01-02"), s.StartTime.Format("15:04"), s.EndTime.Format("15:04"))
+}
+
+// humanize turns an enum value like IN_PROGRESS into "in progress"
+func humanize(s string) string {
+	return strings.ToLower(strings.ReplaceAll(s, "_", " "))
+}
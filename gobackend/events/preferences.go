@@ -0,0 +1,60 @@
+package events
+
+import (
+	"time"
+
+	"stuff/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// delivery is how one recipient gets a notification
+type delivery struct {
+	Store bool // write the notification (IN_APP); everything else depends on it
+	Push  bool // announce it to open streams right away (PUSH, outside quiet hours)
+}
+
+// deliveries applies the recipients' channel preferences for the type and their quiet hours.
+// Email is not decided here; the digest job picks up stored notifications for users who opted in.
+func deliveries(tx *gorm.DB, userIDs []uuid.UUID, nt models.NotificationType, now time.Time) (map[uuid.UUID]delivery, error) {
+	var prefs []models.NotificationPreference
+	if err := tx.Where("user_id IN ? AND type = ?", userIDs, nt).Find(&prefs).Error; err != nil {
+		return nil, err
+	}
+
+	var settings []models.NotificationSettings
+	if err := tx.Where("user_id IN ?", userIDs).Find(&settings).Error; err != nil {
+		return nil, err
+	}
+
+	enabled := make(map[uuid.UUID]map[models.NotificationChannel]bool, len(userIDs))
+	for _, p := range prefs {
+		if enabled[p.UserId] == nil {
+			enabled[p.UserId] = make(map[models.NotificationChannel]bool)
+		}
+		enabled[p.UserId][p.Channel] = p.Enabled
+	}
+
+	quiet := make(map[uuid.UUID]bool, len(settings))
+	for _, s := range settings {
+		quiet[s.UserId] = s.InQuietHours(now)
+	}
+
+	channelOn := func(userID uuid.UUID, c models.NotificationChannel) bool {
+		if on, ok := enabled[userID][c]; ok {
+			return on
+		}
+		return c.DefaultEnabled()
+	}
+
+	result := make(map[uuid.UUID]delivery, len(userIDs))
+	for _, id := range userIDs {
+		store := channelOn(id, models.NotificationChannelInApp)
+		result[id] = delivery{
+			Store: store,
+			Push:  store && channelOn(id, models.NotificationChannelPush) && !quiet[id],
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,111 @@
+package events
+
+import (
+	"regexp"
+	"strings"
+
+	"stuff/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// SubscribeWatchers makes the bus subscribe commenters to the tickets they comment on
+func SubscribeWatchers(b *Bus) {
+	b.Subscribe(TicketCommented, watchOnComment)
+}
+
+func watchOnComment(tx *gorm.DB, e Event) error {
+	ev := e.(TicketCommentedEvent)
+	if ev.ActorID == uuid.Nil {
+		return nil
+	}
+	return Watch(tx, ev.Ticket.Id, ev.ActorID)
+}
+
+// Watch subscribes a user to a ticket; watching twice is not an error
+func Watch(tx *gorm.DB, ticketID, userID uuid.UUID) error {
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&models.TicketWatcher{TicketId: ticketID, UserId: userID}).Error
+}
+
+// ticketWatchers returns the users watching a ticket
+func ticketWatchers(tx *gorm.DB, ticketID uuid.UUID) ([]*uuid.UUID, error) {
+	var ids []uuid.UUID
+	if err := tx.Model(&models.TicketWatcher{}).Where("ticket_id = ?", ticketID).Pluck("user_id", &ids).Error; err != nil {
+		return nil, err
+	}
+
+	recipients := make([]*uuid.UUID, len(ids))
+	for i := range ids {
+		recipients[i] = &ids[i]
+	}
+	return recipients, nil
+}
+
+// maxMentions bounds how many mentions in one comment are looked up
+const maxMentions = 20
+
+// mentionPattern finds @"Full Name", @local-part and @full@address mentions.
+// The @ must start a word, so email addresses in the text are not mentions.
+var mentionPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_.@])@(?:"([^"\n]{1,255})"|([\p{L}\p{N}_.%+-]+(?:@[\p{L}\p{N}-]+(?:\.[\p{L}\p{N}-]+)+)?))`)
+
+// parseMentions returns the lower-cased names mentioned in text, without duplicates
+func parseMentions(text string) []string {
+	seen := map[string]bool{}
+	var names []string
+
+	for _, m := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		name := m[1]
+		if name == "" {
+			name = strings.TrimRight(m[2], ".")
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+		if len(names) == maxMentions {
+			break
+		}
+	}
+	return names
+}
+
+// resolveMentions finds the users mentioned in text. A mention matches a user's full
+// email address, the part before the @, or the quoted full name, ignoring case.
+// Mentions that match more than one user are ignored.
+func resolveMentions(tx *gorm.DB, text string) ([]*uuid.UUID, error) {
+	names := parseMentions(text)
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	var users []models.User
+	err := tx.Select("id", "name", "email").
+		Where("LOWER(email) IN ? OR SPLIT_PART(LOWER(email), '@', 1) IN ? OR LOWER(name) IN ?", names, names, names).
+		Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var mentioned []*uuid.UUID
+	for _, name := range names {
+		var match *uuid.UUID
+		count := 0
+		for i, u := range users {
+			email := strings.ToLower(u.Email)
+			local, _, _ := strings.Cut(email, "@")
+			if email == name || local == name || strings.ToLower(u.Name) == name {
+				match = &users[i].Id
+				count++
+			}
+		}
+		if count == 1 {
+			mentioned = append(mentioned, match)
+		}
+	}
+	return mentioned, nil
+}
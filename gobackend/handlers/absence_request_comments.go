@@ -9,6 +9,7 @@ import (
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // AbsenceRequestComments holds DB for absence request comment handlers
@@ -18,10 +19,22 @@ type AbsenceRequestComments struct {
 
 // ListByAbsenceRequest godoc
 // @Summary      Get all comments for an absence request
+// @Description  Oldest first. Internal notes are only shown to those who can review the request, never to the requester.
+// @Description  Paged with limit/offset or cursor. See X-Total-Count, X-Next-Cursor and Link.
 // @Tags         absence-request-comments
 // @Produce      json
 // @Param        absenceRequestId   path      string  true  "Absence Request ID"
+// @Param        user_id    query     string  false  "Author ID, or me"
+// @Param        visibility query     string  false  "PUBLIC or INTERNAL"
+// @Param        sort       query     string  false  "created_at; prefix - for descending (default created_at)"
+// @Param        include    query     string  false  "user (default user)"
+// @Param        fields     query     string  false  "Fields to return, e.g. id,content"
+// @Param        limit      query     int     false  "Page size (default 50, max 200)"
+// @Param        offset     query     int     false  "Rows to skip"
+// @Param        cursor     query     string  false  "X-Next-Cursor of the previous page"
 // @Success      200  {array}   models.AbsenceRequestComment
+// @Failure      400  {object}  Problem  "invalid filter, sort, include or cursor"
+// @Failure      403  {object}  Problem  "forbidden"
 // @Security     BearerAuth
 // @Router       /absence-requests/{absenceRequestId}/comments [get]
 func (h AbsenceRequestComments) ListByAbsenceRequest(w http.ResponseWriter, r *http.Request) {
@@ -31,26 +44,27 @@ func (h AbsenceRequestComments) ListByAbsenceRequest(w http.ResponseWriter, r *h
 		return
 	}
 	
-	var list []models.AbsenceRequestComment
-	
-	if err := h.DB.Preload("User").Where("absence_request_id = ?", absenceRequestId).Find(&list).Error; err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if _, ok := h.authorizeRequest(w, r, absenceRequestId); !ok {
 		return
 	}
 	
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(list)
+	visible, args := visibleAbsenceCommentsCondition(r)
+	
+	serveList[models.AbsenceRequestComment](w, r, h.DB.Where("absence_request_id = ?", absenceRequestId).Where(visible, args...), commentListSpec)
 }
 
 // CreateOnAbsenceRequest godoc
 // @Summary      Create a comment on an absence request
+// @Description  visibility defaults to PUBLIC. INTERNAL notes can be written by those who can review the request and are never shown to the requester.
 // @Tags         absence-request-comments
 // @Accept       json
 // @Produce      json
 // @Param        absenceRequestId   path      string  true  "Absence Request ID"
 // @Param        comment  body      models.AbsenceRequestComment  true  "Absence Request Comment"
 // @Success      201  {object}  models.AbsenceRequestComment
-// @Failure      400  {string}  string  "Bad request"
+// @Failure      400  {object}  Problem  "Bad request"
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      422  {object}  Problem  "invalid visibility"
 // @Security     BearerAuth
 // @Router       /absence-requests/{absenceRequestId}/comments [post]
 func (h AbsenceRequestComments) CreateOnAbsenceRequest(w http.ResponseWriter, r *http.Request) {
@@ -63,15 +77,47 @@ func (h AbsenceRequestComments) CreateOnAbsenceRequest(w http.ResponseWriter, r
 	var c models.AbsenceRequestComment
 	
 	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeBodyError(w, r, err)
+		return
+	}
+	
+	if c.Visibility == "" {
+		c.Visibility = models.CommentVisibilityPublic
+	}
+	
+	if !c.Visibility.Valid() {
+		writeValidation(w, r, FieldError{Field: "visibility", Code: FieldInvalid, Message: "must be PUBLIC or INTERNAL"})
+		return
+	}
+	
+	a, ok := h.authorizeRequest(w, r, absenceRequestId)
+	
+	if !ok {
 		return
 	}
 	
+	if c.Visibility == models.CommentVisibilityInternal {
+		allowed, err := canReviewUser(h.DB, r, a.UserId)
+	
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+	
+		if !allowed {
+			writeError(w, r, "only reviewers can write internal notes", http.StatusForbidden)
+			return
+		}
+	}
+	
 	c.Id = uuid.New()
+	c.UserId, _ = currentUserID(r)
 	c.AbsenceRequestId = absenceRequestId
+	c.AbsenceRequest = models.AbsenceRequest{}
+	c.User = models.User{}
 	
-	if err := h.DB.Create(&c).Error; err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := h.DB.Omit(clause.Associations).Create(&c).Error; err != nil {
+		writeDBError(w, r, err)
 		return
 	}
 	
@@ -87,7 +133,8 @@ func (h AbsenceRequestComments) CreateOnAbsenceRequest(w http.ResponseWriter, r
 // @Produce      json
 // @Param        id   path      string  true  "Absence Request Comment ID"
 // @Success      200  {object}  models.AbsenceRequestComment
-// @Failure      404  {string}  string  "absence request comment not found"
+// @Failure      404  {object}  Problem  "absence request comment not found"
+// @Failure      403  {object}  Problem  "forbidden"
 // @Security     BearerAuth
 // @Router       /absence-request-comments/{id} [get]
 func (h AbsenceRequestComments) GetByID(w http.ResponseWriter, r *http.Request) {
@@ -101,27 +148,55 @@ func (h AbsenceRequestComments) GetByID(w http.ResponseWriter, r *http.Request)
 	
 	if err := h.DB.Preload("User").Preload("AbsenceRequest").First(&c, "id = ?", id).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
-			http.Error(w, "absence request comment not found", http.StatusNotFound)
+			writeError(w, r, "absence request comment not found", http.StatusNotFound)
 			return
 		}
 	
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDBError(w, r, err)
+		return
+	}
+	
+	allowed, err := canManageUser(h.DB, r, c.AbsenceRequest.UserId)
+	
+	if err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+	
+	if !allowed {
+		writeError(w, r, "forbidden", http.StatusForbidden)
 		return
 	}
 	
+	if c.Visibility == models.CommentVisibilityInternal {
+		internal, err := canReviewUser(h.DB, r, c.AbsenceRequest.UserId)
+	
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+	
+		if !internal {
+			writeError(w, r, "absence request comment not found", http.StatusNotFound)
+			return
+		}
+	}
+	
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(c)
 }
 
 // Update godoc
 // @Summary      Update absence request comment by ID
+// @Description  Only the content can be changed; the visibility is set when the comment is written.
 // @Tags         absence-request-comments
 // @Accept       json
 // @Produce      json
 // @Param        id   path      string  true  "Absence Request Comment ID"
 // @Param        comment  body      models.AbsenceRequestComment  true  "Absence Request Comment"
 // @Success      200  {object}  models.AbsenceRequestComment
-// @Failure      404  {string}  string  "absence request comment not found"
+// @Failure      404  {object}  Problem  "absence request comment not found"
+// @Failure      403  {object}  Problem  "forbidden"
 // @Security     BearerAuth
 // @Router       /absence-request-comments/{id} [put]
 func (h AbsenceRequestComments) Update(w http.ResponseWriter, r *http.Request) {
@@ -134,20 +209,25 @@ func (h AbsenceRequestComments) Update(w http.ResponseWriter, r *http.Request) {
 	var c models.AbsenceRequestComment
 	
 	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeBodyError(w, r, err)
 		return
 	}
 	
 	c.Id = id
+	
+	if !h.authorizeAuthor(w, r, id) {
+		return
+	}
+	
 	result := h.DB.Model(&models.AbsenceRequestComment{}).Where("id = ?", id).Update("content", c.Content)
 	
 	if result.Error != nil {
-		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		writeDBError(w, r, result.Error)
 		return
 	}
 	
 	if result.RowsAffected == 0 {
-		http.Error(w, "absence request comment not found", http.StatusNotFound)
+		writeError(w, r, "absence request comment not found", http.StatusNotFound)
 		return
 	}
 	
@@ -161,7 +241,8 @@ func (h AbsenceRequestComments) Update(w http.ResponseWriter, r *http.Request) {
 // @Tags         absence-request-comments
 // @Param        id   path      string  true  "Absence Request Comment ID"
 // @Success      204  "No Content"
-// @Failure      404  {string}  string  "absence request comment not found"
+// @Failure      404  {object}  Problem  "absence request comment not found"
+// @Failure      403  {object}  Problem  "forbidden"
 // @Security     BearerAuth
 // @Router       /absence-request-comments/{id} [delete]
 func (h AbsenceRequestComments) Delete(w http.ResponseWriter, r *http.Request) {
@@ -171,26 +252,101 @@ func (h AbsenceRequestComments) Delete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
+	if !h.authorizeAuthor(w, r, id) {
+		return
+	}
+	
 	result := h.DB.Delete(&models.AbsenceRequestComment{}, "id = ?", id)
 	
 	if result.Error != nil {
-		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		writeDBError(w, r, result.Error)
 		return
 	}
 	
 	if result.RowsAffected == 0 {
-		http.Error(w, "absence request comment not found", http.StatusNotFound)
+		writeError(w, r, "absence request comment not found", http.StatusNotFound)
 		return
 	}
 	
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// authorizeRequest writes 403/404 unless the caller may see the given absence request,
+// which it returns with only user_id loaded
+func (h AbsenceRequestComments) authorizeRequest(w http.ResponseWriter, r *http.Request, absenceRequestId uuid.UUID) (models.AbsenceRequest, bool) {
+	var a models.AbsenceRequest
+	
+	if err := h.DB.Select("user_id").First(&a, "id = ?", absenceRequestId).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			writeError(w, r, "absence request not found", http.StatusNotFound)
+			return a, false
+		}
+	
+		writeDBError(w, r, err)
+		return a, false
+	}
+	
+	allowed, err := canManageUser(h.DB, r, a.UserId)
+	
+	if err != nil {
+		writeDBError(w, r, err)
+		return a, false
+	}
+	
+	if !allowed {
+		writeError(w, r, "forbidden", http.StatusForbidden)
+		return a, false
+	}
+	
+	return a, true
+}
+
+// authorizeAuthor writes 403 unless the caller wrote the comment or is an admin.
+// A missing comment is let through so the caller reports 404 as before.
+func (h AbsenceRequestComments) authorizeAuthor(w http.ResponseWriter, r *http.Request, id uuid.UUID) bool {
+	var c models.AbsenceRequestComment
+	
+	if err := h.DB.Select("user_id").First(&c, "id = ?", id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return true
+		}
+	
+		writeDBError(w, r, err)
+		return false
+	}
+	
+	if userID, _ := currentUserID(r); c.UserId != userID && !hasRole(r, models.RoleAdmin) {
+		writeError(w, r, "forbidden", http.StatusForbidden)
+		return false
+	}
+	
+	return true
+}
+
+// visibleAbsenceCommentsCondition limits absence request comments to those the caller may read.
+// It is the SQL form of canReviewUser: internal notes are for HR, admins and the managers of the
+// requester's department, and never for the requester.
+func visibleAbsenceCommentsCondition(r *http.Request) (string, []interface{}) {
+	callerID, _ := currentUserID(r)
+	
+	switch {
+	case hasRole(r, PeopleRoles...):
+		return "(visibility = ? OR absence_request_id IN (SELECT id FROM absence_requests WHERE user_id <> ?))",
+			[]interface{}{models.CommentVisibilityPublic, callerID}
+	case hasRole(r, models.RoleManager):
+		departmentID, _ := currentDepartmentID(r)
+		return "(visibility = ? OR absence_request_id IN (SELECT absence_requests.id FROM absence_requests JOIN users ON users.id = absence_requests.user_id WHERE users.department_id = ? AND absence_requests.user_id <> ?))",
+			[]interface{}{models.CommentVisibilityPublic, departmentID, callerID}
+	default:
+		return "visibility = ?", []interface{}{models.CommentVisibilityPublic}
+	}
+}
+
 // RegisterAbsenceRequestComments adds absence request comment routes
 func RegisterAbsenceRequestComments(router *mux.Router, h AbsenceRequestComments, absenceRequestsPrefix, commentsPrefix string) {
-	router.HandleFunc(absenceRequestsPrefix+"/{absenceRequestId}/comments", h.ListByAbsenceRequest).Methods("GET")
-	router.HandleFunc(absenceRequestsPrefix+"/{absenceRequestId}/comments", h.CreateOnAbsenceRequest).Methods("POST")
-	router.HandleFunc(commentsPrefix+"/{id}", h.GetByID).Methods("GET")
-	router.HandleFunc(commentsPrefix+"/{id}", h.Update).Methods("PUT")
-	router.HandleFunc(commentsPrefix+"/{id}", h.Delete).Methods("DELETE")
+	router.HandleFunc(absenceRequestsPrefix+"/{absenceRequestId}/comments", AuthorizeScoped(h.ListByAbsenceRequest, AnyRole, ScopeAbsencesRead)).Methods("GET")
+	router.HandleFunc(absenceRequestsPrefix+"/{absenceRequestId}/comments", AuthorizeScoped(h.CreateOnAbsenceRequest, AnyRole, ScopeAbsencesWrite)).Methods("POST")
+	router.HandleFunc(commentsPrefix+"/{id}", AuthorizeScoped(h.GetByID, AnyRole, ScopeAbsencesRead)).Methods("GET")
+	router.HandleFunc(commentsPrefix+"/{id}", AuthorizeScoped(h.Update, AnyRole, ScopeAbsencesWrite)).Methods("PUT")
+	router.HandleFunc(commentsPrefix+"/{id}", AuthorizeScoped(h.Delete, AnyRole, ScopeAbsencesWrite)).Methods("DELETE")
 }
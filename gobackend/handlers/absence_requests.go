@@ -5,35 +5,83 @@ import (
 	"net/http"
 	"time"
 
+	"stuff/events"
 	"stuff/models"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // AbsenceRequests holds DB for absence request handlers
 type AbsenceRequests struct {
-	DB *gorm.DB
+	DB     *gorm.DB
+	Events *events.Bus
+}
+
+// absenceRequestListSpec controls filtering, sorting and includes for GET /absence-requests.
+// from and to select requests that overlap the range.
+var absenceRequestListSpec = listSpec{
+	filters: map[string]filterFunc{
+		"status":      enumFilter("status", func(s string) bool { return models.RequestStatus(s).Valid() }),
+		"type":        enumFilter("type", func(s string) bool { return models.AbsenceType(s).Valid() }),
+		"user_id":     uuidFilter("user_id"),
+		"reviewed_by": uuidFilter("reviewed_by_user_id"),
+		"from":        fromFilter("end_date"),
+		"to":          toFilter("start_date"),
+	},
+	sorts: map[string]string{
+		"start_date": "start_date",
+		"end_date":   "end_date",
+		"created_at": "created_at",
+		"status":     "status",
+	},
+	defaultSort: "-created_at",
+	includes: map[string]listInclude{
+		"user":             {preload: "User", columns: []string{"user_id"}},
+		"reviewed_by_user": {preload: "ReviewedByUser", columns: []string{"reviewed_by_user_id"}},
+		"comments":         {preload: "Comments", where: visibleAbsenceCommentsCondition},
+	},
+	defaultInclude: []string{"user", "reviewed_by_user"},
 }
 
 // List godoc
-// @Summary      Get all absence requests
+// @Summary      Get absence requests visible to the caller
+// @Description  HR and admins see every request, managers their department's, everyone else their own.
+// @Description  Paged with limit/offset or cursor. See X-Total-Count, X-Next-Cursor and Link.
 // @Tags         absence-requests
 // @Produce      json
+// @Param        status       query     string  false  "PENDING, APPROVED or REJECTED; comma-separated for several"
+// @Param        type         query     string  false  "Absence type; comma-separated for several"
+// @Param        user_id      query     string  false  "User ID, or me"
+// @Param        reviewed_by  query     string  false  "User ID, me, or none for unreviewed"
+// @Param        from         query     string  false  "Absences ending on or after (date)"
+// @Param        to           query     string  false  "Absences starting on or before (date)"
+// @Param        sort         query     string  false  "start_date, end_date, created_at or status; prefix - for descending (default -created_at)"
+// @Param        include      query     string  false  "user, reviewed_by_user, comments (default user,reviewed_by_user)"
+// @Param        fields       query     string  false  "Fields to return, e.g. id,start_date,end_date,status"
+// @Param        limit        query     int     false  "Page size (default 50, max 200)"
+// @Param        offset       query     int     false  "Rows to skip"
+// @Param        cursor       query     string  false  "X-Next-Cursor of the previous page"
 // @Success      200  {array}   models.AbsenceRequest
+// @Failure      400  {object}  Problem  "invalid filter, sort, include or cursor"
 // @Security     BearerAuth
 // @Router       /absence-requests [get]
 func (h AbsenceRequests) List(w http.ResponseWriter, r *http.Request) {
-	var list []models.AbsenceRequest
-	
-	if err := h.DB.Preload("User").Preload("ReviewedByUser").Preload("Comments").Find(&list).Error; err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	query := h.DB
+	
+	switch {
+	case hasRole(r, PeopleRoles...):
+	case hasRole(r, models.RoleManager):
+		departmentID, _ := currentDepartmentID(r)
+		query = query.Where("user_id IN (?)", departmentUserIDs(h.DB, departmentID))
+	default:
+		userID, _ := currentUserID(r)
+		query = query.Where("user_id = ?", userID)
 	}
 	
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(list)
+	serveList[models.AbsenceRequest](w, r, query, absenceRequestListSpec)
 }
 
 // GetByID godoc
@@ -42,7 +90,8 @@ func (h AbsenceRequests) List(w http.ResponseWriter, r *http.Request) {
 // @Produce      json
 // @Param        id   path      string  true  "Absence Request ID"
 // @Success      200  {object}  models.AbsenceRequest
-// @Failure      404  {string}  string  "absence request not found"
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      404  {object}  Problem  "absence request not found"
 // @Security     BearerAuth
 // @Router       /absence-requests/{id} [get]
 func (h AbsenceRequests) GetByID(w http.ResponseWriter, r *http.Request) {
@@ -54,13 +103,17 @@ func (h AbsenceRequests) GetByID(w http.ResponseWriter, r *http.Request) {
 	
 	var a models.AbsenceRequest
 	
-	if err := h.DB.Preload("User").Preload("ReviewedByUser").Preload("Comments").First(&a, "id = ?", id).Error; err != nil {
+	if err := h.DB.Preload("User").Preload("ReviewedByUser").Preload("Comments", conditionArgs(visibleAbsenceCommentsCondition(r))...).First(&a, "id = ?", id).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
-			http.Error(w, "absence request not found", http.StatusNotFound)
+			writeError(w, r, "absence request not found", http.StatusNotFound)
 			return
 		}
 	
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDBError(w, r, err)
+		return
+	}
+	
+	if !h.authorizeOwner(w, r, a.UserId) {
 		return
 	}
 	
@@ -75,25 +128,38 @@ func (h AbsenceRequests) GetByID(w http.ResponseWriter, r *http.Request) {
 // @Produce      json
 // @Param        absenceRequest  body      models.AbsenceRequest  true  "Absence Request"
 // @Success      201  {object}  models.AbsenceRequest
-// @Failure      400  {string}  string  "Bad request"
+// @Failure      400  {object}  Problem  "Bad request"
+// @Failure      403  {object}  Problem  "forbidden"
 // @Security     BearerAuth
 // @Router       /absence-requests [post]
 func (h AbsenceRequests) Create(w http.ResponseWriter, r *http.Request) {
 	var a models.AbsenceRequest
 	
 	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeBodyError(w, r, err)
 		return
 	}
 	
-	a.Id = uuid.New()
+	// Requests default to the caller; filing for someone else requires managing them
+	if a.UserId == uuid.Nil {
+		a.UserId, _ = currentUserID(r)
+	}
 	
-	if a.Status == "" {
-		a.Status = models.RequestStatusPending
+	if !h.authorizeOwner(w, r, a.UserId) {
+		return
 	}
 	
-	if err := h.DB.Create(&a).Error; err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	// New requests always start pending; decisions go through Approve
+	a.Id = uuid.New()
+	a.Status = models.RequestStatusPending
+	a.ReviewedAt = nil
+	a.ReviewedByUserId = nil
+	a.User = models.User{}
+	a.ReviewedByUser = nil
+	a.Comments = nil
+	
+	if err := h.DB.Omit(clause.Associations).Create(&a).Error; err != nil {
+		writeDBError(w, r, err)
 		return
 	}
 	
@@ -110,7 +176,10 @@ func (h AbsenceRequests) Create(w http.ResponseWriter, r *http.Request) {
 // @Param        id   path      string  true  "Absence Request ID"
 // @Param        absenceRequest  body      models.AbsenceRequest  true  "Absence Request"
 // @Success      200  {object}  models.AbsenceRequest
-// @Failure      404  {string}  string  "absence request not found"
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      404  {object}  Problem  "absence request not found"
+// @Failure      409  {object}  Problem  "only pending absence requests can be changed"
+// @Failure      422  {object}  Problem  "invalid status"
 // @Security     BearerAuth
 // @Router       /absence-requests/{id} [put]
 func (h AbsenceRequests) Update(w http.ResponseWriter, r *http.Request) {
@@ -120,43 +189,95 @@ func (h AbsenceRequests) Update(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
+	var existing models.AbsenceRequest
+	
+	if err := h.DB.First(&existing, "id = ?", id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			writeError(w, r, "absence request not found", http.StatusNotFound)
+			return
+		}
+		
+		writeDBError(w, r, err)
+		return
+	}
+	
+	if !h.authorizeOwner(w, r, existing.UserId) {
+		return
+	}
+	
 	var a models.AbsenceRequest
 	
 	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeBodyError(w, r, err)
 		return
 	}
 	
 	a.Id = id
 	
+	if a.UserId == uuid.Nil {
+		a.UserId = existing.UserId
+	}
+	
+	if a.Status != "" && !a.Status.Valid() {
+		writeValidation(w, r, FieldError{Field: "status", Code: FieldInvalid, Message: "invalid status"})
+		return
+	}
+	
+	if a.UserId != existing.UserId && !h.authorizeOwner(w, r, a.UserId) {
+		return
+	}
+	
+	// Decided requests are frozen for their owner so approved dates cannot be stretched
+	// afterwards; a reviewer must be able to review both the current and the new owner
+	if existing.Status != models.RequestStatusPending {
+		for _, ownerID := range []uuid.UUID{existing.UserId, a.UserId} {
+			if reviewer, err := canReviewUser(h.DB, r, ownerID); err != nil || !reviewer {
+				writeError(w, r, "only pending absence requests can be changed", http.StatusConflict)
+				return
+			}
+		}
+	}
+	
 	updates := map[string]interface{}{
 		"user_id":     a.UserId,
 		"type":        a.Type,
 		"start_date":  a.StartDate,
 		"end_date":    a.EndDate,
 		"shift_id":    a.ShiftId,
-		"status":      a.Status,
-		"reviewed_by_user_id": a.ReviewedByUserId,
 	}
 	
-	if a.Status == models.RequestStatusApproved || a.Status == models.RequestStatusRejected {
-		now := time.Now()
-		updates["reviewed_at"] = &now
-	}
+	actorID, _ := currentUserID(r)
+	reviewed := false
 	
-	result := h.DB.Model(&models.AbsenceRequest{}).Where("id = ?", id).Updates(updates)
-	
-	if result.Error != nil {
-		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
-		return
+	// Status changes are decisions and must come from a reviewer of the request's owner,
+	// as it is after this update
+	if a.Status != "" && a.Status != existing.Status {
+		if !h.authorizeReviewer(w, r, a.UserId) {
+			return
+		}
+		
+		reviewerID, _ := currentUserID(r)
+		updates["status"] = a.Status
+		updates["reviewed_by_user_id"] = reviewerID
+		
+		if a.Status == models.RequestStatusApproved || a.Status == models.RequestStatusRejected {
+			now := time.Now()
+			updates["reviewed_at"] = &now
+			reviewed = true
+		}
 	}
 	
-	if result.RowsAffected == 0 {
-		http.Error(w, "absence request not found", http.StatusNotFound)
+	if err := h.updateAndPublish(id, updates, actorID, reviewed); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			writeError(w, r, "absence request not found", http.StatusNotFound)
+			return
+		}
+		
+		writeDBError(w, r, err)
 		return
 	}
 	
-	h.DB.Preload("User").Preload("ReviewedByUser").Preload("Comments").First(&a, "id = ?", id)
+	h.DB.Preload("User").Preload("ReviewedByUser").Preload("Comments", conditionArgs(visibleAbsenceCommentsCondition(r))...).First(&a, "id = ?", id)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(a)
 }
@@ -166,7 +287,8 @@ func (h AbsenceRequests) Update(w http.ResponseWriter, r *http.Request) {
 // @Tags         absence-requests
 // @Param        id   path      string  true  "Absence Request ID"
 // @Success      204  "No Content"
-// @Failure      404  {string}  string  "absence request not found"
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      404  {object}  Problem  "absence request not found"
 // @Security     BearerAuth
 // @Router       /absence-requests/{id} [delete]
 func (h AbsenceRequests) Delete(w http.ResponseWriter, r *http.Request) {
@@ -176,15 +298,31 @@ func (h AbsenceRequests) Delete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
+	var existing models.AbsenceRequest
+	
+	if err := h.DB.First(&existing, "id = ?", id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			writeError(w, r, "absence request not found", http.StatusNotFound)
+			return
+		}
+		
+		writeDBError(w, r, err)
+		return
+	}
+	
+	if !h.authorizeOwner(w, r, existing.UserId) {
+		return
+	}
+	
 	result := h.DB.Delete(&models.AbsenceRequest{}, "id = ?", id)
 	
 	if result.Error != nil {
-		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		writeDBError(w, r, result.Error)
 		return
 	}
 	
 	if result.RowsAffected == 0 {
-		http.Error(w, "absence request not found", http.StatusNotFound)
+		writeError(w, r, "absence request not found", http.StatusNotFound)
 		return
 	}
 	
@@ -193,13 +331,13 @@ func (h AbsenceRequests) Delete(w http.ResponseWriter, r *http.Request) {
 
 // Approve godoc
 // @Summary      Approve an absence request
+// @Description  The caller is recorded as reviewer. Managers may only approve requests from their own department, and nobody may approve their own request.
 // @Tags         absence-requests
-// @Accept       json
 // @Produce      json
 // @Param        id   path      string  true  "Absence Request ID"
-// @Param        body  body      object  false  "Reviewer ID (optional)"  SchemaExample({"reviewed_by_user_id": "uuid"})
 // @Success      200  {object}  models.AbsenceRequest
-// @Failure      404  {string}  string  "absence request not found"
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      404  {object}  Problem  "absence request not found"
 // @Security     BearerAuth
 // @Router       /absence-requests/{id}/approve [put]
 func (h AbsenceRequests) Approve(w http.ResponseWriter, r *http.Request) {
@@ -214,55 +352,103 @@ func (h AbsenceRequests) Approve(w http.ResponseWriter, r *http.Request) {
 	
 	if err := h.DB.First(&a, "id = ?", id).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
-			http.Error(w, "absence request not found", http.StatusNotFound)
+			writeError(w, r, "absence request not found", http.StatusNotFound)
 			return
 		}
 		
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDBError(w, r, err)
 		return
 	}
 	
-	// Parse optional reviewed_by_user_id from body
-	var body struct {
-		ReviewedByUserId *uuid.UUID `json:"reviewed_by_user_id"`
+	if !h.authorizeReviewer(w, r, a.UserId) {
+		return
 	}
 	
-	// Body is optional, so ignore decode errors
-	_ = json.NewDecoder(r.Body).Decode(&body)
-	
+	reviewerID, _ := currentUserID(r)
 	now := time.Now()
 	updates := map[string]interface{}{
-		"status":      models.RequestStatusApproved,
-		"reviewed_at": &now,
+		"status":              models.RequestStatusApproved,
+		"reviewed_at":         &now,
+		"reviewed_by_user_id": reviewerID,
 	}
 	
-	if body.ReviewedByUserId != nil {
-		updates["reviewed_by_user_id"] = body.ReviewedByUserId
+	if err := h.updateAndPublish(id, updates, reviewerID, true); err != nil {
+		if err == gorm.ErrRecordNotFound {
+			writeError(w, r, "absence request not found", http.StatusNotFound)
+			return
+		}
+		
+		writeDBError(w, r, err)
+		return
 	}
 	
-	result := h.DB.Model(&models.AbsenceRequest{}).Where("id = ?", id).Updates(updates)
+	h.DB.Preload("User").Preload("ReviewedByUser").Preload("Comments", conditionArgs(visibleAbsenceCommentsCondition(r))...).First(&a, "id = ?", id)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a)
+}
+
+// updateAndPublish applies the updates and, for a decision, publishes the review in the same transaction
+func (h AbsenceRequests) updateAndPublish(id uuid.UUID, updates map[string]interface{}, actorID uuid.UUID, reviewed bool) error {
+	return h.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.AbsenceRequest{}).Where("id = ?", id).Updates(updates)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		if !reviewed {
+			return nil
+		}
+
+		var a models.AbsenceRequest
+		if err := tx.First(&a, "id = ?", id).Error; err != nil {
+			return err
+		}
+		return h.Events.Publish(tx, events.AbsenceReviewedEvent{ActorID: actorID, Request: a})
+	})
+}
+
+// authorizeOwner writes 403 unless the caller may act for the given request owner
+func (h AbsenceRequests) authorizeOwner(w http.ResponseWriter, r *http.Request, ownerID uuid.UUID) bool {
+	allowed, err := canManageUser(h.DB, r, ownerID)
 	
-	if result.Error != nil {
-		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
-		return
+	if err != nil {
+		writeDBError(w, r, err)
+		return false
 	}
 	
-	if result.RowsAffected == 0 {
-		http.Error(w, "absence request not found", http.StatusNotFound)
-		return
+	if !allowed {
+		writeError(w, r, "forbidden", http.StatusForbidden)
+		return false
 	}
 	
-	h.DB.Preload("User").Preload("ReviewedByUser").Preload("Comments").First(&a, "id = ?", id)
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(a)
+	return true
+}
+
+// authorizeReviewer writes 403 unless the caller may decide on the given owner's requests
+func (h AbsenceRequests) authorizeReviewer(w http.ResponseWriter, r *http.Request, ownerID uuid.UUID) bool {
+	allowed, err := canReviewUser(h.DB, r, ownerID)
+	
+	if err != nil {
+		writeDBError(w, r, err)
+		return false
+	}
+	
+	if !allowed {
+		writeError(w, r, "forbidden", http.StatusForbidden)
+		return false
+	}
+	
+	return true
 }
 
 // RegisterAbsenceRequests adds absence request routes
 func RegisterAbsenceRequests(router *mux.Router, h AbsenceRequests, prefix string) {
-	router.HandleFunc(prefix, h.List).Methods("GET")
-	router.HandleFunc(prefix, h.Create).Methods("POST")
-	router.HandleFunc(prefix+"/{id}", h.GetByID).Methods("GET")
-	router.HandleFunc(prefix+"/{id}", h.Update).Methods("PUT")
-	router.HandleFunc(prefix+"/{id}/approve", h.Approve).Methods("PUT")
-	router.HandleFunc(prefix+"/{id}", h.Delete).Methods("DELETE")
+	router.HandleFunc(prefix, AuthorizeScoped(h.List, AnyRole, ScopeAbsencesRead)).Methods("GET")
+	router.HandleFunc(prefix, AuthorizeScoped(h.Create, AnyRole, ScopeAbsencesWrite)).Methods("POST")
+	router.HandleFunc(prefix+"/{id}", AuthorizeScoped(h.GetByID, AnyRole, ScopeAbsencesRead)).Methods("GET")
+	router.HandleFunc(prefix+"/{id}", AuthorizeScoped(h.Update, AnyRole, ScopeAbsencesWrite)).Methods("PUT")
+	router.HandleFunc(prefix+"/{id}/approve", AuthorizeScoped(h.Approve, StaffRoles, ScopeAbsencesWrite)).Methods("PUT")
+	router.HandleFunc(prefix+"/{id}", AuthorizeScoped(h.Delete, AnyRole, ScopeAbsencesWrite)).Methods("DELETE")
 }
@@ -0,0 +1,752 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"stuff/events"
+	"stuff/models"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// announcementPublishInterval is how often scheduled announcements are checked
+const announcementPublishInterval = 1 * time.Minute
+
+// Announcements holds DB and the event bus for announcement handlers
+type Announcements struct {
+	DB     *gorm.DB
+	Events *events.Bus
+}
+
+type AnnouncementRequest struct {
+	Title         string                      `json:"title"`
+	Body          string                      `json:"body"` // markdown
+	Audience      models.AnnouncementAudience `json:"audience"`
+	AudienceRole  *models.Role                `json:"audience_role"`  // for ROLE
+	DepartmentIds []uuid.UUID                 `json:"department_ids"` // for DEPARTMENTS
+	Pinned        bool                        `json:"pinned"`
+	PublishAt     *time.Time                  `json:"publish_at"` // defaults to now
+	ExpiresAt     *time.Time                  `json:"expires_at"`
+}
+
+type AnnouncementResponse struct {
+	models.Announcement
+	ReadAt *time.Time `json:"read_at"` // when the caller read it; null if unread or not a recipient
+}
+
+type AnnouncementStats struct {
+	Recipients  int64                         `json:"recipients"`
+	Read        int64                         `json:"read"`
+	Rate        float64                       `json:"rate"` // read / recipients, 0 to 1
+	Departments []DepartmentAnnouncementStats `json:"departments"`
+}
+
+type DepartmentAnnouncementStats struct {
+	DepartmentId   uuid.UUID `json:"department_id"`
+	DepartmentName string    `json:"department_name"`
+	Recipients     int64     `json:"recipients"`
+	Read           int64     `json:"read"`
+	Rate           float64   `json:"rate"`
+}
+
+var errAnnouncementPublished = errors.New("announcement already published")
+
+// announcementListSpec controls filtering, sorting and includes for GET /announcements
+var announcementListSpec = listSpec{
+	filters: map[string]filterFunc{
+		"pinned":     boolFilter("pinned"),
+		"audience":   eqFilter("audience"),
+		"created_by": uuidFilter("created_by_user_id"),
+		"from":       fromFilter("publish_at"),
+		"to":         toFilter("publish_at"),
+	},
+	sorts: map[string]string{
+		"pinned":     "pinned",
+		"publish_at": "publish_at",
+		"created_at": "created_at",
+		"title":      "title",
+	},
+	defaultSort: "-pinned,-publish_at",
+	includes: map[string]listInclude{
+		"created_by_user": {preload: "CreatedByUser", columns: []string{"created_by_user_id"}},
+		"departments":     {preload: "Departments"},
+	},
+	defaultInclude: []string{"departments"},
+	computed:       []string{"read_at"},
+}
+
+// List godoc
+// @Summary      List announcements
+// @Description  Published, unexpired announcements sent to the caller, pinned first. With manage=true: every announcement the caller can manage, including scheduled and expired ones (HR and admins see all, others their own), latest publish time first.
+// @Description  Paged with limit/offset or cursor. See X-Total-Count, X-Next-Cursor and Link.
+// @Tags         announcements
+// @Produce      json
+// @Param        manage      query     bool    false  "List announcements the caller manages"
+// @Param        pinned      query     bool    false  "Only pinned or unpinned announcements"
+// @Param        audience    query     string  false  "EVERYONE, DEPARTMENTS or ROLE"
+// @Param        created_by  query     string  false  "Author ID, or me"
+// @Param        from        query     string  false  "Publish time at or after (date or RFC 3339)"
+// @Param        to          query     string  false  "Publish time at or before (date or RFC 3339)"
+// @Param        sort        query     string  false  "pinned, publish_at, created_at or title; prefix - for descending"
+// @Param        include     query     string  false  "created_by_user, departments (default departments)"
+// @Param        fields      query     string  false  "Fields to return, e.g. id,title,read_at"
+// @Param        limit       query     int     false  "Page size (default 50, max 200)"
+// @Param        offset      query     int     false  "Rows to skip"
+// @Param        cursor      query     string  false  "X-Next-Cursor of the previous page"
+// @Success      200  {array}   AnnouncementResponse
+// @Failure      400  {object}  Problem  "invalid filter, sort, include or cursor"
+// @Security     BearerAuth
+// @Router       /announcements [get]
+func (h Announcements) List(w http.ResponseWriter, r *http.Request) {
+	userID, _ := currentUserID(r)
+
+	manage := false
+	if s := r.URL.Query().Get("manage"); s != "" {
+		var err error
+		if manage, err = strconv.ParseBool(s); err != nil {
+			writeErrorCode(w, r, CodeInvalidQuery, "invalid boolean: manage", http.StatusBadRequest)
+			return
+		}
+	}
+
+	spec := announcementListSpec
+	query := h.DB
+	if manage {
+		if !hasRole(r, PeopleRoles...) {
+			query = query.Where("created_by_user_id = ?", userID)
+		}
+		spec.defaultSort = "-publish_at"
+	} else {
+		query = query.
+			Where("id IN (?)", h.DB.Model(&models.AnnouncementReceipt{}).Select("announcement_id").Where("user_id = ?", userID)).
+			Where("published_at IS NOT NULL AND (expires_at IS NULL OR expires_at > ?)", time.Now())
+	}
+
+	var list []models.Announcement
+	l, page, ok := findList(w, r, query, spec, &list)
+	if !ok {
+		return
+	}
+
+	responses, err := h.withReadState(userID, list)
+	if err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	l.write(w, r, responses, page)
+}
+
+// GetByID godoc
+// @Summary      Get announcement by ID
+// @Description  Recipients can see published announcements; authors, HR and admins can see any they manage
+// @Tags         announcements
+// @Produce      json
+// @Param        id   path      string  true  "Announcement ID"
+// @Success      200  {object}  AnnouncementResponse
+// @Failure      404  {object}  Problem  "announcement not found"
+// @Security     BearerAuth
+// @Router       /announcements/{id} [get]
+func (h Announcements) GetByID(w http.ResponseWriter, r *http.Request) {
+	id, ok := uuidParam(w, r, "id")
+	if !ok {
+		return
+	}
+
+	a, ok := h.find(w, r, id)
+	if !ok {
+		return
+	}
+
+	userID, _ := currentUserID(r)
+
+	// Hide announcements from people who neither received nor manage them
+	if !canManageAnnouncement(r, a) {
+		received, err := h.received(userID, a.Id)
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+		if !received {
+			writeError(w, r, "announcement not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	responses, err := h.withReadState(userID, []models.Announcement{a})
+	if err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(responses[0])
+}
+
+// Create godoc
+// @Summary      Create an announcement
+// @Description  Notifications go out at publish_at (right away if omitted). HR and admins may address anyone; managers only their own department.
+// @Tags         announcements
+// @Accept       json
+// @Produce      json
+// @Param        announcement  body      AnnouncementRequest  true  "Announcement"
+// @Success      201  {object}  models.Announcement
+// @Failure      400  {object}  Problem  "invalid announcement"
+// @Failure      403  {object}  Problem  "forbidden"
+// @Security     BearerAuth
+// @Router       /announcements [post]
+func (h Announcements) Create(w http.ResponseWriter, r *http.Request) {
+	var req AnnouncementRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+
+	if req.PublishAt == nil {
+		now := time.Now()
+		req.PublishAt = &now
+	}
+
+	departments, ok := h.validate(w, r, &req)
+	if !ok {
+		return
+	}
+
+	userID, _ := currentUserID(r)
+	a := models.Announcement{
+		Id:              uuid.New(),
+		Title:           SanitizeInput(req.Title),
+		Body:            req.Body,
+		Audience:        req.Audience,
+		AudienceRole:    req.AudienceRole,
+		Pinned:          req.Pinned,
+		PublishAt:       *req.PublishAt,
+		ExpiresAt:       req.ExpiresAt,
+		CreatedByUserId: userID,
+		Departments:     departments,
+	}
+
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit("Departments.*").Create(&a).Error; err != nil {
+			return err
+		}
+
+		if a.PublishAt.After(time.Now()) {
+			return nil
+		}
+		return h.publish(tx, &a)
+	})
+	if err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(a)
+}
+
+// Update godoc
+// @Summary      Update an announcement
+// @Description  Title, body, pinned and expires_at can always change. Audience and publish_at only until the announcement is published.
+// @Tags         announcements
+// @Accept       json
+// @Produce      json
+// @Param        id            path      string               true  "Announcement ID"
+// @Param        announcement  body      AnnouncementRequest  true  "Announcement"
+// @Success      200  {object}  models.Announcement
+// @Failure      400  {object}  Problem  "invalid announcement"
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      404  {object}  Problem  "announcement not found"
+// @Failure      409  {object}  Problem  "announcement already published"
+// @Security     BearerAuth
+// @Router       /announcements/{id} [put]
+func (h Announcements) Update(w http.ResponseWriter, r *http.Request) {
+	id, ok := uuidParam(w, r, "id")
+	if !ok {
+		return
+	}
+
+	existing, ok := h.find(w, r, id)
+	if !ok {
+		return
+	}
+
+	if !canManageAnnouncement(r, existing) {
+		writeError(w, r, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	var req AnnouncementRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+
+	if req.PublishAt == nil {
+		req.PublishAt = &existing.PublishAt
+	}
+
+	published := existing.PublishedAt != nil
+	if published {
+		// The audience has been notified; only the content may change
+		req.Audience = existing.Audience
+		req.AudienceRole = existing.AudienceRole
+		req.DepartmentIds = nil
+		for _, d := range existing.Departments {
+			req.DepartmentIds = append(req.DepartmentIds, d.Id)
+		}
+		if !req.PublishAt.Equal(existing.PublishAt) {
+			writeError(w, r, errAnnouncementPublished.Error(), http.StatusConflict)
+			return
+		}
+	}
+
+	departments, ok := h.validate(w, r, &req)
+	if !ok {
+		return
+	}
+
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		updates := map[string]interface{}{
+			"title":         SanitizeInput(req.Title),
+			"body":          req.Body,
+			"pinned":        req.Pinned,
+			"expires_at":    req.ExpiresAt,
+			"audience":      req.Audience,
+			"audience_role": req.AudienceRole,
+			"publish_at":    *req.PublishAt,
+		}
+
+		query := tx.Model(&models.Announcement{}).Where("id = ?", id)
+		if !published {
+			// The scheduler may have published it in the meantime
+			query = query.Where("published_at IS NULL")
+		}
+
+		result := query.Updates(updates)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errAnnouncementPublished
+		}
+
+		if published {
+			return nil
+		}
+
+		a := models.Announcement{Id: id}
+		if err := tx.Model(&a).Association("Departments").Replace(departments); err != nil {
+			return err
+		}
+
+		if err := tx.First(&a, "id = ?", id).Error; err != nil {
+			return err
+		}
+		if a.PublishAt.After(time.Now()) {
+			return nil
+		}
+		a.Departments = departments
+		return h.publish(tx, &a)
+	})
+
+	if err == errAnnouncementPublished {
+		writeError(w, r, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	var a models.Announcement
+	h.DB.Preload("Departments").First(&a, "id = ?", id)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a)
+}
+
+// Delete godoc
+// @Summary      Delete an announcement
+// @Description  Also removes its read receipts and the notifications it sent
+// @Tags         announcements
+// @Param        id   path      string  true  "Announcement ID"
+// @Success      204  "No Content"
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      404  {object}  Problem  "announcement not found"
+// @Security     BearerAuth
+// @Router       /announcements/{id} [delete]
+func (h Announcements) Delete(w http.ResponseWriter, r *http.Request) {
+	id, ok := uuidParam(w, r, "id")
+	if !ok {
+		return
+	}
+
+	existing, ok := h.find(w, r, id)
+	if !ok {
+		return
+	}
+
+	if !canManageAnnouncement(r, existing) {
+		writeError(w, r, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&existing).Association("Departments").Clear(); err != nil {
+			return err
+		}
+		if err := tx.Where("announcement_id = ?", id).Delete(&models.AnnouncementReceipt{}).Error; err != nil {
+			return err
+		}
+		err := tx.Where("related_entity_type = ? AND related_entity_id = ?", events.EntityAnnouncement, id).
+			Delete(&models.Notification{}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Delete(&models.Announcement{}, "id = ?", id).Error
+	})
+	if err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// MarkRead godoc
+// @Summary      Acknowledge an announcement
+// @Description  Records the caller's read receipt and marks the announcement's notification as read
+// @Tags         announcements
+// @Produce      json
+// @Param        id   path      string  true  "Announcement ID"
+// @Success      200  {object}  models.AnnouncementReceipt
+// @Failure      404  {object}  Problem  "announcement not found"
+// @Security     BearerAuth
+// @Router       /announcements/{id}/read [post]
+func (h Announcements) MarkRead(w http.ResponseWriter, r *http.Request) {
+	id, ok := uuidParam(w, r, "id")
+	if !ok {
+		return
+	}
+
+	userID, _ := currentUserID(r)
+	var receipt models.AnnouncementReceipt
+
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&receipt, "announcement_id = ? AND user_id = ?", id, userID).Error; err != nil {
+			return err
+		}
+
+		// Keep the first read time
+		if receipt.ReadAt != nil {
+			return nil
+		}
+
+		now := time.Now()
+		if err := tx.Model(&receipt).Update("read_at", &now).Error; err != nil {
+			return err
+		}
+		receipt.ReadAt = &now
+
+		return tx.Model(&models.Notification{}).
+			Where("user_id = ? AND related_entity_type = ? AND related_entity_id = ? AND read_at IS NULL", userID, events.EntityAnnouncement, id).
+			Update("read_at", &now).Error
+	})
+
+	if err == gorm.ErrRecordNotFound {
+		writeError(w, r, "announcement not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(receipt)
+}
+
+// Stats godoc
+// @Summary      Announcement acknowledgement rates
+// @Description  How many recipients have read the announcement, overall and per department (the recipient's department when it was published)
+// @Tags         announcements
+// @Produce      json
+// @Param        id   path      string  true  "Announcement ID"
+// @Success      200  {object}  AnnouncementStats
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      404  {object}  Problem  "announcement not found"
+// @Security     BearerAuth
+// @Router       /announcements/{id}/stats [get]
+func (h Announcements) Stats(w http.ResponseWriter, r *http.Request) {
+	id, ok := uuidParam(w, r, "id")
+	if !ok {
+		return
+	}
+
+	a, ok := h.find(w, r, id)
+	if !ok {
+		return
+	}
+
+	if !canManageAnnouncement(r, a) {
+		writeError(w, r, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	stats := AnnouncementStats{Departments: []DepartmentAnnouncementStats{}}
+	err := h.DB.Model(&models.AnnouncementReceipt{}).
+		Select("announcement_receipts.department_id, departments.name AS department_name, COUNT(*) AS recipients, COUNT(announcement_receipts.read_at) AS read").
+		Joins("LEFT JOIN departments ON departments.id = announcement_receipts.department_id").
+		Where("announcement_receipts.announcement_id = ?", id).
+		Group("announcement_receipts.department_id, departments.name").
+		Order("departments.name").
+		Scan(&stats.Departments).Error
+	if err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	for i := range stats.Departments {
+		d := &stats.Departments[i]
+		d.Rate = readRate(d.Read, d.Recipients)
+		stats.Recipients += d.Recipients
+		stats.Read += d.Read
+	}
+	stats.Rate = readRate(stats.Read, stats.Recipients)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// PublishScheduled starts the routine that publishes announcements once their publish time is reached
+func (h Announcements) PublishScheduled() {
+	ticker := time.NewTicker(announcementPublishInterval)
+	go func() {
+		for range ticker.C {
+			var due []models.Announcement
+			err := h.DB.Preload("Departments").
+				Where("published_at IS NULL AND publish_at <= ?", time.Now()).
+				Find(&due).Error
+			if err != nil {
+				log.Printf("announcements: %v", err)
+				continue
+			}
+
+			for i := range due {
+				err := h.DB.Transaction(func(tx *gorm.DB) error {
+					return h.publish(tx, &due[i])
+				})
+				if err != nil && err != errAnnouncementPublished {
+					log.Printf("announcements: publish %s: %v", due[i].Id, err)
+				}
+			}
+		}
+	}()
+}
+
+// publish marks the announcement published, writes a receipt for every member of the
+// audience and publishes the event that notifies them. It claims the announcement first
+// so that only one replica sends it.
+func (h Announcements) publish(tx *gorm.DB, a *models.Announcement) error {
+	now := time.Now()
+	result := tx.Model(&models.Announcement{}).
+		Where("id = ? AND published_at IS NULL", a.Id).
+		Update("published_at", &now)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errAnnouncementPublished
+	}
+	a.PublishedAt = &now
+
+	query := tx.Model(&models.User{}).Select("id, department_id")
+	switch a.Audience {
+	case models.AnnouncementAudienceDepartments:
+		ids := make([]uuid.UUID, len(a.Departments))
+		for i, d := range a.Departments {
+			ids[i] = d.Id
+		}
+		query = query.Where("department_id IN ?", ids)
+	case models.AnnouncementAudienceRole:
+		query = query.Where("role = ?", *a.AudienceRole)
+	}
+
+	var users []models.User
+	if err := query.Find(&users).Error; err != nil {
+		return err
+	}
+	if len(users) == 0 {
+		return nil
+	}
+
+	receipts := make([]models.AnnouncementReceipt, len(users))
+	recipients := make([]uuid.UUID, len(users))
+	for i, u := range users {
+		receipts[i] = models.AnnouncementReceipt{AnnouncementId: a.Id, UserId: u.Id, DepartmentId: u.DepartmentId}
+		recipients[i] = u.Id
+	}
+
+	if err := tx.CreateInBatches(&receipts, 500).Error; err != nil {
+		return err
+	}
+
+	return h.Events.Publish(tx, events.AnnouncementPublishedEvent{Announcement: *a, Recipients: recipients})
+}
+
+// validate checks an announcement request and the caller's right to address its audience.
+// It clears fields that do not apply to the audience and returns the audience departments,
+// or writes an error and returns false.
+func (h Announcements) validate(w http.ResponseWriter, r *http.Request, req *AnnouncementRequest) ([]models.Department, bool) {
+	var missing []FieldError
+	if SanitizeInput(req.Title) == "" {
+		missing = append(missing, FieldError{Field: "title", Code: FieldRequired, Message: "is required"})
+	}
+	if req.Body == "" {
+		missing = append(missing, FieldError{Field: "body", Code: FieldRequired, Message: "is required"})
+	}
+	if len(missing) > 0 {
+		writeValidation(w, r, missing...)
+		return nil, false
+	}
+
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(*req.PublishAt) {
+		writeValidation(w, r, FieldError{Field: "expires_at", Code: FieldInvalid, Message: "must be after publish_at"})
+		return nil, false
+	}
+
+	var departments []models.Department
+
+	switch req.Audience {
+	case models.AnnouncementAudienceEveryone:
+	case models.AnnouncementAudienceRole:
+		if req.AudienceRole == nil || !req.AudienceRole.Valid() {
+			writeValidation(w, r, FieldError{Field: "audience_role", Code: FieldInvalid, Message: "must be a valid role"})
+			return nil, false
+		}
+	case models.AnnouncementAudienceDepartments:
+		if len(req.DepartmentIds) == 0 {
+			writeValidation(w, r, FieldError{Field: "department_ids", Code: FieldRequired, Message: "is required for the DEPARTMENTS audience"})
+			return nil, false
+		}
+		if err := h.DB.Where("id IN ?", req.DepartmentIds).Find(&departments).Error; err != nil {
+			writeDBError(w, r, err)
+			return nil, false
+		}
+		if len(departments) != len(uniqueIDs(req.DepartmentIds)) {
+			writeValidation(w, r, FieldError{Field: "department_ids", Code: FieldUnknown, Message: "contains an unknown department"})
+			return nil, false
+		}
+	default:
+		writeValidation(w, r, FieldError{Field: "audience", Code: FieldInvalid, Message: "must be EVERYONE, DEPARTMENTS or ROLE"})
+		return nil, false
+	}
+
+	if req.Audience != models.AnnouncementAudienceRole {
+		req.AudienceRole = nil
+	}
+
+	// Managers may only address their own department
+	if !hasRole(r, PeopleRoles...) {
+		own, _ := currentDepartmentID(r)
+		if req.Audience != models.AnnouncementAudienceDepartments || len(departments) != 1 || departments[0].Id != own {
+			writeError(w, r, "managers can only address their own department", http.StatusForbidden)
+			return nil, false
+		}
+	}
+
+	return departments, true
+}
+
+// find loads an announcement with its departments, writing 404 if it does not exist
+func (h Announcements) find(w http.ResponseWriter, r *http.Request, id uuid.UUID) (models.Announcement, bool) {
+	var a models.Announcement
+	if err := h.DB.Preload("Departments").First(&a, "id = ?", id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			writeError(w, r, "announcement not found", http.StatusNotFound)
+			return a, false
+		}
+		writeDBError(w, r, err)
+		return a, false
+	}
+	return a, true
+}
+
+// received reports whether the announcement was delivered to the user
+func (h Announcements) received(userID, announcementID uuid.UUID) (bool, error) {
+	var count int64
+	err := h.DB.Model(&models.AnnouncementReceipt{}).
+		Where("announcement_id = ? AND user_id = ?", announcementID, userID).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// withReadState adds the caller's read time to each announcement
+func (h Announcements) withReadState(userID uuid.UUID, list []models.Announcement) ([]AnnouncementResponse, error) {
+	ids := make([]uuid.UUID, len(list))
+	for i, a := range list {
+		ids[i] = a.Id
+	}
+
+	var receipts []models.AnnouncementReceipt
+	if err := h.DB.Where("user_id = ? AND announcement_id IN ?", userID, ids).Find(&receipts).Error; err != nil {
+		return nil, err
+	}
+
+	readAt := make(map[uuid.UUID]*time.Time, len(receipts))
+	for _, rc := range receipts {
+		readAt[rc.AnnouncementId] = rc.ReadAt
+	}
+
+	responses := make([]AnnouncementResponse, len(list))
+	for i, a := range list {
+		responses[i] = AnnouncementResponse{Announcement: a, ReadAt: readAt[a.Id]}
+	}
+	return responses, nil
+}
+
+// canManageAnnouncement reports whether the caller may edit the announcement and see its stats
+func canManageAnnouncement(r *http.Request, a models.Announcement) bool {
+	userID, _ := currentUserID(r)
+	return a.CreatedByUserId == userID || hasRole(r, PeopleRoles...)
+}
+
+// readRate returns read / recipients, or 0 without recipients
+func readRate(read, recipients int64) float64 {
+	if recipients == 0 {
+		return 0
+	}
+	return float64(read) / float64(recipients)
+}
+
+// uniqueIDs returns ids without duplicates
+func uniqueIDs(ids []uuid.UUID) []uuid.UUID {
+	seen := make(map[uuid.UUID]bool, len(ids))
+	var out []uuid.UUID
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+// RegisterAnnouncements registers announcement routes. Managers, HR and admins write announcements; everyone reads the ones sent to them.
+func RegisterAnnouncements(router *mux.Router, h Announcements, prefix string) {
+	router.HandleFunc(prefix, AuthorizeScoped(h.List, AnyRole, ScopeAnnouncementsRead)).Methods("GET")
+	router.HandleFunc(prefix, AuthorizeScoped(h.Create, StaffRoles, ScopeAnnouncementsWrite)).Methods("POST")
+	router.HandleFunc(prefix+"/{id}", AuthorizeScoped(h.GetByID, AnyRole, ScopeAnnouncementsRead)).Methods("GET")
+	router.HandleFunc(prefix+"/{id}", AuthorizeScoped(h.Update, StaffRoles, ScopeAnnouncementsWrite)).Methods("PUT")
+	router.HandleFunc(prefix+"/{id}", AuthorizeScoped(h.Delete, StaffRoles, ScopeAnnouncementsWrite)).Methods("DELETE")
+	router.HandleFunc(prefix+"/{id}/read", AuthorizeScoped(h.MarkRead, AnyRole, ScopeAnnouncementsWrite)).Methods("POST")
+	router.HandleFunc(prefix+"/{id}/stats", AuthorizeScoped(h.Stats, StaffRoles, ScopeAnnouncementsRead)).Methods("GET")
+}
@@ -0,0 +1,318 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"stuff/models"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+const (
+	// apiTokenPrefix marks bearer tokens that are API tokens rather than JWTs
+	apiTokenPrefix = "yo_"
+	// apiTokenDefaultTTL is used when no expiry is requested
+	apiTokenDefaultTTL = 90 * 24 * time.Hour
+	// apiTokenMaxTTL is the longest an API token may live
+	apiTokenMaxTTL = 365 * 24 * time.Hour
+	// apiTokenUsageInterval limits how often last-used details are written
+	apiTokenUsageInterval = 1 * time.Minute
+)
+
+// API token scopes, enforced per route with AuthorizeScoped
+const (
+	ScopeTicketsRead        = "tickets:read"
+	ScopeTicketsWrite       = "tickets:write"
+	ScopeShiftsRead         = "shifts:read"
+	ScopeShiftsWrite        = "shifts:write"
+	ScopeAbsencesRead       = "absences:read"
+	ScopeAbsencesWrite      = "absences:write"
+	ScopeUsersRead          = "users:read"
+	ScopeUsersWrite         = "users:write"
+	ScopeDepartmentsRead    = "departments:read"
+	ScopeDepartmentsWrite   = "departments:write"
+	ScopeNotificationsRead  = "notifications:read"
+	ScopeNotificationsWrite = "notifications:write"
+	ScopeAnnouncementsRead  = "announcements:read"
+	ScopeAnnouncementsWrite = "announcements:write"
+)
+
+// APITokenScopes lists every scope a token can be given
+var APITokenScopes = []string{
+	ScopeTicketsRead, ScopeTicketsWrite,
+	ScopeShiftsRead, ScopeShiftsWrite,
+	ScopeAbsencesRead, ScopeAbsencesWrite,
+	ScopeUsersRead, ScopeUsersWrite,
+	ScopeDepartmentsRead, ScopeDepartmentsWrite,
+	ScopeNotificationsRead, ScopeNotificationsWrite,
+	ScopeAnnouncementsRead, ScopeAnnouncementsWrite,
+}
+
+// APITokens holds DB for API token handlers
+type APITokens struct {
+	DB *gorm.DB
+}
+
+// CreateAPITokenRequest is the body for creating an API token
+type CreateAPITokenRequest struct {
+	Name          string     `json:"name"`
+	Scopes        []string   `json:"scopes"`
+	ExpiresInDays int        `json:"expires_in_days"`   // defaults to 90, at most 365
+	UserId        *uuid.UUID `json:"user_id,omitempty"` // admins only: issue a token for another (service) user
+}
+
+// CreateAPITokenResponse holds the new token; the secret cannot be retrieved again
+type CreateAPITokenResponse struct {
+	Token    string          `json:"token"` // shown once
+	APIToken models.APIToken `json:"api_token"`
+}
+
+// isAPIToken reports whether a bearer token is an API token
+func isAPIToken(token string) bool {
+	return strings.HasPrefix(token, apiTokenPrefix)
+}
+
+// hasScope reports whether the token was granted the scope
+func hasScope(token *models.APIToken, scope string) bool {
+	return slices.Contains(strings.Fields(token.Scopes), scope)
+}
+
+// authenticateAPIToken looks up an API token and returns a context carrying its user.
+// The user's current role and department apply, so a token never outranks its owner.
+func authenticateAPIToken(ctx context.Context, db *gorm.DB, r *http.Request, raw string) (context.Context, error) {
+	var token models.APIToken
+	if err := db.Preload("User").First(&token, "token_hash = ?", hashToken(raw)).Error; err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if token.RevokedAt != nil || now.After(token.ExpiresAt) {
+		return nil, errors.New("token revoked or expired")
+	}
+
+	// Record usage, at most once per interval
+	db.Model(&models.APIToken{}).
+		Where("id = ? AND (last_used_at IS NULL OR last_used_at < ?)", token.Id, now.Add(-apiTokenUsageInterval)).
+		Updates(map[string]interface{}{"last_used_at": now, "last_used_ip": getClientIP(r)})
+
+	ctx = context.WithValue(ctx, UserIDKey, token.User.Id.String())
+	ctx = context.WithValue(ctx, EmailKey, token.User.Email)
+	ctx = context.WithValue(ctx, RoleKey, token.User.Role)
+	ctx = context.WithValue(ctx, DepartmentIDKey, token.User.DepartmentId.String())
+	ctx = context.WithValue(ctx, APITokenKey, &token)
+	return ctx, nil
+}
+
+// apiTokenListSpec controls filtering and sorting for GET /api-tokens
+var apiTokenListSpec = listSpec{
+	filters: map[string]filterFunc{
+		"active": nullFilter("revoked_at"),
+	},
+	sorts: map[string]string{
+		"created_at": "created_at",
+		"expires_at": "expires_at",
+		"name":       "name",
+	},
+	defaultSort: "-created_at",
+}
+
+// List godoc
+// @Summary      List API tokens
+// @Description  The caller's API tokens. Admins may pass user_id to see another user's tokens.
+// @Description  Paged with limit/offset or cursor. See X-Total-Count, X-Next-Cursor and Link.
+// @Tags         api-tokens
+// @Produce      json
+// @Param        user_id  query     string  false  "User ID (admins only)"
+// @Param        active   query     bool    false  "Only tokens that are not (true) or are (false) revoked"
+// @Param        sort     query     string  false  "created_at, expires_at or name; prefix - for descending (default -created_at)"
+// @Param        fields   query     string  false  "Fields to return, e.g. id,name,last_used_at"
+// @Param        limit    query     int     false  "Page size (default 50, max 200)"
+// @Param        offset   query     int     false  "Rows to skip"
+// @Param        cursor   query     string  false  "X-Next-Cursor of the previous page"
+// @Success      200  {array}   models.APIToken
+// @Failure      400  {object}  Problem  "invalid filter, sort or cursor"
+// @Failure      403  {object}  Problem  "forbidden"
+// @Security     BearerAuth
+// @Router       /api-tokens [get]
+func (h APITokens) List(w http.ResponseWriter, r *http.Request) {
+	userID, _ := currentUserID(r)
+
+	if s := r.URL.Query().Get("user_id"); s != "" {
+		id, err := uuid.Parse(s)
+		if err != nil {
+			writeErrorCode(w, r, CodeInvalidQuery, "invalid user_id", http.StatusBadRequest)
+			return
+		}
+		if id != userID && !hasRole(r, models.RoleAdmin) {
+			writeError(w, r, "forbidden", http.StatusForbidden)
+			return
+		}
+		userID = id
+	}
+
+	serveList[models.APIToken](w, r, h.DB.Where("user_id = ?", userID), apiTokenListSpec)
+}
+
+// Create godoc
+// @Summary      Create an API token
+// @Description  Create a named, scoped, expiring token for integrations. The token is only returned once. Send it as "Authorization: Bearer <token>".
+// @Tags         api-tokens
+// @Accept       json
+// @Produce      json
+// @Param        token  body      CreateAPITokenRequest  true  "Token"
+// @Success      201  {object}  CreateAPITokenResponse
+// @Failure      400  {object}  Problem  "invalid request"
+// @Failure      403  {object}  Problem  "forbidden"
+// @Security     BearerAuth
+// @Router       /api-tokens [post]
+func (h APITokens) Create(w http.ResponseWriter, r *http.Request) {
+	callerID, _ := currentUserID(r)
+
+	var req CreateAPITokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+
+	req.Name = SanitizeInput(req.Name)
+	if req.Name == "" {
+		writeValidation(w, r, FieldError{Field: "name", Code: FieldRequired, Message: "is required"})
+		return
+	}
+
+	if len(req.Scopes) == 0 {
+		writeValidation(w, r, FieldError{Field: "scopes", Code: FieldRequired, Message: "needs at least one scope"})
+		return
+	}
+
+	for _, scope := range req.Scopes {
+		if !slices.Contains(APITokenScopes, scope) {
+			writeValidation(w, r, FieldError{Field: "scopes", Code: FieldUnknown, Message: "unknown scope " + scope})
+			return
+		}
+	}
+
+	ttl := apiTokenDefaultTTL
+	if req.ExpiresInDays < 0 {
+		writeValidation(w, r, FieldError{Field: "expires_in_days", Code: FieldInvalid, Message: "must be positive"})
+		return
+	}
+	if req.ExpiresInDays > 0 {
+		ttl = time.Duration(req.ExpiresInDays) * 24 * time.Hour
+	}
+	if ttl > apiTokenMaxTTL {
+		writeValidation(w, r, FieldError{Field: "expires_in_days", Code: FieldInvalid, Message: "may be at most 365"})
+		return
+	}
+
+	ownerID := callerID
+	if req.UserId != nil && *req.UserId != callerID {
+		if !hasRole(r, models.RoleAdmin) {
+			writeError(w, r, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		var count int64
+		if err := h.DB.Model(&models.User{}).Where("id = ?", *req.UserId).Count(&count).Error; err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+		if count == 0 {
+			writeValidation(w, r, FieldError{Field: "user_id", Code: FieldUnknown, Message: "user not found"})
+			return
+		}
+		ownerID = *req.UserId
+	}
+
+	secret, err := newOpaqueToken()
+	if err != nil {
+		writeError(w, r, "failed to create token", http.StatusInternalServerError)
+		return
+	}
+	raw := apiTokenPrefix + secret
+
+	slices.Sort(req.Scopes)
+	token := models.APIToken{
+		Id:              uuid.New(),
+		UserId:          ownerID,
+		Name:            req.Name,
+		Prefix:          raw[:len(apiTokenPrefix)+8],
+		TokenHash:       hashToken(raw),
+		Scopes:          strings.Join(slices.Compact(req.Scopes), " "),
+		ExpiresAt:       time.Now().Add(ttl),
+		CreatedByUserId: callerID,
+	}
+
+	if err := h.DB.Create(&token).Error; err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CreateAPITokenResponse{Token: raw, APIToken: token})
+}
+
+// Revoke godoc
+// @Summary      Revoke an API token
+// @Description  Owners can revoke their own tokens; admins can revoke any token
+// @Tags         api-tokens
+// @Param        id   path      string  true  "Token ID"
+// @Success      204  "No Content"
+// @Failure      404  {object}  Problem  "token not found"
+// @Security     BearerAuth
+// @Router       /api-tokens/{id} [delete]
+func (h APITokens) Revoke(w http.ResponseWriter, r *http.Request) {
+	id, ok := uuidParam(w, r, "id")
+	if !ok {
+		return
+	}
+
+	callerID, _ := currentUserID(r)
+
+	query := h.DB.Model(&models.APIToken{}).Where("id = ? AND revoked_at IS NULL", id)
+	if !hasRole(r, models.RoleAdmin) {
+		query = query.Where("user_id = ?", callerID)
+	}
+
+	result := query.Update("revoked_at", time.Now())
+	if result.Error != nil {
+		writeDBError(w, r, result.Error)
+		return
+	}
+
+	if result.RowsAffected == 0 {
+		writeError(w, r, "token not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListScopes godoc
+// @Summary      List API token scopes
+// @Tags         api-tokens
+// @Produce      json
+// @Success      200  {array}   string
+// @Security     BearerAuth
+// @Router       /api-tokens/scopes [get]
+func (h APITokens) ListScopes(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(APITokenScopes)
+}
+
+// RegisterAPITokens registers API token routes. Tokens are managed from a logged-in session only.
+func RegisterAPITokens(router *mux.Router, h APITokens, prefix string) {
+	router.HandleFunc(prefix, Authorize(h.List, AnyRole)).Methods("GET")
+	router.HandleFunc(prefix, Authorize(h.Create, AnyRole)).Methods("POST")
+	router.HandleFunc(prefix+"/scopes", Authorize(h.ListScopes, AnyRole)).Methods("GET")
+	router.HandleFunc(prefix+"/{id}", Authorize(h.Revoke, AnyRole)).Methods("DELETE")
+}
@@ -0,0 +1,661 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"stuff/models"
+	"stuff/storage"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// Attachments holds DB, blob store and virus scanner for ticket attachment handlers
+type Attachments struct {
+	DB         *gorm.DB
+	Store      storage.Store
+	Scanner    storage.Scanner
+	SigningKey []byte // signs download links, see DownloadSigningKey
+}
+
+const (
+	defaultAttachmentMaxMB  = 10
+	maxAttachmentsPerUpload = 10
+	thumbnailSize           = 256
+	downloadURLTTL          = 15 * time.Minute
+)
+
+// allowedAttachmentTypes are the sniffed content types that may be uploaded
+var allowedAttachmentTypes = map[string]bool{
+	"image/png":          true,
+	"image/jpeg":         true,
+	"image/gif":          true,
+	"image/webp":         true,
+	"text/plain":         true,
+	"application/pdf":    true,
+	"application/zip":    true,
+	"application/x-gzip": true,
+}
+
+// attachmentListSpec controls filtering, sorting and includes for GET /tickets/{id}/attachments
+var attachmentListSpec = listSpec{
+	filters: map[string]filterFunc{
+		"comment_id":  uuidFilter("comment_id"),
+		"uploaded_by": uuidFilter("uploaded_by_user_id"),
+	},
+	sorts: map[string]string{
+		"created_at": "created_at",
+		"file_name":  "file_name",
+		"size":       "size",
+	},
+	defaultSort: "created_at",
+	includes: map[string]listInclude{
+		"uploaded_by_user": {preload: "UploadedByUser", columns: []string{"uploaded_by_user_id"}},
+	},
+	defaultInclude: []string{"uploaded_by_user"},
+	computed:       []string{"download_url", "thumbnail_url"},
+	computedFrom: map[string][]string{
+		"download_url":  {"id"},
+		"thumbnail_url": {"id", "thumbnail_key"},
+	},
+}
+
+// getAttachmentMaxSize reads ATTACHMENT_MAX_MB, the largest file that may be uploaded
+func getAttachmentMaxSize() int64 {
+	if s := os.Getenv("ATTACHMENT_MAX_MB"); s != "" {
+		if mb, err := strconv.Atoi(s); err == nil && mb > 0 {
+			return int64(mb) << 20
+		}
+		log.Printf("invalid ATTACHMENT_MAX_MB %q, using %d", s, defaultAttachmentMaxMB)
+	}
+	return defaultAttachmentMaxMB << 20
+}
+
+// DownloadSigningKey returns the key for signed download links. DOWNLOAD_URL_SECRET is
+// used when set, otherwise a key derived from JWT_SECRET. The built-in default is
+// refused unless APP_ENV=development.
+func DownloadSigningKey() ([]byte, error) {
+	if secret := os.Getenv("DOWNLOAD_URL_SECRET"); secret != "" {
+		return []byte(secret), nil
+	}
+	if os.Getenv("JWT_SECRET") == "" && !isDevelopment() {
+		return nil, errors.New("set DOWNLOAD_URL_SECRET or JWT_SECRET to sign download links")
+	}
+	mac := hmac.New(sha256.New, getJWTSecret())
+	mac.Write([]byte("attachment downloads"))
+	return mac.Sum(nil), nil
+}
+
+// spooledFile is an uploaded file buffered to a temporary file
+type spooledFile struct {
+	name string
+	file *os.File
+	size int64
+}
+
+// ListByTicket godoc
+// @Summary      List attachments on a ticket
+// @Description  download_url and thumbnail_url are signed links relative to the API, valid for 15 minutes.
+// @Description  Files on internal notes are left out for callers who cannot read the notes.
+// @Description  Paged with limit/offset or cursor. See X-Total-Count, X-Next-Cursor and Link.
+// @Tags         attachments
+// @Produce      json
+// @Param        id           path      string  true   "Ticket ID"
+// @Param        comment_id   query     string  false  "Comment ID, or none for files on the ticket itself"
+// @Param        uploaded_by  query     string  false  "Uploader ID, or me"
+// @Param        sort         query     string  false  "created_at, file_name or size; prefix - for descending (default created_at)"
+// @Param        include      query     string  false  "uploaded_by_user (default uploaded_by_user)"
+// @Param        fields       query     string  false  "Fields to return, e.g. id,file_name,download_url"
+// @Param        limit        query     int     false  "Page size (default 50, max 200)"
+// @Param        offset       query     int     false  "Rows to skip"
+// @Param        cursor       query     string  false  "X-Next-Cursor of the previous page"
+// @Success      200  {array}   models.Attachment
+// @Failure      400  {object}  Problem  "invalid filter, sort, include or cursor"
+// @Failure      404  {object}  Problem  "ticket not found"
+// @Security     BearerAuth
+// @Router       /tickets/{id}/attachments [get]
+func (h Attachments) ListByTicket(w http.ResponseWriter, r *http.Request) {
+	ticketID, ok := uuidParam(w, r, "id")
+	if !ok {
+		return
+	}
+
+	if !ticketVisible(w, r, h.DB, ticketID) {
+		return
+	}
+
+	visible, args := visibleAttachmentsCondition(r)
+	var list []models.Attachment
+	l, page, ok := findList(w, r, h.DB.Where("ticket_id = ?", ticketID).Where(visible, args...), attachmentListSpec, &list)
+	if !ok {
+		return
+	}
+
+	for i := range list {
+		h.sign(&list[i])
+	}
+	l.write(w, r, list, page)
+}
+
+// GetByID godoc
+// @Summary      Get an attachment on a ticket
+// @Tags         attachments
+// @Produce      json
+// @Param        id            path      string  true  "Ticket ID"
+// @Param        attachmentId  path      string  true  "Attachment ID"
+// @Success      200  {object}  models.Attachment
+// @Failure      404  {object}  Problem  "attachment not found"
+// @Security     BearerAuth
+// @Router       /tickets/{id}/attachments/{attachmentId} [get]
+func (h Attachments) GetByID(w http.ResponseWriter, r *http.Request) {
+	a, ok := h.findAttachment(w, r)
+	if !ok {
+		return
+	}
+
+	h.sign(&a)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a)
+}
+
+// Upload godoc
+// @Summary      Upload attachments to a ticket
+// @Description  Send one or more "file" parts as multipart/form-data, at most 10 per request.
+// @Description  The content type is sniffed from the file; images, text, PDF, zip and gzip are accepted.
+// @Description  Files larger than ATTACHMENT_MAX_MB (default 10) are refused. Files are virus scanned when a scanner is configured.
+// @Tags         attachments
+// @Accept       multipart/form-data
+// @Produce      json
+// @Param        id          path      string  true   "Ticket ID"
+// @Param        file        formData  file    true   "File; repeat for more files"
+// @Param        comment_id  formData  string  false  "Attach the files to this comment on the ticket"
+// @Success      201  {array}   models.Attachment
+// @Failure      400  {object}  Problem  "not a multipart request"
+// @Failure      404  {object}  Problem  "ticket not found"
+// @Failure      413  {object}  Problem  "file too large"
+// @Failure      415  {object}  Problem  "file type not allowed"
+// @Failure      422  {object}  Problem  "no files, unknown comment or infected file"
+// @Failure      502  {object}  Problem  "virus scanner unavailable"
+// @Security     BearerAuth
+// @Router       /tickets/{id}/attachments [post]
+func (h Attachments) Upload(w http.ResponseWriter, r *http.Request) {
+	ticketID, ok := uuidParam(w, r, "id")
+	if !ok {
+		return
+	}
+
+	if !ticketVisible(w, r, h.DB, ticketID) {
+		return
+	}
+
+	maxSize := getAttachmentMaxSize()
+	r.Body = http.MaxBytesReader(w, r.Body, maxAttachmentsPerUpload*maxSize+1<<20)
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		writeErrorCode(w, r, CodeInvalidBody, "expected a multipart/form-data body", http.StatusBadRequest)
+		return
+	}
+
+	var files []spooledFile
+	defer func() {
+		for _, f := range files {
+			f.file.Close()
+			os.Remove(f.file.Name())
+		}
+	}()
+
+	var commentValue string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeUploadError(w, r, err)
+			return
+		}
+
+		switch {
+		case part.FormName() == "file" && part.FileName() != "":
+			if len(files) == maxAttachmentsPerUpload {
+				writeValidation(w, r, FieldError{Field: "file", Code: FieldInvalid, Message: fmt.Sprintf("at most %d files per request", maxAttachmentsPerUpload)})
+				return
+			}
+			f, err := spool(part, maxSize)
+			if f.file != nil {
+				files = append(files, f)
+			}
+			if err != nil {
+				writeUploadError(w, r, err)
+				return
+			}
+		case part.FormName() == "comment_id":
+			b, err := io.ReadAll(io.LimitReader(part, 64))
+			if err != nil {
+				writeUploadError(w, r, err)
+				return
+			}
+			commentValue = strings.TrimSpace(string(b))
+		}
+		part.Close()
+	}
+
+	if len(files) == 0 {
+		writeValidation(w, r, FieldError{Field: "file", Code: FieldRequired, Message: "is required"})
+		return
+	}
+
+	var commentID *uuid.UUID
+	if commentValue != "" {
+		id, err := uuid.Parse(commentValue)
+		if err != nil {
+			writeValidation(w, r, FieldError{Field: "comment_id", Code: FieldInvalid, Message: "must be a UUID"})
+			return
+		}
+
+		var count int64
+		visible, args := visibleCommentsCondition(r)
+		if err := h.DB.Model(&models.TicketComment{}).Where("id = ? AND ticket_id = ?", id, ticketID).Where(visible, args...).Count(&count).Error; err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+		if count == 0 {
+			writeValidation(w, r, FieldError{Field: "comment_id", Code: FieldUnknown, Message: "no such comment on this ticket"})
+			return
+		}
+		commentID = &id
+	}
+
+	userID, _ := currentUserID(r)
+	attachments := make([]models.Attachment, 0, len(files))
+	var stored []string
+	cleanup := func() {
+		for _, key := range stored {
+			if err := h.Store.Delete(r.Context(), key); err != nil {
+				log.Printf("attachments: delete %s: %v", key, err)
+			}
+		}
+	}
+
+	for _, f := range files {
+		a, keys, ok := h.store(w, r, f, ticketID)
+		stored = append(stored, keys...)
+		if !ok {
+			cleanup()
+			return
+		}
+		a.CommentId = commentID
+		a.UploadedByUserId = userID
+		attachments = append(attachments, a)
+	}
+
+	if err := h.DB.Create(&attachments).Error; err != nil {
+		cleanup()
+		writeDBError(w, r, err)
+		return
+	}
+
+	ids := make([]uuid.UUID, len(attachments))
+	for i, a := range attachments {
+		ids[i] = a.Id
+	}
+	h.DB.Preload("UploadedByUser").Order("created_at, file_name").Find(&attachments, "id IN ?", ids)
+	for i := range attachments {
+		h.sign(&attachments[i])
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(attachments)
+}
+
+// spool copies an uploaded file to a temporary file, failing once it passes maxSize.
+// The returned file is set whenever one was created, so the caller can remove it.
+func spool(part *multipart.Part, maxSize int64) (spooledFile, error) {
+	tmp, err := os.CreateTemp("", "attachment-*")
+	if err != nil {
+		return spooledFile{}, err
+	}
+	f := spooledFile{name: part.FileName(), file: tmp}
+
+	f.size, err = io.Copy(tmp, io.LimitReader(part, maxSize+1))
+	if err != nil {
+		return f, err
+	}
+	if f.size > maxSize {
+		return f, &http.MaxBytesError{Limit: maxSize}
+	}
+	return f, nil
+}
+
+// writeUploadError answers a multipart body that could not be read
+func writeUploadError(w http.ResponseWriter, r *http.Request, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, r, fmt.Sprintf("files may be at most %d MB", getAttachmentMaxSize()>>20), http.StatusRequestEntityTooLarge)
+		return
+	}
+	writeErrorCode(w, r, CodeInvalidBody, "the multipart body could not be read", http.StatusBadRequest)
+}
+
+// store checks one spooled file and writes it, and its thumbnail for images, to the blob store.
+// It returns the keys it wrote so the caller can remove them if a later file fails.
+func (h Attachments) store(w http.ResponseWriter, r *http.Request, f spooledFile, ticketID uuid.UUID) (models.Attachment, []string, bool) {
+	name := cleanFileName(f.name)
+
+	head := make([]byte, 512)
+	n, err := f.file.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		writeInternalError(w, r, err)
+		return models.Attachment{}, nil, false
+	}
+	contentType := http.DetectContentType(head[:n])
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if !allowedAttachmentTypes[mediaType] {
+		writeError(w, r, fmt.Sprintf("%s: files of type %s are not allowed", name, mediaType), http.StatusUnsupportedMediaType)
+		return models.Attachment{}, nil, false
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(f.file, 0, f.size)); err != nil {
+		writeInternalError(w, r, err)
+		return models.Attachment{}, nil, false
+	}
+
+	result, err := h.Scanner.Scan(r.Context(), io.NewSectionReader(f.file, 0, f.size))
+	if err != nil {
+		log.Printf("attachments: scan %s: %v", name, err)
+		writeError(w, r, "the virus scanner is unavailable, try again later", http.StatusBadGateway)
+		return models.Attachment{}, nil, false
+	}
+	if result.Infected {
+		writeErrorCode(w, r, CodeFileInfected, fmt.Sprintf("%s was rejected by the virus scanner (%s)", name, result.Signature), http.StatusUnprocessableEntity)
+		return models.Attachment{}, nil, false
+	}
+
+	a := models.Attachment{
+		Id:          uuid.New(),
+		TicketId:    ticketID,
+		FileName:    name,
+		ContentType: contentType,
+		Size:        f.size,
+		Sha256:      hex.EncodeToString(hash.Sum(nil)),
+		Scanned:     result.Scanned,
+	}
+	a.StorageKey = "tickets/" + ticketID.String() + "/" + a.Id.String()
+
+	if err := h.Store.Put(r.Context(), a.StorageKey, io.NewSectionReader(f.file, 0, f.size), f.size, contentType); err != nil {
+		writeInternalError(w, r, err)
+		return models.Attachment{}, nil, false
+	}
+	keys := []string{a.StorageKey}
+
+	if strings.HasPrefix(mediaType, "image/") {
+		thumb, thumbType, err := storage.Thumbnail(io.NewSectionReader(f.file, 0, f.size), thumbnailSize)
+		if err != nil && !errors.Is(err, storage.ErrNoThumbnail) {
+			log.Printf("attachments: thumbnail %s: %v", name, err)
+		}
+		if err == nil {
+			key := a.StorageKey + ".thumb"
+			if err := h.Store.Put(r.Context(), key, bytes.NewReader(thumb), int64(len(thumb)), thumbType); err != nil {
+				writeInternalError(w, r, err)
+				return models.Attachment{}, keys, false
+			}
+			keys = append(keys, key)
+			a.ThumbnailKey = &key
+		}
+	}
+
+	return a, keys, true
+}
+
+// cleanFileName keeps the base name of an uploaded file without control characters
+func cleanFileName(name string) string {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(c rune) rune {
+		if unicode.IsControl(c) {
+			return -1
+		}
+		return c
+	}, name)
+	name = strings.TrimSpace(name)
+
+	if name == "" || name == "." || name == "/" {
+		return "file"
+	}
+	for len(name) > 255 {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	return name
+}
+
+// Delete godoc
+// @Summary      Delete an attachment
+// @Description  The uploader and staff can delete attachments
+// @Tags         attachments
+// @Param        id            path      string  true  "Ticket ID"
+// @Param        attachmentId  path      string  true  "Attachment ID"
+// @Success      204  "No Content"
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      404  {object}  Problem  "attachment not found"
+// @Security     BearerAuth
+// @Router       /tickets/{id}/attachments/{attachmentId} [delete]
+func (h Attachments) Delete(w http.ResponseWriter, r *http.Request) {
+	a, ok := h.findAttachment(w, r)
+	if !ok {
+		return
+	}
+
+	userID, _ := currentUserID(r)
+	if a.UploadedByUserId != userID && !hasRole(r, StaffRoles...) {
+		writeError(w, r, "only the uploader or staff can delete this attachment", http.StatusForbidden)
+		return
+	}
+
+	result := h.DB.Delete(&models.Attachment{}, "id = ?", a.Id)
+	if result.Error != nil {
+		writeDBError(w, r, result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		writeError(w, r, "attachment not found", http.StatusNotFound)
+		return
+	}
+
+	deleteAttachmentBlobs(r, h.Store, []models.Attachment{a})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteAttachmentBlobs removes the files of deleted attachments. Failures are only
+// logged; the rows are already gone, so an orphaned blob is the worst outcome.
+func deleteAttachmentBlobs(r *http.Request, store storage.Store, attachments []models.Attachment) {
+	for _, a := range attachments {
+		keys := []string{a.StorageKey}
+		if a.ThumbnailKey != nil {
+			keys = append(keys, *a.ThumbnailKey)
+		}
+		for _, key := range keys {
+			if err := store.Delete(r.Context(), key); err != nil {
+				log.Printf("attachments: delete %s: %v", key, err)
+			}
+		}
+	}
+}
+
+// Download godoc
+// @Summary      Download an attachment
+// @Description  Needs no bearer token; the link from download_url carries a signature that expires after 15 minutes
+// @Tags         attachments
+// @Produce      octet-stream
+// @Param        id         path      string  true  "Attachment ID"
+// @Param        expires    query     int     true  "Unix time the link expires"
+// @Param        signature  query     string  true  "Link signature"
+// @Success      200  {file}    file
+// @Failure      403  {object}  Problem  "invalid or expired link"
+// @Failure      404  {object}  Problem  "attachment not found"
+// @Router       /attachments/{id}/download [get]
+func (h Attachments) Download(w http.ResponseWriter, r *http.Request) {
+	h.serve(w, r, "download")
+}
+
+// Thumbnail godoc
+// @Summary      Download an image attachment's thumbnail
+// @Description  Needs no bearer token; the link from thumbnail_url carries a signature that expires after 15 minutes
+// @Tags         attachments
+// @Produce      png,jpeg
+// @Param        id         path      string  true  "Attachment ID"
+// @Param        expires    query     int     true  "Unix time the link expires"
+// @Param        signature  query     string  true  "Link signature"
+// @Success      200  {file}    file
+// @Failure      403  {object}  Problem  "invalid or expired link"
+// @Failure      404  {object}  Problem  "attachment or thumbnail not found"
+// @Router       /attachments/{id}/thumbnail [get]
+func (h Attachments) Thumbnail(w http.ResponseWriter, r *http.Request) {
+	h.serve(w, r, "thumbnail")
+}
+
+// serve checks the link signature and streams the file or its thumbnail
+func (h Attachments) serve(w http.ResponseWriter, r *http.Request, variant string) {
+	id, ok := uuidParam(w, r, "id")
+	if !ok {
+		return
+	}
+
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	signature, sigErr := hex.DecodeString(r.URL.Query().Get("signature"))
+	if err != nil || sigErr != nil || time.Now().Unix() > expires || !hmac.Equal(signature, h.signature(id, variant, expires)) {
+		writeErrorCode(w, r, CodeInvalidToken, "the download link is invalid or has expired", http.StatusForbidden)
+		return
+	}
+
+	var a models.Attachment
+	if err := h.DB.First(&a, "id = ?", id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			writeError(w, r, "attachment not found", http.StatusNotFound)
+			return
+		}
+		writeDBError(w, r, err)
+		return
+	}
+
+	key, contentType, disposition := a.StorageKey, a.ContentType, "attachment"
+	if variant == "thumbnail" {
+		if a.ThumbnailKey == nil {
+			writeError(w, r, "attachment has no thumbnail", http.StatusNotFound)
+			return
+		}
+		key, contentType = *a.ThumbnailKey, "image/png"
+		if a.ContentType == "image/jpeg" {
+			contentType = "image/jpeg"
+		}
+	}
+	if strings.HasPrefix(contentType, "image/") {
+		disposition = "inline"
+	}
+
+	blob, err := h.Store.Get(r.Context(), key)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			writeError(w, r, "attachment file not found", http.StatusNotFound)
+			return
+		}
+		writeInternalError(w, r, err)
+		return
+	}
+	defer blob.Close()
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": a.FileName}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("Cache-Control", "private, max-age=900")
+	if variant == "download" {
+		w.Header().Set("Content-Length", strconv.FormatInt(a.Size, 10))
+	}
+	if _, err := io.Copy(w, blob); err != nil {
+		log.Printf("attachments: send %s: %v", a.Id, err)
+	}
+}
+
+// sign fills in the signed download links of a
+func (h Attachments) sign(a *models.Attachment) {
+	expires := time.Now().Add(downloadURLTTL).Unix()
+	a.DownloadURL = h.link(a.Id, "download", expires)
+	if a.ThumbnailKey != nil {
+		a.ThumbnailURL = h.link(a.Id, "thumbnail", expires)
+	}
+}
+
+// link builds a signed link to the download or thumbnail route
+func (h Attachments) link(id uuid.UUID, variant string, expires int64) string {
+	return fmt.Sprintf("/attachments/%s/%s?expires=%d&signature=%s", id, variant, expires, hex.EncodeToString(h.signature(id, variant, expires)))
+}
+
+// signature is the HMAC of the attachment, the variant and the expiry time
+func (h Attachments) signature(id uuid.UUID, variant string, expires int64) []byte {
+	mac := hmac.New(sha256.New, h.SigningKey)
+	fmt.Fprintf(mac, "%s|%s|%d", id, variant, expires)
+	return mac.Sum(nil)
+}
+
+// visibleAttachmentsCondition leaves out files on internal notes the caller may not read
+func visibleAttachmentsCondition(r *http.Request) (string, []interface{}) {
+	visible, args := visibleCommentsCondition(r)
+	return "(comment_id IS NULL OR comment_id IN (SELECT id FROM ticket_comments WHERE " + visible + "))", args
+}
+
+// findAttachment loads the attachment named by the route, writing 404 if it is not on the ticket
+func (h Attachments) findAttachment(w http.ResponseWriter, r *http.Request) (models.Attachment, bool) {
+	var a models.Attachment
+	ticketID, ok := uuidParam(w, r, "id")
+	if !ok {
+		return a, false
+	}
+	id, ok := uuidParam(w, r, "attachmentId")
+	if !ok || !ticketVisible(w, r, h.DB, ticketID) {
+		return a, false
+	}
+
+	visible, args := visibleAttachmentsCondition(r)
+	if err := h.DB.Preload("UploadedByUser").Where(visible, args...).First(&a, "id = ? AND ticket_id = ?", id, ticketID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			writeError(w, r, "attachment not found", http.StatusNotFound)
+			return a, false
+		}
+		writeDBError(w, r, err)
+		return a, false
+	}
+	return a, true
+}
+
+// RegisterAttachments adds the attachment routes under the tickets prefix, and the
+// signed download routes, which need no bearer token, to the public router
+func RegisterAttachments(router, public *mux.Router, h Attachments, ticketsPrefix, downloadPrefix string) {
+	router.HandleFunc(ticketsPrefix+"/{id}/attachments", AuthorizeScoped(h.ListByTicket, AnyRole, ScopeTicketsRead)).Methods("GET")
+	router.HandleFunc(ticketsPrefix+"/{id}/attachments", AuthorizeScoped(h.Upload, AnyRole, ScopeTicketsWrite)).Methods("POST")
+	router.HandleFunc(ticketsPrefix+"/{id}/attachments/{attachmentId}", AuthorizeScoped(h.GetByID, AnyRole, ScopeTicketsRead)).Methods("GET")
+	router.HandleFunc(ticketsPrefix+"/{id}/attachments/{attachmentId}", AuthorizeScoped(h.Delete, AnyRole, ScopeTicketsWrite)).Methods("DELETE")
+	public.HandleFunc(downloadPrefix+"/{id}/download", h.Download).Methods("GET")
+	public.HandleFunc(downloadPrefix+"/{id}/thumbnail", h.Thumbnail).Methods("GET")
+}
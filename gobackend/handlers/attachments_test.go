@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"stuff/models"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+func TestCleanFileName(t *testing.T) {
+	tests := map[string]string{
+		"report.pdf":                "report.pdf",
+		"  report.pdf  ":            "report.pdf",
+		"../../etc/passwd":          "passwd",
+		`C:\Users\anna\invoice.pdf`: "invoice.pdf",
+		"/":                         "file",
+		"":                          "file",
+		".":                         "file",
+		"bad\x00name\n.txt":         "badname.txt",
+		strings.Repeat("æ", 200):    strings.Repeat("æ", 127),
+	}
+	for in, want := range tests {
+		if got := cleanFileName(in); got != want {
+			t.Errorf("cleanFileName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestSignedLinks(t *testing.T) {
+	h := Attachments{SigningKey: []byte("test key")}
+	a := models.Attachment{Id: uuid.New()}
+	h.sign(&a)
+
+	link, err := url.Parse(a.DownloadURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "/attachments/" + a.Id.String() + "/download"; link.Path != want {
+		t.Fatalf("path = %q, want %q", link.Path, want)
+	}
+	if a.ThumbnailURL != "" {
+		t.Errorf("thumbnail link for an attachment without thumbnail: %q", a.ThumbnailURL)
+	}
+
+	expires, err := strconv.ParseInt(link.Query().Get("expires"), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl := time.Until(time.Unix(expires, 0)); ttl <= 0 || ttl > downloadURLTTL {
+		t.Errorf("link expires in %v", ttl)
+	}
+
+	want := h.signature(a.Id, "download", expires)
+	if got := link.Query().Get("signature"); got != hex.EncodeToString(want) {
+		t.Errorf("signature = %q", got)
+	}
+
+	// Each part of the signed message changes the signature
+	for name, other := range map[string][]byte{
+		"variant": h.signature(a.Id, "thumbnail", expires),
+		"expires": h.signature(a.Id, "download", expires+1),
+		"id":      h.signature(uuid.New(), "download", expires),
+		"key":     Attachments{SigningKey: []byte("other key")}.signature(a.Id, "download", expires),
+	} {
+		if hex.EncodeToString(other) == hex.EncodeToString(want) {
+			t.Errorf("changing the %s kept the signature", name)
+		}
+	}
+}
+
+func TestServeRefusesBadLinks(t *testing.T) {
+	h := Attachments{SigningKey: []byte("test key")}
+	id := uuid.New()
+	future := time.Now().Add(time.Minute).Unix()
+	past := time.Now().Add(-time.Minute).Unix()
+
+	tests := map[string]struct {
+		variant   string
+		expires   string
+		signature string
+	}{
+		"expired":          {"download", strconv.FormatInt(past, 10), hex.EncodeToString(h.signature(id, "download", past))},
+		"other variant":    {"download", strconv.FormatInt(future, 10), hex.EncodeToString(h.signature(id, "thumbnail", future))},
+		"moved expiry":     {"download", strconv.FormatInt(future+60, 10), hex.EncodeToString(h.signature(id, "download", future))},
+		"no signature":     {"download", strconv.FormatInt(future, 10), ""},
+		"not hex":          {"download", strconv.FormatInt(future, 10), "zz"},
+		"no expiry":        {"download", "", hex.EncodeToString(h.signature(id, "download", future))},
+		"thumbnail signed": {"thumbnail", strconv.FormatInt(future, 10), hex.EncodeToString(h.signature(id, "download", future))},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			q := url.Values{"expires": {tt.expires}, "signature": {tt.signature}}
+			r := httptest.NewRequest("GET", "/attachments/"+id.String()+"/"+tt.variant+"?"+q.Encode(), nil)
+			r = mux.SetURLVars(r, map[string]string{"id": id.String()})
+			w := httptest.NewRecorder()
+
+			h.serve(w, r, tt.variant)
+			if w.Code != http.StatusForbidden {
+				t.Errorf("status = %d, want 403", w.Code)
+			}
+		})
+	}
+}
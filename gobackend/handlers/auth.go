@@ -1,12 +1,13 @@
 package handlers
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
-	"os"
 	"time"
 
+	"stuff/mailer"
 	"stuff/models"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -16,9 +17,10 @@ import (
 	"gorm.io/gorm"
 )
 
-// Auth holds DB for authentication handlers
+// Auth holds DB and mailer for authentication handlers
 type Auth struct {
-	DB *gorm.DB
+	DB     *gorm.DB
+	Mailer mailer.Mailer
 }
 
 type LoginRequest struct {
@@ -27,8 +29,20 @@ type LoginRequest struct {
 }
 
 type LoginResponse struct {
-	Token string      `json:"token"`
-	User  models.User `json:"user"`
+	Token         string      `json:"token"`
+	RefreshToken  string      `json:"refresh_token"`
+	ExpiresAt     time.Time   `json:"expires_at"`
+	User          models.User `json:"user"`
+	RecoveryCodes []string    `json:"recovery_codes,omitempty"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type LogoutRequest struct {
+	RefreshToken string `json:"refresh_token"`
+	AllSessions  bool   `json:"all_sessions"`
 }
 
 type RegisterRequest struct {
@@ -39,97 +53,122 @@ type RegisterRequest struct {
 }
 
 type SSORequest struct {
-	Provider     string `json:"provider"` // "google" or "github"
-	IDToken      string `json:"id_token"`
-	Email        string `json:"email"`
-	Name         string `json:"name"`
+	Provider     string    `json:"provider"` // "google" or another configured OpenID Connect provider
+	IDToken      string    `json:"id_token"`
+	Nonce        string    `json:"nonce"` // from /auth/sso/nonce, sent in the provider sign-in request
+	Name         string    `json:"name"`  // used when the token has no name; the email always comes from the token
 	DepartmentId uuid.UUID `json:"department_id,omitempty"`
 }
 
 type Claims struct {
-	UserID string `json:"user_id"`
-	Email  string `json:"email"`
+	UserID       string `json:"user_id"`
+	Email        string `json:"email"`
+	Role         string `json:"role"`
+	DepartmentID string `json:"department_id"`
 	jwt.RegisteredClaims
 }
 
-// getJWTSecret retrieves the JWT secret from environment or uses a default (not recommended for production)
-func getJWTSecret() []byte {
-	secret := os.Getenv("JWT_SECRET")
-	if secret == "" {
-		secret = "your-secret-key-change-this-in-production"
-	}
-	return []byte(secret)
-}
-
 // Login godoc
 // @Summary      User login
-// @Description  Authenticate user and return JWT token
+// @Description  Authenticate user and return JWT token. Users with MFA enabled, or in a department that requires it, get an MFAChallengeResponse instead and must finish at /auth/login/mfa.
 // @Tags         auth
 // @Accept       json
 // @Produce      json
 // @Param        credentials  body      LoginRequest  true  "Login credentials"
 // @Success      200  {object}  LoginResponse
-// @Failure      400  {string}  string  "Invalid request"
-// @Failure      401  {string}  string  "Invalid credentials"
+// @Success      202  {object}  MFAChallengeResponse
+// @Failure      400  {object}  Problem  "Invalid request"
+// @Failure      401  {object}  Problem  "Invalid credentials"
+// @Failure      423  {object}  Problem  "Account temporarily locked"
+// @Failure      429  {object}  Problem  "Too many failed attempts"
 // @Router       /auth/login [post]
 func (h Auth) Login(w http.ResponseWriter, r *http.Request) {
 	var req LoginRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+		writeErrorCode(w, r, CodeInvalidBody, "Invalid request", http.StatusBadRequest)
 		return
 	}
 
 	// Sanitize and validate input
 	req.Email = SanitizeInput(req.Email)
 	if !ValidateEmail(req.Email) {
-		http.Error(w, "Invalid email format", http.StatusBadRequest)
+		writeValidation(w, r, FieldError{Field: "email", Code: FieldInvalid, Message: "Invalid email format"})
 		return
 	}
 
 	var user models.User
 	if err := h.DB.Preload("Department").First(&user, "email = ?", req.Email).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
-			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+			recordLoginAttempt(h.DB, r, req.Email, nil, false, loginReasonUnknownUser)
+			writeErrorCode(w, r, CodeInvalidCredentials, "Invalid credentials", http.StatusUnauthorized)
 			return
 		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDBError(w, r, err)
+		return
+	}
+
+	// Refuse early while the account is throttled or locked
+	if !checkLoginAllowed(w, r, h.DB, user) {
 		return
 	}
 
 	// Verify password
 	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		if err := registerLoginFailure(h.DB, user); err != nil {
+			log.Printf("failed to register login failure for %s: %v", user.Email, err)
+		}
+		recordLoginAttempt(h.DB, r, user.Email, &user.Id, false, loginReasonInvalidPassword)
+		writeErrorCode(w, r, CodeInvalidCredentials, "Invalid credentials", http.StatusUnauthorized)
 		return
 	}
 
-	// Generate JWT token
-	token, err := h.generateToken(user.Id.String(), user.Email)
+	// A second factor is needed before any token is minted
+	if mfaRequired(user) {
+		recordLoginAttempt(h.DB, r, user.Email, &user.Id, false, loginReasonMfaPending)
+
+		challenge, err := newMFAChallenge(user, !user.MfaEnabled)
+		if err != nil {
+			writeError(w, r, "Failed to generate token", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(challenge)
+		return
+	}
+
+	if err := resetLoginFailures(h.DB, user.Id); err != nil {
+		log.Printf("failed to reset login failures for %s: %v", user.Email, err)
+	}
+	recordLoginAttempt(h.DB, r, user.Email, &user.Id, true, loginReasonSuccess)
+
+	// Generate access and refresh tokens
+	session, err := newSession(h.DB, user)
 	if err != nil {
-		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		writeError(w, r, "Failed to generate token", http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(LoginResponse{
-		Token: token,
-		User:  user,
-	})
+	json.NewEncoder(w).Encode(session)
 }
 
 // Register godoc
 // @Summary      User registration
-// @Description  Register a new user
+// @Description  Register a new user. In a department that requires MFA the response is an MFAChallengeResponse for enrollment, finished at /auth/login/mfa, instead of a session.
 // @Tags         auth
 // @Accept       json
 // @Produce      json
 // @Param        user  body      RegisterRequest  true  "Registration details"
 // @Success      201  {object}  LoginResponse
-// @Failure      400  {string}  string  "Invalid request"
+// @Success      202  {object}  MFAChallengeResponse
+// @Failure      400  {object}  Problem  "Invalid request"
 // @Router       /auth/register [post]
 func (h Auth) Register(w http.ResponseWriter, r *http.Request) {
 	var req RegisterRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+		writeErrorCode(w, r, CodeInvalidBody, "Invalid request", http.StatusBadRequest)
 		return
 	}
 
@@ -139,33 +178,33 @@ func (h Auth) Register(w http.ResponseWriter, r *http.Request) {
 
 	// Validate name
 	if !ValidateName(req.Name) {
-		http.Error(w, "Invalid name. Name must be 2-100 characters and contain only letters, spaces, hyphens, or apostrophes", http.StatusBadRequest)
+		writeValidation(w, r, FieldError{Field: "name", Code: FieldInvalid, Message: "Name must be 2-100 characters and contain only letters, spaces, hyphens, or apostrophes"})
 		return
 	}
 
 	// Validate email
 	if !ValidateEmail(req.Email) {
-		http.Error(w, "Invalid email format", http.StatusBadRequest)
+		writeValidation(w, r, FieldError{Field: "email", Code: FieldInvalid, Message: "Invalid email format"})
 		return
 	}
 
 	// Validate password
 	if valid, msg := ValidatePassword(req.Password); !valid {
-		http.Error(w, msg, http.StatusBadRequest)
+		writeValidation(w, r, FieldError{Field: "password", Code: FieldInvalid, Message: msg})
 		return
 	}
 
 	// Check if user already exists
 	var existingUser models.User
 	if err := h.DB.First(&existingUser, "email = ?", req.Email).Error; err == nil {
-		http.Error(w, "User already exists", http.StatusBadRequest)
+		writeProblem(w, r, Problem{Status: http.StatusConflict, Code: CodeAlreadyExists, Detail: "User already exists", Errors: []FieldError{{Field: "email", Code: FieldTaken, Message: "is already in use"}}})
 		return
 	}
 
 	// Hash password
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
 	if err != nil {
-		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+		writeError(w, r, "Failed to hash password", http.StatusInternalServerError)
 		return
 	}
 
@@ -176,308 +215,271 @@ func (h Auth) Register(w http.ResponseWriter, r *http.Request) {
 		Email:        req.Email,
 		PasswordHash: string(hashedPassword),
 		DepartmentId: req.DepartmentId,
+		Role:         models.RoleEmployee,
 	}
 
 	if err := h.DB.Create(&user).Error; err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDBError(w, r, err)
 		return
 	}
 
 	// Load department relation
 	h.DB.Preload("Department").First(&user, "id = ?", user.Id)
 
-	// Generate JWT token
-	token, err := h.generateToken(user.Id.String(), user.Email)
+	// Like Login, no token is minted before the second factor is set up
+	if mfaRequired(user) {
+		challenge, err := newMFAChallenge(user, true)
+		if err != nil {
+			writeError(w, r, "Failed to generate token", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(challenge)
+		return
+	}
+
+	// Generate access and refresh tokens
+	session, err := newSession(h.DB, user)
 	if err != nil {
-		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		writeError(w, r, "Failed to generate token", http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(LoginResponse{
-		Token: token,
-		User:  user,
-	})
+	json.NewEncoder(w).Encode(session)
 }
 
 // SSOLogin godoc
-// @Summary      SSO login (Google/GitHub)
-// @Description  Authenticate user via SSO and return JWT token
+// @Summary      SSO login with an ID token
+// @Description  Authenticate with an ID token obtained directly from Google or another OpenID Connect provider (e.g. native sign-in on mobile). Browser logins use /auth/sso/{provider}/authorize instead.
+// @Description  Get a nonce from /auth/sso/nonce first and send it in the provider sign-in request; each nonce works once.
 // @Tags         auth
 // @Accept       json
 // @Produce      json
 // @Param        sso  body      SSORequest  true  "SSO credentials"
 // @Success      200  {object}  LoginResponse
-// @Failure      400  {string}  string  "Invalid request"
+// @Failure      400  {object}  Problem  "Invalid request, or invalid or expired nonce"
+// @Failure      401  {object}  Problem  "Invalid token"
+// @Failure      403  {object}  Problem  "Email not verified"
 // @Router       /auth/sso [post]
 func (h Auth) SSOLogin(w http.ResponseWriter, r *http.Request) {
 	var req SSORequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request", http.StatusBadRequest)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.IDToken == "" {
+		writeErrorCode(w, r, CodeInvalidBody, "Invalid request", http.StatusBadRequest)
 		return
 	}
 
-	// Sanitize input
-	req.Email = SanitizeInput(req.Email)
-	req.Name = SanitizeInput(req.Name)
+	// The nonce must be one this server handed out, so a captured ID token cannot be replayed
+	if !consumeSSONonce(h.DB, req.Nonce) {
+		recordLoginAttempt(h.DB, r, "", nil, false, loginReasonSSOFailed)
+		writeErrorCode(w, r, CodeInvalidToken, "Invalid or expired nonce", http.StatusBadRequest)
+		return
+	}
 
-	// Verify Google token if it's a Google SSO request
+	var identity ssoIdentity
 	if req.Provider == "google" {
-		tokenInfo, err := VerifyGoogleToken(req.IDToken)
+		tokenInfo, err := VerifyGoogleToken(req.IDToken, req.Nonce)
 		if err != nil {
-			http.Error(w, "Invalid Google token: "+err.Error(), http.StatusUnauthorized)
+			log.Printf("google sso: %v", err)
+			recordLoginAttempt(h.DB, r, "", nil, false, loginReasonSSOFailed)
+			writeErrorCode(w, r, CodeInvalidToken, "Invalid Google token", http.StatusUnauthorized)
 			return
 		}
-		
-		// Use verified email and name from Google
-		req.Email = tokenInfo.Email
-		if tokenInfo.Name != "" {
-			req.Name = tokenInfo.Name
-		}
-	}
-
-	// Validate email
-	if !ValidateEmail(req.Email) {
-		http.Error(w, "Invalid email format", http.StatusBadRequest)
-		return
-	}
 
-	// Try to find existing user
-	var user models.User
-	err := h.DB.Preload("Department").First(&user, "email = ?", req.Email).Error
-	
-	if err == gorm.ErrRecordNotFound {
-		// Create new user for SSO
-		// Use a default department if not provided
-		departmentId := req.DepartmentId
-		if departmentId == uuid.Nil {
-			// Get first department as default
-			var dept models.Department
-			if err := h.DB.First(&dept).Error; err != nil {
-				http.Error(w, "No default department found", http.StatusInternalServerError)
-				return
-			}
-			departmentId = dept.Id
+		identity = ssoIdentity{
+			Provider:      "google",
+			Subject:       tokenInfo.Subject,
+			Email:         tokenInfo.Email,
+			EmailVerified: bool(tokenInfo.EmailVerified),
+			Name:          tokenInfo.Name,
 		}
-
-		user = models.User{
-			Id:           uuid.New(),
-			Name:         req.Name,
-			Email:        req.Email,
-			PasswordHash: "", // No password for SSO users
-			DepartmentId: departmentId,
+	} else {
+		provider, ok := getSSOProvider(req.Provider)
+		if !ok || !provider.isOIDC() {
+			writeError(w, r, "Unsupported provider for ID token login", http.StatusBadRequest)
+			return
 		}
 
-		if err := h.DB.Create(&user).Error; err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		claims, err := provider.verifyIDToken(req.IDToken, req.Nonce)
+		if err != nil {
+			log.Printf("sso login (%s): %v", provider.Name, err)
+			recordLoginAttempt(h.DB, r, "", nil, false, loginReasonSSOFailed)
+			writeErrorCode(w, r, CodeInvalidToken, "Invalid token", http.StatusUnauthorized)
 			return
 		}
 
-		h.DB.Preload("Department").First(&user, "id = ?", user.Id)
-	} else if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	// Generate JWT token
-	token, err := h.generateToken(user.Id.String(), user.Email)
-	if err != nil {
-		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
-		return
+		identity = ssoIdentity{
+			Provider:      provider.Name,
+			Subject:       claims.Subject,
+			Email:         claims.Email,
+			EmailVerified: bool(claims.EmailVerified) || provider.TrustEmail,
+			Name:          claims.Name,
+		}
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(LoginResponse{
-		Token: token,
-		User:  user,
-	})
-}
-
-// generateToken creates a JWT token for the user
-func (h Auth) generateToken(userID, email string) (string, error) {
-	claims := Claims{
-		UserID: userID,
-		Email:  email,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-		},
+	if identity.Name == "" {
+		identity.Name = req.Name
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(getJWTSecret())
+	h.ssoSession(w, r, identity, req.DepartmentId)
 }
 
-// RegisterAuth registers authentication routes
-func RegisterAuth(router *mux.Router, h Auth, basePath string) {
-	router.HandleFunc(basePath+"/login", h.Login).Methods("POST")
-	router.HandleFunc(basePath+"/register", h.Register).Methods("POST")
-	router.HandleFunc(basePath+"/sso", h.SSOLogin).Methods("POST")
-	router.HandleFunc(basePath+"/github/callback", h.GitHubCallback).Methods("GET")
-}
-
-// GitHubCallback godoc
-// @Summary      GitHub OAuth callback
-// @Description  Handle GitHub OAuth callback and exchange code for token
+// Refresh godoc
+// @Summary      Refresh access token
+// @Description  Exchange a refresh token for a new access token and a rotated refresh token. Presenting an already used refresh token revokes every token from the same login.
 // @Tags         auth
+// @Accept       json
 // @Produce      json
-// @Param        code   query     string  true  "Authorization code"
+// @Param        body  body      RefreshRequest  true  "Refresh token"
 // @Success      200  {object}  LoginResponse
-// @Failure      400  {string}  string  "Invalid request"
-// @Router       /auth/github/callback [get]
-func (h Auth) GitHubCallback(w http.ResponseWriter, r *http.Request) {
-	code := r.URL.Query().Get("code")
-	if code == "" {
-		http.Error(w, "No authorization code provided", http.StatusBadRequest)
+// @Failure      400  {object}  Problem  "Invalid request"
+// @Failure      401  {object}  Problem  "Invalid refresh token"
+// @Router       /auth/refresh [post]
+func (h Auth) Refresh(w http.ResponseWriter, r *http.Request) {
+	var req RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		writeErrorCode(w, r, CodeInvalidBody, "Invalid request", http.StatusBadRequest)
 		return
 	}
 
-	// Exchange code for access token
-	clientID := os.Getenv("GITHUB_CLIENT_ID")
-	clientSecret := os.Getenv("GITHUB_CLIENT_SECRET")
-
-	if clientID == "" || clientSecret == "" {
-		http.Error(w, "GitHub OAuth not configured", http.StatusInternalServerError)
+	var current models.RefreshToken
+	if err := h.DB.First(&current, "token_hash = ?", hashToken(req.RefreshToken)).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			writeErrorCode(w, r, CodeInvalidToken, "Invalid refresh token", http.StatusUnauthorized)
+			return
+		}
+		writeDBError(w, r, err)
 		return
 	}
 
-	// Create form data for token exchange
-	tokenURL := "https://github.com/login/oauth/access_token"
-	data := map[string]string{
-		"client_id":     clientID,
-		"client_secret": clientSecret,
-		"code":          code,
+	// A rotated or revoked token being presented again means it leaked: kill the whole family
+	if current.UsedAt != nil || current.RevokedAt != nil {
+		_ = revokeTokenFamily(h.DB, current.FamilyId)
+		writeErrorCode(w, r, CodeTokenRevoked, "Refresh token reuse detected", http.StatusUnauthorized)
+		return
 	}
 
-	jsonData, _ := json.Marshal(data)
-	req, err := http.NewRequest("POST", tokenURL, bytes.NewBuffer(jsonData))
-	if err != nil {
-		http.Error(w, "Failed to create request", http.StatusInternalServerError)
+	if time.Now().After(current.ExpiresAt) {
+		writeErrorCode(w, r, CodeTokenExpired, "Refresh token expired", http.StatusUnauthorized)
 		return
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Accept", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		http.Error(w, "Failed to exchange code", http.StatusInternalServerError)
+	var user models.User
+	if err := h.DB.Preload("Department").First(&user, "id = ?", current.UserId).Error; err != nil {
+		writeErrorCode(w, r, CodeInvalidToken, "Invalid refresh token", http.StatusUnauthorized)
 		return
 	}
-	defer resp.Body.Close()
 
-	var tokenResponse struct {
-		AccessToken string `json:"access_token"`
-		TokenType   string `json:"token_type"`
-		Scope       string `json:"scope"`
-	}
+	var resp LoginResponse
+	errReused := errors.New("refresh token reused")
 
-	if err := json.NewDecoder(resp.Body).Decode(&tokenResponse); err != nil {
-		http.Error(w, "Failed to parse token response", http.StatusInternalServerError)
-		return
-	}
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		// Claim the token atomically so two concurrent refreshes cannot both succeed
+		result := tx.Model(&models.RefreshToken{}).
+			Where("id = ? AND used_at IS NULL AND revoked_at IS NULL", current.Id).
+			Update("used_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errReused
+		}
 
-	// Get user info from GitHub
-	userReq, err := http.NewRequest("GET", "https://api.github.com/user", nil)
-	if err != nil {
-		http.Error(w, "Failed to create user request", http.StatusInternalServerError)
+		issued, next, err := issueTokens(tx, user, current.FamilyId)
+		if err != nil {
+			return err
+		}
+
+		resp = issued
+		return tx.Model(&models.RefreshToken{}).Where("id = ?", current.Id).Update("replaced_by_id", next.Id).Error
+	})
+
+	if err == errReused {
+		_ = revokeTokenFamily(h.DB, current.FamilyId)
+		writeErrorCode(w, r, CodeTokenRevoked, "Refresh token reuse detected", http.StatusUnauthorized)
 		return
 	}
 
-	userReq.Header.Set("Authorization", "Bearer "+tokenResponse.AccessToken)
-	userReq.Header.Set("Accept", "application/json")
-
-	userResp, err := client.Do(userReq)
 	if err != nil {
-		http.Error(w, "Failed to get user info", http.StatusInternalServerError)
+		writeError(w, r, "Failed to generate token", http.StatusInternalServerError)
 		return
 	}
-	defer userResp.Body.Close()
 
-	var githubUser struct {
-		Login string `json:"login"`
-		Name  string `json:"name"`
-		Email string `json:"email"`
-	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
 
-	if err := json.NewDecoder(userResp.Body).Decode(&githubUser); err != nil {
-		http.Error(w, "Failed to parse user info", http.StatusInternalServerError)
+// Logout godoc
+// @Summary      Logout
+// @Description  Revoke the presented access token and the refresh token family it belongs to, or every session of the user when all_sessions is set
+// @Tags         auth
+// @Accept       json
+// @Param        body  body      LogoutRequest  false  "Refresh token to revoke"
+// @Success      204  "No Content"
+// @Failure      401  {object}  Problem  "Unauthorized"
+// @Security     BearerAuth
+// @Router       /auth/logout [post]
+func (h Auth) Logout(w http.ResponseWriter, r *http.Request) {
+	claims, ok := GetClaimsFromContext(r.Context())
+	if !ok {
+		writeError(w, r, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	// If email is not public, fetch it separately
-	if githubUser.Email == "" {
-		emailReq, _ := http.NewRequest("GET", "https://api.github.com/user/emails", nil)
-		emailReq.Header.Set("Authorization", "Bearer "+tokenResponse.AccessToken)
-		emailReq.Header.Set("Accept", "application/json")
+	// Body is optional
+	var req LogoutRequest
+	_ = json.NewDecoder(r.Body).Decode(&req)
 
-		emailResp, err := client.Do(emailReq)
-		if err == nil {
-			defer emailResp.Body.Close()
-			var emails []struct {
-				Email   string `json:"email"`
-				Primary bool   `json:"primary"`
-			}
-			if err := json.NewDecoder(emailResp.Body).Decode(&emails); err == nil {
-				for _, e := range emails {
-					if e.Primary {
-						githubUser.Email = e.Email
-						break
-					}
-				}
-			}
-		}
+	if err := revokeAccessToken(h.DB, claims); err != nil {
+		writeError(w, r, "Failed to revoke token", http.StatusInternalServerError)
+		return
 	}
 
-	// Try to find or create user
-	var user models.User
-	err = h.DB.Preload("Department").First(&user, "email = ?", githubUser.Email).Error
-
-	if err == gorm.ErrRecordNotFound {
-		// Get first department as default
-		var dept models.Department
-		if err := h.DB.First(&dept).Error; err != nil {
-			http.Error(w, "No default department found", http.StatusInternalServerError)
+	if req.AllSessions {
+		if err := h.DB.Model(&models.RefreshToken{}).
+			Where("user_id = ? AND revoked_at IS NULL", claims.UserID).
+			Update("revoked_at", time.Now()).Error; err != nil {
+			writeError(w, r, "Failed to revoke sessions", http.StatusInternalServerError)
 			return
 		}
-
-		userName := githubUser.Name
-		if userName == "" {
-			userName = githubUser.Login
-		}
-
-		user = models.User{
-			Id:           uuid.New(),
-			Name:         userName,
-			Email:        githubUser.Email,
-			PasswordHash: "", // No password for SSO users
-			DepartmentId: dept.Id,
-		}
-
-		if err := h.DB.Create(&user).Error; err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+	} else if req.RefreshToken != "" {
+		var rt models.RefreshToken
+		if err := h.DB.First(&rt, "token_hash = ? AND user_id = ?", hashToken(req.RefreshToken), claims.UserID).Error; err == nil {
+			if err := revokeTokenFamily(h.DB, rt.FamilyId); err != nil {
+				writeError(w, r, "Failed to revoke session", http.StatusInternalServerError)
+				return
+			}
 		}
-
-		h.DB.Preload("Department").First(&user, "id = ?", user.Id)
-	} else if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	// Generate JWT token
-	token, err := h.generateToken(user.Id.String(), user.Email)
-	if err != nil {
-		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
-		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(LoginResponse{
-		Token: token,
-		User:  user,
-	})
+	w.WriteHeader(http.StatusNoContent)
 }
 
+// RegisterAuth registers authentication routes
+func RegisterAuth(router *mux.Router, h Auth, basePath string) {
+	router.HandleFunc(basePath+"/login", h.Login).Methods("POST")
+	router.HandleFunc(basePath+"/register", h.Register).Methods("POST")
+	router.HandleFunc(basePath+"/sso", h.SSOLogin).Methods("POST")
+	router.HandleFunc(basePath+"/sso/providers", h.ListSSOProviders).Methods("GET")
+	router.HandleFunc(basePath+"/sso/nonce", h.SSONonce).Methods("POST")
+	router.HandleFunc(basePath+"/sso/{provider}/authorize", h.SSOAuthorize).Methods("GET")
+	router.HandleFunc(basePath+"/sso/{provider}/callback", h.SSOCallback).Methods("GET")
+	router.Handle(basePath+"/identities", SessionAuthMiddleware(h.DB)(http.HandlerFunc(h.ListIdentities))).Methods("GET")
+	router.Handle(basePath+"/identities/{provider}", SessionAuthMiddleware(h.DB)(http.HandlerFunc(h.LinkIdentity))).Methods("POST")
+	router.Handle(basePath+"/identities/{provider}/callback", SessionAuthMiddleware(h.DB)(http.HandlerFunc(h.LinkIdentityCallback))).Methods("POST")
+	router.Handle(basePath+"/identities/{id}", SessionAuthMiddleware(h.DB)(http.HandlerFunc(h.UnlinkIdentity))).Methods("DELETE")
+	router.HandleFunc(basePath+"/refresh", h.Refresh).Methods("POST")
+	router.Handle(basePath+"/logout", SessionAuthMiddleware(h.DB)(http.HandlerFunc(h.Logout))).Methods("POST")
+	router.HandleFunc(basePath+"/password/forgot", h.ForgotPassword).Methods("POST")
+	router.HandleFunc(basePath+"/password/reset", h.ResetPassword).Methods("POST")
+	router.Handle(basePath+"/password/change", SessionAuthMiddleware(h.DB)(http.HandlerFunc(h.ChangePassword))).Methods("POST")
+	router.HandleFunc(basePath+"/login/mfa", h.LoginMFA).Methods("POST")
+	router.HandleFunc(basePath+"/login/mfa/setup", h.LoginMFASetup).Methods("POST")
+	router.Handle(basePath+"/mfa/setup", SessionAuthMiddleware(h.DB)(http.HandlerFunc(h.SetupMFA))).Methods("POST")
+	router.Handle(basePath+"/mfa/confirm", SessionAuthMiddleware(h.DB)(http.HandlerFunc(h.ConfirmMFA))).Methods("POST")
+	router.Handle(basePath+"/mfa/disable", SessionAuthMiddleware(h.DB)(http.HandlerFunc(h.DisableMFA))).Methods("POST")
+	router.Handle(basePath+"/mfa/recovery-codes", SessionAuthMiddleware(h.DB)(http.HandlerFunc(h.RegenerateRecoveryCodes))).Methods("POST")
+}
@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"net/http"
+
+	"stuff/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Role sets used when registering routes
+var (
+	// AnyRole allows every authenticated user
+	AnyRole = []models.Role{models.RoleEmployee, models.RoleManager, models.RoleHR, models.RoleAdmin}
+	// StaffRoles allows users who manage other people
+	StaffRoles = []models.Role{models.RoleManager, models.RoleHR, models.RoleAdmin}
+	// PeopleRoles allows users who administer people across departments
+	PeopleRoles = []models.Role{models.RoleHR, models.RoleAdmin}
+	// AdminRoles allows administrators only
+	AdminRoles = []models.Role{models.RoleAdmin}
+)
+
+// Authorize wraps a handler so only callers with one of the given roles may invoke it.
+// API tokens are refused; routes open to them use AuthorizeScoped.
+func Authorize(next http.HandlerFunc, roles []models.Role) http.HandlerFunc {
+	return AuthorizeScoped(next, roles, "")
+}
+
+// AuthorizeScoped is Authorize for routes that API tokens may call when they carry the scope
+func AuthorizeScoped(next http.HandlerFunc, roles []models.Role, scope string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := currentUserID(r); !ok {
+			writeError(w, r, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		if !hasRole(r, roles...) {
+			writeError(w, r, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		if token, ok := GetAPITokenFromContext(r.Context()); ok {
+			if scope == "" {
+				writeError(w, r, "API tokens cannot be used for this endpoint", http.StatusForbidden)
+				return
+			}
+			if !hasScope(token, scope) {
+				writeErrorCode(w, r, CodeMissingScope, "token is missing scope "+scope, http.StatusForbidden)
+				return
+			}
+		}
+
+		next(w, r)
+	}
+}
+
+// hasRole reports whether the caller has one of the given roles
+func hasRole(r *http.Request, roles ...models.Role) bool {
+	role, ok := GetRoleFromContext(r.Context())
+	if !ok {
+		return false
+	}
+
+	for _, allowed := range roles {
+		if role == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// currentUserID returns the caller's user ID parsed from the context
+func currentUserID(r *http.Request) (uuid.UUID, bool) {
+	s, ok := GetUserIDFromContext(r.Context())
+	if !ok {
+		return uuid.Nil, false
+	}
+
+	id, err := uuid.Parse(s)
+	if err != nil {
+		return uuid.Nil, false
+	}
+
+	return id, true
+}
+
+// currentDepartmentID returns the caller's department ID parsed from the context
+func currentDepartmentID(r *http.Request) (uuid.UUID, bool) {
+	s, ok := GetDepartmentIDFromContext(r.Context())
+	if !ok {
+		return uuid.Nil, false
+	}
+
+	id, err := uuid.Parse(s)
+	if err != nil {
+		return uuid.Nil, false
+	}
+
+	return id, true
+}
+
+// canManageUser reports whether the caller may act on behalf of the given user.
+// HR and admins may manage anyone, managers only users in their own department,
+// and everyone else only themselves.
+func canManageUser(db *gorm.DB, r *http.Request, userID uuid.UUID) (bool, error) {
+	callerID, ok := currentUserID(r)
+	if !ok {
+		return false, nil
+	}
+
+	if callerID == userID || hasRole(r, PeopleRoles...) {
+		return true, nil
+	}
+
+	if !hasRole(r, models.RoleManager) {
+		return false, nil
+	}
+
+	return inCallerDepartment(db, r, userID)
+}
+
+// canReviewUser reports whether the caller may review (approve, reject, schedule) the given user.
+// Unlike canManageUser nobody may review themselves.
+func canReviewUser(db *gorm.DB, r *http.Request, userID uuid.UUID) (bool, error) {
+	callerID, ok := currentUserID(r)
+	if !ok || callerID == userID {
+		return false, nil
+	}
+
+	if hasRole(r, PeopleRoles...) {
+		return true, nil
+	}
+
+	if !hasRole(r, models.RoleManager) {
+		return false, nil
+	}
+
+	return inCallerDepartment(db, r, userID)
+}
+
+// inCallerDepartment reports whether the given user belongs to the caller's department
+func inCallerDepartment(db *gorm.DB, r *http.Request, userID uuid.UUID) (bool, error) {
+	departmentID, ok := currentDepartmentID(r)
+	if !ok {
+		return false, nil
+	}
+
+	var count int64
+	err := db.Model(&models.User{}).Where("id = ? AND department_id = ?", userID, departmentID).Count(&count).Error
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// departmentUserIDs returns a subquery selecting the IDs of users in the given department
+func departmentUserIDs(db *gorm.DB, departmentID uuid.UUID) *gorm.DB {
+	return db.Model(&models.User{}).Select("id").Where("department_id = ?", departmentID)
+}
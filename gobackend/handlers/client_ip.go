@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	trustedProxiesOnce sync.Once
+	trustedProxies     []*net.IPNet
+)
+
+// getTrustedProxies parses TRUSTED_PROXIES (comma-separated IPs or CIDRs) once.
+// Loopback is always trusted so a local reverse proxy works out of the box.
+func getTrustedProxies() []*net.IPNet {
+	trustedProxiesOnce.Do(func() {
+		entries := []string{"127.0.0.0/8", "::1/128"}
+		entries = append(entries, strings.Split(os.Getenv("TRUSTED_PROXIES"), ",")...)
+
+		for _, entry := range entries {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+
+			if !strings.Contains(entry, "/") {
+				if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+					entry += "/32"
+				} else {
+					entry += "/128"
+				}
+			}
+
+			_, network, err := net.ParseCIDR(entry)
+			if err != nil {
+				log.Printf("ignoring invalid TRUSTED_PROXIES entry %q: %v", entry, err)
+				continue
+			}
+			trustedProxies = append(trustedProxies, network)
+		}
+	})
+
+	return trustedProxies
+}
+
+// isTrustedProxy reports whether ip belongs to a configured proxy
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range getTrustedProxies() {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// getClientIP extracts the client IP from the request.
+// Forwarding headers are only honoured when the direct peer is a trusted proxy,
+// and X-Forwarded-For is walked right to left so clients cannot inject addresses.
+func getClientIP(r *http.Request) string {
+	remote := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+
+	remoteIP := net.ParseIP(remote)
+	if remoteIP == nil || !isTrustedProxy(remoteIP) {
+		return remote
+	}
+
+	// Check X-Forwarded-For header first (for proxied requests)
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := net.ParseIP(strings.TrimSpace(hops[i]))
+			if hop == nil {
+				break
+			}
+			if !isTrustedProxy(hop) || i == 0 {
+				return hop.String()
+			}
+		}
+	}
+
+	// Check X-Real-IP header
+	if realIP := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); realIP != nil {
+		return realIP.String()
+	}
+
+	return remote
+}
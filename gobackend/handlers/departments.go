@@ -9,6 +9,7 @@ import (
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // Departments holds DB for department handlers
@@ -16,23 +17,37 @@ type Departments struct {
 	DB *gorm.DB
 }
 
+// departmentListSpec controls filtering and sorting for GET /departments
+var departmentListSpec = listSpec{
+	filters: map[string]filterFunc{
+		"q":           searchFilter("name"),
+		"require_mfa": boolFilter("require_mfa"),
+	},
+	sorts: map[string]string{
+		"name":       "name",
+		"created_at": "created_at",
+	},
+	defaultSort: "name",
+}
+
 // List godoc
 // @Summary      Get all departments
+// @Description  Paged with limit/offset or cursor. See X-Total-Count, X-Next-Cursor and Link.
 // @Tags         departments
 // @Produce      json
+// @Param        q            query     string  false  "Search in name"
+// @Param        require_mfa  query     bool    false  "Only departments that do or do not require MFA"
+// @Param        sort         query     string  false  "name or created_at; prefix - for descending (default name)"
+// @Param        fields       query     string  false  "Fields to return, e.g. id,name"
+// @Param        limit        query     int     false  "Page size (default 50, max 200)"
+// @Param        offset       query     int     false  "Rows to skip"
+// @Param        cursor       query     string  false  "X-Next-Cursor of the previous page"
 // @Success      200  {array}   models.Department
+// @Failure      400  {object}  Problem  "invalid filter, sort or cursor"
 // @Security     BearerAuth
 // @Router       /departments [get]
 func (h Departments) List(w http.ResponseWriter, r *http.Request) {
-	var list []models.Department
-
-	if err := h.DB.Find(&list).Error; err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(list)
+	serveList[models.Department](w, r, h.DB, departmentListSpec)
 }
 
 // Create godoc
@@ -42,20 +57,23 @@ func (h Departments) List(w http.ResponseWriter, r *http.Request) {
 // @Produce      json
 // @Param        department  body      models.Department  true  "Department"
 // @Success      201  {object}  models.Department
+// @Failure      403  {object}  Problem  "forbidden"
 // @Security     BearerAuth
 // @Router       /departments [post]
 func (h Departments) Create(w http.ResponseWriter, r *http.Request) {
 	var d models.Department
 	
 	if err := json.NewDecoder(r.Body).Decode(&d); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeBodyError(w, r, err)
 		return
 	}
 	
 	d.Id = uuid.New()
+	d.Users = nil
+	d.Feedbacks = nil
 	
-	if err := h.DB.Create(&d).Error; err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err := h.DB.Omit(clause.Associations).Create(&d).Error; err != nil {
+		writeDBError(w, r, err)
 		return
 	}
 	
@@ -64,8 +82,56 @@ func (h Departments) Create(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(d)
 }
 
-// RegisterDepartments adds department routes to router (no :id routes)
+// SetMfaRequirement godoc
+// @Summary      Require MFA for a department
+// @Description  When enabled, password logins for users in the department must complete TOTP MFA, enrolling first if needed
+// @Tags         departments
+// @Accept       json
+// @Produce      json
+// @Param        id    path      string  true  "Department ID"
+// @Param        body  body      object  true  "Requirement"  SchemaExample({"require_mfa": true})
+// @Success      200  {object}  models.Department
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      404  {object}  Problem  "department not found"
+// @Security     BearerAuth
+// @Router       /departments/{id}/mfa [put]
+func (h Departments) SetMfaRequirement(w http.ResponseWriter, r *http.Request) {
+	id, ok := uuidParam(w, r, "id")
+	
+	if !ok {
+		return
+	}
+	
+	var body struct {
+		RequireMfa bool `json:"require_mfa"`
+	}
+	
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+	
+	result := h.DB.Model(&models.Department{}).Where("id = ?", id).Update("require_mfa", body.RequireMfa)
+	
+	if result.Error != nil {
+		writeDBError(w, r, result.Error)
+		return
+	}
+	
+	if result.RowsAffected == 0 {
+		writeError(w, r, "department not found", http.StatusNotFound)
+		return
+	}
+	
+	var d models.Department
+	h.DB.First(&d, "id = ?", id)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d)
+}
+
+// RegisterDepartments adds department routes to router
 func RegisterDepartments(router *mux.Router, h Departments, prefix string) {
-	router.HandleFunc(prefix, h.List).Methods("GET")
-	router.HandleFunc(prefix, h.Create).Methods("POST")
+	router.HandleFunc(prefix, AuthorizeScoped(h.List, AnyRole, ScopeDepartmentsRead)).Methods("GET")
+	router.HandleFunc(prefix, AuthorizeScoped(h.Create, AdminRoles, ScopeDepartmentsWrite)).Methods("POST")
+	router.HandleFunc(prefix+"/{id}/mfa", Authorize(h.SetMfaRequirement, AdminRoles)).Methods("PUT")
 }
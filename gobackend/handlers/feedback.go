@@ -2,36 +2,84 @@ package handlers
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 
+	"stuff/events"
 	"stuff/models"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // Feedback holds DB for feedback handlers
 type Feedback struct {
-	DB *gorm.DB
+	DB     *gorm.DB
+	Events *events.Bus
+}
+
+// FeedbackRequest is the body of POST /feedback and PUT /feedback/{id}
+type FeedbackRequest struct {
+	DepartmentId uuid.UUID `json:"department_id"`
+	Rating       int       `json:"rating"`
+}
+
+// Ratings run from minRating to maxRating
+const (
+	minRating = 1
+	maxRating = 5
+)
+
+// feedbackListSpec controls filtering, sorting and includes for GET /feedback
+var feedbackListSpec = listSpec{
+	filters: map[string]filterFunc{
+		"department_id": uuidFilter("department_id"),
+		"rating":        eqFilter("rating"),
+		"from":          fromFilter("created_at"),
+		"to":            toFilter("created_at"),
+	},
+	sorts: map[string]string{
+		"created_at": "created_at",
+		"rating":     "rating",
+	},
+	defaultSort: "-created_at",
+	includes: map[string]listInclude{
+		"department": {preload: "Department", columns: []string{"department_id"}},
+	},
 }
 
 // List godoc
 // @Summary      Get all feedback
+// @Description  Managers see their own department's feedback only.
+// @Description  Paged with limit/offset or cursor. See X-Total-Count, X-Next-Cursor and Link.
 // @Tags         feedback
 // @Produce      json
+// @Param        department_id  query     string  false  "Department ID"
+// @Param        rating         query     string  false  "Rating; comma-separated for several"
+// @Param        from           query     string  false  "Given at or after (date or RFC 3339)"
+// @Param        to             query     string  false  "Given at or before (date or RFC 3339)"
+// @Param        sort           query     string  false  "created_at or rating; prefix - for descending (default -created_at)"
+// @Param        include        query     string  false  "department"
+// @Param        fields         query     string  false  "Fields to return, e.g. id,rating"
+// @Param        limit          query     int     false  "Page size (default 50, max 200)"
+// @Param        offset         query     int     false  "Rows to skip"
+// @Param        cursor         query     string  false  "X-Next-Cursor of the previous page"
 // @Success      200  {array}   models.Feedback
+// @Failure      400  {object}  Problem  "invalid filter, sort, include or cursor"
+// @Failure      403  {object}  Problem  "forbidden"
+// @Security     BearerAuth
 // @Router       /feedback [get]
 func (h Feedback) List(w http.ResponseWriter, r *http.Request) {
-	var list []models.Feedback
+	query := h.DB
 
-	if err := h.DB.Find(&list).Error; err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	if !hasRole(r, PeopleRoles...) {
+		departmentID, _ := currentDepartmentID(r)
+		query = query.Where("department_id = ?", departmentID)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(list)
+	serveList[models.Feedback](w, r, query, feedbackListSpec)
 }
 
 // GetByID godoc
@@ -40,14 +88,22 @@ func (h Feedback) List(w http.ResponseWriter, r *http.Request) {
 // @Produce      json
 // @Param        id   path      string  true  "Feedback ID"
 // @Success      200  {object}  models.Feedback
-// @Failure      404  {string}  string  "Feedback not found"
+// @Failure      404  {object}  Problem  "Feedback not found"
+// @Failure      403  {object}  Problem  "forbidden"
+// @Security     BearerAuth
 // @Router       /feedback/{id} [get]
 func (h Feedback) GetByID(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 	var feedback models.Feedback
 
 	if err := h.DB.First(&feedback, "id = ?", id).Error; err != nil {
-		http.Error(w, "Feedback not found", http.StatusNotFound)
+		writeError(w, r, "Feedback not found", http.StatusNotFound)
+		return
+	}
+
+	// Managers only read their own department's feedback
+	if departmentID, _ := currentDepartmentID(r); !hasRole(r, PeopleRoles...) && feedback.DepartmentId != departmentID {
+		writeError(w, r, "Feedback not found", http.StatusNotFound)
 		return
 	}
 
@@ -60,22 +116,39 @@ func (h Feedback) GetByID(w http.ResponseWriter, r *http.Request) {
 // @Tags         feedback
 // @Accept       json
 // @Produce      json
-// @Param        feedback  body      models.Feedback  true  "Feedback"
+// @Param        feedback  body      FeedbackRequest  true  "Feedback"
 // @Success      201  {object}  models.Feedback
-// @Failure      400  {string}  string  "Bad request"
+// @Failure      400  {object}  Problem  "Bad request"
+// @Failure      422  {object}  Problem  "unknown department or rating out of range"
 // @Router       /feedback [post]
 func (h Feedback) Create(w http.ResponseWriter, r *http.Request) {
-	var f models.Feedback
+	var req FeedbackRequest
 
-	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, r, err)
 		return
 	}
 
-	f.Id = uuid.New()
+	if !h.validate(w, r, req) {
+		return
+	}
+
+	f := models.Feedback{
+		Id:           uuid.New(),
+		DepartmentId: req.DepartmentId,
+		Rating:       req.Rating,
+	}
+
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit(clause.Associations).Create(&f).Error; err != nil {
+			return err
+		}
+
+		return h.Events.Publish(tx, events.FeedbackReceivedEvent{Feedback: f})
+	})
 
-	if err := h.DB.Create(&f).Error; err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err != nil {
+		writeDBError(w, r, err)
 		return
 	}
 
@@ -90,27 +163,40 @@ func (h Feedback) Create(w http.ResponseWriter, r *http.Request) {
 // @Accept       json
 // @Produce      json
 // @Param        id        path      string  true  "Feedback ID"
-// @Param        feedback  body      models.Feedback  true  "Feedback"
+// @Param        feedback  body      FeedbackRequest  true  "Feedback"
 // @Success      200  {object}  models.Feedback
-// @Failure      404  {string}  string  "Feedback not found"
+// @Failure      404  {object}  Problem  "Feedback not found"
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      422  {object}  Problem  "unknown department or rating out of range"
+// @Security     BearerAuth
 // @Router       /feedback/{id} [put]
 func (h Feedback) Update(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 	var feedback models.Feedback
 
 	if err := h.DB.First(&feedback, "id = ?", id).Error; err != nil {
-		http.Error(w, "Feedback not found", http.StatusNotFound)
+		writeError(w, r, "Feedback not found", http.StatusNotFound)
+		return
+	}
+
+	req := FeedbackRequest{DepartmentId: feedback.DepartmentId, Rating: feedback.Rating}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, r, err)
 		return
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&feedback); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if !h.validate(w, r, req) {
 		return
 	}
 
-	feedback.Id, _ = uuid.Parse(id)
+	feedback.DepartmentId = req.DepartmentId
+	feedback.Rating = req.Rating
 
-	h.DB.Save(&feedback)
+	if err := h.DB.Model(&feedback).Updates(map[string]interface{}{"department_id": req.DepartmentId, "rating": req.Rating}).Error; err != nil {
+		writeDBError(w, r, err)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(feedback)
@@ -121,25 +207,48 @@ func (h Feedback) Update(w http.ResponseWriter, r *http.Request) {
 // @Tags         feedback
 // @Param        id   path      string  true  "Feedback ID"
 // @Success      204  "No Content"
-// @Failure      404  {string}  string  "Feedback not found"
+// @Failure      404  {object}  Problem  "Feedback not found"
+// @Failure      403  {object}  Problem  "forbidden"
+// @Security     BearerAuth
 // @Router       /feedback/{id} [delete]
 func (h Feedback) Delete(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 
 	result := h.DB.Delete(&models.Feedback{}, "id = ?", id)
 	if result.RowsAffected == 0 {
-		http.Error(w, "Feedback not found", http.StatusNotFound)
+		writeError(w, r, "Feedback not found", http.StatusNotFound)
 		return
 	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
-// RegisterFeedback adds feedback routes
-func RegisterFeedback(router *mux.Router, h Feedback, prefix string) {
-	router.HandleFunc(prefix, h.List).Methods("GET")
-	router.HandleFunc(prefix, h.Create).Methods("POST")
-	router.HandleFunc(prefix+"/{id}", h.GetByID).Methods("GET")
-	router.HandleFunc(prefix+"/{id}", h.Update).Methods("PUT")
-	router.HandleFunc(prefix+"/{id}", h.Delete).Methods("DELETE")
+// validate writes 422 unless the request names an existing department and a rating in range
+func (h Feedback) validate(w http.ResponseWriter, r *http.Request, req FeedbackRequest) bool {
+	var errs []FieldError
+
+	if req.DepartmentId == uuid.Nil {
+		errs = append(errs, FieldError{Field: "department_id", Code: FieldRequired, Message: "is required"})
+	} else if !departmentExists(h.DB, req.DepartmentId) {
+		errs = append(errs, FieldError{Field: "department_id", Code: FieldUnknown, Message: "unknown department"})
+	}
+	if req.Rating < minRating || req.Rating > maxRating {
+		errs = append(errs, FieldError{Field: "rating", Code: FieldInvalid, Message: fmt.Sprintf("must be between %d and %d", minRating, maxRating)})
+	}
+
+	if len(errs) > 0 {
+		writeValidation(w, r, errs...)
+		return false
+	}
+	return true
+}
+
+// RegisterFeedback adds feedback routes. Feedback is given anonymously, so only creating
+// it goes on the public router; reading it is for staff and changing it for admins.
+func RegisterFeedback(router, public *mux.Router, h Feedback, prefix string) {
+	public.HandleFunc(prefix, h.Create).Methods("POST")
+	router.HandleFunc(prefix, Authorize(h.List, StaffRoles)).Methods("GET")
+	router.HandleFunc(prefix+"/{id}", Authorize(h.GetByID, StaffRoles)).Methods("GET")
+	router.HandleFunc(prefix+"/{id}", Authorize(h.Update, AdminRoles)).Methods("PUT")
+	router.HandleFunc(prefix+"/{id}", Authorize(h.Delete, AdminRoles)).Methods("DELETE")
 }
@@ -1,51 +1,132 @@
 package handlers
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/golang-jwt/jwt/v5"
 )
 
-// GoogleTokenInfo represents the response from Google token verification
+// googleJWKSURL is where Google publishes the keys that sign its ID tokens
+const googleJWKSURL = "https://www.googleapis.com/oauth2/v3/certs"
+
+// googleIssuers are the iss values Google uses in ID tokens
+var googleIssuers = []string{"https://accounts.google.com", "accounts.google.com"}
+
+// GoogleTokenInfo holds the claims of a verified Google ID token
 type GoogleTokenInfo struct {
-	Email         string `json:"email"`
-	EmailVerified string `json:"email_verified"`
-	Name          string `json:"name"`
-	Picture       string `json:"picture"`
-	GivenName     string `json:"given_name"`
-	FamilyName    string `json:"family_name"`
-	Locale        string `json:"locale"`
+	Email         string       `json:"email"`
+	EmailVerified flexibleBool `json:"email_verified"`
+	Name          string       `json:"name"`
+	Picture       string       `json:"picture"`
+	GivenName     string       `json:"given_name"`
+	FamilyName    string       `json:"family_name"`
+	Locale        string       `json:"locale"`
+	Nonce         string       `json:"nonce"`
+	jwt.RegisteredClaims
+}
+
+// flexibleBool accepts both true and "true", as Google has sent both
+type flexibleBool bool
+
+func (b *flexibleBool) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	switch v := value.(type) {
+	case bool:
+		*b = flexibleBool(v)
+	case string:
+		*b = flexibleBool(v == "true")
+	default:
+		*b = false
+	}
+	return nil
+}
+
+var (
+	googleKeysOnce sync.Once
+	googleKeys     *remoteKeySet
+)
+
+// getGoogleKeys returns the shared cache of Google signing keys.
+// GOOGLE_JWKS_URL overrides the key location, e.g. to test against a local key set.
+func getGoogleKeys() *remoteKeySet {
+	googleKeysOnce.Do(func() {
+		url := os.Getenv("GOOGLE_JWKS_URL")
+		if url == "" {
+			url = googleJWKSURL
+		}
+		googleKeys = newRemoteKeySet(url)
+	})
+	return googleKeys
 }
 
-// VerifyGoogleToken verifies a Google ID token
-func VerifyGoogleToken(idToken string) (*GoogleTokenInfo, error) {
-	// Google's token verification endpoint
-	url := fmt.Sprintf("https://oauth2.googleapis.com/tokeninfo?id_token=%s", idToken)
+// getGoogleClientIDs returns the accepted audiences from GOOGLE_CLIENT_ID (comma separated, e.g. web and mobile clients)
+func getGoogleClientIDs() []string {
+	var ids []string
+	for _, id := range strings.Split(os.Getenv("GOOGLE_CLIENT_ID"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
 
-	client := &http.Client{
-		Timeout: 10 * time.Second,
+// VerifyGoogleToken verifies a Google ID token locally against Google's published keys.
+// The signature, issuer, audience, expiry and nonce are checked.
+func VerifyGoogleToken(idToken, expectedNonce string) (*GoogleTokenInfo, error) {
+	clientIDs := getGoogleClientIDs()
+	if len(clientIDs) == 0 {
+		return nil, errors.New("Google sign-in is not configured")
 	}
 
-	resp, err := client.Get(url)
+	var tokenInfo GoogleTokenInfo
+	_, err := jwt.ParseWithClaims(idToken, &tokenInfo, getGoogleKeys().keyFunc,
+		jwt.WithValidMethods([]string{"RS256"}),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(1*time.Minute),
+	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to verify token: %v", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("invalid token: status code %d", resp.StatusCode)
+	if !slices.Contains(googleIssuers, tokenInfo.Issuer) {
+		return nil, errors.New("invalid token issuer")
 	}
 
-	var tokenInfo GoogleTokenInfo
-	if err := json.NewDecoder(resp.Body).Decode(&tokenInfo); err != nil {
-		return nil, fmt.Errorf("failed to decode token info: %v", err)
+	if !audienceMatches(tokenInfo.Audience, clientIDs) {
+		return nil, errors.New("token was not issued for this application")
+	}
+
+	if expectedNonce == "" || subtle.ConstantTimeCompare([]byte(tokenInfo.Nonce), []byte(expectedNonce)) != 1 {
+		return nil, errors.New("invalid token nonce")
 	}
 
 	// Verify email is verified
-	if tokenInfo.EmailVerified != "true" {
-		return nil, fmt.Errorf("email not verified")
+	if !tokenInfo.EmailVerified {
+		return nil, errors.New("email not verified")
 	}
 
 	return &tokenInfo, nil
 }
+
+// audienceMatches reports whether any token audience is one of the accepted client IDs
+func audienceMatches(audience jwt.ClaimStrings, clientIDs []string) bool {
+	for _, aud := range audience {
+		if slices.Contains(clientIDs, aud) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// useGoogleKeys points VerifyGoogleToken at a local key set for the test
+func useGoogleKeys(t *testing.T, j *testJWKS) {
+	t.Helper()
+	getGoogleKeys()
+	saved := googleKeys
+	googleKeys = newRemoteKeySet(j.srv.URL)
+	t.Cleanup(func() { googleKeys = saved })
+}
+
+func googleClaims() jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":            "https://accounts.google.com",
+		"aud":            "web-client",
+		"sub":            "110169484474386276334",
+		"email":          "ada@example.com",
+		"email_verified": true,
+		"name":           "Ada Lovelace",
+		"nonce":          "n-0S6_WzA2Mj",
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Hour).Unix(),
+	}
+}
+
+func TestVerifyGoogleToken(t *testing.T) {
+	t.Setenv("GOOGLE_CLIENT_ID", "web-client, mobile-client")
+	j := newTestJWKS(t)
+	j.addKey(t, "g1")
+	useGoogleKeys(t, j)
+
+	tests := []struct {
+		name    string
+		edit    func(jwt.MapClaims)
+		nonce   string
+		wantErr string
+	}{
+		{name: "valid", edit: func(jwt.MapClaims) {}},
+		{name: "second client ID", edit: func(c jwt.MapClaims) { c["aud"] = "mobile-client" }},
+		{name: "issuer without scheme", edit: func(c jwt.MapClaims) { c["iss"] = "accounts.google.com" }},
+		{name: "email_verified as string", edit: func(c jwt.MapClaims) { c["email_verified"] = "true" }},
+		{name: "wrong audience", edit: func(c jwt.MapClaims) { c["aud"] = "someone-else" }, wantErr: "not issued for this application"},
+		{name: "wrong issuer", edit: func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" }, wantErr: "invalid token issuer"},
+		{name: "expired", edit: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() }, wantErr: "expired"},
+		{name: "no expiry", edit: func(c jwt.MapClaims) { delete(c, "exp") }, wantErr: "exp"},
+		{name: "wrong nonce", edit: func(jwt.MapClaims) {}, nonce: "replayed", wantErr: "invalid token nonce"},
+		{name: "token without nonce", edit: func(c jwt.MapClaims) { delete(c, "nonce") }, wantErr: "invalid token nonce"},
+		{name: "email not verified", edit: func(c jwt.MapClaims) { c["email_verified"] = false }, wantErr: "email not verified"},
+		{name: "email_verified as false string", edit: func(c jwt.MapClaims) { c["email_verified"] = "false" }, wantErr: "email not verified"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := googleClaims()
+			tt.edit(claims)
+			nonce := tt.nonce
+			if nonce == "" {
+				nonce = "n-0S6_WzA2Mj"
+			}
+
+			info, err := VerifyGoogleToken(j.sign(t, "g1", claims), nonce)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err = %v", err)
+			}
+			if info.Email != "ada@example.com" || info.Subject != "110169484474386276334" || !bool(info.EmailVerified) {
+				t.Errorf("claims = %+v", info)
+			}
+		})
+	}
+}
+
+func TestVerifyGoogleTokenRequiresNonce(t *testing.T) {
+	t.Setenv("GOOGLE_CLIENT_ID", "web-client")
+	j := newTestJWKS(t)
+	j.addKey(t, "g1")
+	useGoogleKeys(t, j)
+
+	// A token without a nonce must not pass just because none was expected
+	claims := googleClaims()
+	delete(claims, "nonce")
+	if _, err := VerifyGoogleToken(j.sign(t, "g1", claims), ""); err == nil {
+		t.Error("token accepted without a nonce")
+	}
+	if _, err := VerifyGoogleToken(j.sign(t, "g1", googleClaims()), ""); err == nil {
+		t.Error("token accepted without an expected nonce")
+	}
+}
+
+func TestVerifyGoogleTokenSignature(t *testing.T) {
+	t.Setenv("GOOGLE_CLIENT_ID", "web-client")
+	j := newTestJWKS(t)
+	j.addKey(t, "g1")
+	useGoogleKeys(t, j)
+
+	// Signed by a key Google did not publish, under a published kid
+	forged := newTestJWKS(t)
+	forged.addKey(t, "g1")
+	if _, err := VerifyGoogleToken(forged.sign(t, "g1", googleClaims()), "n-0S6_WzA2Mj"); err == nil {
+		t.Error("forged token accepted")
+	}
+
+	// HS256 with the public key as secret is rejected
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, googleClaims())
+	token.Header["kid"] = "g1"
+	signed, err := token.SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyGoogleToken(signed, "n-0S6_WzA2Mj"); err == nil {
+		t.Error("HS256 token accepted")
+	}
+
+	// Tampering with the payload breaks the signature
+	parts := strings.Split(j.sign(t, "g1", googleClaims()), ".")
+	claims := googleClaims()
+	claims["email"] = "admin@example.com"
+	payload, _ := json.Marshal(claims)
+	parts[1] = base64.RawURLEncoding.EncodeToString(payload)
+	if _, err := VerifyGoogleToken(strings.Join(parts, "."), "n-0S6_WzA2Mj"); err == nil {
+		t.Error("tampered token accepted")
+	}
+}
+
+func TestVerifyGoogleTokenNotConfigured(t *testing.T) {
+	t.Setenv("GOOGLE_CLIENT_ID", " , ")
+	if _, err := VerifyGoogleToken("x.y.z", "nonce"); err == nil || !strings.Contains(err.Error(), "not configured") {
+		t.Errorf("err = %v, want not configured", err)
+	}
+}
@@ -13,14 +13,14 @@ func uuidParam(w http.ResponseWriter, r *http.Request, name string) (uuid.UUID,
 	s := vars[name]
 
 	if s == "" {
-		http.Error(w, "missing path parameter: "+name, http.StatusBadRequest)
+		writeError(w, r, "missing path parameter: "+name, http.StatusBadRequest)
 		return uuid.Nil, false
 	}
 	
 	id, err := uuid.Parse(s)
 	
 	if err != nil {
-		http.Error(w, "invalid UUID: "+name, http.StatusBadRequest)
+		writeError(w, r, "invalid UUID: "+name, http.StatusBadRequest)
 		return uuid.Nil, false
 	}
 	
@@ -0,0 +1,173 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"stuff/models"
+
+	"gorm.io/gorm"
+)
+
+// ListIdentities godoc
+// @Summary      List linked logins
+// @Description  SSO identities linked to the caller's account
+// @Tags         auth
+// @Produce      json
+// @Success      200  {array}   models.Identity
+// @Failure      401  {object}  Problem  "Unauthorized"
+// @Security     BearerAuth
+// @Router       /auth/identities [get]
+func (h Auth) ListIdentities(w http.ResponseWriter, r *http.Request) {
+	userID, ok := currentUserID(r)
+	if !ok {
+		writeError(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var identities []models.Identity
+	if err := h.DB.Where("user_id = ?", userID).Order("created_at").Find(&identities).Error; err != nil {
+		writeError(w, r, "Failed to load identities", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(identities)
+}
+
+// LinkIdentity godoc
+// @Summary      Start linking a provider
+// @Description  Like /auth/sso/{provider}/authorize, but the provider account is linked to the caller instead of signing in. Finish with /auth/identities/{provider}/callback.
+// @Tags         auth
+// @Produce      json
+// @Param        provider      path      string  true   "Provider name"
+// @Param        redirect_uri  query     string  false  "Where the provider sends the user back"
+// @Success      200  {object}  SSOAuthorizeResponse
+// @Failure      400  {object}  Problem  "Invalid redirect URI"
+// @Failure      404  {object}  Problem  "Unknown provider"
+// @Security     BearerAuth
+// @Router       /auth/identities/{provider} [post]
+func (h Auth) LinkIdentity(w http.ResponseWriter, r *http.Request) {
+	userID, ok := currentUserID(r)
+	if !ok {
+		writeError(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	h.startSSO(w, r, &userID)
+}
+
+// LinkIdentityCallback godoc
+// @Summary      Finish linking a provider
+// @Description  Exchange the authorization code and link the provider account to the caller
+// @Tags         auth
+// @Produce      json
+// @Param        provider  path      string  true  "Provider name"
+// @Param        code      query     string  true  "Authorization code"
+// @Param        state     query     string  true  "State from the link step"
+// @Success      201  {object}  models.Identity
+// @Failure      400  {object}  Problem  "Invalid or expired state"
+// @Failure      409  {object}  Problem  "Already linked to another account"
+// @Security     BearerAuth
+// @Router       /auth/identities/{provider}/callback [post]
+func (h Auth) LinkIdentityCallback(w http.ResponseWriter, r *http.Request) {
+	userID, ok := currentUserID(r)
+	if !ok {
+		writeError(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	identity, saved, ok := h.finishSSO(w, r)
+	if !ok {
+		return
+	}
+
+	// The state must have been created by the same user
+	if saved.LinkUserId == nil || *saved.LinkUserId != userID {
+		writeErrorCode(w, r, CodeInvalidToken, "Invalid or expired state", http.StatusBadRequest)
+		return
+	}
+
+	var existing models.Identity
+	err := h.DB.First(&existing, "provider = ? AND subject = ?", identity.Provider, identity.Subject).Error
+	if err == nil {
+		if existing.UserId != userID {
+			writeError(w, r, "This "+identity.Provider+" account is linked to another user", http.StatusConflict)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(existing)
+		return
+	}
+	if err != gorm.ErrRecordNotFound {
+		writeError(w, r, "Failed to link account", http.StatusInternalServerError)
+		return
+	}
+
+	identity.Email = SanitizeInput(identity.Email)
+	if err := linkIdentity(h.DB, userID, identity); err != nil {
+		writeError(w, r, "Failed to link account", http.StatusInternalServerError)
+		return
+	}
+
+	var linked models.Identity
+	h.DB.First(&linked, "provider = ? AND subject = ?", identity.Provider, identity.Subject)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(linked)
+}
+
+// UnlinkIdentity godoc
+// @Summary      Unlink a provider
+// @Description  Remove a linked login. The last sign-in method of an account without a password cannot be removed.
+// @Tags         auth
+// @Param        id   path      string  true  "Identity ID"
+// @Success      204  "No Content"
+// @Failure      404  {object}  Problem  "identity not found"
+// @Failure      409  {object}  Problem  "Last sign-in method"
+// @Security     BearerAuth
+// @Router       /auth/identities/{id} [delete]
+func (h Auth) UnlinkIdentity(w http.ResponseWriter, r *http.Request) {
+	userID, ok := currentUserID(r)
+	if !ok {
+		writeError(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, ok := uuidParam(w, r, "id")
+	if !ok {
+		return
+	}
+
+	var user models.User
+	if err := h.DB.First(&user, "id = ?", userID).Error; err != nil {
+		writeError(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var count int64
+	if err := h.DB.Model(&models.Identity{}).Where("user_id = ?", userID).Count(&count).Error; err != nil {
+		writeError(w, r, "Failed to unlink account", http.StatusInternalServerError)
+		return
+	}
+
+	if user.PasswordHash == "" && count <= 1 {
+		writeError(w, r, "Set a password before removing your last sign-in method", http.StatusConflict)
+		return
+	}
+
+	result := h.DB.Where("id = ? AND user_id = ?", id, userID).Delete(&models.Identity{})
+	if result.Error != nil {
+		writeError(w, r, "Failed to unlink account", http.StatusInternalServerError)
+		return
+	}
+
+	if result.RowsAffected == 0 {
+		writeError(w, r, "identity not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"stuff/events"
+	"stuff/inbound"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// InboundMail holds DB and the event bus for the inbound email gateway
+type InboundMail struct {
+	DB     *gorm.DB
+	Events *events.Bus
+	Secret string // bearer token for the webhook, from INBOUND_WEBHOOK_SECRET; the webhook is off without it
+
+	// AuthservID is the authserv-id of the relay's Authentication-Results header, from
+	// INBOUND_AUTHSERV_ID. When set, mail is only taken if the relay verified the sender.
+	AuthservID string
+}
+
+// InboundMailResponse tells the webhook caller what became of a message
+type InboundMailResponse struct {
+	TicketId  uuid.UUID  `json:"ticket_id"`
+	CommentId *uuid.UUID `json:"comment_id,omitempty"` // set when the message was a reply
+	Duplicate bool       `json:"duplicate"`            // the message was received before
+}
+
+// Receive godoc
+// @Summary      Receive an inbound email
+// @Description  Takes a raw RFC 5322 message, e.g. from a mail provider's inbound webhook. Mail from a known user opens a ticket,
+// @Description  or is added as a comment when the subject contains [#<ticket ID>] or the message replies to one received earlier.
+// @Description  Replies are only taken from the ticket's creator, assignee, watchers and staff, and not for closed tickets.
+// @Description  Quoted text and signatures are stripped. Authenticate with the INBOUND_WEBHOOK_SECRET as bearer token.
+// @Tags         inbound
+// @Accept       plain
+// @Produce      json
+// @Param        message  body      string  true  "Raw message (message/rfc822)"
+// @Success      200  {object}  InboundMailResponse  "received before; nothing changed"
+// @Success      201  {object}  InboundMailResponse
+// @Failure      400  {object}  Problem  "malformed message"
+// @Failure      401  {object}  Problem  "invalid secret"
+// @Failure      403  {object}  Problem  "the sender may not comment on the ticket"
+// @Failure      404  {object}  Problem  "the webhook is not enabled"
+// @Failure      409  {object}  Problem  "the ticket is closed"
+// @Failure      413  {object}  Problem  "message too large"
+// @Failure      422  {object}  Problem  "unknown or unverified sender, or no text"
+// @Router       /inbound/email [post]
+func (h InboundMail) Receive(w http.ResponseWriter, r *http.Request) {
+	if h.Secret == "" {
+		writeError(w, r, "not found", http.StatusNotFound)
+		return
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(h.Secret)) != 1 {
+		writeErrorCode(w, r, CodeInvalidToken, "invalid webhook secret", http.StatusUnauthorized)
+		return
+	}
+
+	maxSize := inbound.MaxSize()
+	raw, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, r, fmt.Sprintf("messages may be at most %d MB", maxSize>>20), http.StatusRequestEntityTooLarge)
+			return
+		}
+		writeErrorCode(w, r, CodeInvalidBody, "the request body could not be read", http.StatusBadRequest)
+		return
+	}
+
+	result, err := h.receive(raw)
+	switch {
+	case errors.Is(err, inbound.ErrMalformed):
+		writeErrorCode(w, r, CodeInvalidBody, "the body is not a valid email message", http.StatusBadRequest)
+		return
+	case errors.Is(err, inbound.ErrUnknownSender):
+		writeValidation(w, r, FieldError{Field: "from", Code: FieldUnknown, Message: "the sender is not a user"})
+		return
+	case errors.Is(err, inbound.ErrUnverifiedSender):
+		writeValidation(w, r, FieldError{Field: "from", Code: FieldInvalid, Message: "the relay did not verify the sender"})
+		return
+	case errors.Is(err, inbound.ErrNotParticipant):
+		writeError(w, r, "the sender may not comment on the ticket", http.StatusForbidden)
+		return
+	case errors.Is(err, inbound.ErrTicketClosed):
+		writeError(w, r, "the ticket is closed; write a new email to open a new ticket", http.StatusConflict)
+		return
+	case errors.Is(err, inbound.ErrNoText):
+		writeValidation(w, r, FieldError{Field: "body", Code: FieldRequired, Message: "nothing is left once quotes and signatures are removed"})
+		return
+	case err != nil:
+		writeDBError(w, r, err)
+		return
+	}
+
+	resp := InboundMailResponse{TicketId: result.Ticket.Id, Duplicate: result.Duplicate}
+	if result.Comment != nil {
+		resp.CommentId = &result.Comment.Id
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !result.Duplicate {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// ListenSMTP starts the inbound SMTP listener if INBOUND_SMTP_ADDR is set
+func (h InboundMail) ListenSMTP() error {
+	server, err := inbound.ServerFromEnv(func(raw []byte) error {
+		_, err := h.receive(raw)
+		return err
+	})
+	if err != nil || server == nil {
+		return err
+	}
+	if h.AuthservID == "" {
+		log.Printf("inbound mail: INBOUND_AUTHSERV_ID is not set, so senders are taken at their From address")
+	}
+
+	l, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := server.Serve(l); err != nil {
+			log.Printf("inbound mail: %v", err)
+		}
+	}()
+	return nil
+}
+
+func (h InboundMail) receive(raw []byte) (inbound.Result, error) {
+	msg, err := inbound.Parse(bytes.NewReader(raw))
+	if err != nil {
+		return inbound.Result{}, err
+	}
+	if h.AuthservID != "" {
+		if err := inbound.Verify(msg, h.AuthservID); err != nil {
+			return inbound.Result{}, err
+		}
+	}
+	return inbound.Process(h.DB, h.Events, msg, time.Now())
+}
+
+// RegisterInboundMail adds the inbound email webhook. It authenticates with its own secret,
+// so it goes on the public router.
+func RegisterInboundMail(router *mux.Router, h InboundMail, prefix string) {
+	router.HandleFunc(prefix+"/email", h.Receive).Methods("POST")
+}
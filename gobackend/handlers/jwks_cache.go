@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// jwksDefaultTTL is used when the provider sends no usable Cache-Control max-age
+	jwksDefaultTTL = 1 * time.Hour
+	// jwksMinRefresh limits refetches triggered by an unknown kid, and retries after a failed one
+	jwksMinRefresh = 1 * time.Minute
+)
+
+// remoteKeySet caches the public keys published at a JWKS URL.
+// Keys are refetched when the cache expires or a token names an unknown kid,
+// and the previous keys keep working if a refetch fails.
+type remoteKeySet struct {
+	url    string
+	client *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]interface{}
+	expiresAt time.Time
+	fetchedAt time.Time
+	lastErr   error // why the last refresh failed, until one succeeds
+}
+
+// newRemoteKeySet creates a key cache for the given JWKS URL
+func newRemoteKeySet(url string) *remoteKeySet {
+	return &remoteKeySet{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// keyFunc resolves the public key for a token by its kid
+func (s *remoteKeySet) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		return nil, errors.New("token has no kid")
+	}
+
+	key, err := s.key(kid)
+	if err != nil {
+		return nil, err
+	}
+
+	switch key.(type) {
+	case *rsa.PublicKey:
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, jwt.ErrSignatureInvalid
+		}
+	case *ecdsa.PublicKey:
+		if _, ok := token.Method.(*jwt.SigningMethodECDSA); !ok {
+			return nil, jwt.ErrSignatureInvalid
+		}
+	case ed25519.PublicKey:
+		if _, ok := token.Method.(*jwt.SigningMethodEd25519); !ok {
+			return nil, jwt.ErrSignatureInvalid
+		}
+	}
+
+	return key, nil
+}
+
+// key returns the cached key for kid, refreshing the set when needed
+func (s *remoteKeySet) key(kid string) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	key, known := s.keys[kid]
+
+	expired := now.After(s.expiresAt)
+	canRefetch := now.Sub(s.fetchedAt) >= jwksMinRefresh
+	if expired || (!known && canRefetch) {
+		if err := s.refresh(now); err != nil && len(s.keys) == 0 {
+			return nil, err
+		}
+		key, known = s.keys[kid]
+	}
+
+	if !known && len(s.keys) == 0 && s.lastErr != nil {
+		return nil, s.lastErr
+	}
+	if !known {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	return key, nil
+}
+
+// refresh downloads the key set; the caller holds s.mu. After a failure the next attempt
+// waits jwksMinRefresh, and the stale keys are served meanwhile, so an unreachable provider
+// does not turn every login into a blocking fetch.
+func (s *remoteKeySet) refresh(now time.Time) error {
+	s.fetchedAt = now
+
+	keys, ttl, err := s.fetch()
+	if err != nil {
+		s.expiresAt = now.Add(jwksMinRefresh)
+		s.lastErr = err
+		return err
+	}
+
+	s.keys = keys
+	s.expiresAt = now.Add(ttl)
+	s.lastErr = nil
+	return nil
+}
+
+// fetch downloads and parses the key set, returning how long it may be cached
+func (s *remoteKeySet) fetch() (map[string]interface{}, time.Duration, error) {
+	resp, err := s.client.Get(s.url)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to fetch signing keys: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("failed to fetch signing keys: status code %d", resp.StatusCode)
+	}
+
+	var set JWKSet
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode signing keys: %v", err)
+	}
+
+	keys := map[string]interface{}{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := parseJWK(jwk)
+		if err != nil {
+			// Skip key types we cannot use rather than rejecting the whole set
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+
+	return keys, cacheMaxAge(resp.Header.Get("Cache-Control")), nil
+}
+
+// cacheMaxAge reads max-age from a Cache-Control header
+func cacheMaxAge(header string) time.Duration {
+	for _, directive := range strings.Split(header, ",") {
+		directive = strings.TrimSpace(directive)
+		if value, ok := strings.CutPrefix(directive, "max-age="); ok {
+			if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+				return time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	return jwksDefaultTTL
+}
+
+// parseJWK converts a JSON Web Key into a public key
+func parseJWK(jwk JWK) (interface{}, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+	}
+}
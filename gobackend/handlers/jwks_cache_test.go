@@ -0,0 +1,344 @@
+package handlers
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testJWKS serves a key set from locally generated RSA keys
+type testJWKS struct {
+	srv *httptest.Server
+
+	mu      sync.Mutex
+	keys    map[string]*rsa.PrivateKey
+	fail    bool
+	fetches int
+	maxAge  int
+}
+
+func newTestJWKS(t *testing.T) *testJWKS {
+	t.Helper()
+	j := &testJWKS{keys: map[string]*rsa.PrivateKey{}}
+	j.srv = httptest.NewServer(http.HandlerFunc(j.serve))
+	t.Cleanup(j.srv.Close)
+	return j
+}
+
+func (j *testJWKS) serve(w http.ResponseWriter, r *http.Request) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.fetches++
+	if j.fail {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	var set JWKSet
+	for kid, key := range j.keys {
+		set.Keys = append(set.Keys, rsaJWK(kid, &key.PublicKey))
+	}
+	if j.maxAge > 0 {
+		w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(j.maxAge))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(set)
+}
+
+// addKey generates and publishes a new key
+func (j *testJWKS) addKey(t *testing.T, kid string) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.mu.Lock()
+	j.keys[kid] = key
+	j.mu.Unlock()
+	return key
+}
+
+func (j *testJWKS) removeKey(kid string) {
+	j.mu.Lock()
+	delete(j.keys, kid)
+	j.mu.Unlock()
+}
+
+func (j *testJWKS) setFail(fail bool) {
+	j.mu.Lock()
+	j.fail = fail
+	j.mu.Unlock()
+}
+
+func (j *testJWKS) fetchCount() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.fetches
+}
+
+// sign signs claims with a published key
+func (j *testJWKS) sign(t *testing.T, kid string, claims jwt.Claims) string {
+	t.Helper()
+	j.mu.Lock()
+	key := j.keys[kid]
+	j.mu.Unlock()
+	if key == nil {
+		t.Fatalf("no key %q", kid)
+	}
+	return signRS256(t, key, kid, claims)
+}
+
+func signRS256(t *testing.T, key *rsa.PrivateKey, kid string, claims jwt.Claims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func rsaJWK(kid string, pub *rsa.PublicKey) JWK {
+	return JWK{
+		Kty: "RSA",
+		Kid: kid,
+		Use: "sig",
+		Alg: "RS256",
+		N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+	}
+}
+
+// parseWith verifies a token against the key set only, without checking claims
+func parseWith(s *remoteKeySet, token string) error {
+	_, err := jwt.Parse(token, s.keyFunc, jwt.WithValidMethods([]string{"RS256"}))
+	return err
+}
+
+func TestRemoteKeySetCachesKeys(t *testing.T) {
+	j := newTestJWKS(t)
+	j.addKey(t, "k1")
+	j.maxAge = 600
+	s := newRemoteKeySet(j.srv.URL)
+
+	token := j.sign(t, "k1", jwt.MapClaims{"sub": "1"})
+	for range 3 {
+		if err := parseWith(s, token); err != nil {
+			t.Fatalf("parse: %v", err)
+		}
+	}
+	if n := j.fetchCount(); n != 1 {
+		t.Errorf("fetches = %d, want 1", n)
+	}
+	if ttl := time.Until(s.expiresAt); ttl < 590*time.Second || ttl > 600*time.Second {
+		t.Errorf("cache expires in %v, want about max-age=600", ttl)
+	}
+
+	// Once the cache expires the set is fetched again
+	s.expiresAt = time.Now().Add(-time.Second)
+	if err := parseWith(s, token); err != nil {
+		t.Fatalf("parse after expiry: %v", err)
+	}
+	if n := j.fetchCount(); n != 2 {
+		t.Errorf("fetches after expiry = %d, want 2", n)
+	}
+}
+
+func TestRemoteKeySetRotation(t *testing.T) {
+	j := newTestJWKS(t)
+	j.addKey(t, "old")
+	s := newRemoteKeySet(j.srv.URL)
+
+	if err := parseWith(s, j.sign(t, "old", jwt.MapClaims{})); err != nil {
+		t.Fatalf("parse with old key: %v", err)
+	}
+
+	// The provider rotates in a new key; a token naming it forces a refetch,
+	// but not more often than jwksMinRefresh
+	j.addKey(t, "new")
+	j.removeKey("old")
+	rotated := j.sign(t, "new", jwt.MapClaims{})
+
+	err := parseWith(s, rotated)
+	if err == nil || !strings.Contains(err.Error(), "unknown signing key") {
+		t.Fatalf("parse right after the last fetch = %v, want unknown signing key", err)
+	}
+	if n := j.fetchCount(); n != 1 {
+		t.Errorf("fetches = %d, want 1 within jwksMinRefresh", n)
+	}
+
+	s.fetchedAt = time.Now().Add(-jwksMinRefresh)
+	if err := parseWith(s, rotated); err != nil {
+		t.Fatalf("parse with rotated key: %v", err)
+	}
+	if n := j.fetchCount(); n != 2 {
+		t.Errorf("fetches = %d, want 2", n)
+	}
+	if _, ok := s.keys["old"]; ok {
+		t.Error("retired key is still cached")
+	}
+}
+
+func TestRemoteKeySetBackoff(t *testing.T) {
+	j := newTestJWKS(t)
+	j.addKey(t, "k1")
+	s := newRemoteKeySet(j.srv.URL)
+	token := j.sign(t, "k1", jwt.MapClaims{})
+
+	if err := parseWith(s, token); err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	// The provider goes down after the cache expires: the stale keys keep working
+	// and the next attempt waits jwksMinRefresh
+	j.setFail(true)
+	s.expiresAt = time.Now().Add(-time.Second)
+	if err := parseWith(s, token); err != nil {
+		t.Fatalf("parse with stale keys: %v", err)
+	}
+	if s.lastErr == nil {
+		t.Error("lastErr not recorded")
+	}
+	if wait := time.Until(s.expiresAt); wait <= 0 || wait > jwksMinRefresh {
+		t.Errorf("next refresh in %v, want within jwksMinRefresh", wait)
+	}
+	for range 3 {
+		parseWith(s, token)
+	}
+	if n := j.fetchCount(); n != 2 {
+		t.Errorf("fetches = %d, want 2 while backing off", n)
+	}
+
+	// Recovery clears the error
+	j.setFail(false)
+	s.expiresAt = time.Now().Add(-time.Second)
+	if err := parseWith(s, token); err != nil {
+		t.Fatalf("parse after recovery: %v", err)
+	}
+	if s.lastErr != nil {
+		t.Errorf("lastErr = %v after a successful refresh", s.lastErr)
+	}
+}
+
+func TestRemoteKeySetUnreachable(t *testing.T) {
+	j := newTestJWKS(t)
+	j.addKey(t, "k1")
+	j.setFail(true)
+	s := newRemoteKeySet(j.srv.URL)
+	token := j.sign(t, "k1", jwt.MapClaims{})
+
+	// Without any cached keys the fetch error is reported, also while backing off
+	for range 2 {
+		err := parseWith(s, token)
+		if err == nil || !strings.Contains(err.Error(), "status code 503") {
+			t.Fatalf("parse = %v, want the fetch error", err)
+		}
+	}
+	if n := j.fetchCount(); n != 1 {
+		t.Errorf("fetches = %d, want 1", n)
+	}
+}
+
+func TestRemoteKeySetKeyFunc(t *testing.T) {
+	j := newTestJWKS(t)
+	j.addKey(t, "k1")
+	s := newRemoteKeySet(j.srv.URL)
+
+	if _, err := s.keyFunc(&jwt.Token{Header: map[string]interface{}{}, Method: jwt.SigningMethodRS256}); err == nil {
+		t.Error("token without kid accepted")
+	}
+
+	// An RSA key must not verify an HMAC or ECDSA signed token
+	for _, method := range []jwt.SigningMethod{jwt.SigningMethodHS256, jwt.SigningMethodES256} {
+		token := &jwt.Token{Header: map[string]interface{}{"kid": "k1"}, Method: method}
+		if _, err := s.keyFunc(token); !errors.Is(err, jwt.ErrSignatureInvalid) {
+			t.Errorf("%s with RSA key: err = %v, want ErrSignatureInvalid", method.Alg(), err)
+		}
+	}
+
+	// A token signed by another key under a published kid fails verification
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := parseWith(s, signRS256(t, other, "k1", jwt.MapClaims{})); !errors.Is(err, jwt.ErrTokenSignatureInvalid) {
+		t.Errorf("forged token: err = %v, want ErrTokenSignatureInvalid", err)
+	}
+}
+
+func TestCacheMaxAge(t *testing.T) {
+	tests := map[string]time.Duration{
+		"public, max-age=19800, must-revalidate": 19800 * time.Second,
+		"max-age=60":                             time.Minute,
+		"no-cache":                               jwksDefaultTTL,
+		"max-age=0":                              jwksDefaultTTL,
+		"max-age=abc":                            jwksDefaultTTL,
+		"":                                       jwksDefaultTTL,
+	}
+	for header, want := range tests {
+		if got := cacheMaxAge(header); got != want {
+			t.Errorf("cacheMaxAge(%q) = %v, want %v", header, got, want)
+		}
+	}
+}
+
+func TestParseJWK(t *testing.T) {
+	b64 := base64.RawURLEncoding.EncodeToString
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := parseJWK(rsaJWK("r", &rsaKey.PublicKey))
+	if err != nil || !rsaKey.PublicKey.Equal(key) {
+		t.Errorf("RSA: key = %v, err = %v", key, err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err = parseJWK(JWK{Kty: "EC", Crv: "P-256", X: b64(ecKey.X.Bytes()), Y: b64(ecKey.Y.Bytes())})
+	if err != nil || !ecKey.PublicKey.Equal(key) {
+		t.Errorf("EC: key = %v, err = %v", key, err)
+	}
+
+	edKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err = parseJWK(JWK{Kty: "OKP", Crv: "Ed25519", X: b64(edKey)})
+	if err != nil || !edKey.Equal(key) {
+		t.Errorf("OKP: key = %v, err = %v", key, err)
+	}
+
+	invalid := []JWK{
+		{Kty: "oct"},
+		{Kty: "EC", Crv: "secp256k1"},
+		{Kty: "OKP", Crv: "X25519"},
+		{Kty: "OKP", Crv: "Ed25519", X: b64([]byte("short"))},
+		{Kty: "RSA", N: "!!", E: "AQAB"},
+	}
+	for _, jwk := range invalid {
+		if _, err := parseJWK(jwk); err == nil {
+			t.Errorf("parseJWK(%+v) accepted", jwk)
+		}
+	}
+}
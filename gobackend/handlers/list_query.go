@@ -0,0 +1,630 @@
+package handlers
+
+// Shared handling of list endpoints. Every list understands these query parameters:
+//
+//   - limit and offset, or cursor for keyset pagination (pass the X-Next-Cursor of the previous page)
+//   - sort: comma-separated keys, "-" for descending, e.g. sort=-created_at,title
+//   - include: relations to embed, e.g. include=comments; an empty include= embeds none
+//   - fields: fields to return, e.g. fields=id,title,status
+//   - the endpoint's own filters, e.g. status=OPEN&assigned_to=me
+//
+// Responses carry X-Total-Count (matches before paging), X-Next-Cursor when there are more
+// results, and a Link header with next, prev and first links. Sorts on nullable columns
+// page by offset only and never get a cursor.
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 200
+)
+
+// filterFunc turns a query parameter value into a WHERE condition
+type filterFunc func(r *http.Request, value string) (string, []interface{}, error)
+
+// listInclude is a relation that can be embedded with include=
+type listInclude struct {
+	preload string                                        // association name for Preload
+	columns []string                                      // foreign keys the relation needs when fields= narrows the select
+	where   func(r *http.Request) (string, []interface{}) // limits the embedded rows to those the caller may see
+}
+
+// listSpec describes what a list endpoint lets clients filter, sort and include
+type listSpec struct {
+	filters        map[string]filterFunc  // query parameter -> condition
+	sorts          map[string]string      // sort key -> column
+	defaultSort    string                 // e.g. "-created_at"
+	includes       map[string]listInclude // include name (the JSON key) -> relation
+	defaultInclude []string               // embedded when include= is absent
+	computed       []string               // fields= names the handler or model adds to the response
+	computedFrom   map[string][]string    // columns a computed field needs when fields= narrows the select
+	defaultLimit   int                    // defaults to 50
+	maxLimit       int                    // defaults to 200
+}
+
+type sortField struct {
+	key    string
+	column string
+	desc   bool
+}
+
+// listRequest is a parsed list request
+type listRequest struct {
+	spec     listSpec
+	where    []listCondition
+	sort     []sortField
+	limit    int
+	offset   int
+	cursor   []json.RawMessage // set in cursor mode
+	includes []string
+	preloads map[string][]interface{} // Preload conditions by include name
+	fields   []string                 // nil returns every field
+}
+
+type listCondition struct {
+	sql  string
+	args []interface{}
+}
+
+// listPage is what a list query found
+type listPage struct {
+	total      int64
+	hasMore    bool
+	nextCursor string
+}
+
+// cursorToken is the decoded form of a cursor
+type cursorToken struct {
+	Sort   string            `json:"s"`
+	Values []json.RawMessage `json:"v"`
+}
+
+// errBadList marks errors caused by the request rather than the database
+var errBadList = errors.New("bad list request")
+
+func badList(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", errBadList, fmt.Sprintf(format, args...))
+}
+
+// serveList parses the list parameters, runs query and writes the page
+func serveList[T any](w http.ResponseWriter, r *http.Request, query *gorm.DB, spec listSpec) {
+	var list []T
+	l, page, ok := findList(w, r, query, spec, &list)
+	if !ok {
+		return
+	}
+	l.write(w, r, list, page)
+}
+
+// findList parses the list parameters and runs query into dest, a pointer to a slice of models.
+// It writes 400 or 500 and returns false on failure.
+func findList(w http.ResponseWriter, r *http.Request, query *gorm.DB, spec listSpec, dest interface{}) (*listRequest, listPage, bool) {
+	l, err := parseList(r, spec)
+	if err == nil {
+		var page listPage
+		page, err = l.find(query, dest)
+		if err == nil {
+			return l, page, true
+		}
+	}
+
+	if errors.Is(err, errBadList) {
+		writeErrorCode(w, r, CodeInvalidQuery, strings.TrimPrefix(err.Error(), errBadList.Error()+": "), http.StatusBadRequest)
+	} else {
+		writeDBError(w, r, err)
+	}
+	return nil, listPage{}, false
+}
+
+// parseList reads the list parameters of the request
+func parseList(r *http.Request, spec listSpec) (*listRequest, error) {
+	q := r.URL.Query()
+	l := &listRequest{spec: spec, limit: spec.defaultLimit}
+	if l.limit == 0 {
+		l.limit = defaultListLimit
+	}
+	maxLimit := spec.maxLimit
+	if maxLimit == 0 {
+		maxLimit = maxListLimit
+	}
+
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return nil, badList("invalid limit")
+		}
+		l.limit = min(n, maxLimit)
+	}
+
+	if s := q.Get("offset"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return nil, badList("invalid offset")
+		}
+		l.offset = n
+	}
+
+	// In name order, so the same request always builds the same SQL
+	names := slices.Sorted(maps.Keys(spec.filters))
+	for _, name := range names {
+		value := q.Get(name)
+		if value == "" {
+			continue
+		}
+		sql, args, err := spec.filters[name](r, value)
+		if err != nil {
+			return nil, badList("invalid %s: %v", name, err)
+		}
+		l.where = append(l.where, listCondition{sql, args})
+	}
+
+	sortParam := q.Get("sort")
+	if sortParam == "" {
+		sortParam = spec.defaultSort
+	}
+	for _, key := range splitList(sortParam) {
+		desc := strings.HasPrefix(key, "-")
+		key = strings.TrimPrefix(key, "-")
+		column, ok := spec.sorts[key]
+		if !ok {
+			return nil, badList("cannot sort by %s", key)
+		}
+		l.sort = append(l.sort, sortField{key: key, column: column, desc: desc})
+	}
+	// A unique last key keeps pages stable
+	if !slices.ContainsFunc(l.sort, func(s sortField) bool { return s.column == "id" }) {
+		l.sort = append(l.sort, sortField{key: "id", column: "id"})
+	}
+
+	if q.Has("cursor") && q.Get("cursor") != "" {
+		if q.Has("offset") {
+			return nil, badList("use either cursor or offset")
+		}
+		raw, err := base64.RawURLEncoding.DecodeString(q.Get("cursor"))
+		var token cursorToken
+		if err == nil {
+			err = json.Unmarshal(raw, &token)
+		}
+		if err != nil || len(token.Values) != len(l.sort) {
+			return nil, badList("invalid cursor")
+		}
+		if token.Sort != l.sortSignature() {
+			return nil, badList("cursor does not match sort")
+		}
+		l.cursor = token.Values
+	}
+
+	l.includes = spec.defaultInclude
+	if q.Has("include") {
+		l.includes = splitList(q.Get("include"))
+	}
+	l.preloads = map[string][]interface{}{}
+	for _, name := range l.includes {
+		include, ok := spec.includes[name]
+		if !ok {
+			return nil, badList("cannot include %s", name)
+		}
+		if include.where != nil {
+			l.preloads[name] = conditionArgs(include.where(r))
+		}
+	}
+
+	if q.Has("fields") {
+		l.fields = splitList(q.Get("fields"))
+		if len(l.fields) == 0 {
+			return nil, badList("fields must name at least one field")
+		}
+	}
+
+	return l, nil
+}
+
+// conditionArgs turns a condition into the arguments of Where or Preload
+func conditionArgs(sql string, args []interface{}) []interface{} {
+	return append([]interface{}{sql}, args...)
+}
+
+// find runs the query with the request's filters, sort, page and includes
+func (l *listRequest) find(query *gorm.DB, dest interface{}) (listPage, error) {
+	var page listPage
+
+	stmt := &gorm.Statement{DB: query}
+	if err := stmt.Parse(dest); err != nil {
+		return page, err
+	}
+	model := stmt.Schema
+
+	for _, f := range l.fields {
+		if _, ok := l.spec.includes[f]; ok || slices.Contains(l.spec.computed, f) {
+			continue
+		}
+		if field := model.LookUpField(f); field == nil || field.DBName == "" {
+			return page, badList("unknown field %s", f)
+		}
+	}
+
+	for _, c := range l.where {
+		query = query.Where(c.sql, c.args...)
+	}
+	query = query.Session(&gorm.Session{})
+
+	if err := query.Model(dest).Count(&page.total).Error; err != nil {
+		return page, err
+	}
+
+	// Keyset paging cannot step over NULLs, so nullable sorts page by offset only
+	keyset := true
+	for _, s := range l.sort {
+		if field := model.LookUpField(s.column); field != nil && field.FieldType.Kind() == reflect.Ptr {
+			keyset = false
+		}
+	}
+	if l.cursor != nil && !keyset {
+		return page, badList("cursor cannot be used with this sort; use offset")
+	}
+
+	if l.cursor != nil {
+		sql, args, err := l.cursorCondition(model)
+		if err != nil {
+			return page, err
+		}
+		query = query.Where(sql, args...)
+	}
+
+	for _, s := range l.sort {
+		query = query.Order(clauseOrder(s))
+	}
+
+	for _, name := range l.includes {
+		query = query.Preload(l.spec.includes[name].preload, l.preloads[name]...)
+	}
+
+	if l.fields != nil {
+		columns := []string{"id"}
+		for _, f := range l.fields {
+			if field := model.LookUpField(f); field != nil && field.DBName != "" {
+				columns = append(columns, field.DBName)
+			}
+			columns = append(columns, l.spec.computedFrom[f]...)
+		}
+		for _, name := range l.includes {
+			columns = append(columns, l.spec.includes[name].columns...)
+		}
+		for _, s := range l.sort {
+			columns = append(columns, s.column)
+		}
+		slices.Sort(columns)
+		query = query.Select(slices.Compact(columns))
+	}
+
+	if l.cursor == nil {
+		query = query.Offset(l.offset)
+	}
+
+	// Fetch one extra row to learn whether there is a next page
+	if err := query.Limit(l.limit + 1).Find(dest).Error; err != nil {
+		return page, err
+	}
+
+	items := reflect.ValueOf(dest).Elem()
+	if items.Len() > l.limit {
+		page.hasMore = true
+		items.Set(items.Slice(0, l.limit))
+
+		if keyset {
+			cursor, err := l.encodeCursor(model, items.Index(l.limit-1))
+			if err != nil {
+				return page, err
+			}
+			page.nextCursor = cursor
+		}
+	}
+
+	return page, nil
+}
+
+// write sets the paging headers and encodes items, keeping only the requested fields
+func (l *listRequest) write(w http.ResponseWriter, r *http.Request, items interface{}, page listPage) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Total-Count", strconv.FormatInt(page.total, 10))
+	if page.nextCursor != "" {
+		w.Header().Set("X-Next-Cursor", page.nextCursor)
+	}
+	if link := l.linkHeader(r, page); link != "" {
+		w.Header().Set("Link", link)
+	}
+
+	if l.fields == nil {
+		json.NewEncoder(w).Encode(items)
+		return
+	}
+
+	raw, err := json.Marshal(items)
+	if err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	var rows []map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &rows); err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	keep := append(slices.Clone(l.fields), l.includes...)
+	for _, row := range rows {
+		for key := range row {
+			if !slices.Contains(keep, key) {
+				delete(row, key)
+			}
+		}
+	}
+
+	if rows == nil {
+		rows = []map[string]json.RawMessage{}
+	}
+	json.NewEncoder(w).Encode(rows)
+}
+
+// linkHeader builds relative next, prev and first links that keep the other parameters
+func (l *listRequest) linkHeader(r *http.Request, page listPage) string {
+	link := func(rel string, set map[string]string) string {
+		q := r.URL.Query()
+		for k, v := range set {
+			if v == "" {
+				q.Del(k)
+			} else {
+				q.Set(k, v)
+			}
+		}
+		return fmt.Sprintf(`<?%s>; rel="%s"`, q.Encode(), rel)
+	}
+
+	var links []string
+	if l.cursor != nil {
+		if page.hasMore {
+			links = append(links, link("next", map[string]string{"cursor": page.nextCursor}))
+		}
+		links = append(links, link("first", map[string]string{"cursor": ""}))
+		return strings.Join(links, ", ")
+	}
+
+	if page.hasMore {
+		links = append(links, link("next", map[string]string{"offset": strconv.Itoa(l.offset + l.limit)}))
+	}
+	if l.offset > 0 {
+		prev := max(l.offset-l.limit, 0)
+		links = append(links, link("prev", map[string]string{"offset": strconv.Itoa(prev)}))
+		links = append(links, link("first", map[string]string{"offset": ""}))
+	}
+	return strings.Join(links, ", ")
+}
+
+// cursorCondition selects the rows after the cursor in sort order:
+// (a > x) OR (a = x AND b > y) OR ..., with < for descending keys
+func (l *listRequest) cursorCondition(model *schema.Schema) (string, []interface{}, error) {
+	values := make([]interface{}, len(l.sort))
+	for i, s := range l.sort {
+		field := model.LookUpField(s.column)
+		if field == nil {
+			return "", nil, fmt.Errorf("unknown sort column %s", s.column)
+		}
+		v := reflect.New(field.FieldType)
+		if err := json.Unmarshal(l.cursor[i], v.Interface()); err != nil {
+			return "", nil, badList("invalid cursor")
+		}
+		values[i] = v.Elem().Interface()
+	}
+
+	var ors []string
+	var args []interface{}
+	for i, s := range l.sort {
+		var ands []string
+		for j := 0; j < i; j++ {
+			ands = append(ands, l.sort[j].column+" = ?")
+			args = append(args, values[j])
+		}
+		op := " > ?"
+		if s.desc {
+			op = " < ?"
+		}
+		ands = append(ands, s.column+op)
+		args = append(args, values[i])
+		ors = append(ors, "("+strings.Join(ands, " AND ")+")")
+	}
+
+	return strings.Join(ors, " OR "), args, nil
+}
+
+// encodeCursor captures the sort values of the last row on a page
+func (l *listRequest) encodeCursor(model *schema.Schema, last reflect.Value) (string, error) {
+	token := cursorToken{Sort: l.sortSignature()}
+	for _, s := range l.sort {
+		field := model.LookUpField(s.column)
+		if field == nil {
+			return "", fmt.Errorf("unknown sort column %s", s.column)
+		}
+		v, _ := field.ValueOf(context.Background(), last)
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		token.Values = append(token.Values, raw)
+	}
+	raw, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// sortSignature identifies the sort a cursor was made for
+func (l *listRequest) sortSignature() string {
+	keys := make([]string, len(l.sort))
+	for i, s := range l.sort {
+		keys[i] = s.key
+		if s.desc {
+			keys[i] = "-" + s.key
+		}
+	}
+	return strings.Join(keys, ",")
+}
+
+func clauseOrder(s sortField) string {
+	if s.desc {
+		return s.column + " DESC"
+	}
+	return s.column + " ASC"
+}
+
+// splitList splits a comma-separated parameter, dropping empty items
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// Filters
+
+// eqFilter matches a column against one value or a comma-separated list of values
+func eqFilter(column string) filterFunc {
+	return func(r *http.Request, value string) (string, []interface{}, error) {
+		values := splitList(value)
+		if len(values) == 1 {
+			return column + " = ?", []interface{}{values[0]}, nil
+		}
+		return column + " IN ?", []interface{}{values}, nil
+	}
+}
+
+// enumFilter is eqFilter restricted to the values valid accepts
+func enumFilter(column string, valid func(string) bool) filterFunc {
+	return func(r *http.Request, value string) (string, []interface{}, error) {
+		for _, v := range splitList(value) {
+			if !valid(v) {
+				return "", nil, fmt.Errorf("unknown value %q", v)
+			}
+		}
+		return eqFilter(column)(r, value)
+	}
+}
+
+// uuidFilter matches a UUID column. "me" is the caller and "none" matches NULL.
+func uuidFilter(column string) filterFunc {
+	return func(r *http.Request, value string) (string, []interface{}, error) {
+		if value == "none" {
+			return column + " IS NULL", nil, nil
+		}
+
+		var ids []uuid.UUID
+		for _, v := range splitList(value) {
+			if v == "me" {
+				id, _ := currentUserID(r)
+				ids = append(ids, id)
+				continue
+			}
+			id, err := uuid.Parse(v)
+			if err != nil {
+				return "", nil, fmt.Errorf("invalid UUID %q", v)
+			}
+			ids = append(ids, id)
+		}
+		return column + " IN ?", []interface{}{ids}, nil
+	}
+}
+
+// searchFilter matches rows where any of the columns contains the value, ignoring case
+func searchFilter(columns ...string) filterFunc {
+	return func(r *http.Request, value string) (string, []interface{}, error) {
+		pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(value) + "%"
+
+		conditions := make([]string, len(columns))
+		args := make([]interface{}, len(columns))
+		for i, column := range columns {
+			conditions[i] = column + " ILIKE ?"
+			args[i] = pattern
+		}
+		return "(" + strings.Join(conditions, " OR ") + ")", args, nil
+	}
+}
+
+// boolFilter matches a boolean column
+func boolFilter(column string) filterFunc {
+	return func(r *http.Request, value string) (string, []interface{}, error) {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return "", nil, errors.New("must be true or false")
+		}
+		return column + " = ?", []interface{}{b}, nil
+	}
+}
+
+// nullFilter matches rows where the column is NULL (true) or set (false)
+func nullFilter(column string) filterFunc {
+	return func(r *http.Request, value string) (string, []interface{}, error) {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return "", nil, errors.New("must be true or false")
+		}
+		if b {
+			return column + " IS NULL", nil, nil
+		}
+		return column + " IS NOT NULL", nil, nil
+	}
+}
+
+// fromFilter matches rows where the column is at or after a time (RFC 3339) or date (YYYY-MM-DD)
+func fromFilter(column string) filterFunc {
+	return func(r *http.Request, value string) (string, []interface{}, error) {
+		t, _, err := parseTimeOrDate(value)
+		if err != nil {
+			return "", nil, err
+		}
+		return column + " >= ?", []interface{}{t}, nil
+	}
+}
+
+// toFilter matches rows where the column is before a time, or on or before a date
+func toFilter(column string) filterFunc {
+	return func(r *http.Request, value string) (string, []interface{}, error) {
+		t, dateOnly, err := parseTimeOrDate(value)
+		if err != nil {
+			return "", nil, err
+		}
+		if dateOnly {
+			return column + " < ?", []interface{}{t.AddDate(0, 0, 1)}, nil
+		}
+		return column + " <= ?", []interface{}{t}, nil
+	}
+}
+
+func parseTimeOrDate(value string) (time.Time, bool, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, false, nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, true, nil
+	}
+	return time.Time{}, false, errors.New("must be a date (2006-01-02) or RFC 3339 time")
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"stuff/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm/schema"
+)
+
+var testListSpec = listSpec{
+	filters: map[string]filterFunc{
+		"status": enumFilter("status", func(s string) bool { return models.TicketStatus(s).Valid() }),
+	},
+	sorts: map[string]string{
+		"created_at": "created_at",
+		"title":      "title",
+	},
+	defaultSort: "-created_at",
+	includes: map[string]listInclude{
+		"category": {preload: "Category", columns: []string{"category_id"}},
+	},
+}
+
+func parseTestList(t *testing.T, query string) (*listRequest, error) {
+	t.Helper()
+	return parseList(httptest.NewRequest("GET", "/tickets?"+query, nil), testListSpec)
+}
+
+func TestParseList(t *testing.T) {
+	tests := []struct {
+		query   string
+		wantErr string
+		limit   int
+		offset  int
+		sort    string
+	}{
+		{query: "", limit: defaultListLimit, sort: "-created_at,id"},
+		{query: "limit=10&offset=20", limit: 10, offset: 20, sort: "-created_at,id"},
+		{query: "limit=1000", limit: maxListLimit, sort: "-created_at,id"},
+		{query: "sort=title,-created_at", limit: defaultListLimit, sort: "title,-created_at,id"},
+		{query: "limit=0", wantErr: "invalid limit"},
+		{query: "limit=x", wantErr: "invalid limit"},
+		{query: "offset=-1", wantErr: "invalid offset"},
+		{query: "sort=password_hash", wantErr: "cannot sort by password_hash"},
+		{query: "status=NOPE", wantErr: "invalid status"},
+		{query: "include=secrets", wantErr: "cannot include secrets"},
+		{query: "fields=,", wantErr: "fields must name at least one field"},
+		{query: "cursor=abc&offset=0", wantErr: "use either cursor or offset"},
+		{query: "cursor=not-base64!", wantErr: "invalid cursor"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			l, err := parseTestList(t, tt.query)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if l.limit != tt.limit || l.offset != tt.offset || l.sortSignature() != tt.sort {
+				t.Errorf("limit %d offset %d sort %q, want %d %d %q", l.limit, l.offset, l.sortSignature(), tt.limit, tt.offset, tt.sort)
+			}
+		})
+	}
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	model, err := schema.Parse(&models.Ticket{}, &sync.Map{}, schema.NamingStrategy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := parseTestList(t, "sort=title,-created_at")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	last := models.Ticket{Id: uuid.New(), Title: "Printer", CreatedAt: time.Date(2026, 10, 5, 10, 0, 0, 0, time.UTC)}
+	cursor, err := l.encodeCursor(model, reflect.ValueOf(last))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next, err := parseTestList(t, "sort=title,-created_at&cursor="+cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sql, args, err := next.cursorCondition(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantSQL := "(title > ?) OR (title = ? AND created_at < ?) OR (title = ? AND created_at = ? AND id > ?)"
+	if sql != wantSQL {
+		t.Errorf("sql = %q, want %q", sql, wantSQL)
+	}
+	wantArgs := []interface{}{"Printer", "Printer", last.CreatedAt, "Printer", last.CreatedAt, last.Id}
+	if len(args) != len(wantArgs) {
+		t.Fatalf("args = %v, want %v", args, wantArgs)
+	}
+	for i := range args {
+		if at, ok := args[i].(time.Time); ok {
+			if !at.Equal(wantArgs[i].(time.Time)) {
+				t.Errorf("args[%d] = %v, want %v", i, at, wantArgs[i])
+			}
+		} else if args[i] != wantArgs[i] {
+			t.Errorf("args[%d] = %v, want %v", i, args[i], wantArgs[i])
+		}
+	}
+
+	// A cursor only fits the sort it was made for
+	if _, err := parseTestList(t, "sort=title&cursor="+cursor); err == nil || !strings.Contains(err.Error(), "invalid cursor") {
+		t.Errorf("cursor with fewer sort keys: err = %v", err)
+	}
+	if _, err := parseTestList(t, "sort=-title,created_at&cursor="+cursor); err == nil || !strings.Contains(err.Error(), "cursor does not match sort") {
+		t.Errorf("cursor with another sort: err = %v", err)
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	tests := map[string][]string{
+		"":          nil,
+		"a":         {"a"},
+		"a,,b":      {"a", "b"},
+		" a , b ,":  {"a", "b"},
+		",,":        nil,
+		"OPEN,DONE": {"OPEN", "DONE"},
+	}
+	for in, want := range tests {
+		if got := splitList(in); !reflect.DeepEqual(got, want) {
+			t.Errorf("splitList(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
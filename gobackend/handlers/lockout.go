@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"stuff/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	// loginFreeAttempts is how many consecutive failures are allowed before delays kick in
+	loginFreeAttempts = 3
+	// loginMaxDelay caps the progressive delay between attempts
+	loginMaxDelay = 1 * time.Minute
+	// lockoutThreshold is the number of consecutive failures that locks the account
+	lockoutThreshold = 10
+	// lockoutDuration is how long a locked account stays locked
+	lockoutDuration = 15 * time.Minute
+)
+
+// Login attempt reasons recorded in models.LoginAttempt
+const (
+	loginReasonSuccess         = "SUCCESS"
+	loginReasonMfaPending      = "MFA_PENDING"
+	loginReasonUnknownUser     = "UNKNOWN_USER"
+	loginReasonInvalidPassword = "INVALID_PASSWORD"
+	loginReasonInvalidMfa      = "INVALID_MFA_CODE"
+	loginReasonThrottled       = "THROTTLED"
+	loginReasonLocked          = "LOCKED"
+	loginReasonSSOFailed       = "SSO_FAILED"
+)
+
+// loginBlockedUntil returns when the user may try to log in again and whether that is due to a lockout
+func loginBlockedUntil(user models.User, now time.Time) (time.Time, bool) {
+	if user.LockedUntil != nil && now.Before(*user.LockedUntil) {
+		return *user.LockedUntil, true
+	}
+
+	if user.FailedLoginCount < loginFreeAttempts || user.LastFailedLoginAt == nil {
+		return time.Time{}, false
+	}
+
+	// 1s, 2s, 4s, ... after each further failure
+	exponent := float64(user.FailedLoginCount - loginFreeAttempts)
+	delay := time.Duration(math.Pow(2, exponent)) * time.Second
+	if delay > loginMaxDelay || delay <= 0 {
+		delay = loginMaxDelay
+	}
+
+	return user.LastFailedLoginAt.Add(delay), false
+}
+
+// checkLoginAllowed writes 429 (throttled) or 423 (locked) and returns false if the user must wait
+func checkLoginAllowed(w http.ResponseWriter, r *http.Request, db *gorm.DB, user models.User) bool {
+	now := time.Now()
+	until, locked := loginBlockedUntil(user, now)
+	if !now.Before(until) {
+		return true
+	}
+
+	retryAfter := int(math.Ceil(until.Sub(now).Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+
+	if locked {
+		recordLoginAttempt(db, r, user.Email, &user.Id, false, loginReasonLocked)
+		writeError(w, r, "Account temporarily locked. Please try again later.", http.StatusLocked)
+		return false
+	}
+
+	recordLoginAttempt(db, r, user.Email, &user.Id, false, loginReasonThrottled)
+	writeError(w, r, "Too many failed attempts. Please try again later.", http.StatusTooManyRequests)
+	return false
+}
+
+// registerLoginFailure counts a failed attempt and locks the account once the threshold is reached
+func registerLoginFailure(db *gorm.DB, user models.User) error {
+	now := time.Now()
+
+	err := db.Model(&models.User{}).Where("id = ?", user.Id).Updates(map[string]interface{}{
+		"failed_login_count":   gorm.Expr("failed_login_count + 1"),
+		"last_failed_login_at": &now,
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	// Lock and start counting afresh so the lock is not immediately re-triggered when it expires
+	lockedUntil := now.Add(lockoutDuration)
+	return db.Model(&models.User{}).
+		Where("id = ? AND failed_login_count >= ?", user.Id, lockoutThreshold).
+		Updates(map[string]interface{}{
+			"failed_login_count": 0,
+			"locked_until":       &lockedUntil,
+		}).Error
+}
+
+// resetLoginFailures clears the failure counter and any lock
+func resetLoginFailures(db *gorm.DB, userID uuid.UUID) error {
+	return db.Model(&models.User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+		"failed_login_count":   0,
+		"last_failed_login_at": nil,
+		"locked_until":         nil,
+	}).Error
+}
+
+// recordLoginAttempt stores an audit row; failures to write are logged but never block a login
+func recordLoginAttempt(db *gorm.DB, r *http.Request, email string, userID *uuid.UUID, success bool, reason string) {
+	userAgent := r.UserAgent()
+	if len(userAgent) > 512 {
+		userAgent = userAgent[:512]
+	}
+
+	attempt := models.LoginAttempt{
+		Id:        uuid.New(),
+		UserId:    userID,
+		Email:     email,
+		IPAddress: getClientIP(r),
+		UserAgent: userAgent,
+		Success:   success,
+		Reason:    reason,
+	}
+
+	if err := db.Create(&attempt).Error; err != nil {
+		log.Printf("failed to record login attempt for %s: %v", email, err)
+	}
+}
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"net/http"
+
+	"stuff/models"
+
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// LoginAttempts holds DB for login attempt audit handlers
+type LoginAttempts struct {
+	DB *gorm.DB
+}
+
+// loginAttemptListSpec controls filtering and sorting for GET /login-attempts
+var loginAttemptListSpec = listSpec{
+	filters: map[string]filterFunc{
+		"user_id": uuidFilter("user_id"),
+		"email":   eqFilter("email"),
+		"ip":      eqFilter("ip_address"),
+		"success": boolFilter("success"),
+		"reason":  eqFilter("reason"),
+		"since":   fromFilter("created_at"),
+		"until":   toFilter("created_at"),
+	},
+	sorts: map[string]string{
+		"created_at": "created_at",
+		"email":      "email",
+		"ip_address": "ip_address",
+	},
+	defaultSort:  "-created_at",
+	defaultLimit: 100,
+	maxLimit:     500,
+}
+
+// List godoc
+// @Summary      List login attempts
+// @Description  Newest first. Filter by user, email, IP, outcome and time range.
+// @Description  Paged with limit/offset or cursor. See X-Total-Count, X-Next-Cursor and Link.
+// @Tags         login-attempts
+// @Produce      json
+// @Param        user_id  query     string  false  "User ID"
+// @Param        email    query     string  false  "Email"
+// @Param        ip       query     string  false  "Client IP"
+// @Param        success  query     bool    false  "Only successful (true) or failed (false) attempts"
+// @Param        reason   query     string  false  "Reason, e.g. INVALID_PASSWORD or LOCKED"
+// @Param        since    query     string  false  "Lower bound (date or RFC 3339)"
+// @Param        until    query     string  false  "Upper bound (date or RFC 3339)"
+// @Param        sort     query     string  false  "created_at, email or ip_address; prefix - for descending (default -created_at)"
+// @Param        fields   query     string  false  "Fields to return, e.g. email,success,created_at"
+// @Param        limit    query     int     false  "Page size (default 100, max 500)"
+// @Param        offset   query     int     false  "Rows to skip"
+// @Param        cursor   query     string  false  "X-Next-Cursor of the previous page"
+// @Success      200  {array}   models.LoginAttempt
+// @Failure      400  {object}  Problem  "Bad request"
+// @Failure      403  {object}  Problem  "forbidden"
+// @Security     BearerAuth
+// @Router       /login-attempts [get]
+func (h LoginAttempts) List(w http.ResponseWriter, r *http.Request) {
+	serveList[models.LoginAttempt](w, r, h.DB, loginAttemptListSpec)
+}
+
+// RegisterLoginAttempts adds login attempt audit routes
+func RegisterLoginAttempts(router *mux.Router, h LoginAttempts, prefix string) {
+	router.HandleFunc(prefix, Authorize(h.List, AdminRoles)).Methods("GET")
+}
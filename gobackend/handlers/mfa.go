@@ -0,0 +1,569 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"stuff/models"
+	"stuff/totp"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const (
+	// mfaIssuer is the account issuer shown in authenticator apps
+	mfaIssuer = "YourOffice"
+	// mfaChallengeTTL is how long a user has to complete the second login step
+	mfaChallengeTTL = 5 * time.Minute
+	// mfaChallengeAudience marks challenge tokens so they are never accepted as access tokens
+	mfaChallengeAudience = "mfa_challenge"
+	// recoveryCodeCount is how many recovery codes are issued at a time
+	recoveryCodeCount = 10
+)
+
+// MFAChallengeClaims identify a user who passed the password step of a login
+type MFAChallengeClaims struct {
+	UserID string `json:"user_id"`
+	Enroll bool   `json:"enroll"`
+	jwt.RegisteredClaims
+}
+
+type MFAChallengeResponse struct {
+	MfaRequired        bool      `json:"mfa_required"`
+	EnrollmentRequired bool      `json:"enrollment_required"`
+	ChallengeToken     string    `json:"challenge_token"`
+	ExpiresAt          time.Time `json:"expires_at"`
+}
+
+type MFAChallengeRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+}
+
+type MFALoginRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"`
+	RecoveryCode   string `json:"recovery_code"`
+}
+
+type MFASetupResponse struct {
+	Secret     string `json:"secret"`
+	OtpauthURI string `json:"otpauth_uri"`
+}
+
+type MFACodeRequest struct {
+	Code string `json:"code"`
+}
+
+type MFADisableRequest struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// newMFAChallenge signs a short-lived token that can only be redeemed at /auth/login/mfa
+func newMFAChallenge(user models.User, enroll bool) (MFAChallengeResponse, error) {
+	now := time.Now()
+	expiresAt := now.Add(mfaChallengeTTL)
+
+	claims := MFAChallengeClaims{
+		UserID: user.Id.String(),
+		Enroll: enroll,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			Audience:  jwt.ClaimStrings{mfaChallengeAudience},
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+
+	signed, err := signToken(claims)
+	if err != nil {
+		return MFAChallengeResponse{}, err
+	}
+
+	return MFAChallengeResponse{
+		MfaRequired:        true,
+		EnrollmentRequired: enroll,
+		ChallengeToken:     signed,
+		ExpiresAt:          expiresAt,
+	}, nil
+}
+
+// parseMFAChallenge validates a challenge token
+func parseMFAChallenge(tokenString string) (*MFAChallengeClaims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &MFAChallengeClaims{}, verificationKeyFunc, jwt.WithAudience(mfaChallengeAudience))
+
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(*MFAChallengeClaims)
+	if !ok || !token.Valid {
+		return nil, jwt.ErrTokenInvalidClaims
+	}
+
+	return claims, nil
+}
+
+// mfaRequired reports whether a password login for user needs a second factor
+func mfaRequired(user models.User) bool {
+	return user.MfaEnabled || user.Department.RequireMfa
+}
+
+// verifyTOTP checks a code against the user's secret and records its time step so it cannot be replayed
+func verifyTOTP(db *gorm.DB, user models.User, code string) (bool, error) {
+	if user.MfaSecret == "" {
+		return false, nil
+	}
+
+	step, ok := totp.Validate(user.MfaSecret, code, time.Now())
+	if !ok || step <= user.MfaLastStep {
+		return false, nil
+	}
+
+	result := db.Model(&models.User{}).
+		Where("id = ? AND mfa_last_step < ?", user.Id, step).
+		Update("mfa_last_step", step)
+	if result.Error != nil {
+		return false, result.Error
+	}
+
+	return result.RowsAffected > 0, nil
+}
+
+// useRecoveryCode consumes one of the user's unused recovery codes
+func useRecoveryCode(db *gorm.DB, userID uuid.UUID, code string) (bool, error) {
+	result := db.Model(&models.MfaRecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hashToken(normalizeRecoveryCode(code))).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return false, result.Error
+	}
+
+	return result.RowsAffected > 0, nil
+}
+
+// generateRecoveryCodes replaces the user's recovery codes and returns the new plaintext codes
+func generateRecoveryCodes(db *gorm.DB, userID uuid.UUID) ([]string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	rows := make([]models.MfaRecoveryCode, 0, recoveryCodeCount)
+
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+
+		raw := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		code := raw[:4] + "-" + raw[4:]
+
+		codes = append(codes, code)
+		rows = append(rows, models.MfaRecoveryCode{
+			Id:       uuid.New(),
+			UserId:   userID,
+			CodeHash: hashToken(normalizeRecoveryCode(code)),
+		})
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&models.MfaRecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&rows).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// normalizeRecoveryCode makes recovery code comparison ignore case and separators
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
+
+// startMFAEnrollment stores a fresh, not yet enabled secret for the user
+func startMFAEnrollment(db *gorm.DB, user models.User) (MFASetupResponse, error) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return MFASetupResponse{}, err
+	}
+
+	if err := db.Model(&models.User{}).Where("id = ?", user.Id).Updates(map[string]interface{}{
+		"mfa_secret":    secret,
+		"mfa_last_step": 0,
+	}).Error; err != nil {
+		return MFASetupResponse{}, err
+	}
+
+	return MFASetupResponse{
+		Secret:     secret,
+		OtpauthURI: totp.URI(mfaIssuer, user.Email, secret),
+	}, nil
+}
+
+// LoginMFA godoc
+// @Summary      Complete an MFA login
+// @Description  Redeem the challenge token from /auth/login with a TOTP code or a recovery code. For enrollment challenges the code confirms the secret from /auth/login/mfa/setup and recovery codes are returned once.
+// @Tags         auth
+// @Accept       json
+// @Produce      json
+// @Param        body  body      MFALoginRequest  true  "Challenge and code"
+// @Success      200  {object}  LoginResponse
+// @Failure      400  {object}  Problem  "Invalid request"
+// @Failure      401  {object}  Problem  "Invalid code"
+// @Failure      423  {object}  Problem  "Account temporarily locked"
+// @Failure      429  {object}  Problem  "Too many failed attempts"
+// @Router       /auth/login/mfa [post]
+func (h Auth) LoginMFA(w http.ResponseWriter, r *http.Request) {
+	var req MFALoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorCode(w, r, CodeInvalidBody, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	challenge, err := parseMFAChallenge(req.ChallengeToken)
+	if err != nil {
+		writeErrorCode(w, r, CodeInvalidToken, "Invalid or expired challenge", http.StatusUnauthorized)
+		return
+	}
+
+	var user models.User
+	if err := h.DB.Preload("Department").First(&user, "id = ?", challenge.UserID).Error; err != nil {
+		writeErrorCode(w, r, CodeInvalidToken, "Invalid or expired challenge", http.StatusUnauthorized)
+		return
+	}
+
+	// Codes count towards the same lockout as passwords
+	if !checkLoginAllowed(w, r, h.DB, user) {
+		return
+	}
+
+	var valid bool
+	if req.RecoveryCode != "" && user.MfaEnabled {
+		valid, err = useRecoveryCode(h.DB, user.Id, req.RecoveryCode)
+	} else {
+		valid, err = verifyTOTP(h.DB, user, req.Code)
+	}
+
+	if err != nil {
+		writeError(w, r, "Failed to verify code", http.StatusInternalServerError)
+		return
+	}
+
+	if !valid {
+		if err := registerLoginFailure(h.DB, user); err != nil {
+			log.Printf("failed to register login failure for %s: %v", user.Email, err)
+		}
+		recordLoginAttempt(h.DB, r, user.Email, &user.Id, false, loginReasonInvalidMfa)
+		writeErrorCode(w, r, CodeInvalidCredentials, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	var recoveryCodes []string
+	if !user.MfaEnabled {
+		if !challenge.Enroll {
+			writeErrorCode(w, r, CodeInvalidToken, "Invalid or expired challenge", http.StatusUnauthorized)
+			return
+		}
+
+		if err := h.DB.Model(&models.User{}).Where("id = ?", user.Id).Update("mfa_enabled", true).Error; err != nil {
+			writeError(w, r, "Failed to enable MFA", http.StatusInternalServerError)
+			return
+		}
+
+		user.MfaEnabled = true
+		recoveryCodes, err = generateRecoveryCodes(h.DB, user.Id)
+		if err != nil {
+			writeError(w, r, "Failed to generate recovery codes", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := resetLoginFailures(h.DB, user.Id); err != nil {
+		log.Printf("failed to reset login failures for %s: %v", user.Email, err)
+	}
+	recordLoginAttempt(h.DB, r, user.Email, &user.Id, true, loginReasonSuccess)
+
+	session, err := newSession(h.DB, user)
+	if err != nil {
+		writeError(w, r, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	session.RecoveryCodes = recoveryCodes
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(session)
+}
+
+// LoginMFASetup godoc
+// @Summary      Start MFA enrollment during login
+// @Description  For users whose department requires MFA but who have not enrolled yet. Returns a new secret for the authenticator app; confirm it at /auth/login/mfa.
+// @Tags         auth
+// @Accept       json
+// @Produce      json
+// @Param        body  body      MFAChallengeRequest  true  "Enrollment challenge"
+// @Success      200  {object}  MFASetupResponse
+// @Failure      401  {object}  Problem  "Invalid or expired challenge"
+// @Router       /auth/login/mfa/setup [post]
+func (h Auth) LoginMFASetup(w http.ResponseWriter, r *http.Request) {
+	var req MFAChallengeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorCode(w, r, CodeInvalidBody, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	challenge, err := parseMFAChallenge(req.ChallengeToken)
+	if err != nil || !challenge.Enroll {
+		writeErrorCode(w, r, CodeInvalidToken, "Invalid or expired challenge", http.StatusUnauthorized)
+		return
+	}
+
+	var user models.User
+	if err := h.DB.First(&user, "id = ?", challenge.UserID).Error; err != nil || user.MfaEnabled {
+		writeErrorCode(w, r, CodeInvalidToken, "Invalid or expired challenge", http.StatusUnauthorized)
+		return
+	}
+
+	setup, err := startMFAEnrollment(h.DB, user)
+	if err != nil {
+		writeError(w, r, "Failed to start MFA enrollment", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(setup)
+}
+
+// SetupMFA godoc
+// @Summary      Start MFA enrollment
+// @Description  Generate a TOTP secret and otpauth:// URI for QR display. MFA is enabled once a code is confirmed at /auth/mfa/confirm.
+// @Tags         auth
+// @Produce      json
+// @Success      200  {object}  MFASetupResponse
+// @Failure      409  {object}  Problem  "MFA already enabled"
+// @Security     BearerAuth
+// @Router       /auth/mfa/setup [post]
+func (h Auth) SetupMFA(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	if user.MfaEnabled {
+		writeError(w, r, "MFA already enabled", http.StatusConflict)
+		return
+	}
+
+	setup, err := startMFAEnrollment(h.DB, user)
+	if err != nil {
+		writeError(w, r, "Failed to start MFA enrollment", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(setup)
+}
+
+// ConfirmMFA godoc
+// @Summary      Confirm MFA enrollment
+// @Description  Verify a code from the authenticator app, enable MFA and return recovery codes. Recovery codes are only shown once.
+// @Tags         auth
+// @Accept       json
+// @Produce      json
+// @Param        body  body      MFACodeRequest  true  "TOTP code"
+// @Success      200  {object}  RecoveryCodesResponse
+// @Failure      401  {object}  Problem  "Invalid code"
+// @Failure      409  {object}  Problem  "MFA already enabled"
+// @Security     BearerAuth
+// @Router       /auth/mfa/confirm [post]
+func (h Auth) ConfirmMFA(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	if user.MfaEnabled {
+		writeError(w, r, "MFA already enabled", http.StatusConflict)
+		return
+	}
+
+	var req MFACodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorCode(w, r, CodeInvalidBody, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	valid, err := verifyTOTP(h.DB, user, req.Code)
+	if err != nil {
+		writeError(w, r, "Failed to verify code", http.StatusInternalServerError)
+		return
+	}
+
+	if !valid {
+		writeErrorCode(w, r, CodeInvalidCredentials, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	if err := h.DB.Model(&models.User{}).Where("id = ?", user.Id).Update("mfa_enabled", true).Error; err != nil {
+		writeError(w, r, "Failed to enable MFA", http.StatusInternalServerError)
+		return
+	}
+
+	codes, err := generateRecoveryCodes(h.DB, user.Id)
+	if err != nil {
+		writeError(w, r, "Failed to generate recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// DisableMFA godoc
+// @Summary      Disable MFA
+// @Description  Turn off MFA after re-verifying the password and a current code. Not allowed when the user's department requires MFA.
+// @Tags         auth
+// @Accept       json
+// @Param        body  body      MFADisableRequest  true  "Password and TOTP code"
+// @Success      204  "No Content"
+// @Failure      401  {object}  Problem  "Invalid credentials"
+// @Failure      403  {object}  Problem  "MFA is required for your department"
+// @Security     BearerAuth
+// @Router       /auth/mfa/disable [post]
+func (h Auth) DisableMFA(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	if !user.MfaEnabled {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if user.Department.RequireMfa {
+		writeErrorCode(w, r, CodeMfaRequired, "MFA is required for your department", http.StatusForbidden)
+		return
+	}
+
+	var req MFADisableRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorCode(w, r, CodeInvalidBody, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
+		writeErrorCode(w, r, CodeInvalidCredentials, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+
+	valid, err := verifyTOTP(h.DB, user, req.Code)
+	if err != nil {
+		writeError(w, r, "Failed to verify code", http.StatusInternalServerError)
+		return
+	}
+
+	if !valid {
+		writeErrorCode(w, r, CodeInvalidCredentials, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+
+	err = h.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.User{}).Where("id = ?", user.Id).Updates(map[string]interface{}{
+			"mfa_enabled":   false,
+			"mfa_secret":    "",
+			"mfa_last_step": 0,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", user.Id).Delete(&models.MfaRecoveryCode{}).Error
+	})
+	if err != nil {
+		writeError(w, r, "Failed to disable MFA", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RegenerateRecoveryCodes godoc
+// @Summary      Regenerate MFA recovery codes
+// @Description  Replace all recovery codes after verifying a current TOTP code
+// @Tags         auth
+// @Accept       json
+// @Produce      json
+// @Param        body  body      MFACodeRequest  true  "TOTP code"
+// @Success      200  {object}  RecoveryCodesResponse
+// @Failure      401  {object}  Problem  "Invalid code"
+// @Security     BearerAuth
+// @Router       /auth/mfa/recovery-codes [post]
+func (h Auth) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.currentUser(w, r)
+	if !ok {
+		return
+	}
+
+	if !user.MfaEnabled {
+		writeError(w, r, "MFA is not enabled", http.StatusConflict)
+		return
+	}
+
+	var req MFACodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorCode(w, r, CodeInvalidBody, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	valid, err := verifyTOTP(h.DB, user, req.Code)
+	if err != nil {
+		writeError(w, r, "Failed to verify code", http.StatusInternalServerError)
+		return
+	}
+
+	if !valid {
+		writeErrorCode(w, r, CodeInvalidCredentials, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	codes, err := generateRecoveryCodes(h.DB, user.Id)
+	if err != nil {
+		writeError(w, r, "Failed to generate recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// currentUser loads the authenticated caller with their department or writes 401
+func (h Auth) currentUser(w http.ResponseWriter, r *http.Request) (models.User, bool) {
+	var user models.User
+
+	userID, ok := currentUserID(r)
+	if !ok {
+		writeError(w, r, "Unauthorized", http.StatusUnauthorized)
+		return user, false
+	}
+
+	if err := h.DB.Preload("Department").First(&user, "id = ?", userID).Error; err != nil {
+		writeError(w, r, "Unauthorized", http.StatusUnauthorized)
+		return user, false
+	}
+
+	return user, true
+}
@@ -0,0 +1,19 @@
+package handlers
+
+import "testing"
+
+func TestNormalizeRecoveryCode(t *testing.T) {
+	tests := map[string]string{
+		"abcd-efgh":     "abcdefgh",
+		" ABCD-EFGH ":   "abcdefgh",
+		"abcd efgh":     "abcdefgh",
+		"ab-cd ef-gh":   "abcdefgh",
+		"":              "",
+		"abcd-efgh-ijk": "abcdefghijk",
+	}
+	for in, want := range tests {
+		if got := normalizeRecoveryCode(in); got != want {
+			t.Errorf("normalizeRecoveryCode(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
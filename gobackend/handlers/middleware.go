@@ -2,10 +2,15 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"strings"
 
+	"stuff/models"
+
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
 )
 
 // contextKey is a type for context keys
@@ -16,60 +21,122 @@ const (
 	UserIDKey contextKey = "userID"
 	// EmailKey is the context key for email
 	EmailKey contextKey = "email"
+	// RoleKey is the context key for the user's role
+	RoleKey contextKey = "role"
+	// DepartmentIDKey is the context key for the user's department ID
+	DepartmentIDKey contextKey = "departmentID"
+	// ClaimsKey is the context key for the full access token claims
+	ClaimsKey contextKey = "claims"
+	// APITokenKey is the context key for the API token a request was authenticated with
+	APITokenKey contextKey = "apiToken"
 )
 
-// AuthMiddleware validates JWT tokens
-func AuthMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Get token from Authorization header
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			http.Error(w, "Authorization header required", http.StatusUnauthorized)
-			return
-		}
-
-		// Check if it's a Bearer token
-		parts := strings.Split(authHeader, " ")
-		if len(parts) != 2 || parts[0] != "Bearer" {
-			http.Error(w, "Invalid authorization header format", http.StatusUnauthorized)
-			return
-		}
-
-		tokenString := parts[1]
-
-		// Parse and validate token
-		token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-			// Verify signing method
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, jwt.ErrSignatureInvalid
+// AuthMiddleware validates JWT access tokens and API tokens and rejects revoked ones
+func AuthMiddleware(db *gorm.DB) mux.MiddlewareFunc {
+	return authMiddleware(db, true)
+}
+
+// SessionAuthMiddleware is AuthMiddleware for account and session endpoints, which API tokens may not use
+func SessionAuthMiddleware(db *gorm.DB) mux.MiddlewareFunc {
+	return authMiddleware(db, false)
+}
+
+func authMiddleware(db *gorm.DB, allowAPITokens bool) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Get token from Authorization header
+			authHeader := r.Header.Get("Authorization")
+			if authHeader == "" && isStreamRequest(r) {
+				// Browsers cannot set headers on EventSource or WebSocket connections
+				if token := r.URL.Query().Get("access_token"); token != "" {
+					authHeader = "Bearer " + token
+				}
+			}
+			if authHeader == "" {
+				writeError(w, r, "Authorization header required", http.StatusUnauthorized)
+				return
+			}
+
+			// Check if it's a Bearer token
+			parts := strings.Split(authHeader, " ")
+			if len(parts) != 2 || parts[0] != "Bearer" {
+				writeError(w, r, "Invalid authorization header format", http.StatusUnauthorized)
+				return
 			}
-			return getJWTSecret(), nil
+
+			if isAPIToken(parts[1]) {
+				if !allowAPITokens {
+					writeError(w, r, "API tokens cannot be used for this endpoint", http.StatusForbidden)
+					return
+				}
+
+				ctx, err := authenticateAPIToken(r.Context(), db, r, parts[1])
+				if err != nil {
+					writeErrorCode(w, r, CodeInvalidToken, "Invalid token", http.StatusUnauthorized)
+					return
+				}
+
+				next.ServeHTTP(w, r.WithContext(ctx))
+				return
+			}
+
+			// Parse and validate token
+			claims, err := parseAccessToken(parts[1])
+			if errors.Is(err, jwt.ErrTokenExpired) {
+				writeErrorCode(w, r, CodeTokenExpired, "Token has expired", http.StatusUnauthorized)
+				return
+			}
+			if err != nil {
+				writeErrorCode(w, r, CodeInvalidToken, "Invalid token", http.StatusUnauthorized)
+				return
+			}
+
+			// Reject tokens revoked by logout
+			revoked, err := isTokenRevoked(db, claims.ID)
+			if err != nil {
+				writeInternalError(w, r, err)
+				return
+			}
+
+			if revoked {
+				writeErrorCode(w, r, CodeTokenRevoked, "Token has been revoked", http.StatusUnauthorized)
+				return
+			}
+
+			// Add user info to context
+			ctx := withClaims(r.Context(), claims)
+
+			// Call next handler with updated context
+			next.ServeHTTP(w, r.WithContext(ctx))
 		})
+	}
+}
+
+// parseAccessToken parses and validates a signed access token
+func parseAccessToken(tokenString string) (*Claims, error) {
+	// The key is picked by kid and must match the token's algorithm
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, verificationKeyFunc)
+
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(*Claims)
+	if !ok || !token.Valid {
+		return nil, jwt.ErrTokenInvalidClaims
+	}
+
+	// Tokens issued before revocation support carry no ID and cannot be revoked
+	if claims.ID == "" {
+		return nil, jwt.ErrTokenInvalidId
+	}
 
-		if err != nil {
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
-			return
-		}
-
-		if !token.Valid {
-			http.Error(w, "Token is not valid", http.StatusUnauthorized)
-			return
-		}
-
-		// Extract claims
-		claims, ok := token.Claims.(*Claims)
-		if !ok {
-			http.Error(w, "Invalid token claims", http.StatusUnauthorized)
-			return
-		}
-
-		// Add user info to context
-		ctx := context.WithValue(r.Context(), UserIDKey, claims.UserID)
-		ctx = context.WithValue(ctx, EmailKey, claims.Email)
-
-		// Call next handler with updated context
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
+	// Audience-bound tokens (such as MFA challenges) are not access tokens
+	if len(claims.Audience) > 0 {
+		return nil, jwt.ErrTokenInvalidAudience
+	}
+
+	return claims, nil
 }
 
 // GetUserIDFromContext retrieves user ID from context
@@ -84,37 +151,63 @@ func GetEmailFromContext(ctx context.Context) (string, bool) {
 	return email, ok
 }
 
+// GetRoleFromContext retrieves the user's role from context
+func GetRoleFromContext(ctx context.Context) (models.Role, bool) {
+	role, ok := ctx.Value(RoleKey).(models.Role)
+	return role, ok
+}
+
+// GetDepartmentIDFromContext retrieves the user's department ID from context
+func GetDepartmentIDFromContext(ctx context.Context) (string, bool) {
+	departmentID, ok := ctx.Value(DepartmentIDKey).(string)
+	return departmentID, ok
+}
+
+// GetClaimsFromContext retrieves the access token claims from context
+func GetClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(ClaimsKey).(*Claims)
+	return claims, ok
+}
+
+// GetAPITokenFromContext retrieves the API token the request was authenticated with, if any
+func GetAPITokenFromContext(ctx context.Context) (*models.APIToken, bool) {
+	token, ok := ctx.Value(APITokenKey).(*models.APIToken)
+	return token, ok
+}
+
+// withClaims stores the identity carried by claims on the context
+func withClaims(ctx context.Context, claims *Claims) context.Context {
+	ctx = context.WithValue(ctx, UserIDKey, claims.UserID)
+	ctx = context.WithValue(ctx, EmailKey, claims.Email)
+	ctx = context.WithValue(ctx, RoleKey, models.Role(claims.Role))
+	ctx = context.WithValue(ctx, DepartmentIDKey, claims.DepartmentID)
+	ctx = context.WithValue(ctx, ClaimsKey, claims)
+	return ctx
+}
+
 // OptionalAuthMiddleware validates JWT tokens but doesn't require them
-func OptionalAuthMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		
-		// If no auth header, just continue
-		if authHeader == "" {
-			next.ServeHTTP(w, r)
-			return
-		}
-
-		// Try to parse token
-		parts := strings.Split(authHeader, " ")
-		if len(parts) == 2 && parts[0] == "Bearer" {
-			tokenString := parts[1]
-			token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-				if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-					return nil, jwt.ErrSignatureInvalid
-				}
-				return getJWTSecret(), nil
-			})
-
-			if err == nil && token.Valid {
-				if claims, ok := token.Claims.(*Claims); ok {
-					ctx := context.WithValue(r.Context(), UserIDKey, claims.UserID)
-					ctx = context.WithValue(ctx, EmailKey, claims.Email)
-					r = r.WithContext(ctx)
+func OptionalAuthMiddleware(db *gorm.DB) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authHeader := r.Header.Get("Authorization")
+
+			// If no auth header, just continue
+			if authHeader == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// Try to parse token
+			parts := strings.Split(authHeader, " ")
+			if len(parts) == 2 && parts[0] == "Bearer" {
+				if claims, err := parseAccessToken(parts[1]); err == nil {
+					if revoked, err := isTokenRevoked(db, claims.ID); err == nil && !revoked {
+						r = r.WithContext(withClaims(r.Context(), claims))
+					}
 				}
 			}
-		}
 
-		next.ServeHTTP(w, r)
-	})
+			next.ServeHTTP(w, r)
+		})
+	}
 }
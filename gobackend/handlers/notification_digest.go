@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"stuff/mailer"
+	"stuff/models"
+
+	"github.com/google/uuid"
+)
+
+// defaultDigestInterval is how often digests go out unless NOTIFICATION_DIGEST_INTERVAL says otherwise
+const defaultDigestInterval = 1 * time.Hour
+
+// getDigestInterval reads NOTIFICATION_DIGEST_INTERVAL, e.g. "30m" or "24h"
+func getDigestInterval() time.Duration {
+	if s := os.Getenv("NOTIFICATION_DIGEST_INTERVAL"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil && d > 0 {
+			return d
+		}
+		log.Printf("invalid NOTIFICATION_DIGEST_INTERVAL %q, using %s", s, defaultDigestInterval)
+	}
+	return defaultDigestInterval
+}
+
+// SendDigests starts the digest routine. Each run, every user with unread notifications
+// of types they get by email receives one email listing them. Users in quiet hours are
+// skipped until the next run after their quiet hours end.
+func (h Notifications) SendDigests() {
+	ticker := time.NewTicker(getDigestInterval())
+	go func() {
+		for range ticker.C {
+			if err := h.sendDigests(time.Now()); err != nil {
+				log.Printf("notification digest: %v", err)
+			}
+		}
+	}()
+}
+
+func (h Notifications) sendDigests(now time.Time) error {
+	var pending []models.Notification
+	err := h.DB.
+		Joins("JOIN notification_preferences p ON p.user_id = notifications.user_id AND p.type = notifications.type").
+		Where("p.channel = ? AND p.enabled", models.NotificationChannelEmail).
+		Where("notifications.read_at IS NULL AND notifications.emailed_at IS NULL").
+		Order("notifications.user_id, notifications.created_at").
+		Find(&pending).Error
+	if err != nil {
+		return err
+	}
+
+	byUser := make(map[uuid.UUID][]models.Notification)
+	for _, n := range pending {
+		byUser[n.UserId] = append(byUser[n.UserId], n)
+	}
+
+	for userID, list := range byUser {
+		settings, err := loadNotificationSettings(h.DB, userID)
+		if err != nil {
+			return err
+		}
+		if settings.InQuietHours(now) {
+			continue
+		}
+
+		var user models.User
+		if err := h.DB.First(&user, "id = ?", userID).Error; err != nil {
+			return err
+		}
+
+		if err := h.Mailer.Send(digestMessage(user, settings, list)); err != nil {
+			// Left unmarked, so the next run tries again
+			log.Printf("notification digest to %s failed: %v", user.Email, err)
+			continue
+		}
+
+		ids := make([]uuid.UUID, len(list))
+		for i, n := range list {
+			ids[i] = n.Id
+		}
+		if err := h.DB.Model(&models.Notification{}).Where("id IN ?", ids).Update("emailed_at", now).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// digestMessage renders one email listing the notifications, oldest first, in the user's time zone
+func digestMessage(user models.User, settings models.NotificationSettings, list []models.Notification) mailer.Message {
+	loc, err := time.LoadLocation(settings.TimeZone)
+	if err != nil {
+		loc = time.Local
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Hi %s,\n\n", user.Name)
+	if len(list) == 1 {
+		b.WriteString("You have an unread notification in YourOffice:\n\n")
+	} else {
+		fmt.Fprintf(&b, "You have %d unread notifications in YourOffice:\n\n", len(list))
+	}
+
+	for _, n := range list {
+		fmt.Fprintf(&b, "- %s (%s)\n  %s\n\n", n.Title, n.CreatedAt.In(loc).Format("2006-01-02 15:04"), n.Message)
+	}
+
+	b.WriteString("Open YourOffice to see them: " + getAppBaseURL() + "\n\n")
+	b.WriteString("You get this email because email is turned on in your notification preferences.\n")
+
+	subject := "1 unread notification"
+	if len(list) != 1 {
+		subject = fmt.Sprintf("%d unread notifications", len(list))
+	}
+
+	return mailer.Message{
+		To:      user.Email,
+		Subject: "YourOffice: " + subject,
+		Body:    b.String(),
+	}
+}
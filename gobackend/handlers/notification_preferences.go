@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"stuff/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// defaultTimeZone is used for quiet hours until a user picks a zone
+const defaultTimeZone = "Europe/Copenhagen"
+
+// notificationTypes lists every type a preference can be set for
+var notificationTypes = []models.NotificationType{
+	models.NotificationTypeTicketAssigned,
+	models.NotificationTypeTicketUpdated,
+	models.NotificationTypeTicketCommented,
+	models.NotificationTypeAbsenceApproved,
+	models.NotificationTypeAbsenceRejected,
+	models.NotificationTypeAbsenceCommented,
+	models.NotificationTypeShiftCreated,
+	models.NotificationTypeShiftCancelled,
+	models.NotificationTypeFeedbackReceived,
+	models.NotificationTypeSystemAnnouncement,
+	models.NotificationTypeTicketSLABreached,
+	models.NotificationTypeTicketMentioned,
+}
+
+// notificationChannels lists every delivery channel
+var notificationChannels = []models.NotificationChannel{
+	models.NotificationChannelInApp,
+	models.NotificationChannelEmail,
+	models.NotificationChannelPush,
+}
+
+type NotificationPreferenceEntry struct {
+	Type    models.NotificationType    `json:"type"`
+	Channel models.NotificationChannel `json:"channel"`
+	Enabled bool                       `json:"enabled"`
+}
+
+type NotificationSettingsRequest struct {
+	QuietHoursStart string `json:"quiet_hours_start"` // "22:00", empty to turn quiet hours off
+	QuietHoursEnd   string `json:"quiet_hours_end"`   // "07:00"
+	TimeZone        string `json:"time_zone"`         // IANA name, defaults to Europe/Copenhagen
+}
+
+// GetPreferences godoc
+// @Summary      Get my notification preferences
+// @Description  Every type and channel with its effective setting. IN_APP and PUSH are on and EMAIL is off unless changed. Turning IN_APP off mutes the type on every channel.
+// @Tags         notifications
+// @Produce      json
+// @Success      200  {array}   NotificationPreferenceEntry
+// @Security     BearerAuth
+// @Router       /notifications/preferences [get]
+func (h Notifications) GetPreferences(w http.ResponseWriter, r *http.Request) {
+	userID, _ := currentUserID(r)
+
+	entries, err := h.preferences(userID)
+	if err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// UpdatePreferences godoc
+// @Summary      Change my notification preferences
+// @Description  Only the listed type/channel pairs change; the rest keep their setting
+// @Tags         notifications
+// @Accept       json
+// @Produce      json
+// @Param        preferences  body      []NotificationPreferenceEntry  true  "Preferences to change"
+// @Success      200  {array}   NotificationPreferenceEntry
+// @Failure      400  {object}  Problem  "invalid type or channel"
+// @Security     BearerAuth
+// @Router       /notifications/preferences [put]
+func (h Notifications) UpdatePreferences(w http.ResponseWriter, r *http.Request) {
+	userID, _ := currentUserID(r)
+
+	var req []NotificationPreferenceEntry
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+
+	rows := make([]models.NotificationPreference, 0, len(req))
+	for _, e := range req {
+		if !e.Type.Valid() {
+			writeValidation(w, r, FieldError{Field: "type", Code: FieldInvalid, Message: "invalid notification type " + e.Type.String()})
+			return
+		}
+		if !e.Channel.Valid() {
+			writeValidation(w, r, FieldError{Field: "channel", Code: FieldInvalid, Message: "invalid channel " + e.Channel.String()})
+			return
+		}
+
+		rows = append(rows, models.NotificationPreference{
+			Id:      uuid.New(),
+			UserId:  userID,
+			Type:    e.Type,
+			Channel: e.Channel,
+			Enabled: e.Enabled,
+		})
+	}
+
+	if len(rows) > 0 {
+		err := h.DB.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "user_id"}, {Name: "type"}, {Name: "channel"}},
+			DoUpdates: clause.AssignmentColumns([]string{"enabled", "updated_at"}),
+		}).Create(&rows).Error
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+	}
+
+	entries, err := h.preferences(userID)
+	if err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// GetSettings godoc
+// @Summary      Get my quiet hours
+// @Tags         notifications
+// @Produce      json
+// @Success      200  {object}  models.NotificationSettings
+// @Security     BearerAuth
+// @Router       /notifications/settings [get]
+func (h Notifications) GetSettings(w http.ResponseWriter, r *http.Request) {
+	userID, _ := currentUserID(r)
+
+	settings, err := loadNotificationSettings(h.DB, userID)
+	if err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+// UpdateSettings godoc
+// @Summary      Set my quiet hours
+// @Description  During quiet hours nothing is pushed and email digests wait until they end. Notifications are still stored.
+// @Tags         notifications
+// @Accept       json
+// @Produce      json
+// @Param        settings  body      NotificationSettingsRequest  true  "Quiet hours"
+// @Success      200  {object}  models.NotificationSettings
+// @Failure      400  {object}  Problem  "invalid quiet hours or time zone"
+// @Security     BearerAuth
+// @Router       /notifications/settings [put]
+func (h Notifications) UpdateSettings(w http.ResponseWriter, r *http.Request) {
+	userID, _ := currentUserID(r)
+
+	var req NotificationSettingsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+
+	if (req.QuietHoursStart == "") != (req.QuietHoursEnd == "") {
+		writeValidation(w, r,
+			FieldError{Field: "quiet_hours_start", Code: FieldRequired, Message: "set both quiet_hours_start and quiet_hours_end, or neither"},
+			FieldError{Field: "quiet_hours_end", Code: FieldRequired, Message: "set both quiet_hours_start and quiet_hours_end, or neither"})
+		return
+	}
+
+	for field, s := range map[string]string{"quiet_hours_start": req.QuietHoursStart, "quiet_hours_end": req.QuietHoursEnd} {
+		if _, err := time.Parse("15:04", s); s != "" && err != nil {
+			writeValidation(w, r, FieldError{Field: field, Code: FieldInvalid, Message: "must be HH:MM"})
+			return
+		}
+	}
+
+	if req.TimeZone == "" {
+		req.TimeZone = defaultTimeZone
+	}
+	if _, err := time.LoadLocation(req.TimeZone); err != nil {
+		writeValidation(w, r, FieldError{Field: "time_zone", Code: FieldUnknown, Message: "unknown time zone"})
+		return
+	}
+
+	settings := models.NotificationSettings{
+		UserId:          userID,
+		QuietHoursStart: req.QuietHoursStart,
+		QuietHoursEnd:   req.QuietHoursEnd,
+		TimeZone:        req.TimeZone,
+	}
+
+	if err := h.DB.Save(&settings).Error; err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+// preferences returns the effective setting of every type and channel for the user
+func (h Notifications) preferences(userID uuid.UUID) ([]NotificationPreferenceEntry, error) {
+	var saved []models.NotificationPreference
+	if err := h.DB.Where("user_id = ?", userID).Find(&saved).Error; err != nil {
+		return nil, err
+	}
+
+	type key struct {
+		t models.NotificationType
+		c models.NotificationChannel
+	}
+	enabled := make(map[key]bool, len(saved))
+	for _, p := range saved {
+		enabled[key{p.Type, p.Channel}] = p.Enabled
+	}
+
+	entries := make([]NotificationPreferenceEntry, 0, len(notificationTypes)*len(notificationChannels))
+	for _, t := range notificationTypes {
+		for _, c := range notificationChannels {
+			on, ok := enabled[key{t, c}]
+			if !ok {
+				on = c.DefaultEnabled()
+			}
+			entries = append(entries, NotificationPreferenceEntry{Type: t, Channel: c, Enabled: on})
+		}
+	}
+	return entries, nil
+}
+
+// loadNotificationSettings returns the user's settings, or the defaults if none are saved
+func loadNotificationSettings(db *gorm.DB, userID uuid.UUID) (models.NotificationSettings, error) {
+	settings := models.NotificationSettings{UserId: userID, TimeZone: defaultTimeZone}
+
+	err := db.First(&settings, "user_id = ?", userID).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return settings, err
+	}
+	return settings, nil
+}
@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"stuff/models"
+	"stuff/realtime"
+
+	"github.com/google/uuid"
+	"golang.org/x/net/websocket"
+	"gorm.io/gorm"
+)
+
+const (
+	// streamPingInterval keeps idle streams open through proxies
+	streamPingInterval = 25 * time.Second
+	// streamReplayLimit caps how many missed notifications are replayed on resume
+	streamReplayLimit = 200
+	// streamRetry is the reconnect delay suggested to EventSource clients
+	streamRetry = 5 * time.Second
+)
+
+// StreamMessage is a WebSocket frame: a notification, or a ping on idle connections
+type StreamMessage struct {
+	Event        string               `json:"event"` // "notification" or "ping"
+	Notification *models.Notification `json:"notification,omitempty"`
+}
+
+// isStreamRequest reports whether the request opens an SSE or WebSocket stream
+func isStreamRequest(r *http.Request) bool {
+	return r.Method == http.MethodGet && (isWebSocketRequest(r) || strings.Contains(r.Header.Get("Accept"), "text/event-stream"))
+}
+
+func isWebSocketRequest(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// Stream godoc
+// @Summary      Stream my notifications
+// @Description  Pushes new notifications as Server-Sent Events (event "notification", id = notification ID). Send "Upgrade: websocket" to get the same stream as WebSocket JSON frames instead.
+// @Description  Reconnect with Last-Event-ID (or ?last_event_id=) to receive what was missed. Browsers may pass the access token as ?access_token=.
+// @Description  The stream ends when the access token expires or the client falls too far behind; reconnect and resume.
+// @Tags         notifications
+// @Produce      text/event-stream
+// @Param        Last-Event-ID  header    string  false  "ID of the last notification received"
+// @Param        last_event_id  query     string  false  "Same as Last-Event-ID, for WebSocket clients"
+// @Success      200  {string}  string  "event stream"
+// @Failure      400  {object}  Problem  "invalid Last-Event-ID"
+// @Security     BearerAuth
+// @Router       /notifications/stream [get]
+func (h Notifications) Stream(w http.ResponseWriter, r *http.Request) {
+	userID, _ := currentUserID(r)
+
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+
+	var since *models.Notification
+	if lastID != "" {
+		id, err := uuid.Parse(lastID)
+		if err != nil {
+			writeErrorCode(w, r, CodeInvalidQuery, "invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+
+		var last models.Notification
+		err = h.DB.First(&last, "id = ? AND user_id = ?", id, userID).Error
+		if err != nil && err != gorm.ErrRecordNotFound {
+			writeDBError(w, r, err)
+			return
+		}
+		// An unknown or deleted ID resumes from now
+		if err == nil {
+			since = &last
+		}
+	}
+
+	// Subscribe before replaying so nothing created in between is lost
+	sub := h.Hub.Subscribe(userID)
+	defer sub.Close()
+
+	var missed []models.Notification
+	if since != nil {
+		err := h.DB.Where("user_id = ?", userID).
+			Where("created_at > ? OR (created_at = ? AND id > ?)", since.CreatedAt, since.CreatedAt, since.Id).
+			Order("created_at, id").
+			Limit(streamReplayLimit).
+			Find(&missed).Error
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+	}
+
+	// End the stream when the access token expires; the client reconnects with a fresh one
+	ctx := r.Context()
+	if claims, ok := ctx.Value(ClaimsKey).(*Claims); ok && claims.ExpiresAt != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, claims.ExpiresAt.Time)
+		defer cancel()
+	}
+
+	if isWebSocketRequest(r) {
+		h.streamWebSocket(ctx, w, r, sub, missed)
+		return
+	}
+	h.streamSSE(ctx, w, sub, missed)
+}
+
+// streamSSE writes the stream as text/event-stream
+func (h Notifications) streamSSE(ctx context.Context, w http.ResponseWriter, sub *realtime.Subscription, missed []models.Notification) {
+	rc := http.NewResponseController(w)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // nginx must not buffer the stream
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := fmt.Fprintf(w, "retry: %d\n\n", streamRetry.Milliseconds()); err != nil {
+		return
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	send := func(n models.Notification) error {
+		data, err := json.Marshal(n)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "id: %s\nevent: notification\ndata: %s\n\n", n.Id, data); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	ping := func() error {
+		if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	pumpNotifications(ctx, sub, missed, send, ping)
+}
+
+// streamWebSocket upgrades the connection and writes the stream as JSON frames
+func (h Notifications) streamWebSocket(ctx context.Context, w http.ResponseWriter, r *http.Request, sub *realtime.Subscription, missed []models.Notification) {
+	server := websocket.Server{
+		// Connections are authenticated by token, not cookies, so any origin may connect
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+
+			// The client does not send anything; reading only notices when it goes away
+			go func() {
+				defer cancel()
+				var discard []byte
+				for websocket.Message.Receive(ws, &discard) == nil {
+				}
+			}()
+
+			send := func(n models.Notification) error {
+				return websocket.JSON.Send(ws, StreamMessage{Event: "notification", Notification: &n})
+			}
+
+			ping := func() error {
+				return websocket.JSON.Send(ws, StreamMessage{Event: "ping"})
+			}
+
+			pumpNotifications(ctx, sub, missed, send, ping)
+		},
+	}
+
+	server.ServeHTTP(w, r)
+}
+
+// pumpNotifications sends the missed notifications, then live ones, until ctx ends,
+// the subscription is dropped or a write fails
+func pumpNotifications(ctx context.Context, sub *realtime.Subscription, missed []models.Notification, send func(models.Notification) error, ping func() error) {
+	replayed := make(map[uuid.UUID]bool, len(missed))
+	for _, n := range missed {
+		if err := send(n); err != nil {
+			return
+		}
+		replayed[n.Id] = true
+	}
+
+	ticker := time.NewTicker(streamPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if replayed[n.Id] {
+				continue
+			}
+			if err := send(n); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := ping(); err != nil {
+				return
+			}
+		}
+	}
+}
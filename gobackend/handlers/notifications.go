@@ -0,0 +1,227 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"stuff/mailer"
+	"stuff/models"
+	"stuff/realtime"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// Notifications holds DB for notification handlers, the hub that streams new ones and the mailer for digests
+type Notifications struct {
+	DB     *gorm.DB
+	Hub    *realtime.Hub
+	Mailer mailer.Mailer
+}
+
+type UnreadCountResponse struct {
+	Count int64 `json:"count"`
+}
+
+// notificationListSpec controls filtering and sorting for GET /notifications
+var notificationListSpec = listSpec{
+	filters: map[string]filterFunc{
+		"unread": nullFilter("read_at"),
+		"type":   enumFilter("type", func(s string) bool { return models.NotificationType(s).Valid() }),
+		"from":   fromFilter("created_at"),
+		"to":     toFilter("created_at"),
+	},
+	sorts: map[string]string{
+		"created_at": "created_at",
+	},
+	defaultSort: "-created_at",
+}
+
+// List godoc
+// @Summary      List my notifications
+// @Description  The caller's notifications, newest first. Paged with limit/offset or cursor. See X-Total-Count, X-Next-Cursor and Link.
+// @Tags         notifications
+// @Produce      json
+// @Param        unread  query     bool    false  "Only unread notifications"
+// @Param        type    query     string  false  "Notification type, e.g. TICKET_ASSIGNED; comma-separated for several"
+// @Param        from    query     string  false  "Created at or after (date or RFC 3339)"
+// @Param        to      query     string  false  "Created at or before (date or RFC 3339)"
+// @Param        sort    query     string  false  "created_at; prefix - for descending (default -created_at)"
+// @Param        fields  query     string  false  "Fields to return, e.g. id,title,read_at"
+// @Param        limit   query     int     false  "Page size (default 50, max 200)"
+// @Param        offset  query     int     false  "Number of notifications to skip"
+// @Param        cursor  query     string  false  "X-Next-Cursor of the previous page"
+// @Success      200  {array}   models.Notification
+// @Failure      400  {object}  Problem  "invalid query"
+// @Security     BearerAuth
+// @Router       /notifications [get]
+func (h Notifications) List(w http.ResponseWriter, r *http.Request) {
+	userID, _ := currentUserID(r)
+
+	serveList[models.Notification](w, r, h.DB.Where("user_id = ?", userID), notificationListSpec)
+}
+
+// UnreadCount godoc
+// @Summary      Count my unread notifications
+// @Tags         notifications
+// @Produce      json
+// @Success      200  {object}  UnreadCountResponse
+// @Security     BearerAuth
+// @Router       /notifications/unread-count [get]
+func (h Notifications) UnreadCount(w http.ResponseWriter, r *http.Request) {
+	userID, _ := currentUserID(r)
+
+	var count int64
+	err := h.DB.Model(&models.Notification{}).
+		Where("user_id = ? AND read_at IS NULL", userID).
+		Count(&count).Error
+	if err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(UnreadCountResponse{Count: count})
+}
+
+// GetByID godoc
+// @Summary      Get one of my notifications
+// @Tags         notifications
+// @Produce      json
+// @Param        id   path      string  true  "Notification ID"
+// @Success      200  {object}  models.Notification
+// @Failure      404  {object}  Problem  "notification not found"
+// @Security     BearerAuth
+// @Router       /notifications/{id} [get]
+func (h Notifications) GetByID(w http.ResponseWriter, r *http.Request) {
+	id, ok := uuidParam(w, r, "id")
+	if !ok {
+		return
+	}
+
+	n, ok := h.find(w, r, id)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(n)
+}
+
+// MarkRead godoc
+// @Summary      Mark a notification as read
+// @Tags         notifications
+// @Produce      json
+// @Param        id   path      string  true  "Notification ID"
+// @Success      200  {object}  models.Notification
+// @Failure      404  {object}  Problem  "notification not found"
+// @Security     BearerAuth
+// @Router       /notifications/{id}/read [put]
+func (h Notifications) MarkRead(w http.ResponseWriter, r *http.Request) {
+	id, ok := uuidParam(w, r, "id")
+	if !ok {
+		return
+	}
+
+	n, ok := h.find(w, r, id)
+	if !ok {
+		return
+	}
+
+	// Keep the first read time
+	if n.ReadAt == nil {
+		now := time.Now()
+		if err := h.DB.Model(&n).Update("read_at", &now).Error; err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+		n.ReadAt = &now
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(n)
+}
+
+// MarkAllRead godoc
+// @Summary      Mark all my notifications as read
+// @Tags         notifications
+// @Success      204  "No Content"
+// @Security     BearerAuth
+// @Router       /notifications/read-all [put]
+func (h Notifications) MarkAllRead(w http.ResponseWriter, r *http.Request) {
+	userID, _ := currentUserID(r)
+
+	err := h.DB.Model(&models.Notification{}).
+		Where("user_id = ? AND read_at IS NULL", userID).
+		Update("read_at", time.Now()).Error
+	if err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Delete godoc
+// @Summary      Delete one of my notifications
+// @Tags         notifications
+// @Param        id   path      string  true  "Notification ID"
+// @Success      204  "No Content"
+// @Failure      404  {object}  Problem  "notification not found"
+// @Security     BearerAuth
+// @Router       /notifications/{id} [delete]
+func (h Notifications) Delete(w http.ResponseWriter, r *http.Request) {
+	id, ok := uuidParam(w, r, "id")
+	if !ok {
+		return
+	}
+
+	userID, _ := currentUserID(r)
+
+	result := h.DB.Where("id = ? AND user_id = ?", id, userID).Delete(&models.Notification{})
+	if result.Error != nil {
+		writeDBError(w, r, result.Error)
+		return
+	}
+
+	if result.RowsAffected == 0 {
+		writeError(w, r, "notification not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// find loads a notification owned by the caller, writing 404 for anyone else's
+func (h Notifications) find(w http.ResponseWriter, r *http.Request, id uuid.UUID) (models.Notification, bool) {
+	userID, _ := currentUserID(r)
+
+	var n models.Notification
+	if err := h.DB.First(&n, "id = ? AND user_id = ?", id, userID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			writeError(w, r, "notification not found", http.StatusNotFound)
+			return n, false
+		}
+		writeDBError(w, r, err)
+		return n, false
+	}
+
+	return n, true
+}
+
+// RegisterNotifications registers notification routes; every route is scoped to the caller's own notifications
+func RegisterNotifications(router *mux.Router, h Notifications, prefix string) {
+	router.HandleFunc(prefix, AuthorizeScoped(h.List, AnyRole, ScopeNotificationsRead)).Methods("GET")
+	router.HandleFunc(prefix+"/unread-count", AuthorizeScoped(h.UnreadCount, AnyRole, ScopeNotificationsRead)).Methods("GET")
+	router.HandleFunc(prefix+"/read-all", AuthorizeScoped(h.MarkAllRead, AnyRole, ScopeNotificationsWrite)).Methods("PUT")
+	router.HandleFunc(prefix+"/stream", AuthorizeScoped(h.Stream, AnyRole, ScopeNotificationsRead)).Methods("GET")
+	router.HandleFunc(prefix+"/preferences", AuthorizeScoped(h.GetPreferences, AnyRole, ScopeNotificationsRead)).Methods("GET")
+	router.HandleFunc(prefix+"/preferences", AuthorizeScoped(h.UpdatePreferences, AnyRole, ScopeNotificationsWrite)).Methods("PUT")
+	router.HandleFunc(prefix+"/settings", AuthorizeScoped(h.GetSettings, AnyRole, ScopeNotificationsRead)).Methods("GET")
+	router.HandleFunc(prefix+"/settings", AuthorizeScoped(h.UpdateSettings, AnyRole, ScopeNotificationsWrite)).Methods("PUT")
+	router.HandleFunc(prefix+"/{id}", AuthorizeScoped(h.GetByID, AnyRole, ScopeNotificationsRead)).Methods("GET")
+	router.HandleFunc(prefix+"/{id}/read", AuthorizeScoped(h.MarkRead, AnyRole, ScopeNotificationsWrite)).Methods("PUT")
+	router.HandleFunc(prefix+"/{id}", AuthorizeScoped(h.Delete, AnyRole, ScopeNotificationsWrite)).Methods("DELETE")
+}
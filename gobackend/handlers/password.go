@@ -0,0 +1,273 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"stuff/mailer"
+	"stuff/models"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// passwordResetTTL is how long a password reset link stays valid
+const passwordResetTTL = 1 * time.Hour
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// getAppBaseURL returns the public URL of the frontend used in emailed links
+func getAppBaseURL() string {
+	base := os.Getenv("APP_BASE_URL")
+	if base == "" {
+		base = "http://localhost:8080"
+	}
+	return base
+}
+
+// ForgotPassword godoc
+// @Summary      Request a password reset
+// @Description  Email a single-use reset link if an account exists. Always answers 202 so account existence is not revealed.
+// @Tags         auth
+// @Accept       json
+// @Param        body  body      ForgotPasswordRequest  true  "Account email"
+// @Success      202  "Accepted"
+// @Failure      400  {object}  Problem  "Invalid request"
+// @Router       /auth/password/forgot [post]
+func (h Auth) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req ForgotPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorCode(w, r, CodeInvalidBody, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	req.Email = SanitizeInput(req.Email)
+	if !ValidateEmail(req.Email) {
+		writeValidation(w, r, FieldError{Field: "email", Code: FieldInvalid, Message: "Invalid email format"})
+		return
+	}
+
+	var user models.User
+	if err := h.DB.First(&user, "email = ?", req.Email).Error; err != nil {
+		if err != gorm.ErrRecordNotFound {
+			writeError(w, r, "Failed to process request", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	token, err := newOpaqueToken()
+	if err != nil {
+		writeError(w, r, "Failed to process request", http.StatusInternalServerError)
+		return
+	}
+
+	err = h.DB.Transaction(func(tx *gorm.DB) error {
+		// Only the most recent link is valid
+		now := time.Now()
+		if err := tx.Model(&models.PasswordResetToken{}).
+			Where("user_id = ? AND used_at IS NULL", user.Id).
+			Update("used_at", &now).Error; err != nil {
+			return err
+		}
+
+		return tx.Create(&models.PasswordResetToken{
+			Id:        uuid.New(),
+			UserId:    user.Id,
+			TokenHash: hashToken(token),
+			ExpiresAt: now.Add(passwordResetTTL),
+		}).Error
+	})
+	if err != nil {
+		writeError(w, r, "Failed to process request", http.StatusInternalServerError)
+		return
+	}
+
+	link := getAppBaseURL() + "/reset-password?token=" + url.QueryEscape(token)
+	msg := mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your YourOffice password",
+		Body: "Hi " + user.Name + ",\n\n" +
+			"Someone asked to reset the password for your YourOffice account.\n" +
+			"Use the link below within one hour to choose a new password:\n\n" +
+			link + "\n\n" +
+			"If this wasn't you, you can ignore this email.\n",
+	}
+
+	if err := h.Mailer.Send(msg); err != nil {
+		log.Printf("password reset mail to %s failed: %v", user.Email, err)
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ResetPassword godoc
+// @Summary      Reset password with a token
+// @Description  Set a new password using the token from a reset email. The token is single-use and all sessions are revoked.
+// @Tags         auth
+// @Accept       json
+// @Param        body  body      ResetPasswordRequest  true  "Reset token and new password"
+// @Success      204  "No Content"
+// @Failure      400  {object}  Problem  "Invalid or expired token"
+// @Router       /auth/password/reset [post]
+func (h Auth) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		writeErrorCode(w, r, CodeInvalidBody, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if valid, msg := ValidatePassword(req.NewPassword); !valid {
+		writeValidation(w, r, FieldError{Field: "new_password", Code: FieldInvalid, Message: msg})
+		return
+	}
+
+	var reset models.PasswordResetToken
+	if err := h.DB.First(&reset, "token_hash = ?", hashToken(req.Token)).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			writeErrorCode(w, r, CodeInvalidToken, "Invalid or expired token", http.StatusBadRequest)
+			return
+		}
+		writeError(w, r, "Failed to reset password", http.StatusInternalServerError)
+		return
+	}
+
+	if reset.UsedAt != nil || time.Now().After(reset.ExpiresAt) {
+		writeErrorCode(w, r, CodeInvalidToken, "Invalid or expired token", http.StatusBadRequest)
+		return
+	}
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		writeError(w, r, "Failed to hash password", http.StatusInternalServerError)
+		return
+	}
+
+	errUsed := errors.New("reset token already used")
+	err = h.DB.Transaction(func(tx *gorm.DB) error {
+		// Consume the token atomically so it cannot be replayed concurrently
+		result := tx.Model(&models.PasswordResetToken{}).
+			Where("id = ? AND used_at IS NULL", reset.Id).
+			Update("used_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errUsed
+		}
+
+		if err := setPassword(tx, reset.UserId, string(hashed)); err != nil {
+			return err
+		}
+
+		// The reset link went to the user's email, so they evidently receive mail there
+		return tx.Model(&models.User{}).
+			Where("id = ? AND email_verified_at IS NULL", reset.UserId).
+			Update("email_verified_at", time.Now()).Error
+	})
+
+	if err == errUsed {
+		writeErrorCode(w, r, CodeInvalidToken, "Invalid or expired token", http.StatusBadRequest)
+		return
+	}
+
+	if err != nil {
+		writeError(w, r, "Failed to reset password", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ChangePassword godoc
+// @Summary      Change password
+// @Description  Change the caller's password after re-verifying the current one. Every refresh token of the user is revoked, including the caller's, so every session must sign in again with the new password.
+// @Tags         auth
+// @Accept       json
+// @Param        body  body      ChangePasswordRequest  true  "Current and new password"
+// @Success      204  "No Content"
+// @Failure      400  {object}  Problem  "Invalid request"
+// @Failure      401  {object}  Problem  "Current password is incorrect"
+// @Security     BearerAuth
+// @Router       /auth/password/change [post]
+func (h Auth) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	userID, ok := currentUserID(r)
+	if !ok {
+		writeError(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeErrorCode(w, r, CodeInvalidBody, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	var user models.User
+	if err := h.DB.First(&user, "id = ?", userID).Error; err != nil {
+		writeError(w, r, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.CurrentPassword)); err != nil {
+		writeErrorCode(w, r, CodeInvalidCredentials, "Current password is incorrect", http.StatusUnauthorized)
+		return
+	}
+
+	if valid, msg := ValidatePassword(req.NewPassword); !valid {
+		writeValidation(w, r, FieldError{Field: "new_password", Code: FieldInvalid, Message: msg})
+		return
+	}
+
+	if req.NewPassword == req.CurrentPassword {
+		writeValidation(w, r, FieldError{Field: "new_password", Code: FieldInvalid, Message: "must differ from the current password"})
+		return
+	}
+
+	hashed, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		writeError(w, r, "Failed to hash password", http.StatusInternalServerError)
+		return
+	}
+
+	if err := setPassword(h.DB, user.Id, string(hashed)); err != nil {
+		writeError(w, r, "Failed to change password", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setPassword stores a new password hash, lifts any login lock and revokes every refresh token of the user
+func setPassword(db *gorm.DB, userID uuid.UUID, passwordHash string) error {
+	if err := db.Model(&models.User{}).Where("id = ?", userID).Update("password_hash", passwordHash).Error; err != nil {
+		return err
+	}
+
+	if err := resetLoginFailures(db, userID); err != nil {
+		return err
+	}
+
+	return db.Model(&models.RefreshToken{}).
+		Where("user_id = ? AND revoked_at IS NULL", userID).
+		Update("revoked_at", time.Now()).Error
+}
@@ -0,0 +1,282 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+)
+
+// Problem is an RFC 7807 error response, sent as application/problem+json
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	Code      string       `json:"code"`                 // stable, machine-readable, e.g. "not_found"
+	RequestID string       `json:"request_id,omitempty"` // matches the X-Request-ID response header
+	Errors    []FieldError `json:"errors,omitempty"`     // set for validation errors
+}
+
+// FieldError describes what is wrong with one field of a request
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error codes. Clients may depend on these; the detail text may change.
+const (
+	CodeBadRequest         = "bad_request"
+	CodeInvalidBody        = "invalid_body"
+	CodeInvalidQuery       = "invalid_query"
+	CodeValidationFailed   = "validation_failed"
+	CodeUnauthorized       = "unauthorized"
+	CodeInvalidCredentials = "invalid_credentials"
+	CodeInvalidToken       = "invalid_token"
+	CodeTokenExpired       = "token_expired"
+	CodeTokenRevoked       = "token_revoked"
+	CodeForbidden          = "forbidden"
+	CodeMissingScope       = "missing_scope"
+	CodeMfaRequired        = "mfa_required"
+	CodeNotFound           = "not_found"
+	CodeConflict           = "conflict"
+	CodeAlreadyExists      = "already_exists"
+	CodeInvalidReference   = "invalid_reference"
+	CodeInvalidTransition  = "invalid_transition"
+	CodePayloadTooLarge    = "payload_too_large"
+	CodeUnsupportedMedia   = "unsupported_media_type"
+	CodeFileInfected       = "file_infected"
+	CodeAccountLocked      = "account_locked"
+	CodeRateLimited        = "rate_limited"
+	CodeInternal           = "internal_error"
+	CodeUpstream           = "upstream_error"
+)
+
+// Field error codes
+const (
+	FieldRequired = "required"
+	FieldInvalid  = "invalid"
+	FieldTooLong  = "too_long"
+	FieldTaken    = "taken"
+	FieldUnknown  = "unknown"
+)
+
+// RequestIDKey is the context key for the request ID
+const RequestIDKey contextKey = "requestID"
+
+// requestIDPattern limits the request IDs accepted from clients and proxies
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// RequestID gives every request an ID, taken from X-Request-ID when the client or proxy
+// sent a sensible one. It is echoed in the X-Request-ID response header, in problem
+// responses and in server-side error logs.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			id = uuid.NewString()
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), RequestIDKey, id)))
+	})
+}
+
+// requestID returns the ID RequestID gave the request
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(RequestIDKey).(string)
+	return id
+}
+
+// codeForStatus is the code used when a handler does not give a more specific one
+func codeForStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return CodeBadRequest
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusRequestEntityTooLarge:
+		return CodePayloadTooLarge
+	case http.StatusUnsupportedMediaType:
+		return CodeUnsupportedMedia
+	case http.StatusUnprocessableEntity:
+		return CodeValidationFailed
+	case http.StatusLocked:
+		return CodeAccountLocked
+	case http.StatusTooManyRequests:
+		return CodeRateLimited
+	case http.StatusBadGateway:
+		return CodeUpstream
+	}
+	if status >= 500 {
+		return CodeInternal
+	}
+	return CodeBadRequest
+}
+
+// writeProblem fills in the common members and writes p
+func writeProblem(w http.ResponseWriter, r *http.Request, p Problem) {
+	if p.Type == "" {
+		p.Type = "about:blank"
+	}
+	if p.Title == "" {
+		p.Title = http.StatusText(p.Status)
+	}
+	if p.Code == "" {
+		p.Code = codeForStatus(p.Status)
+	}
+	p.Instance = r.URL.Path
+	p.RequestID = requestID(r)
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// NotFound answers requests for routes that do not exist
+func NotFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, "no such endpoint", http.StatusNotFound)
+}
+
+// MethodNotAllowed answers requests with a method the route does not support
+func MethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeErrorCode(w, r, "method_not_allowed", r.Method+" is not supported here", http.StatusMethodNotAllowed)
+}
+
+// writeError is http.Error for problem responses, with the code taken from the status
+func writeError(w http.ResponseWriter, r *http.Request, detail string, status int) {
+	writeProblem(w, r, Problem{Status: status, Detail: detail})
+}
+
+// writeErrorCode is writeError with a specific code
+func writeErrorCode(w http.ResponseWriter, r *http.Request, code, detail string, status int) {
+	writeProblem(w, r, Problem{Status: status, Code: code, Detail: detail})
+}
+
+// writeValidation answers 422 with the fields that failed validation
+func writeValidation(w http.ResponseWriter, r *http.Request, errs ...FieldError) {
+	detail := "the request has invalid fields"
+	if len(errs) == 1 {
+		detail = errs[0].Field + ": " + errs[0].Message
+	}
+	writeProblem(w, r, Problem{Status: http.StatusUnprocessableEntity, Code: CodeValidationFailed, Detail: detail, Errors: errs})
+}
+
+// writeBodyError answers a request body that could not be decoded.
+// Type mismatches name the field instead of the Go types involved.
+func writeBodyError(w http.ResponseWriter, r *http.Request, err error) {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		writeValidation(w, r, FieldError{
+			Field:   typeErr.Field,
+			Code:    FieldInvalid,
+			Message: "has the wrong type (got a JSON " + typeErr.Value + ")",
+		})
+		return
+	}
+
+	detail := "the request body is not valid JSON"
+	if errors.Is(err, io.EOF) {
+		detail = "the request body is empty"
+	}
+	writeErrorCode(w, r, CodeInvalidBody, detail, http.StatusBadRequest)
+}
+
+// keyPattern finds the column in Postgres constraint details such as
+// `Key (email)=(a@b.dk) already exists.`
+var keyPattern = regexp.MustCompile(`Key \(([^)]+)\)=`)
+
+// writeDBError answers a failed database call. Not found becomes 404, unique violations and
+// deleting rows still in use 409, and broken references, missing and malformed values 422.
+// Anything else is logged with the request
+// ID and answered with a generic 500, so SQL and constraint names never reach the client.
+func writeDBError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		writeError(w, r, "not found", http.StatusNotFound)
+		return
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		field := pgErr.ColumnName
+		if m := keyPattern.FindStringSubmatch(pgErr.Detail); m != nil {
+			field = m[1]
+		}
+
+		switch pgErr.Code {
+		case "23505": // unique_violation
+			p := Problem{Status: http.StatusConflict, Code: CodeAlreadyExists, Detail: "a record with the same value already exists"}
+			if field != "" {
+				p.Detail = field + " is already in use"
+				p.Errors = []FieldError{{Field: field, Code: FieldTaken, Message: "is already in use"}}
+			}
+			writeProblem(w, r, p)
+			return
+		case "23503": // foreign_key_violation
+			if strings.Contains(pgErr.Detail, "still referenced") {
+				writeErrorCode(w, r, CodeConflict, "the record is still in use and cannot be removed", http.StatusConflict)
+				return
+			}
+			p := Problem{Status: http.StatusUnprocessableEntity, Code: CodeInvalidReference, Detail: "the record refers to something that does not exist"}
+			if field != "" {
+				p.Detail = field + " refers to something that does not exist"
+				p.Errors = []FieldError{{Field: field, Code: FieldUnknown, Message: "does not exist"}}
+			}
+			writeProblem(w, r, p)
+			return
+		case "23502": // not_null_violation
+			writeValidation(w, r, FieldError{Field: field, Code: FieldRequired, Message: "is required"})
+			return
+		case "22001": // string_data_right_truncation
+			writeValidation(w, r, FieldError{Field: field, Code: FieldTooLong, Message: "is too long"})
+			return
+		case "22P02", "22007", "22008", "23514": // invalid text, datetime format and range, check_violation
+			p := Problem{Status: http.StatusUnprocessableEntity, Code: CodeValidationFailed, Detail: "the request has an invalid value"}
+			if field != "" {
+				p.Errors = []FieldError{{Field: field, Code: FieldInvalid, Message: "is invalid"}}
+			}
+			writeProblem(w, r, p)
+			return
+		}
+	}
+
+	switch {
+	case errors.Is(err, gorm.ErrDuplicatedKey):
+		writeErrorCode(w, r, CodeAlreadyExists, "a record with the same value already exists", http.StatusConflict)
+		return
+	case errors.Is(err, gorm.ErrForeignKeyViolated):
+		writeErrorCode(w, r, CodeInvalidReference, "the record refers to something that does not exist", http.StatusUnprocessableEntity)
+		return
+	}
+
+	writeInternalError(w, r, err)
+}
+
+// writeInternalError logs err with the request ID and answers a generic 500
+func writeInternalError(w http.ResponseWriter, r *http.Request, err error) {
+	id := requestID(r)
+	log.Printf("request %s %s %s: %v", id, r.Method, r.URL.Path, err)
+	writeProblem(w, r, Problem{
+		Status: http.StatusInternalServerError,
+		Code:   CodeInternal,
+		Detail: fmt.Sprintf("something went wrong on our side; quote request ID %s when reporting it", id),
+	})
+}
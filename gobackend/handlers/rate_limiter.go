@@ -49,7 +49,7 @@ func (rl *RateLimiter) RateLimitMiddleware(next http.Handler) http.Handler {
 		// Check if limit exceeded
 		if len(validRequests) >= rl.limit {
 			w.Header().Set("Retry-After", "60")
-			http.Error(w, "Rate limit exceeded. Please try again later.", http.StatusTooManyRequests)
+			writeError(w, r, "Rate limit exceeded. Please try again later.", http.StatusTooManyRequests)
 			return
 		}
 
@@ -61,24 +61,6 @@ func (rl *RateLimiter) RateLimitMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-// getClientIP extracts the client IP from the request
-func getClientIP(r *http.Request) string {
-	// Check X-Forwarded-For header first (for proxied requests)
-	forwarded := r.Header.Get("X-Forwarded-For")
-	if forwarded != "" {
-		return forwarded
-	}
-
-	// Check X-Real-IP header
-	realIP := r.Header.Get("X-Real-IP")
-	if realIP != "" {
-		return realIP
-	}
-
-	// Fall back to RemoteAddr
-	return r.RemoteAddr
-}
-
 // Cleanup removes old entries periodically
 func (rl *RateLimiter) Cleanup() {
 	ticker := time.NewTicker(1 * time.Hour)
@@ -0,0 +1,468 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"stuff/models"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// maxKeywords bounds the length of a routing rule's keyword list
+const maxKeywords = 500
+
+// Routing holds DB for routing rule and assignment group handlers
+type Routing struct {
+	DB *gorm.DB
+}
+
+// AssignmentGroupRequest is the body for creating or updating an assignment group
+type AssignmentGroupRequest struct {
+	Name        string                    `json:"name"`
+	Description string                    `json:"description"`
+	Strategy    models.AssignmentStrategy `json:"strategy"`   // ROUND_ROBIN (default) or LEAST_OPEN
+	MemberIds   []uuid.UUID               `json:"member_ids"` // replaces the members
+}
+
+// RoutingRuleRequest is the body for creating or updating a routing rule
+type RoutingRuleRequest struct {
+	Name         string     `json:"name"`
+	Position     int        `json:"position"` // lower positions are tried first
+	Enabled      *bool      `json:"enabled"`  // default true
+	CategoryId   *uuid.UUID `json:"category_id"`
+	Keywords     string     `json:"keywords"` // comma-separated
+	DepartmentId *uuid.UUID `json:"department_id"`
+	GroupId      uuid.UUID  `json:"group_id"`
+}
+
+// assignmentGroupListSpec controls filtering, sorting and includes for GET /routing/groups
+var assignmentGroupListSpec = listSpec{
+	filters: map[string]filterFunc{
+		"q":        searchFilter("name", "description"),
+		"strategy": enumFilter("strategy", func(s string) bool { return models.AssignmentStrategy(s).Valid() }),
+	},
+	sorts: map[string]string{
+		"name":       "name",
+		"created_at": "created_at",
+	},
+	defaultSort: "name",
+	includes: map[string]listInclude{
+		"members": {preload: "Members.User"},
+	},
+	defaultInclude: []string{"members"},
+}
+
+// routingRuleListSpec controls filtering, sorting and includes for GET /routing/rules
+var routingRuleListSpec = listSpec{
+	filters: map[string]filterFunc{
+		"enabled":       boolFilter("enabled"),
+		"group_id":      uuidFilter("group_id"),
+		"category_id":   uuidFilter("category_id"),
+		"department_id": uuidFilter("department_id"),
+	},
+	sorts: map[string]string{
+		"position":   "position",
+		"name":       "name",
+		"created_at": "created_at",
+	},
+	defaultSort: "position",
+	includes: map[string]listInclude{
+		"category":   {preload: "Category", columns: []string{"category_id"}},
+		"department": {preload: "Department", columns: []string{"department_id"}},
+		"group":      {preload: "Group", columns: []string{"group_id"}},
+	},
+	defaultInclude: []string{"category", "department", "group"},
+}
+
+// ListGroups godoc
+// @Summary      Get all assignment groups
+// @Description  Paged with limit/offset or cursor. See X-Total-Count, X-Next-Cursor and Link.
+// @Tags         routing
+// @Produce      json
+// @Param        q         query     string  false  "Search in name and description"
+// @Param        strategy  query     string  false  "ROUND_ROBIN or LEAST_OPEN"
+// @Param        sort      query     string  false  "name or created_at; prefix - for descending (default name)"
+// @Param        include   query     string  false  "members (default members)"
+// @Param        fields    query     string  false  "Fields to return, e.g. id,name"
+// @Param        limit     query     int     false  "Page size (default 50, max 200)"
+// @Param        offset    query     int     false  "Rows to skip"
+// @Param        cursor    query     string  false  "X-Next-Cursor of the previous page"
+// @Success      200  {array}   models.AssignmentGroup
+// @Failure      400  {object}  Problem  "invalid filter, sort, include or cursor"
+// @Failure      403  {object}  Problem  "forbidden"
+// @Security     BearerAuth
+// @Router       /routing/groups [get]
+func (h Routing) ListGroups(w http.ResponseWriter, r *http.Request) {
+	serveList[models.AssignmentGroup](w, r, h.DB, assignmentGroupListSpec)
+}
+
+// CreateGroup godoc
+// @Summary      Create an assignment group
+// @Description  ROUND_ROBIN hands tickets to the members in turn; LEAST_OPEN to the member with the fewest open tickets.
+// @Description  Members who are absent or not on a shift are skipped.
+// @Tags         routing
+// @Accept       json
+// @Produce      json
+// @Param        group  body      AssignmentGroupRequest  true  "Group"
+// @Success      201  {object}  models.AssignmentGroup
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      409  {object}  Problem  "the name is in use"
+// @Failure      422  {object}  Problem  "invalid fields"
+// @Security     BearerAuth
+// @Router       /routing/groups [post]
+func (h Routing) CreateGroup(w http.ResponseWriter, r *http.Request) {
+	var req AssignmentGroupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+
+	g := models.AssignmentGroup{Id: uuid.New()}
+	if !h.applyGroup(w, r, req, &g) {
+		return
+	}
+
+	if err := h.DB.Create(&g).Error; err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	h.DB.Preload("Members.User").First(&g, "id = ?", g.Id)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(g)
+}
+
+// UpdateGroup godoc
+// @Summary      Update an assignment group
+// @Description  Replaces the members.
+// @Tags         routing
+// @Accept       json
+// @Produce      json
+// @Param        id     path      string                  true  "Group ID"
+// @Param        group  body      AssignmentGroupRequest  true  "Group"
+// @Success      200  {object}  models.AssignmentGroup
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      404  {object}  Problem  "group not found"
+// @Failure      409  {object}  Problem  "the name is in use"
+// @Failure      422  {object}  Problem  "invalid fields"
+// @Security     BearerAuth
+// @Router       /routing/groups/{id} [put]
+func (h Routing) UpdateGroup(w http.ResponseWriter, r *http.Request) {
+	id, ok := uuidParam(w, r, "id")
+	if !ok {
+		return
+	}
+
+	var g models.AssignmentGroup
+	if err := h.DB.First(&g, "id = ?", id).Error; err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	var req AssignmentGroupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+	if !h.applyGroup(w, r, req, &g) {
+		return
+	}
+
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("group_id = ?", g.Id).Delete(&models.AssignmentGroupMember{}).Error; err != nil {
+			return err
+		}
+		return tx.Save(&g).Error
+	})
+	if err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	h.DB.Preload("Members.User").First(&g, "id = ?", g.Id)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(g)
+}
+
+// DeleteGroup godoc
+// @Summary      Delete an assignment group
+// @Description  Groups still used by routing rules cannot be deleted.
+// @Tags         routing
+// @Param        id  path  string  true  "Group ID"
+// @Success      204  "No Content"
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      404  {object}  Problem  "group not found"
+// @Failure      409  {object}  Problem  "the group is in use"
+// @Security     BearerAuth
+// @Router       /routing/groups/{id} [delete]
+func (h Routing) DeleteGroup(w http.ResponseWriter, r *http.Request) {
+	id, ok := uuidParam(w, r, "id")
+	if !ok {
+		return
+	}
+
+	result := h.DB.Delete(&models.AssignmentGroup{}, "id = ?", id)
+	if result.Error != nil {
+		writeDBError(w, r, result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		writeError(w, r, "group not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// applyGroup validates the request and copies it onto g, writing 422 on invalid fields
+func (h Routing) applyGroup(w http.ResponseWriter, r *http.Request, req AssignmentGroupRequest, g *models.AssignmentGroup) bool {
+	var errs []FieldError
+
+	name := SanitizeInput(req.Name)
+	if name == "" {
+		errs = append(errs, FieldError{Field: "name", Code: FieldRequired, Message: "is required"})
+	}
+
+	strategy := req.Strategy
+	if strategy == "" {
+		strategy = models.AssignmentRoundRobin
+	}
+	if !strategy.Valid() {
+		errs = append(errs, FieldError{Field: "strategy", Code: FieldInvalid, Message: "must be ROUND_ROBIN or LEAST_OPEN"})
+	}
+
+	memberIDs := uniqueIDs(req.MemberIds)
+	if len(memberIDs) > 0 {
+		var count int64
+		if err := h.DB.Model(&models.User{}).Where("id IN ?", memberIDs).Count(&count).Error; err != nil {
+			writeDBError(w, r, err)
+			return false
+		}
+		if int(count) != len(memberIDs) {
+			errs = append(errs, FieldError{Field: "member_ids", Code: FieldUnknown, Message: "contains an unknown user"})
+		}
+	}
+
+	if len(errs) > 0 {
+		writeValidation(w, r, errs...)
+		return false
+	}
+
+	g.Name = name
+	g.Description = SanitizeInput(req.Description)
+	g.Strategy = strategy
+	g.Members = make([]models.AssignmentGroupMember, len(memberIDs))
+	for i, id := range memberIDs {
+		g.Members[i] = models.AssignmentGroupMember{GroupId: g.Id, UserId: id}
+	}
+	return true
+}
+
+// ListRules godoc
+// @Summary      Get all routing rules
+// @Description  New tickets go to the group of the first enabled rule that matches, in position order.
+// @Description  Paged with limit/offset or cursor. See X-Total-Count, X-Next-Cursor and Link.
+// @Tags         routing
+// @Produce      json
+// @Param        enabled        query     bool    false  "Only enabled or disabled rules"
+// @Param        group_id       query     string  false  "Group ID"
+// @Param        category_id    query     string  false  "Category ID, or none for rules without a category"
+// @Param        department_id  query     string  false  "Department ID, or none for rules without a department"
+// @Param        sort           query     string  false  "position, name or created_at; prefix - for descending (default position)"
+// @Param        include        query     string  false  "category, department, group (default all)"
+// @Param        fields         query     string  false  "Fields to return, e.g. id,name"
+// @Param        limit          query     int     false  "Page size (default 50, max 200)"
+// @Param        offset         query     int     false  "Rows to skip"
+// @Param        cursor         query     string  false  "X-Next-Cursor of the previous page"
+// @Success      200  {array}   models.RoutingRule
+// @Failure      400  {object}  Problem  "invalid filter, sort, include or cursor"
+// @Failure      403  {object}  Problem  "forbidden"
+// @Security     BearerAuth
+// @Router       /routing/rules [get]
+func (h Routing) ListRules(w http.ResponseWriter, r *http.Request) {
+	serveList[models.RoutingRule](w, r, h.DB, routingRuleListSpec)
+}
+
+// CreateRule godoc
+// @Summary      Create a routing rule
+// @Description  Every condition that is set must match: the category, any of the keywords in the title or description, and the requester's department.
+// @Tags         routing
+// @Accept       json
+// @Produce      json
+// @Param        rule  body      RoutingRuleRequest  true  "Rule"
+// @Success      201  {object}  models.RoutingRule
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      422  {object}  Problem  "invalid fields"
+// @Security     BearerAuth
+// @Router       /routing/rules [post]
+func (h Routing) CreateRule(w http.ResponseWriter, r *http.Request) {
+	var req RoutingRuleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+
+	rule := models.RoutingRule{Id: uuid.New()}
+	if !h.applyRule(w, r, req, &rule) {
+		return
+	}
+
+	if err := h.DB.Create(&rule).Error; err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	h.DB.Preload("Category").Preload("Department").Preload("Group").First(&rule, "id = ?", rule.Id)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rule)
+}
+
+// UpdateRule godoc
+// @Summary      Update a routing rule
+// @Description  Only affects tickets created or re-routed afterwards.
+// @Tags         routing
+// @Accept       json
+// @Produce      json
+// @Param        id    path      string              true  "Rule ID"
+// @Param        rule  body      RoutingRuleRequest  true  "Rule"
+// @Success      200  {object}  models.RoutingRule
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      404  {object}  Problem  "rule not found"
+// @Failure      422  {object}  Problem  "invalid fields"
+// @Security     BearerAuth
+// @Router       /routing/rules/{id} [put]
+func (h Routing) UpdateRule(w http.ResponseWriter, r *http.Request) {
+	id, ok := uuidParam(w, r, "id")
+	if !ok {
+		return
+	}
+
+	var rule models.RoutingRule
+	if err := h.DB.First(&rule, "id = ?", id).Error; err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	var req RoutingRuleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+	if !h.applyRule(w, r, req, &rule) {
+		return
+	}
+
+	if err := h.DB.Save(&rule).Error; err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	h.DB.Preload("Category").Preload("Department").Preload("Group").First(&rule, "id = ?", rule.Id)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rule)
+}
+
+// DeleteRule godoc
+// @Summary      Delete a routing rule
+// @Description  Tickets it assigned keep their assignee.
+// @Tags         routing
+// @Param        id  path  string  true  "Rule ID"
+// @Success      204  "No Content"
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      404  {object}  Problem  "rule not found"
+// @Security     BearerAuth
+// @Router       /routing/rules/{id} [delete]
+func (h Routing) DeleteRule(w http.ResponseWriter, r *http.Request) {
+	id, ok := uuidParam(w, r, "id")
+	if !ok {
+		return
+	}
+
+	result := h.DB.Delete(&models.RoutingRule{}, "id = ?", id)
+	if result.Error != nil {
+		writeDBError(w, r, result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		writeError(w, r, "rule not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// applyRule validates the request and copies it onto rule, writing 422 on invalid fields
+func (h Routing) applyRule(w http.ResponseWriter, r *http.Request, req RoutingRuleRequest, rule *models.RoutingRule) bool {
+	var errs []FieldError
+
+	name := SanitizeInput(req.Name)
+	if name == "" {
+		errs = append(errs, FieldError{Field: "name", Code: FieldRequired, Message: "is required"})
+	}
+
+	// Stored normalised, so the list reads the way it is matched
+	var keywords []string
+	for _, k := range strings.Split(SanitizeInput(req.Keywords), ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			keywords = append(keywords, k)
+		}
+	}
+	joined := strings.Join(keywords, ", ")
+	if len(joined) > maxKeywords {
+		errs = append(errs, FieldError{Field: "keywords", Code: FieldTooLong, Message: fmt.Sprintf("may be at most %d characters", maxKeywords)})
+	}
+
+	if req.CategoryId != nil && !categoryExists(h.DB, *req.CategoryId) {
+		errs = append(errs, FieldError{Field: "category_id", Code: FieldUnknown, Message: "unknown category"})
+	}
+	if req.DepartmentId != nil && !departmentExists(h.DB, *req.DepartmentId) {
+		errs = append(errs, FieldError{Field: "department_id", Code: FieldUnknown, Message: "unknown department"})
+	}
+	if req.GroupId == uuid.Nil {
+		errs = append(errs, FieldError{Field: "group_id", Code: FieldRequired, Message: "is required"})
+	} else if !groupExists(h.DB, req.GroupId) {
+		errs = append(errs, FieldError{Field: "group_id", Code: FieldUnknown, Message: "unknown group"})
+	}
+
+	if len(errs) > 0 {
+		writeValidation(w, r, errs...)
+		return false
+	}
+
+	rule.Name = name
+	rule.Position = req.Position
+	rule.Enabled = req.Enabled == nil || *req.Enabled
+	rule.CategoryId = req.CategoryId
+	rule.Keywords = joined
+	rule.DepartmentId = req.DepartmentId
+	rule.GroupId = req.GroupId
+	rule.Category = nil
+	rule.Department = nil
+	rule.Group = nil
+	return true
+}
+
+func groupExists(db *gorm.DB, id uuid.UUID) bool {
+	var count int64
+	db.Model(&models.AssignmentGroup{}).Where("id = ?", id).Count(&count)
+	return count > 0
+}
+
+// RegisterRouting adds routing rule and assignment group routes
+func RegisterRouting(router *mux.Router, h Routing, prefix string) {
+	router.HandleFunc(prefix+"/groups", Authorize(h.ListGroups, StaffRoles)).Methods("GET")
+	router.HandleFunc(prefix+"/groups", Authorize(h.CreateGroup, AdminRoles)).Methods("POST")
+	router.HandleFunc(prefix+"/groups/{id}", Authorize(h.UpdateGroup, AdminRoles)).Methods("PUT")
+	router.HandleFunc(prefix+"/groups/{id}", Authorize(h.DeleteGroup, AdminRoles)).Methods("DELETE")
+	router.HandleFunc(prefix+"/rules", Authorize(h.ListRules, StaffRoles)).Methods("GET")
+	router.HandleFunc(prefix+"/rules", Authorize(h.CreateRule, AdminRoles)).Methods("POST")
+	router.HandleFunc(prefix+"/rules/{id}", Authorize(h.UpdateRule, AdminRoles)).Methods("PUT")
+	router.HandleFunc(prefix+"/rules/{id}", Authorize(h.DeleteRule, AdminRoles)).Methods("DELETE")
+}
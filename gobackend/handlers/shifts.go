@@ -4,36 +4,62 @@ import (
 	"encoding/json"
 	"net/http"
 
+	"stuff/events"
 	"stuff/models"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // Shifts holds DB for shift handlers
 type Shifts struct {
-	DB *gorm.DB
+	DB     *gorm.DB
+	Events *events.Bus
+}
+
+// shiftListSpec controls filtering, sorting and includes for the shift lists.
+// from and to select shifts that overlap the range.
+var shiftListSpec = listSpec{
+	filters: map[string]filterFunc{
+		"user_id": uuidFilter("user_id"),
+		"from":    fromFilter("end_time"),
+		"to":      toFilter("start_time"),
+	},
+	sorts: map[string]string{
+		"start_time": "start_time",
+		"end_time":   "end_time",
+		"created_at": "created_at",
+	},
+	defaultSort: "start_time",
+	includes: map[string]listInclude{
+		"user": {preload: "User", columns: []string{"user_id"}},
+	},
+	defaultInclude: []string{"user"},
 }
 
 // List godoc
 // @Summary      Get all shifts
+// @Description  Paged with limit/offset or cursor. See X-Total-Count, X-Next-Cursor and Link.
 // @Tags         shifts
 // @Produce      json
+// @Param        user_id  query     string  false  "User ID, or me"
+// @Param        from     query     string  false  "Shifts ending at or after (date or RFC 3339)"
+// @Param        to       query     string  false  "Shifts starting at or before (date or RFC 3339)"
+// @Param        sort     query     string  false  "start_time, end_time or created_at; prefix - for descending (default start_time)"
+// @Param        include  query     string  false  "user (default user)"
+// @Param        fields   query     string  false  "Fields to return, e.g. id,start_time,end_time"
+// @Param        limit    query     int     false  "Page size (default 50, max 200)"
+// @Param        offset   query     int     false  "Rows to skip"
+// @Param        cursor   query     string  false  "X-Next-Cursor of the previous page"
 // @Success      200  {array}   models.Shift
+// @Failure      400  {object}  Problem  "invalid filter, sort, include or cursor"
 // @Security     BearerAuth
 // @Security     BearerAuth
 // @Router       /shifts [get]
 func (h Shifts) List(w http.ResponseWriter, r *http.Request) {
-	var list []models.Shift
-
-	if err := h.DB.Preload("User").Find(&list).Error; err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(list)
+	serveList[models.Shift](w, r, h.DB, shiftListSpec)
 }
 
 // GetByID godoc
@@ -42,7 +68,7 @@ func (h Shifts) List(w http.ResponseWriter, r *http.Request) {
 // @Produce      json
 // @Param        id   path      string  true  "Shift ID"
 // @Success      200  {object}  models.Shift
-// @Failure      404  {string}  string  "shift not found"
+// @Failure      404  {object}  Problem  "shift not found"
 // @Security     BearerAuth
 // @Security     BearerAuth
 // @Router       /shifts/{id} [get]
@@ -57,11 +83,11 @@ func (h Shifts) GetByID(w http.ResponseWriter, r *http.Request) {
 	
 	if err := h.DB.Preload("User").First(&s, "id = ?", id).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
-			http.Error(w, "shift not found", http.StatusNotFound)
+			writeError(w, r, "shift not found", http.StatusNotFound)
 			return
 		}
 	
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDBError(w, r, err)
 		return
 	}
 	
@@ -76,7 +102,8 @@ func (h Shifts) GetByID(w http.ResponseWriter, r *http.Request) {
 // @Produce      json
 // @Param        shift  body      models.Shift  true  "Shift"
 // @Success      201  {object}  models.Shift
-// @Failure      400  {string}  string  "Bad request"
+// @Failure      400  {object}  Problem  "Bad request"
+// @Failure      403  {object}  Problem  "forbidden"
 // @Security     BearerAuth
 // @Security     BearerAuth
 // @Router       /shifts [post]
@@ -84,14 +111,36 @@ func (h Shifts) Create(w http.ResponseWriter, r *http.Request) {
 	var s models.Shift
 	
 	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeBodyError(w, r, err)
+		return
+	}
+	
+	allowed, err := canManageUser(h.DB, r, s.UserId)
+	
+	if err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+	
+	if !allowed {
+		writeError(w, r, "forbidden", http.StatusForbidden)
 		return
 	}
 	
 	s.Id = uuid.New()
+	s.User = models.User{}
+	actorID, _ := currentUserID(r)
+	
+	err = h.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit(clause.Associations).Create(&s).Error; err != nil {
+			return err
+		}
+		
+		return h.Events.Publish(tx, events.ShiftCreatedEvent{ActorID: actorID, Shift: s})
+	})
 	
-	if err := h.DB.Create(&s).Error; err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if err != nil {
+		writeDBError(w, r, err)
 		return
 	}
 	
@@ -108,7 +157,8 @@ func (h Shifts) Create(w http.ResponseWriter, r *http.Request) {
 // @Param        id   path      string  true  "Shift ID"
 // @Param        shift  body      models.Shift  true  "Shift"
 // @Success      200  {object}  models.Shift
-// @Failure      404  {string}  string  "shift not found"
+// @Failure      404  {object}  Problem  "shift not found"
+// @Failure      403  {object}  Problem  "forbidden"
 // @Security     BearerAuth
 // @Security     BearerAuth
 // @Router       /shifts/{id} [put]
@@ -119,15 +169,42 @@ func (h Shifts) Update(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
+	var existing models.Shift
+	
+	if err := h.DB.First(&existing, "id = ?", id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			writeError(w, r, "shift not found", http.StatusNotFound)
+			return
+		}
+	
+		writeDBError(w, r, err)
+		return
+	}
+	
 	var s models.Shift
 	
 	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeBodyError(w, r, err)
 		return
 	}
 	
 	s.Id = id
 	
+	// The caller must be allowed to schedule both the current and the new shift owner
+	for _, userID := range []uuid.UUID{existing.UserId, s.UserId} {
+		allowed, err := canManageUser(h.DB, r, userID)
+	
+		if err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+	
+		if !allowed {
+			writeError(w, r, "forbidden", http.StatusForbidden)
+			return
+		}
+	}
+	
 	result := h.DB.Model(&models.Shift{}).Where("id = ?", id).Updates(map[string]interface{}{
 		"user_id":    s.UserId,
 		"start_time": s.StartTime,
@@ -135,12 +212,12 @@ func (h Shifts) Update(w http.ResponseWriter, r *http.Request) {
 	})
 	
 	if result.Error != nil {
-		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		writeDBError(w, r, result.Error)
 		return
 	}
 	
 	if result.RowsAffected == 0 {
-		http.Error(w, "shift not found", http.StatusNotFound)
+		writeError(w, r, "shift not found", http.StatusNotFound)
 		return
 	}
 	
@@ -154,7 +231,8 @@ func (h Shifts) Update(w http.ResponseWriter, r *http.Request) {
 // @Tags         shifts
 // @Param        id   path      string  true  "Shift ID"
 // @Success      204  "No Content"
-// @Failure      404  {string}  string  "shift not found"
+// @Failure      404  {object}  Problem  "shift not found"
+// @Failure      403  {object}  Problem  "forbidden"
 // @Security     BearerAuth
 // @Security     BearerAuth
 // @Router       /shifts/{id} [delete]
@@ -165,15 +243,53 @@ func (h Shifts) Delete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	result := h.DB.Delete(&models.Shift{}, "id = ?", id)
+	var existing models.Shift
 	
-	if result.Error != nil {
-		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+	if err := h.DB.First(&existing, "id = ?", id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			writeError(w, r, "shift not found", http.StatusNotFound)
+			return
+		}
+	
+		writeDBError(w, r, err)
 		return
 	}
 	
-	if result.RowsAffected == 0 {
-		http.Error(w, "shift not found", http.StatusNotFound)
+	allowed, err := canManageUser(h.DB, r, existing.UserId)
+	
+	if err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+	
+	if !allowed {
+		writeError(w, r, "forbidden", http.StatusForbidden)
+		return
+	}
+	
+	actorID, _ := currentUserID(r)
+	
+	err = h.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Delete(&models.Shift{}, "id = ?", id)
+		
+		if result.Error != nil {
+			return result.Error
+		}
+		
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		
+		return h.Events.Publish(tx, events.ShiftCancelledEvent{ActorID: actorID, Shift: existing})
+	})
+	
+	if err == gorm.ErrRecordNotFound {
+		writeError(w, r, "shift not found", http.StatusNotFound)
+		return
+	}
+	
+	if err != nil {
+		writeDBError(w, r, err)
 		return
 	}
 	
@@ -182,10 +298,16 @@ func (h Shifts) Delete(w http.ResponseWriter, r *http.Request) {
 
 // ListByUser godoc
 // @Summary      Get all shifts for a user
+// @Description  Takes the same query parameters as GET /shifts
 // @Tags         shifts
 // @Produce      json
 // @Param        userId   path      string  true  "User ID"
+// @Param        from     query     string  false  "Shifts ending at or after (date or RFC 3339)"
+// @Param        to       query     string  false  "Shifts starting at or before (date or RFC 3339)"
+// @Param        limit    query     int     false  "Page size (default 50, max 200)"
+// @Param        cursor   query     string  false  "X-Next-Cursor of the previous page"
 // @Success      200  {array}   models.Shift
+// @Failure      400  {object}  Problem  "invalid filter, sort, include or cursor"
 // @Security     BearerAuth
 // @Router       /shifts/user/{userId} [get]
 func (h Shifts) ListByUser(w http.ResponseWriter, r *http.Request) {
@@ -195,23 +317,15 @@ func (h Shifts) ListByUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	var list []models.Shift
-	
-	if err := h.DB.Preload("User").Where("user_id = ?", userId).Find(&list).Error; err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(list)
+	serveList[models.Shift](w, r, h.DB.Where("user_id = ?", userId), shiftListSpec)
 }
 
 // RegisterShifts adds shift routes
 func RegisterShifts(router *mux.Router, h Shifts, prefix string) {
-	router.HandleFunc(prefix, h.List).Methods("GET")
-	router.HandleFunc(prefix, h.Create).Methods("POST")
-	router.HandleFunc(prefix+"/user/{userId}", h.ListByUser).Methods("GET")
-	router.HandleFunc(prefix+"/{id}", h.GetByID).Methods("GET")
-	router.HandleFunc(prefix+"/{id}", h.Update).Methods("PUT")
-	router.HandleFunc(prefix+"/{id}", h.Delete).Methods("DELETE")
+	router.HandleFunc(prefix, AuthorizeScoped(h.List, AnyRole, ScopeShiftsRead)).Methods("GET")
+	router.HandleFunc(prefix, AuthorizeScoped(h.Create, StaffRoles, ScopeShiftsWrite)).Methods("POST")
+	router.HandleFunc(prefix+"/user/{userId}", AuthorizeScoped(h.ListByUser, AnyRole, ScopeShiftsRead)).Methods("GET")
+	router.HandleFunc(prefix+"/{id}", AuthorizeScoped(h.GetByID, AnyRole, ScopeShiftsRead)).Methods("GET")
+	router.HandleFunc(prefix+"/{id}", AuthorizeScoped(h.Update, StaffRoles, ScopeShiftsWrite)).Methods("PUT")
+	router.HandleFunc(prefix+"/{id}", AuthorizeScoped(h.Delete, StaffRoles, ScopeShiftsWrite)).Methods("DELETE")
 }
@@ -0,0 +1,301 @@
+package handlers
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// defaultJWTSecret is the development fallback used when neither keys nor JWT_SECRET are configured
+const defaultJWTSecret = "your-secret-key-change-this-in-production"
+
+// hmacKeyID is the kid used for tokens signed with the shared HMAC secret
+const hmacKeyID = "hs256"
+
+// verificationKey is a key that tokens may be verified with
+type verificationKey struct {
+	method jwt.SigningMethod
+	key    interface{}
+}
+
+// keySet holds the active signing key and every key still accepted for verification
+type keySet struct {
+	signingKID    string
+	signingMethod jwt.SigningMethod
+	signingKey    interface{}
+	verify        map[string]verificationKey
+	jwks          JWKSet
+}
+
+// JWK is a public key in JSON Web Key format (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKSet is the document served at /.well-known/jwks.json
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+var activeKeys atomic.Pointer[keySet]
+
+// getJWTSecret retrieves the JWT secret from environment or uses a default (development only, see LoadSigningKeys)
+func getJWTSecret() []byte {
+	secret := os.Getenv("JWT_SECRET")
+	if secret == "" {
+		secret = defaultJWTSecret
+	}
+	return []byte(secret)
+}
+
+// isDevelopment reports whether APP_ENV is set to development
+func isDevelopment() bool {
+	return strings.EqualFold(os.Getenv("APP_ENV"), "development")
+}
+
+// LoadSigningKeys (re)loads the JWT keys. Call it at startup and again to pick up rotated keys.
+//
+// With JWT_KEYS_DIR set, every *.pem file in it is a key whose file name is its kid.
+// Private keys (RSA for RS256, Ed25519 for EdDSA) can sign; public-only keys are kept
+// for verifying tokens signed before a rotation. JWT_SIGNING_KEY_ID selects the signing
+// key and defaults to the last private key by name.
+//
+// Without JWT_KEYS_DIR tokens are signed with HS256 and JWT_SECRET. The built-in
+// default secret is refused unless APP_ENV=development.
+func LoadSigningKeys() error {
+	dir := os.Getenv("JWT_KEYS_DIR")
+	if dir == "" {
+		if os.Getenv("JWT_SECRET") == "" && !isDevelopment() {
+			return errors.New("refusing to start with the default JWT secret: set JWT_KEYS_DIR or JWT_SECRET, or APP_ENV=development")
+		}
+
+		secret := getJWTSecret()
+		activeKeys.Store(&keySet{
+			signingKID:    hmacKeyID,
+			signingMethod: jwt.SigningMethodHS256,
+			signingKey:    secret,
+			verify: map[string]verificationKey{
+				hmacKeyID: {method: jwt.SigningMethodHS256, key: secret},
+			},
+			jwks: JWKSet{Keys: []JWK{}},
+		})
+		return nil
+	}
+
+	set, err := loadKeyDir(dir, os.Getenv("JWT_SIGNING_KEY_ID"))
+	if err != nil {
+		return err
+	}
+
+	activeKeys.Store(set)
+	return nil
+}
+
+// loadKeyDir reads every PEM key in dir
+func loadKeyDir(dir, signingKID string) (*keySet, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	set := &keySet{verify: map[string]verificationKey{}, jwks: JWKSet{Keys: []JWK{}}}
+	signers := map[string]verificationKey{}
+	var lastSigner string
+
+	for _, path := range paths {
+		kid := strings.TrimSuffix(filepath.Base(path), ".pem")
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		private, public, method, err := parsePEMKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", kid, err)
+		}
+
+		jwk, err := publicJWK(kid, public)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", kid, err)
+		}
+
+		set.verify[kid] = verificationKey{method: method, key: public}
+		set.jwks.Keys = append(set.jwks.Keys, jwk)
+
+		if private != nil {
+			signers[kid] = verificationKey{method: method, key: private}
+			lastSigner = kid
+		}
+	}
+
+	if signingKID == "" {
+		signingKID = lastSigner
+	}
+
+	signer, ok := signers[signingKID]
+	if !ok {
+		return nil, fmt.Errorf("no private signing key %q found in %s", signingKID, dir)
+	}
+
+	set.signingKID = signingKID
+	set.signingMethod = signer.method
+	set.signingKey = signer.key
+	return set, nil
+}
+
+// parsePEMKey returns the private key (nil for public-only files), the public key and the JWT algorithm
+func parsePEMKey(data []byte) (interface{}, interface{}, jwt.SigningMethod, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, nil, nil, errors.New("no PEM block found")
+	}
+
+	var parsed interface{}
+	var err error
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, nil, nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	switch key := parsed.(type) {
+	case *rsa.PrivateKey:
+		return key, &key.PublicKey, jwt.SigningMethodRS256, nil
+	case *rsa.PublicKey:
+		return nil, key, jwt.SigningMethodRS256, nil
+	case ed25519.PrivateKey:
+		return key, key.Public(), jwt.SigningMethodEdDSA, nil
+	case ed25519.PublicKey:
+		return nil, key, jwt.SigningMethodEdDSA, nil
+	default:
+		return nil, nil, nil, fmt.Errorf("unsupported key type %T", parsed)
+	}
+}
+
+// publicJWK converts a public key into its JWK representation
+func publicJWK(kid string, public interface{}) (JWK, error) {
+	switch key := public.(type) {
+	case *rsa.PublicKey:
+		return JWK{
+			Kty: "RSA",
+			Kid: kid,
+			Use: "sig",
+			Alg: jwt.SigningMethodRS256.Alg(),
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}, nil
+	case ed25519.PublicKey:
+		return JWK{
+			Kty: "OKP",
+			Kid: kid,
+			Use: "sig",
+			Alg: jwt.SigningMethodEdDSA.Alg(),
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(key),
+		}, nil
+	default:
+		return JWK{}, fmt.Errorf("unsupported public key type %T", public)
+	}
+}
+
+// currentKeys returns the loaded key set, loading it on first use
+func currentKeys() (*keySet, error) {
+	if set := activeKeys.Load(); set != nil {
+		return set, nil
+	}
+
+	if err := LoadSigningKeys(); err != nil {
+		return nil, err
+	}
+
+	return activeKeys.Load(), nil
+}
+
+// signToken signs claims with the active key and sets the kid header
+func signToken(claims jwt.Claims) (string, error) {
+	set, err := currentKeys()
+	if err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(set.signingMethod, claims)
+	token.Header["kid"] = set.signingKID
+	return token.SignedString(set.signingKey)
+}
+
+// verificationKeyFunc resolves the key for a token by its kid and checks the algorithm matches
+func verificationKeyFunc(token *jwt.Token) (interface{}, error) {
+	set, err := currentKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		kid = hmacKeyID
+	}
+
+	key, ok := set.verify[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, jwt.ErrSignatureInvalid
+	}
+
+	return key.key, nil
+}
+
+// JWKS godoc
+// @Summary      JSON Web Key Set
+// @Description  Public keys that verify tokens issued by this API. Empty when tokens are signed with a shared HMAC secret.
+// @Tags         auth
+// @Produce      json
+// @Success      200  {object}  JWKSet
+// @Router       /.well-known/jwks.json [get]
+func JWKS(w http.ResponseWriter, r *http.Request) {
+	set, err := currentKeys()
+	if err != nil {
+		writeError(w, r, "signing keys not configured", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(set.jwks)
+}
@@ -0,0 +1,520 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"stuff/events"
+	"stuff/models"
+	"stuff/sla"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// slaBreachInterval is how often open tickets are checked against their due dates
+const slaBreachInterval = 1 * time.Minute
+
+// SLA holds DB and the event bus for SLA policy and business calendar handlers
+type SLA struct {
+	DB     *gorm.DB
+	Events *events.Bus
+}
+
+// SLAPolicyRequest is the body for creating or updating an SLA policy
+type SLAPolicyRequest struct {
+	Name                 string                 `json:"name"`
+	CategoryId           *uuid.UUID             `json:"category_id"` // omit for every category
+	Priority             *models.TicketPriority `json:"priority"`    // omit for every priority
+	FirstResponseMinutes int                    `json:"first_response_minutes"`
+	ResolutionMinutes    int                    `json:"resolution_minutes"`
+	CalendarId           *uuid.UUID             `json:"calendar_id"` // omit to count round the clock
+}
+
+// BusinessCalendarRequest is the body for creating or updating a business calendar
+type BusinessCalendarRequest struct {
+	Name     string                   `json:"name"`
+	TimeZone string                   `json:"time_zone"` // default Europe/Copenhagen
+	Workdays string                   `json:"workdays"`  // ISO weekdays, default "1,2,3,4,5"
+	DayStart string                   `json:"day_start"` // default "08:00"
+	DayEnd   string                   `json:"day_end"`   // default "16:00"
+	Holidays []BusinessHolidayRequest `json:"holidays"`
+}
+
+// BusinessHolidayRequest is a day off in a BusinessCalendarRequest
+type BusinessHolidayRequest struct {
+	Date string `json:"date"` // 2006-01-02
+	Name string `json:"name"`
+}
+
+// slaPolicyListSpec controls filtering and sorting for GET /sla/policies
+var slaPolicyListSpec = listSpec{
+	filters: map[string]filterFunc{
+		"category_id": uuidFilter("category_id"),
+		"priority":    enumFilter("priority", func(s string) bool { return models.TicketPriority(s).Valid() }),
+		"calendar_id": uuidFilter("calendar_id"),
+	},
+	sorts: map[string]string{
+		"name":       "name",
+		"created_at": "created_at",
+	},
+	defaultSort: "name",
+	includes: map[string]listInclude{
+		"category": {preload: "Category", columns: []string{"category_id"}},
+		"calendar": {preload: "Calendar", columns: []string{"calendar_id"}},
+	},
+	defaultInclude: []string{"category", "calendar"},
+}
+
+// businessCalendarListSpec controls sorting and includes for GET /sla/calendars
+var businessCalendarListSpec = listSpec{
+	filters: map[string]filterFunc{
+		"q": searchFilter("name"),
+	},
+	sorts: map[string]string{
+		"name":       "name",
+		"created_at": "created_at",
+	},
+	defaultSort: "name",
+	includes: map[string]listInclude{
+		"holidays": {preload: "Holidays"},
+	},
+	defaultInclude: []string{"holidays"},
+}
+
+// ListPolicies godoc
+// @Summary      Get all SLA policies
+// @Description  Paged with limit/offset or cursor. See X-Total-Count, X-Next-Cursor and Link.
+// @Tags         sla
+// @Produce      json
+// @Param        category_id  query     string  false  "Category ID, or none for policies that apply to every category"
+// @Param        priority     query     string  false  "LOW, NORMAL, HIGH or URGENT; comma-separated for several"
+// @Param        calendar_id  query     string  false  "Calendar ID, or none for round-the-clock policies"
+// @Param        sort         query     string  false  "name or created_at; prefix - for descending (default name)"
+// @Param        include      query     string  false  "category, calendar (default both)"
+// @Param        fields       query     string  false  "Fields to return, e.g. id,name"
+// @Param        limit        query     int     false  "Page size (default 50, max 200)"
+// @Param        offset       query     int     false  "Rows to skip"
+// @Param        cursor       query     string  false  "X-Next-Cursor of the previous page"
+// @Success      200  {array}   models.SLAPolicy
+// @Failure      400  {object}  Problem  "invalid filter, sort, include or cursor"
+// @Failure      403  {object}  Problem  "forbidden"
+// @Security     BearerAuth
+// @Router       /sla/policies [get]
+func (h SLA) ListPolicies(w http.ResponseWriter, r *http.Request) {
+	serveList[models.SLAPolicy](w, r, h.DB, slaPolicyListSpec)
+}
+
+// CreatePolicy godoc
+// @Summary      Create an SLA policy
+// @Description  A policy for a category and a priority wins over one for the category only, which wins over one for the priority only, which wins over a default policy. Existing tickets keep their due dates.
+// @Tags         sla
+// @Accept       json
+// @Produce      json
+// @Param        policy  body      SLAPolicyRequest  true  "Policy"
+// @Success      201  {object}  models.SLAPolicy
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      409  {object}  Problem  "a policy for the category and priority exists"
+// @Failure      422  {object}  Problem  "invalid fields"
+// @Security     BearerAuth
+// @Router       /sla/policies [post]
+func (h SLA) CreatePolicy(w http.ResponseWriter, r *http.Request) {
+	var req SLAPolicyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+
+	p := models.SLAPolicy{Id: uuid.New()}
+	if !h.applyPolicy(w, r, req, &p) {
+		return
+	}
+
+	if err := h.DB.Create(&p).Error; err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	h.DB.Preload("Category").Preload("Calendar").First(&p, "id = ?", p.Id)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(p)
+}
+
+// UpdatePolicy godoc
+// @Summary      Update an SLA policy
+// @Description  Existing tickets keep their due dates; new tickets and tickets whose priority or category changes use the new targets.
+// @Tags         sla
+// @Accept       json
+// @Produce      json
+// @Param        id      path      string            true  "Policy ID"
+// @Param        policy  body      SLAPolicyRequest  true  "Policy"
+// @Success      200  {object}  models.SLAPolicy
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      404  {object}  Problem  "policy not found"
+// @Failure      409  {object}  Problem  "a policy for the category and priority exists"
+// @Failure      422  {object}  Problem  "invalid fields"
+// @Security     BearerAuth
+// @Router       /sla/policies/{id} [put]
+func (h SLA) UpdatePolicy(w http.ResponseWriter, r *http.Request) {
+	id, ok := uuidParam(w, r, "id")
+	if !ok {
+		return
+	}
+
+	var p models.SLAPolicy
+	if err := h.DB.First(&p, "id = ?", id).Error; err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	var req SLAPolicyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+	if !h.applyPolicy(w, r, req, &p) {
+		return
+	}
+
+	if err := h.DB.Save(&p).Error; err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	h.DB.Preload("Category").Preload("Calendar").First(&p, "id = ?", p.Id)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+// DeletePolicy godoc
+// @Summary      Delete an SLA policy
+// @Description  Tickets under the policy keep their due dates but no longer count against an SLA.
+// @Tags         sla
+// @Param        id  path  string  true  "Policy ID"
+// @Success      204  "No Content"
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      404  {object}  Problem  "policy not found"
+// @Security     BearerAuth
+// @Router       /sla/policies/{id} [delete]
+func (h SLA) DeletePolicy(w http.ResponseWriter, r *http.Request) {
+	id, ok := uuidParam(w, r, "id")
+	if !ok {
+		return
+	}
+
+	result := h.DB.Delete(&models.SLAPolicy{}, "id = ?", id)
+	if result.Error != nil {
+		writeDBError(w, r, result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		writeError(w, r, "policy not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// applyPolicy validates the request and copies it onto p, writing 409 or 422 on failure
+func (h SLA) applyPolicy(w http.ResponseWriter, r *http.Request, req SLAPolicyRequest, p *models.SLAPolicy) bool {
+	var errs []FieldError
+
+	name := SanitizeInput(req.Name)
+	if name == "" {
+		errs = append(errs, FieldError{Field: "name", Code: FieldRequired, Message: "is required"})
+	}
+	if req.Priority != nil && !req.Priority.Valid() {
+		errs = append(errs, FieldError{Field: "priority", Code: FieldInvalid, Message: "must be LOW, NORMAL, HIGH or URGENT"})
+	}
+	if req.CategoryId != nil && !categoryExists(h.DB, *req.CategoryId) {
+		errs = append(errs, FieldError{Field: "category_id", Code: FieldUnknown, Message: "unknown category"})
+	}
+	if req.CalendarId != nil && !calendarExists(h.DB, *req.CalendarId) {
+		errs = append(errs, FieldError{Field: "calendar_id", Code: FieldUnknown, Message: "unknown calendar"})
+	}
+	if req.FirstResponseMinutes <= 0 {
+		errs = append(errs, FieldError{Field: "first_response_minutes", Code: FieldInvalid, Message: "must be positive"})
+	}
+	if req.ResolutionMinutes <= 0 {
+		errs = append(errs, FieldError{Field: "resolution_minutes", Code: FieldInvalid, Message: "must be positive"})
+	} else if req.ResolutionMinutes < req.FirstResponseMinutes {
+		errs = append(errs, FieldError{Field: "resolution_minutes", Code: FieldInvalid, Message: "may not be less than first_response_minutes"})
+	}
+	if len(errs) > 0 {
+		writeValidation(w, r, errs...)
+		return false
+	}
+
+	// Only one policy may cover each combination, or the match would be ambiguous
+	var taken int64
+	err := h.DB.Model(&models.SLAPolicy{}).
+		Where("id <> ?", p.Id).
+		Where("category_id IS NOT DISTINCT FROM ?", req.CategoryId).
+		Where("priority IS NOT DISTINCT FROM ?", req.Priority).
+		Count(&taken).Error
+	if err != nil {
+		writeDBError(w, r, err)
+		return false
+	}
+	if taken > 0 {
+		writeErrorCode(w, r, CodeAlreadyExists, "a policy for this category and priority already exists", http.StatusConflict)
+		return false
+	}
+
+	p.Name = name
+	p.CategoryId = req.CategoryId
+	p.Priority = req.Priority
+	p.FirstResponseMinutes = req.FirstResponseMinutes
+	p.ResolutionMinutes = req.ResolutionMinutes
+	p.CalendarId = req.CalendarId
+	p.Category = nil
+	p.Calendar = nil
+	return true
+}
+
+// ListCalendars godoc
+// @Summary      Get all business calendars
+// @Description  Paged with limit/offset or cursor. See X-Total-Count, X-Next-Cursor and Link.
+// @Tags         sla
+// @Produce      json
+// @Param        q        query     string  false  "Search in name"
+// @Param        sort     query     string  false  "name or created_at; prefix - for descending (default name)"
+// @Param        include  query     string  false  "holidays (default holidays)"
+// @Param        fields   query     string  false  "Fields to return, e.g. id,name"
+// @Param        limit    query     int     false  "Page size (default 50, max 200)"
+// @Param        offset   query     int     false  "Rows to skip"
+// @Param        cursor   query     string  false  "X-Next-Cursor of the previous page"
+// @Success      200  {array}   models.BusinessCalendar
+// @Failure      400  {object}  Problem  "invalid filter, sort, include or cursor"
+// @Failure      403  {object}  Problem  "forbidden"
+// @Security     BearerAuth
+// @Router       /sla/calendars [get]
+func (h SLA) ListCalendars(w http.ResponseWriter, r *http.Request) {
+	serveList[models.BusinessCalendar](w, r, h.DB, businessCalendarListSpec)
+}
+
+// CreateCalendar godoc
+// @Summary      Create a business calendar
+// @Tags         sla
+// @Accept       json
+// @Produce      json
+// @Param        calendar  body      BusinessCalendarRequest  true  "Calendar"
+// @Success      201  {object}  models.BusinessCalendar
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      422  {object}  Problem  "invalid fields"
+// @Security     BearerAuth
+// @Router       /sla/calendars [post]
+func (h SLA) CreateCalendar(w http.ResponseWriter, r *http.Request) {
+	var req BusinessCalendarRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+
+	c := models.BusinessCalendar{Id: uuid.New()}
+	if !req.apply(w, r, &c) {
+		return
+	}
+
+	if err := h.DB.Create(&c).Error; err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(c)
+}
+
+// UpdateCalendar godoc
+// @Summary      Update a business calendar
+// @Description  Replaces the holidays. Existing tickets keep their due dates.
+// @Tags         sla
+// @Accept       json
+// @Produce      json
+// @Param        id        path      string                   true  "Calendar ID"
+// @Param        calendar  body      BusinessCalendarRequest  true  "Calendar"
+// @Success      200  {object}  models.BusinessCalendar
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      404  {object}  Problem  "calendar not found"
+// @Failure      422  {object}  Problem  "invalid fields"
+// @Security     BearerAuth
+// @Router       /sla/calendars/{id} [put]
+func (h SLA) UpdateCalendar(w http.ResponseWriter, r *http.Request) {
+	id, ok := uuidParam(w, r, "id")
+	if !ok {
+		return
+	}
+
+	var c models.BusinessCalendar
+	if err := h.DB.First(&c, "id = ?", id).Error; err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	var req BusinessCalendarRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+	if !req.apply(w, r, &c) {
+		return
+	}
+
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("calendar_id = ?", c.Id).Delete(&models.BusinessHoliday{}).Error; err != nil {
+			return err
+		}
+		return tx.Save(&c).Error
+	})
+	if err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
+
+// DeleteCalendar godoc
+// @Summary      Delete a business calendar
+// @Description  Calendars still used by SLA policies cannot be deleted.
+// @Tags         sla
+// @Param        id  path  string  true  "Calendar ID"
+// @Success      204  "No Content"
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      404  {object}  Problem  "calendar not found"
+// @Failure      409  {object}  Problem  "the calendar is in use"
+// @Security     BearerAuth
+// @Router       /sla/calendars/{id} [delete]
+func (h SLA) DeleteCalendar(w http.ResponseWriter, r *http.Request) {
+	id, ok := uuidParam(w, r, "id")
+	if !ok {
+		return
+	}
+
+	result := h.DB.Delete(&models.BusinessCalendar{}, "id = ?", id)
+	if result.Error != nil {
+		writeDBError(w, r, result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		writeError(w, r, "calendar not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apply validates the request and copies it onto c, writing 422 on invalid fields
+func (req BusinessCalendarRequest) apply(w http.ResponseWriter, r *http.Request, c *models.BusinessCalendar) bool {
+	var errs []FieldError
+
+	name := SanitizeInput(req.Name)
+	if name == "" {
+		errs = append(errs, FieldError{Field: "name", Code: FieldRequired, Message: "is required"})
+	}
+
+	timeZone := strings.TrimSpace(req.TimeZone)
+	if timeZone == "" {
+		timeZone = "Europe/Copenhagen"
+	}
+	if _, err := time.LoadLocation(timeZone); err != nil {
+		errs = append(errs, FieldError{Field: "time_zone", Code: FieldInvalid, Message: "unknown time zone"})
+	}
+
+	workdays := strings.ReplaceAll(req.Workdays, " ", "")
+	if workdays == "" {
+		workdays = "1,2,3,4,5"
+	}
+	for _, day := range strings.Split(workdays, ",") {
+		if n, err := strconv.Atoi(day); err != nil || n < 1 || n > 7 {
+			errs = append(errs, FieldError{Field: "workdays", Code: FieldInvalid, Message: "must be ISO weekdays 1 (Monday) to 7 (Sunday), comma-separated"})
+			break
+		}
+	}
+
+	dayStart, dayEnd := req.DayStart, req.DayEnd
+	if dayStart == "" {
+		dayStart = "08:00"
+	}
+	if dayEnd == "" {
+		dayEnd = "16:00"
+	}
+	start, err1 := time.Parse("15:04", dayStart)
+	end, err2 := time.Parse("15:04", dayEnd)
+	if err1 != nil {
+		errs = append(errs, FieldError{Field: "day_start", Code: FieldInvalid, Message: "must be HH:MM"})
+	}
+	if err2 != nil {
+		errs = append(errs, FieldError{Field: "day_end", Code: FieldInvalid, Message: "must be HH:MM"})
+	}
+	if err1 == nil && err2 == nil && !start.Before(end) {
+		errs = append(errs, FieldError{Field: "day_end", Code: FieldInvalid, Message: "must be after day_start"})
+	}
+
+	holidays := make([]models.BusinessHoliday, 0, len(req.Holidays))
+	seen := map[string]bool{}
+	for i, hd := range req.Holidays {
+		date, err := time.Parse("2006-01-02", hd.Date)
+		if err != nil {
+			errs = append(errs, FieldError{Field: "holidays[" + strconv.Itoa(i) + "].date", Code: FieldInvalid, Message: "must be YYYY-MM-DD"})
+			continue
+		}
+		if seen[hd.Date] {
+			errs = append(errs, FieldError{Field: "holidays[" + strconv.Itoa(i) + "].date", Code: FieldTaken, Message: "is listed twice"})
+			continue
+		}
+		seen[hd.Date] = true
+		holidays = append(holidays, models.BusinessHoliday{Id: uuid.New(), CalendarId: c.Id, Date: date, Name: SanitizeInput(hd.Name)})
+	}
+
+	if len(errs) > 0 {
+		writeValidation(w, r, errs...)
+		return false
+	}
+
+	c.Name = name
+	c.TimeZone = timeZone
+	c.Workdays = workdays
+	c.DayStart = dayStart
+	c.DayEnd = dayEnd
+	c.Holidays = holidays
+	return true
+}
+
+func calendarExists(db *gorm.DB, id uuid.UUID) bool {
+	var count int64
+	db.Model(&models.BusinessCalendar{}).Where("id = ?", id).Count(&count)
+	return count > 0
+}
+
+// DetectBreaches starts the routine that marks overdue tickets as breached and notifies about them
+func (h SLA) DetectBreaches() {
+	ticker := time.NewTicker(slaBreachInterval)
+	go func() {
+		for range ticker.C {
+			if _, err := sla.DetectBreaches(h.DB, h.Events, time.Now()); err != nil {
+				log.Printf("sla: %v", err)
+			}
+		}
+	}()
+}
+
+// RegisterSLA adds SLA policy and business calendar routes
+func RegisterSLA(router *mux.Router, h SLA, prefix string) {
+	router.HandleFunc(prefix+"/policies", Authorize(h.ListPolicies, StaffRoles)).Methods("GET")
+	router.HandleFunc(prefix+"/policies", Authorize(h.CreatePolicy, AdminRoles)).Methods("POST")
+	router.HandleFunc(prefix+"/policies/{id}", Authorize(h.UpdatePolicy, AdminRoles)).Methods("PUT")
+	router.HandleFunc(prefix+"/policies/{id}", Authorize(h.DeletePolicy, AdminRoles)).Methods("DELETE")
+	router.HandleFunc(prefix+"/calendars", Authorize(h.ListCalendars, StaffRoles)).Methods("GET")
+	router.HandleFunc(prefix+"/calendars", Authorize(h.CreateCalendar, AdminRoles)).Methods("POST")
+	router.HandleFunc(prefix+"/calendars/{id}", Authorize(h.UpdateCalendar, AdminRoles)).Methods("PUT")
+	router.HandleFunc(prefix+"/calendars/{id}", Authorize(h.DeleteCalendar, AdminRoles)).Methods("DELETE")
+}
@@ -0,0 +1,494 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"stuff/models"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// ssoStateTTL is how long a started SSO login may take to come back
+const ssoStateTTL = 10 * time.Minute
+
+var (
+	// errUnverifiedEmail is returned when a new account would be created without a verified email
+	errUnverifiedEmail = errors.New("provider did not return a verified email")
+	// errEmailTaken is returned when a provider email belongs to an existing account it may
+	// not be linked to automatically
+	errEmailTaken = errors.New("email belongs to an existing account")
+	// errSignupPending is returned while a first-time SSO user waits in the onboarding queue
+	errSignupPending = errors.New("signup awaiting approval")
+	// errSignupRejected is returned when the onboarding request was rejected
+	errSignupRejected = errors.New("signup rejected")
+)
+
+type SSOProvidersResponse struct {
+	Providers []string `json:"providers"`
+}
+
+type SSOAuthorizeResponse struct {
+	AuthorizationURL string `json:"authorization_url"`
+	State            string `json:"state"`
+}
+
+// SSONonceResponse is a nonce for an ID token login and when it expires
+type SSONonceResponse struct {
+	Nonce     string    `json:"nonce"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type SSOPendingResponse struct {
+	Status  models.RequestStatus `json:"status"`
+	Message string               `json:"message"`
+}
+
+// getSSORedirectURIs returns the redirect URIs clients may ask for, from SSO_REDIRECT_URIS (comma separated)
+func getSSORedirectURIs() []string {
+	var uris []string
+	for _, uri := range strings.Split(os.Getenv("SSO_REDIRECT_URIS"), ",") {
+		if uri = strings.TrimSpace(uri); uri != "" {
+			uris = append(uris, uri)
+		}
+	}
+	if len(uris) == 0 {
+		uris = []string{getAppBaseURL() + "/auth/callback"}
+	}
+	return uris
+}
+
+// pkceChallenge derives the S256 code challenge for a verifier (RFC 7636)
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// ListSSOProviders godoc
+// @Summary      List SSO providers
+// @Description  Names of the configured single sign-on providers
+// @Tags         auth
+// @Produce      json
+// @Success      200  {object}  SSOProvidersResponse
+// @Router       /auth/sso/providers [get]
+func (h Auth) ListSSOProviders(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SSOProvidersResponse{Providers: ssoProviderNames()})
+}
+
+// SSONonce godoc
+// @Summary      Get a nonce for SSO login with an ID token
+// @Description  Send the nonce in the sign-in request to the provider, then the ID token and the nonce to /auth/sso. The nonce works once and expires after 10 minutes.
+// @Tags         auth
+// @Produce      json
+// @Success      200  {object}  SSONonceResponse
+// @Router       /auth/sso/nonce [post]
+func (h Auth) SSONonce(w http.ResponseWriter, r *http.Request) {
+	nonce, err := newOpaqueToken()
+	if err != nil {
+		writeError(w, r, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+
+	expiresAt := time.Now().Add(ssoStateTTL)
+	err = h.DB.Create(&models.SSONonce{
+		Id:        uuid.New(),
+		NonceHash: hashToken(nonce),
+		ExpiresAt: expiresAt,
+	}).Error
+	if err != nil {
+		writeError(w, r, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SSONonceResponse{Nonce: nonce, ExpiresAt: expiresAt})
+}
+
+// consumeSSONonce deletes an issued nonce and reports whether it existed and had not expired
+func consumeSSONonce(db *gorm.DB, nonce string) bool {
+	if nonce == "" {
+		return false
+	}
+	result := db.Where("nonce_hash = ? AND expires_at > ?", hashToken(nonce), time.Now()).Delete(&models.SSONonce{})
+	return result.Error == nil && result.RowsAffected == 1
+}
+
+// SSOAuthorize godoc
+// @Summary      Start SSO login
+// @Description  Create a state, nonce and PKCE verifier and return the provider URL to send the user to. The redirect URI must be listed in SSO_REDIRECT_URIS.
+// @Tags         auth
+// @Produce      json
+// @Param        provider      path      string  true   "Provider name, e.g. github, google or entra"
+// @Param        redirect_uri  query     string  false  "Where the provider sends the user back (defaults to the first allowed URI)"
+// @Success      200  {object}  SSOAuthorizeResponse
+// @Failure      400  {object}  Problem  "Invalid redirect URI"
+// @Failure      404  {object}  Problem  "Unknown provider"
+// @Router       /auth/sso/{provider}/authorize [get]
+func (h Auth) SSOAuthorize(w http.ResponseWriter, r *http.Request) {
+	h.startSSO(w, r, nil)
+}
+
+// startSSO stores a new login state and writes the provider authorization URL.
+// linkUserID is set when the result should be linked to that user instead of signing in.
+func (h Auth) startSSO(w http.ResponseWriter, r *http.Request, linkUserID *uuid.UUID) {
+	provider, ok := getSSOProvider(mux.Vars(r)["provider"])
+	if !ok {
+		writeError(w, r, "Unknown provider", http.StatusNotFound)
+		return
+	}
+
+	allowed := getSSORedirectURIs()
+	redirectURI := r.URL.Query().Get("redirect_uri")
+	if redirectURI == "" {
+		redirectURI = allowed[0]
+	}
+	if !slices.Contains(allowed, redirectURI) {
+		writeError(w, r, "Invalid redirect URI", http.StatusBadRequest)
+		return
+	}
+
+	state, err := newOpaqueToken()
+	if err != nil {
+		writeError(w, r, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+	nonce, err := newOpaqueToken()
+	if err != nil {
+		writeError(w, r, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+	verifier, err := newOpaqueToken()
+	if err != nil {
+		writeError(w, r, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+
+	authURL, err := provider.authorizationURL(redirectURI, state, nonce, pkceChallenge(verifier))
+	if err != nil {
+		log.Printf("sso authorize: %v", err)
+		writeError(w, r, "Provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	err = h.DB.Create(&models.OAuthState{
+		Id:           uuid.New(),
+		StateHash:    hashToken(state),
+		Provider:     provider.Name,
+		CodeVerifier: verifier,
+		Nonce:        nonce,
+		RedirectURI:  redirectURI,
+		ExpiresAt:    time.Now().Add(ssoStateTTL),
+		LinkUserId:   linkUserID,
+	}).Error
+	if err != nil {
+		writeError(w, r, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SSOAuthorizeResponse{AuthorizationURL: authURL, State: state})
+}
+
+// finishSSO consumes the state from the callback and returns the verified provider identity.
+// It writes the error response and returns false on failure.
+func (h Auth) finishSSO(w http.ResponseWriter, r *http.Request) (ssoIdentity, models.OAuthState, bool) {
+	provider, ok := getSSOProvider(mux.Vars(r)["provider"])
+	if !ok {
+		writeError(w, r, "Unknown provider", http.StatusNotFound)
+		return ssoIdentity{}, models.OAuthState{}, false
+	}
+
+	query := r.URL.Query()
+	if providerErr := query.Get("error"); providerErr != "" {
+		writeError(w, r, "Login cancelled or denied by provider: "+SanitizeInput(providerErr), http.StatusBadRequest)
+		return ssoIdentity{}, models.OAuthState{}, false
+	}
+
+	code := query.Get("code")
+	state := query.Get("state")
+	if code == "" || state == "" {
+		writeError(w, r, "Missing code or state", http.StatusBadRequest)
+		return ssoIdentity{}, models.OAuthState{}, false
+	}
+
+	// Consume the state so it cannot be replayed
+	var saved models.OAuthState
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&saved, "state_hash = ?", hashToken(state)).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&saved).Error
+	})
+	if err != nil || saved.Provider != provider.Name || time.Now().After(saved.ExpiresAt) {
+		writeErrorCode(w, r, CodeInvalidToken, "Invalid or expired state", http.StatusBadRequest)
+		return ssoIdentity{}, models.OAuthState{}, false
+	}
+
+	tokens, err := provider.exchangeCode(code, saved.CodeVerifier, saved.RedirectURI)
+	if err != nil {
+		log.Printf("sso callback (%s): %v", provider.Name, err)
+		recordLoginAttempt(h.DB, r, "", nil, false, loginReasonSSOFailed)
+		writeError(w, r, "Login failed", http.StatusUnauthorized)
+		return ssoIdentity{}, models.OAuthState{}, false
+	}
+
+	identity, err := provider.identity(tokens, saved.Nonce)
+	if err != nil {
+		log.Printf("sso callback (%s): %v", provider.Name, err)
+		recordLoginAttempt(h.DB, r, "", nil, false, loginReasonSSOFailed)
+		writeError(w, r, "Login failed", http.StatusUnauthorized)
+		return ssoIdentity{}, models.OAuthState{}, false
+	}
+
+	return identity, saved, true
+}
+
+// SSOCallback godoc
+// @Summary      Finish SSO login
+// @Description  Exchange the authorization code from the provider for a session. The state must come from /auth/sso/{provider}/authorize and can be used once. First-time users wait for approval (202) when the onboarding queue is on.
+// @Tags         auth
+// @Produce      json
+// @Param        provider  path      string  true  "Provider name"
+// @Param        code      query     string  true  "Authorization code"
+// @Param        state     query     string  true  "State from the authorize step"
+// @Success      200  {object}  LoginResponse
+// @Success      202  {object}  SSOPendingResponse
+// @Failure      400  {object}  Problem  "Invalid or expired state"
+// @Failure      401  {object}  Problem  "Login failed"
+// @Failure      403  {object}  Problem  "Email not verified or signup rejected"
+// @Failure      409  {object}  Problem  "Email belongs to an existing account"
+// @Router       /auth/sso/{provider}/callback [get]
+func (h Auth) SSOCallback(w http.ResponseWriter, r *http.Request) {
+	identity, saved, ok := h.finishSSO(w, r)
+	if !ok {
+		return
+	}
+
+	if saved.LinkUserId != nil {
+		writeErrorCode(w, r, CodeInvalidToken, "Invalid or expired state", http.StatusBadRequest)
+		return
+	}
+
+	h.ssoSession(w, r, identity, uuid.Nil)
+}
+
+// ssoSession signs in the user behind a verified provider identity
+func (h Auth) ssoSession(w http.ResponseWriter, r *http.Request, identity ssoIdentity, departmentID uuid.UUID) {
+	identity.Email = SanitizeInput(identity.Email)
+	identity.Name = SanitizeInput(identity.Name)
+
+	user, err := h.resolveSSOUser(identity, departmentID)
+	switch err {
+	case nil:
+	case errUnverifiedEmail:
+		recordLoginAttempt(h.DB, r, identity.Email, nil, false, loginReasonSSOFailed)
+		writeError(w, r, "Your "+identity.Provider+" account has no verified email address", http.StatusForbidden)
+		return
+	case errEmailTaken:
+		recordLoginAttempt(h.DB, r, identity.Email, nil, false, loginReasonSSOFailed)
+		writeError(w, r, "An account with this email already exists. Sign in to it and link "+identity.Provider+" from your account settings.", http.StatusConflict)
+		return
+	case errSignupPending:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(SSOPendingResponse{
+			Status:  models.RequestStatusPending,
+			Message: "Your account is awaiting approval",
+		})
+		return
+	case errSignupRejected:
+		writeError(w, r, "Your signup was not approved", http.StatusForbidden)
+		return
+	default:
+		writeDBError(w, r, err)
+		return
+	}
+
+	session, err := newSession(h.DB, user)
+	if err != nil {
+		writeError(w, r, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	recordLoginAttempt(h.DB, r, user.Email, &user.Id, true, loginReasonSuccess)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(session)
+}
+
+// resolveSSOUser finds the user for a provider identity.
+//
+// A linked identity signs in its user. Otherwise a verified email links the identity to the
+// account with that email, if that account has no password or its own email is verified too;
+// someone could have registered with an email they do not own. An unverified provider email
+// never links. First-time users are created in the requested or default department, or
+// queued for approval when the onboarding queue is on.
+func (h Auth) resolveSSOUser(identity ssoIdentity, departmentID uuid.UUID) (models.User, error) {
+	var linked models.Identity
+	err := h.DB.Preload("User.Department").
+		First(&linked, "provider = ? AND subject = ?", identity.Provider, identity.Subject).Error
+	if err == nil {
+		now := time.Now()
+		h.DB.Model(&linked).Updates(map[string]interface{}{"last_used_at": &now, "email": identity.Email})
+		return linked.User, nil
+	}
+	if err != gorm.ErrRecordNotFound {
+		return models.User{}, err
+	}
+
+	if !ValidateEmail(identity.Email) {
+		return models.User{}, errUnverifiedEmail
+	}
+
+	var user models.User
+	err = h.DB.Preload("Department").First(&user, "email = ?", identity.Email).Error
+	if err == nil {
+		if !identity.EmailVerified || user.PasswordHash != "" && user.EmailVerifiedAt == nil {
+			return models.User{}, errEmailTaken
+		}
+		if err := linkIdentity(h.DB, user.Id, identity); err != nil {
+			return models.User{}, err
+		}
+		return user, nil
+	}
+	if err != gorm.ErrRecordNotFound {
+		return models.User{}, err
+	}
+
+	if !identity.EmailVerified {
+		return models.User{}, errUnverifiedEmail
+	}
+
+	settings, err := loadSSOSettings(h.DB)
+	if err != nil {
+		return models.User{}, err
+	}
+
+	if !settings.OnboardingQueue {
+		if departmentID != uuid.Nil && !departmentExists(h.DB, departmentID) {
+			departmentID = uuid.Nil
+		}
+		if departmentID == uuid.Nil && settings.DefaultDepartmentId != nil {
+			departmentID = *settings.DefaultDepartmentId
+		}
+	}
+
+	// Without a department to put them in, first-time users wait for someone to place them
+	if settings.OnboardingQueue || departmentID == uuid.Nil {
+		return models.User{}, queueSSOSignup(h.DB, identity)
+	}
+
+	user, err = createSSOUser(h.DB, identity, departmentID, models.RoleEmployee)
+	if err != nil {
+		return models.User{}, err
+	}
+
+	h.DB.Preload("Department").First(&user, "id = ?", user.Id)
+	return user, nil
+}
+
+// createSSOUser creates a password-less account with the identity linked
+func createSSOUser(db *gorm.DB, identity ssoIdentity, departmentID uuid.UUID, role models.Role) (models.User, error) {
+	name := identity.Name
+	if name == "" {
+		name = identity.Email
+	}
+
+	now := time.Now()
+	user := models.User{
+		Id:              uuid.New(),
+		Name:            name,
+		Email:           identity.Email,
+		PasswordHash:    "", // No password for SSO users
+		DepartmentId:    departmentID,
+		Role:            role,
+		EmailVerifiedAt: &now, // only verified provider emails get here
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		return linkIdentity(tx, user.Id, identity)
+	})
+
+	return user, err
+}
+
+// linkIdentity stores a provider identity for the user
+func linkIdentity(db *gorm.DB, userID uuid.UUID, identity ssoIdentity) error {
+	now := time.Now()
+	return db.Create(&models.Identity{
+		Id:         uuid.New(),
+		UserId:     userID,
+		Provider:   identity.Provider,
+		Subject:    identity.Subject,
+		Email:      identity.Email,
+		LastUsedAt: &now,
+	}).Error
+}
+
+// queueSSOSignup records a first-time SSO user for approval and returns the state of their request
+func queueSSOSignup(db *gorm.DB, identity ssoIdentity) error {
+	var signup models.SSOSignup
+	err := db.First(&signup, "provider = ? AND subject = ?", identity.Provider, identity.Subject).Error
+	if err == gorm.ErrRecordNotFound {
+		name := identity.Name
+		if name == "" {
+			name = identity.Email
+		}
+
+		err = db.Create(&models.SSOSignup{
+			Id:       uuid.New(),
+			Provider: identity.Provider,
+			Subject:  identity.Subject,
+			Email:    identity.Email,
+			Name:     name,
+			Status:   models.RequestStatusPending,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return errSignupPending
+	}
+	if err != nil {
+		return err
+	}
+
+	switch signup.Status {
+	case models.RequestStatusRejected:
+		return errSignupRejected
+	case models.RequestStatusApproved:
+		// The account made on approval is gone; ask again
+		db.Model(&signup).Updates(map[string]interface{}{"status": models.RequestStatusPending, "user_id": nil})
+	}
+	return errSignupPending
+}
+
+// loadSSOSettings returns the SSO settings, or the defaults when none are saved
+func loadSSOSettings(db *gorm.DB) (models.SSOSettings, error) {
+	var settings models.SSOSettings
+	err := db.First(&settings, 1).Error
+	if err == gorm.ErrRecordNotFound {
+		return models.SSOSettings{Id: 1, OnboardingQueue: true}, nil
+	}
+	return settings, err
+}
+
+// departmentExists reports whether a department with the ID exists
+func departmentExists(db *gorm.DB, id uuid.UUID) bool {
+	var count int64
+	db.Model(&models.Department{}).Where("id = ?", id).Count(&count)
+	return count > 0
+}
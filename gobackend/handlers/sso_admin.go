@@ -0,0 +1,288 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"stuff/models"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// SSOAdmin holds DB for SSO settings and onboarding handlers
+type SSOAdmin struct {
+	DB *gorm.DB
+}
+
+type SSOSettingsRequest struct {
+	DefaultDepartmentId *uuid.UUID `json:"default_department_id"`
+	OnboardingQueue     bool       `json:"onboarding_queue"`
+}
+
+type ApproveSignupRequest struct {
+	DepartmentId uuid.UUID   `json:"department_id"`
+	Role         models.Role `json:"role"`
+}
+
+// GetSettings godoc
+// @Summary      Get SSO settings
+// @Description  Where first-time SSO users end up: a default department, or the onboarding queue
+// @Tags         sso
+// @Produce      json
+// @Success      200  {object}  models.SSOSettings
+// @Failure      403  {object}  Problem  "forbidden"
+// @Security     BearerAuth
+// @Router       /sso/settings [get]
+func (h SSOAdmin) GetSettings(w http.ResponseWriter, r *http.Request) {
+	settings, err := loadSSOSettings(h.DB)
+	if err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+// UpdateSettings godoc
+// @Summary      Update SSO settings
+// @Description  With the onboarding queue on, first-time SSO users wait for approval. With it off they are created in the department they asked for or the default department.
+// @Tags         sso
+// @Accept       json
+// @Produce      json
+// @Param        settings  body      SSOSettingsRequest  true  "Settings"
+// @Success      200  {object}  models.SSOSettings
+// @Failure      400  {object}  Problem  "unknown department"
+// @Failure      403  {object}  Problem  "forbidden"
+// @Security     BearerAuth
+// @Router       /sso/settings [put]
+func (h SSOAdmin) UpdateSettings(w http.ResponseWriter, r *http.Request) {
+	var req SSOSettingsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+
+	if req.DefaultDepartmentId != nil && !departmentExists(h.DB, *req.DefaultDepartmentId) {
+		writeValidation(w, r, FieldError{Field: "default_department_id", Code: FieldUnknown, Message: "unknown department"})
+		return
+	}
+
+	settings := models.SSOSettings{
+		Id:                  1,
+		DefaultDepartmentId: req.DefaultDepartmentId,
+		OnboardingQueue:     req.OnboardingQueue,
+	}
+
+	if err := h.DB.Save(&settings).Error; err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+// ssoSignupListSpec controls filtering and sorting for GET /sso/signups
+var ssoSignupListSpec = listSpec{
+	filters: map[string]filterFunc{
+		"status":   enumFilter("status", func(s string) bool { return models.RequestStatus(s).Valid() }),
+		"provider": eqFilter("provider"),
+		"q":        searchFilter("name", "email"),
+	},
+	sorts: map[string]string{
+		"created_at": "created_at",
+		"name":       "name",
+		"email":      "email",
+	},
+	defaultSort: "created_at",
+}
+
+// ListSignups godoc
+// @Summary      List SSO signups
+// @Description  First-time SSO users in the onboarding queue, oldest first.
+// @Description  Paged with limit/offset or cursor. See X-Total-Count, X-Next-Cursor and Link.
+// @Tags         sso
+// @Produce      json
+// @Param        status    query     string  false  "PENDING (default), APPROVED or REJECTED; comma-separated for several"
+// @Param        provider  query     string  false  "Provider, e.g. google"
+// @Param        q         query     string  false  "Search in name and email"
+// @Param        sort      query     string  false  "created_at, name or email; prefix - for descending (default created_at)"
+// @Param        fields    query     string  false  "Fields to return, e.g. id,email,status"
+// @Param        limit     query     int     false  "Page size (default 50, max 200)"
+// @Param        offset    query     int     false  "Rows to skip"
+// @Param        cursor    query     string  false  "X-Next-Cursor of the previous page"
+// @Success      200  {array}   models.SSOSignup
+// @Failure      400  {object}  Problem  "invalid filter, sort or cursor"
+// @Failure      403  {object}  Problem  "forbidden"
+// @Security     BearerAuth
+// @Router       /sso/signups [get]
+func (h SSOAdmin) ListSignups(w http.ResponseWriter, r *http.Request) {
+	query := h.DB
+	if r.URL.Query().Get("status") == "" {
+		query = query.Where("status = ?", models.RequestStatusPending)
+	}
+
+	serveList[models.SSOSignup](w, r, query, ssoSignupListSpec)
+}
+
+// ApproveSignup godoc
+// @Summary      Approve an SSO signup
+// @Description  Create the account in the given department and link the provider login. The user can sign in right away.
+// @Tags         sso
+// @Accept       json
+// @Produce      json
+// @Param        id    path      string                true  "Signup ID"
+// @Param        body  body      ApproveSignupRequest  true  "Department and role"
+// @Success      201  {object}  models.User
+// @Failure      400  {object}  Problem  "invalid request"
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      404  {object}  Problem  "signup not found"
+// @Failure      409  {object}  Problem  "signup already handled or email taken"
+// @Security     BearerAuth
+// @Router       /sso/signups/{id}/approve [post]
+func (h SSOAdmin) ApproveSignup(w http.ResponseWriter, r *http.Request) {
+	id, ok := uuidParam(w, r, "id")
+	if !ok {
+		return
+	}
+
+	var req ApproveSignupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+
+	if req.Role == "" {
+		req.Role = models.RoleEmployee
+	}
+
+	if !req.Role.Valid() {
+		writeValidation(w, r, FieldError{Field: "role", Code: FieldInvalid, Message: "invalid role"})
+		return
+	}
+
+	// Only admins may hand out roles other than employee
+	if req.Role != models.RoleEmployee && !hasRole(r, models.RoleAdmin) {
+		writeError(w, r, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	if !departmentExists(h.DB, req.DepartmentId) {
+		writeValidation(w, r, FieldError{Field: "department_id", Code: FieldUnknown, Message: "unknown department"})
+		return
+	}
+
+	reviewerID, _ := currentUserID(r)
+	errHandled := errors.New("signup already handled")
+	errTaken := errors.New("email taken")
+
+	var user models.User
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		var signup models.SSOSignup
+		if err := tx.First(&signup, "id = ?", id).Error; err != nil {
+			return err
+		}
+		if signup.Status != models.RequestStatusPending {
+			return errHandled
+		}
+
+		var count int64
+		if err := tx.Model(&models.User{}).Where("email = ?", signup.Email).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return errTaken
+		}
+
+		identity := ssoIdentity{
+			Provider: signup.Provider,
+			Subject:  signup.Subject,
+			Email:    signup.Email,
+			Name:     signup.Name,
+		}
+
+		var err error
+		user, err = createSSOUser(tx, identity, req.DepartmentId, req.Role)
+		if err != nil {
+			return err
+		}
+
+		return tx.Model(&signup).Updates(map[string]interface{}{
+			"status":              models.RequestStatusApproved,
+			"user_id":             user.Id,
+			"reviewed_by_user_id": reviewerID,
+			"updated_at":          time.Now(),
+		}).Error
+	})
+
+	switch err {
+	case nil:
+	case gorm.ErrRecordNotFound:
+		writeError(w, r, "signup not found", http.StatusNotFound)
+		return
+	case errHandled:
+		writeError(w, r, "signup already handled", http.StatusConflict)
+		return
+	case errTaken:
+		writeError(w, r, "an account with this email already exists; the user should sign in to it and link the provider", http.StatusConflict)
+		return
+	default:
+		writeDBError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(user)
+}
+
+// RejectSignup godoc
+// @Summary      Reject an SSO signup
+// @Tags         sso
+// @Param        id   path      string  true  "Signup ID"
+// @Success      204  "No Content"
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      404  {object}  Problem  "signup not found"
+// @Security     BearerAuth
+// @Router       /sso/signups/{id}/reject [post]
+func (h SSOAdmin) RejectSignup(w http.ResponseWriter, r *http.Request) {
+	id, ok := uuidParam(w, r, "id")
+	if !ok {
+		return
+	}
+
+	reviewerID, _ := currentUserID(r)
+
+	result := h.DB.Model(&models.SSOSignup{}).
+		Where("id = ? AND status = ?", id, models.RequestStatusPending).
+		Updates(map[string]interface{}{
+			"status":              models.RequestStatusRejected,
+			"reviewed_by_user_id": reviewerID,
+		})
+
+	if result.Error != nil {
+		writeDBError(w, r, result.Error)
+		return
+	}
+
+	if result.RowsAffected == 0 {
+		writeError(w, r, "signup not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RegisterSSOAdmin registers SSO settings and onboarding routes
+func RegisterSSOAdmin(router *mux.Router, h SSOAdmin, prefix string) {
+	router.HandleFunc(prefix+"/settings", Authorize(h.GetSettings, AdminRoles)).Methods("GET")
+	router.HandleFunc(prefix+"/settings", Authorize(h.UpdateSettings, AdminRoles)).Methods("PUT")
+	router.HandleFunc(prefix+"/signups", Authorize(h.ListSignups, PeopleRoles)).Methods("GET")
+	router.HandleFunc(prefix+"/signups/{id}/approve", Authorize(h.ApproveSignup, PeopleRoles)).Methods("POST")
+	router.HandleFunc(prefix+"/signups/{id}/reject", Authorize(h.RejectSignup, PeopleRoles)).Methods("POST")
+}
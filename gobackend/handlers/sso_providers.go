@@ -0,0 +1,509 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ssoProvider is an OAuth 2.0 / OpenID Connect identity provider.
+//
+// Providers with an Issuer are OpenID Connect providers: endpoints are discovered from
+// {issuer}/.well-known/openid-configuration and the ID token is verified against the
+// provider's JWKS. Providers without an Issuer (GitHub) are plain OAuth 2.0 and the
+// profile is read from UserInfoURL.
+type ssoProvider struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	AuthURL      string
+	TokenURL     string
+	UserInfoURL  string
+	// EmailsURL lists the account's addresses when the profile has no verified email (GitHub)
+	EmailsURL string
+	// TrustEmail treats the provider's email as verified even without an email_verified claim
+	TrustEmail bool
+
+	mu         sync.Mutex
+	discovered bool
+	keys       *remoteKeySet
+}
+
+// ssoIdentity is the verified result of a provider login
+type ssoIdentity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// ssoTokenResponse is the token endpoint response
+type ssoTokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// oidcClaims are the ID token claims we use
+type oidcClaims struct {
+	Email             string       `json:"email"`
+	EmailVerified     flexibleBool `json:"email_verified"`
+	Name              string       `json:"name"`
+	PreferredUsername string       `json:"preferred_username"`
+	Nonce             string       `json:"nonce"`
+	TenantID          string       `json:"tid"`
+	jwt.RegisteredClaims
+}
+
+// ssoPresets are the built-in providers; each is enabled once it has a client ID
+var ssoPresets = map[string]*ssoProvider{
+	"github": {
+		AuthURL:     "https://github.com/login/oauth/authorize",
+		TokenURL:    "https://github.com/login/oauth/access_token",
+		UserInfoURL: "https://api.github.com/user",
+		EmailsURL:   "https://api.github.com/user/emails",
+		Scopes:      []string{"read:user", "user:email"},
+	},
+	"google": {
+		Issuer: "https://accounts.google.com",
+		Scopes: []string{"openid", "email", "profile"},
+	},
+	"entra": {
+		Scopes: []string{"openid", "email", "profile"},
+	},
+}
+
+var (
+	ssoProvidersOnce sync.Once
+	ssoProviders     map[string]*ssoProvider
+)
+
+// getSSOProviders returns the configured providers by name.
+//
+// Every provider is configured with SSO_<NAME>_CLIENT_ID, SSO_<NAME>_CLIENT_SECRET,
+// SSO_<NAME>_ISSUER, SSO_<NAME>_SCOPES, SSO_<NAME>_AUTH_URL, SSO_<NAME>_TOKEN_URL,
+// SSO_<NAME>_USERINFO_URL and SSO_<NAME>_TRUST_EMAIL. Besides the built-in github,
+// google and entra presets, SSO_PROVIDERS names additional providers.
+func getSSOProviders() map[string]*ssoProvider {
+	ssoProvidersOnce.Do(func() {
+		ssoProviders = map[string]*ssoProvider{}
+
+		names := map[string]bool{}
+		for name := range ssoPresets {
+			names[name] = true
+		}
+		for _, name := range strings.Split(os.Getenv("SSO_PROVIDERS"), ",") {
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				names[name] = true
+			}
+		}
+
+		for name := range names {
+			preset, ok := ssoPresets[name]
+			if !ok {
+				preset = &ssoProvider{}
+			}
+			if p := loadSSOProvider(name, preset); p != nil {
+				ssoProviders[name] = p
+			}
+		}
+	})
+	return ssoProviders
+}
+
+// loadSSOProvider applies the environment configuration on top of a preset; nil if the provider has no client ID
+func loadSSOProvider(name string, preset *ssoProvider) *ssoProvider {
+	env := func(key string) string {
+		return strings.TrimSpace(os.Getenv("SSO_" + strings.ToUpper(name) + "_" + key))
+	}
+
+	p := &ssoProvider{
+		Name:         name,
+		Issuer:       preset.Issuer,
+		ClientID:     env("CLIENT_ID"),
+		ClientSecret: env("CLIENT_SECRET"),
+		Scopes:       preset.Scopes,
+		AuthURL:      preset.AuthURL,
+		TokenURL:     preset.TokenURL,
+		UserInfoURL:  preset.UserInfoURL,
+		EmailsURL:    preset.EmailsURL,
+		TrustEmail:   strings.EqualFold(env("TRUST_EMAIL"), "true"),
+	}
+
+	// Settings from before the provider registry
+	switch name {
+	case "github":
+		if p.ClientID == "" {
+			p.ClientID = os.Getenv("GITHUB_CLIENT_ID")
+			p.ClientSecret = os.Getenv("GITHUB_CLIENT_SECRET")
+		}
+	case "google":
+		if p.ClientID == "" {
+			if ids := getGoogleClientIDs(); len(ids) > 0 {
+				p.ClientID = ids[0]
+			}
+			p.ClientSecret = os.Getenv("GOOGLE_CLIENT_SECRET")
+		}
+	case "entra":
+		tenant := env("TENANT")
+		if tenant == "" {
+			tenant = "common"
+		}
+		p.Issuer = "https://login.microsoftonline.com/" + tenant + "/v2.0"
+	}
+
+	if p.ClientID == "" {
+		return nil
+	}
+
+	if v := env("ISSUER"); v != "" {
+		p.Issuer = strings.TrimSuffix(v, "/")
+	}
+	if v := env("SCOPES"); v != "" {
+		p.Scopes = strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ' ' })
+	}
+	if len(p.Scopes) == 0 && p.isOIDC() {
+		p.Scopes = []string{"openid", "email", "profile"}
+	}
+	if v := env("AUTH_URL"); v != "" {
+		p.AuthURL = v
+	}
+	if v := env("TOKEN_URL"); v != "" {
+		p.TokenURL = v
+	}
+	if v := env("USERINFO_URL"); v != "" {
+		p.UserInfoURL = v
+	}
+
+	return p
+}
+
+// getSSOProvider looks up a configured provider
+func getSSOProvider(name string) (*ssoProvider, bool) {
+	p, ok := getSSOProviders()[strings.ToLower(name)]
+	return p, ok
+}
+
+// ssoProviderNames returns the configured provider names in order
+func ssoProviderNames() []string {
+	names := []string{}
+	for name := range getSSOProviders() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// isOIDC reports whether the provider issues ID tokens
+func (p *ssoProvider) isOIDC() bool {
+	return p.Issuer != ""
+}
+
+// discover loads the provider's OpenID configuration once; explicitly configured endpoints win
+func (p *ssoProvider) discover() error {
+	if !p.isOIDC() {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovered {
+		return nil
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(p.Issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return fmt.Errorf("%s discovery failed: %v", p.Name, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s discovery failed: status code %d", p.Name, resp.StatusCode)
+	}
+
+	var config struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		UserinfoEndpoint      string `json:"userinfo_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&config); err != nil {
+		return fmt.Errorf("%s discovery failed: %v", p.Name, err)
+	}
+
+	// Multi-tenant Entra ID publishes a {tenantid} template as its issuer
+	if config.Issuer != p.Issuer && !strings.Contains(config.Issuer, "{tenantid}") {
+		return fmt.Errorf("%s discovery returned issuer %q", p.Name, config.Issuer)
+	}
+	if config.JWKSURI == "" {
+		return fmt.Errorf("%s discovery returned no jwks_uri", p.Name)
+	}
+
+	if p.AuthURL == "" {
+		p.AuthURL = config.AuthorizationEndpoint
+	}
+	if p.TokenURL == "" {
+		p.TokenURL = config.TokenEndpoint
+	}
+	if p.UserInfoURL == "" {
+		p.UserInfoURL = config.UserinfoEndpoint
+	}
+	if config.Issuer != p.Issuer {
+		p.Issuer = config.Issuer
+	}
+
+	p.keys = newRemoteKeySet(config.JWKSURI)
+	p.discovered = true
+	return nil
+}
+
+// authorizationURL builds the URL the user is sent to, with PKCE (S256), state and nonce
+func (p *ssoProvider) authorizationURL(redirectURI, state, nonce, codeChallenge string) (string, error) {
+	if err := p.discover(); err != nil {
+		return "", err
+	}
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.ClientID)
+	params.Set("redirect_uri", redirectURI)
+	params.Set("scope", strings.Join(p.Scopes, " "))
+	params.Set("state", state)
+	params.Set("code_challenge", codeChallenge)
+	params.Set("code_challenge_method", "S256")
+	if p.isOIDC() {
+		params.Set("nonce", nonce)
+	}
+
+	separator := "?"
+	if strings.Contains(p.AuthURL, "?") {
+		separator = "&"
+	}
+	return p.AuthURL + separator + params.Encode(), nil
+}
+
+// exchangeCode redeems an authorization code at the token endpoint
+func (p *ssoProvider) exchangeCode(code, codeVerifier, redirectURI string) (*ssoTokenResponse, error) {
+	if err := p.discover(); err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURI)
+	form.Set("client_id", p.ClientID)
+	form.Set("code_verifier", codeVerifier)
+	if p.ClientSecret != "" {
+		form.Set("client_secret", p.ClientSecret)
+	}
+
+	req, err := http.NewRequest("POST", p.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exchange code: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var tokens ssoTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("failed to parse token response: %v", err)
+	}
+
+	// GitHub reports errors with status 200
+	if tokens.Error != "" {
+		return nil, fmt.Errorf("code exchange rejected: %s", tokens.Error)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.AccessToken == "" {
+		return nil, fmt.Errorf("code exchange failed: status code %d", resp.StatusCode)
+	}
+	if p.isOIDC() && tokens.IDToken == "" {
+		return nil, errors.New("provider returned no ID token")
+	}
+
+	return &tokens, nil
+}
+
+// verifyIDToken checks an ID token's signature, issuer, audience, expiry and nonce
+func (p *ssoProvider) verifyIDToken(idToken, expectedNonce string) (*oidcClaims, error) {
+	if err := p.discover(); err != nil {
+		return nil, err
+	}
+
+	var claims oidcClaims
+	_, err := jwt.ParseWithClaims(idToken, &claims, p.keys.keyFunc,
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512", "EdDSA"}),
+		jwt.WithAudience(p.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(1*time.Minute),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify ID token: %v", err)
+	}
+
+	issuer := strings.ReplaceAll(p.Issuer, "{tenantid}", claims.TenantID)
+	if claims.Issuer != issuer {
+		return nil, errors.New("invalid ID token issuer")
+	}
+
+	if expectedNonce == "" || subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(expectedNonce)) != 1 {
+		return nil, errors.New("invalid ID token nonce")
+	}
+
+	if claims.Subject == "" {
+		return nil, errors.New("ID token has no subject")
+	}
+
+	return &claims, nil
+}
+
+// identity turns a token response into the verified identity of the user
+func (p *ssoProvider) identity(tokens *ssoTokenResponse, expectedNonce string) (ssoIdentity, error) {
+	id := ssoIdentity{Provider: p.Name}
+
+	if p.isOIDC() {
+		claims, err := p.verifyIDToken(tokens.IDToken, expectedNonce)
+		if err != nil {
+			return id, err
+		}
+		id.Subject = claims.Subject
+		id.Email = claims.Email
+		id.EmailVerified = bool(claims.EmailVerified)
+		id.Name = claims.Name
+		if id.Name == "" {
+			id.Name = claims.PreferredUsername
+		}
+	}
+
+	// Plain OAuth providers, and OIDC providers that leave the email out of the ID token
+	if (!p.isOIDC() || id.Email == "") && p.UserInfoURL != "" {
+		if err := p.readUserInfo(tokens.AccessToken, &id); err != nil {
+			return id, err
+		}
+	}
+
+	if id.Subject == "" {
+		return id, errors.New("provider returned no user ID")
+	}
+
+	if p.TrustEmail && id.Email != "" {
+		id.EmailVerified = true
+	}
+
+	return id, nil
+}
+
+// readUserInfo fills in the identity from the userinfo endpoint (and the emails endpoint for GitHub)
+func (p *ssoProvider) readUserInfo(accessToken string, id *ssoIdentity) error {
+	var info map[string]interface{}
+	if err := p.getJSON(p.UserInfoURL, accessToken, &info); err != nil {
+		return fmt.Errorf("failed to get user info: %v", err)
+	}
+
+	// OIDC userinfo has "sub"; GitHub has a numeric "id"
+	subject := jsonString(info["sub"])
+	if subject == "" {
+		subject = jsonString(info["id"])
+	}
+	if id.Subject != "" && subject != "" && subject != id.Subject {
+		return errors.New("user info does not match the ID token")
+	}
+	if id.Subject == "" {
+		id.Subject = subject
+	}
+
+	if id.Name == "" {
+		id.Name = jsonString(info["name"])
+	}
+	if id.Name == "" {
+		id.Name = jsonString(info["login"])
+	}
+
+	if email := jsonString(info["email"]); email != "" && id.Email == "" {
+		id.Email = email
+		verified, _ := info["email_verified"].(bool)
+		id.EmailVerified = verified || jsonString(info["email_verified"]) == "true"
+	}
+
+	if !id.EmailVerified && p.EmailsURL != "" {
+		var emails []struct {
+			Email    string `json:"email"`
+			Primary  bool   `json:"primary"`
+			Verified bool   `json:"verified"`
+		}
+		if err := p.getJSON(p.EmailsURL, accessToken, &emails); err == nil {
+			for _, e := range emails {
+				if e.Primary && e.Verified {
+					id.Email = e.Email
+					id.EmailVerified = true
+					break
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// getJSON performs an authenticated GET and decodes the JSON response
+func (p *ssoProvider) getJSON(endpoint, accessToken string, out interface{}) error {
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status code %d", resp.StatusCode)
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	decoder.UseNumber()
+	return decoder.Decode(out)
+}
+
+// jsonString converts a decoded JSON string or number to a string
+func jsonString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,514 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+// mockIdP is a minimal OpenID Connect provider: discovery, an authorization endpoint
+// that issues codes bound to the PKCE challenge, a token endpoint that checks the
+// verifier and signs ID tokens, and userinfo.
+type mockIdP struct {
+	srv          *httptest.Server
+	jwks         *testJWKS
+	clientID     string
+	clientSecret string
+
+	mu          sync.Mutex
+	grants      map[string]mockGrant
+	discoveries int
+	// claims is applied to every ID token, e.g. to omit the email
+	claims func(jwt.MapClaims)
+}
+
+type mockGrant struct {
+	challenge   string
+	redirectURI string
+	nonce       string
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+	idp := &mockIdP{
+		jwks:         newTestJWKS(t),
+		clientID:     "office-app",
+		clientSecret: "s3cret",
+		grants:       map[string]mockGrant{},
+	}
+	idp.jwks.addKey(t, "idp-1")
+
+	routes := http.NewServeMux()
+	routes.HandleFunc("/.well-known/openid-configuration", idp.discovery)
+	routes.HandleFunc("/authorize", idp.authorize)
+	routes.HandleFunc("/token", idp.token)
+	routes.HandleFunc("/userinfo", idp.userinfo)
+	idp.srv = httptest.NewServer(routes)
+	t.Cleanup(idp.srv.Close)
+	return idp
+}
+
+// provider configures a provider for the IdP the way the environment would
+func (idp *mockIdP) provider(t *testing.T) *ssoProvider {
+	t.Helper()
+	t.Setenv("SSO_MOCK_CLIENT_ID", idp.clientID)
+	t.Setenv("SSO_MOCK_CLIENT_SECRET", idp.clientSecret)
+	t.Setenv("SSO_MOCK_ISSUER", idp.srv.URL+"/")
+	p := loadSSOProvider("mock", &ssoProvider{})
+	if p == nil {
+		t.Fatal("provider not configured")
+	}
+	return p
+}
+
+func (idp *mockIdP) discovery(w http.ResponseWriter, r *http.Request) {
+	idp.mu.Lock()
+	idp.discoveries++
+	idp.mu.Unlock()
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 idp.srv.URL,
+		"authorization_endpoint": idp.srv.URL + "/authorize",
+		"token_endpoint":         idp.srv.URL + "/token",
+		"userinfo_endpoint":      idp.srv.URL + "/userinfo",
+		"jwks_uri":               idp.jwks.srv.URL,
+	})
+}
+
+func (idp *mockIdP) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("response_type") != "code" || q.Get("client_id") != idp.clientID ||
+		q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "invalid_request", http.StatusBadRequest)
+		return
+	}
+
+	code, _ := newOpaqueToken()
+	idp.mu.Lock()
+	idp.grants[code] = mockGrant{
+		challenge:   q.Get("code_challenge"),
+		redirectURI: q.Get("redirect_uri"),
+		nonce:       q.Get("nonce"),
+	}
+	idp.mu.Unlock()
+
+	redirect, _ := url.Parse(q.Get("redirect_uri"))
+	params := redirect.Query()
+	params.Set("code", code)
+	params.Set("state", q.Get("state"))
+	redirect.RawQuery = params.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (idp *mockIdP) token(w http.ResponseWriter, r *http.Request) {
+	tokenError := func(code string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": code})
+	}
+
+	if r.Method != "POST" || r.FormValue("grant_type") != "authorization_code" {
+		tokenError("unsupported_grant_type")
+		return
+	}
+	if r.FormValue("client_id") != idp.clientID || r.FormValue("client_secret") != idp.clientSecret {
+		tokenError("invalid_client")
+		return
+	}
+
+	// Codes work once, for the redirect URI and PKCE verifier they were issued for
+	idp.mu.Lock()
+	grant, ok := idp.grants[r.FormValue("code")]
+	delete(idp.grants, r.FormValue("code"))
+	claimsFunc := idp.claims
+	idp.mu.Unlock()
+	if !ok || grant.redirectURI != r.FormValue("redirect_uri") || pkceChallenge(r.FormValue("code_verifier")) != grant.challenge {
+		tokenError("invalid_grant")
+		return
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":            idp.srv.URL,
+		"aud":            idp.clientID,
+		"sub":            "mock-user-1",
+		"email":          "grace@example.com",
+		"email_verified": true,
+		"name":           "Grace Hopper",
+		"nonce":          grant.nonce,
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+	}
+	if claimsFunc != nil {
+		claimsFunc(claims)
+	}
+	idToken, err := idp.sign(claims)
+	if err != nil {
+		tokenError("server_error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token": "at-" + grant.challenge,
+		"token_type":   "Bearer",
+		"id_token":     idToken,
+	})
+}
+
+func (idp *mockIdP) userinfo(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer at-") {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sub":            "mock-user-1",
+		"email":          "grace@userinfo.example.com",
+		"email_verified": "true",
+	})
+}
+
+func (idp *mockIdP) sign(claims jwt.MapClaims) (string, error) {
+	idp.jwks.mu.Lock()
+	key := idp.jwks.keys["idp-1"]
+	idp.jwks.mu.Unlock()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "idp-1"
+	return token.SignedString(key)
+}
+
+// login runs the browser part of the flow and returns the code and state from the redirect
+func (idp *mockIdP) login(t *testing.T, authURL string) (code, state string) {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize status = %d", resp.StatusCode)
+	}
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return location.Query().Get("code"), location.Query().Get("state")
+}
+
+const mockRedirectURI = "officeas://auth"
+
+func TestSSOProviderDiscovery(t *testing.T) {
+	idp := newMockIdP(t)
+	p := idp.provider(t)
+
+	if p.Issuer != idp.srv.URL {
+		t.Errorf("issuer = %q, want trailing slash trimmed", p.Issuer)
+	}
+	if strings.Join(p.Scopes, " ") != "openid email profile" {
+		t.Errorf("scopes = %v, want the OpenID defaults", p.Scopes)
+	}
+
+	for range 2 {
+		if err := p.discover(); err != nil {
+			t.Fatalf("discover: %v", err)
+		}
+	}
+	if idp.discoveries != 1 {
+		t.Errorf("discoveries = %d, want 1", idp.discoveries)
+	}
+	if p.AuthURL != idp.srv.URL+"/authorize" || p.TokenURL != idp.srv.URL+"/token" || p.UserInfoURL != idp.srv.URL+"/userinfo" {
+		t.Errorf("endpoints = %q %q %q", p.AuthURL, p.TokenURL, p.UserInfoURL)
+	}
+	if p.keys == nil || p.keys.url != idp.jwks.srv.URL {
+		t.Errorf("keys not loaded from jwks_uri")
+	}
+
+	// Configured endpoints win over discovery
+	t.Setenv("SSO_MOCK_TOKEN_URL", "https://token.example.com")
+	p = idp.provider(t)
+	if err := p.discover(); err != nil {
+		t.Fatalf("discover: %v", err)
+	}
+	if p.TokenURL != "https://token.example.com" {
+		t.Errorf("token URL = %q, want the configured one", p.TokenURL)
+	}
+}
+
+func TestSSOProviderDiscoveryErrors(t *testing.T) {
+	documents := map[string]map[string]string{
+		"issuer mismatch": {"issuer": "https://evil.example.com", "jwks_uri": "https://evil.example.com/keys"},
+		"no jwks_uri":     {},
+	}
+	for name, doc := range documents {
+		t.Run(name, func(t *testing.T) {
+			var srv *httptest.Server
+			srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if doc["issuer"] == "" {
+					doc["issuer"] = srv.URL
+				}
+				json.NewEncoder(w).Encode(doc)
+			}))
+			defer srv.Close()
+
+			p := &ssoProvider{Name: "mock", Issuer: srv.URL, ClientID: "office-app"}
+			if err := p.discover(); err == nil {
+				t.Fatal("discover accepted the document")
+			}
+			if _, err := p.authorizationURL(mockRedirectURI, "s", "n", "c"); err == nil {
+				t.Error("authorization URL built without discovery")
+			}
+		})
+	}
+
+	p := &ssoProvider{Name: "mock", Issuer: "http://127.0.0.1:1", ClientID: "office-app"}
+	if err := p.discover(); err == nil {
+		t.Error("discover succeeded against an unreachable issuer")
+	}
+}
+
+func TestSSOProviderLogin(t *testing.T) {
+	idp := newMockIdP(t)
+	p := idp.provider(t)
+
+	verifier, _ := newOpaqueToken()
+	authURL, err := p.authorizationURL(mockRedirectURI, "state-123", "nonce-456", pkceChallenge(verifier))
+	if err != nil {
+		t.Fatalf("authorizationURL: %v", err)
+	}
+
+	parsed, _ := url.Parse(authURL)
+	q := parsed.Query()
+	want := map[string]string{
+		"response_type":         "code",
+		"client_id":             idp.clientID,
+		"redirect_uri":          mockRedirectURI,
+		"scope":                 "openid email profile",
+		"state":                 "state-123",
+		"nonce":                 "nonce-456",
+		"code_challenge":        pkceChallenge(verifier),
+		"code_challenge_method": "S256",
+	}
+	for key, value := range want {
+		if q.Get(key) != value {
+			t.Errorf("%s = %q, want %q", key, q.Get(key), value)
+		}
+	}
+	if q.Get("code_challenge") == verifier {
+		t.Error("verifier sent in the authorization URL")
+	}
+
+	code, state := idp.login(t, authURL)
+	if state != "state-123" {
+		t.Errorf("state = %q, want it returned unchanged", state)
+	}
+
+	tokens, err := p.exchangeCode(code, verifier, mockRedirectURI)
+	if err != nil {
+		t.Fatalf("exchangeCode: %v", err)
+	}
+	identity, err := p.identity(tokens, "nonce-456")
+	if err != nil {
+		t.Fatalf("identity: %v", err)
+	}
+	wantIdentity := ssoIdentity{Provider: "mock", Subject: "mock-user-1", Email: "grace@example.com", EmailVerified: true, Name: "Grace Hopper"}
+	if identity != wantIdentity {
+		t.Errorf("identity = %+v, want %+v", identity, wantIdentity)
+	}
+
+	// The code was redeemed
+	if _, err := p.exchangeCode(code, verifier, mockRedirectURI); err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Errorf("second exchange = %v, want invalid_grant", err)
+	}
+}
+
+func TestSSOProviderPKCE(t *testing.T) {
+	idp := newMockIdP(t)
+	p := idp.provider(t)
+
+	verifier, _ := newOpaqueToken()
+	authURL, err := p.authorizationURL(mockRedirectURI, "state", "nonce", pkceChallenge(verifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An intercepted code is useless without the verifier
+	code, _ := idp.login(t, authURL)
+	if _, err := p.exchangeCode(code, "guessed-verifier", mockRedirectURI); err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Errorf("exchange with wrong verifier = %v, want invalid_grant", err)
+	}
+
+	code, _ = idp.login(t, authURL)
+	if _, err := p.exchangeCode(code, verifier, "https://evil.example.com/cb"); err == nil {
+		t.Error("exchange with another redirect URI accepted")
+	}
+
+	// RFC 7636 appendix B
+	if got := pkceChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"); got != "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM" {
+		t.Errorf("pkceChallenge = %q", got)
+	}
+}
+
+func TestSSOProviderNonce(t *testing.T) {
+	idp := newMockIdP(t)
+	p := idp.provider(t)
+
+	verifier, _ := newOpaqueToken()
+	authURL, err := p.authorizationURL(mockRedirectURI, "state", "nonce-1", pkceChallenge(verifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := idp.login(t, authURL)
+	tokens, err := p.exchangeCode(code, verifier, mockRedirectURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An ID token from another login cannot be injected into this one
+	for _, nonce := range []string{"nonce-2", ""} {
+		if _, err := p.identity(tokens, nonce); err == nil || !strings.Contains(err.Error(), "nonce") {
+			t.Errorf("identity with nonce %q = %v, want a nonce error", nonce, err)
+		}
+	}
+}
+
+func TestSSOProviderVerifyIDToken(t *testing.T) {
+	idp := newMockIdP(t)
+	p := idp.provider(t)
+
+	tests := []struct {
+		name string
+		edit func(jwt.MapClaims)
+	}{
+		{"wrong audience", func(c jwt.MapClaims) { c["aud"] = "another-app" }},
+		{"wrong issuer", func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" }},
+		{"expired", func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() }},
+		{"no subject", func(c jwt.MapClaims) { delete(c, "sub") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := jwt.MapClaims{
+				"iss":   idp.srv.URL,
+				"aud":   idp.clientID,
+				"sub":   "mock-user-1",
+				"nonce": "n",
+				"iat":   time.Now().Unix(),
+				"exp":   time.Now().Add(time.Minute).Unix(),
+			}
+			if _, err := p.verifyIDToken(idp.jwks.sign(t, "idp-1", claims), "n"); err != nil {
+				t.Fatalf("valid token rejected: %v", err)
+			}
+			tt.edit(claims)
+			if _, err := p.verifyIDToken(idp.jwks.sign(t, "idp-1", claims), "n"); err == nil {
+				t.Error("token accepted")
+			}
+		})
+	}
+}
+
+func TestSSOProviderUserInfo(t *testing.T) {
+	idp := newMockIdP(t)
+	idp.claims = func(c jwt.MapClaims) {
+		delete(c, "email")
+		delete(c, "email_verified")
+	}
+	p := idp.provider(t)
+
+	verifier, _ := newOpaqueToken()
+	authURL, err := p.authorizationURL(mockRedirectURI, "state", "nonce", pkceChallenge(verifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := idp.login(t, authURL)
+	tokens, err := p.exchangeCode(code, verifier, mockRedirectURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without an email in the ID token it comes from userinfo, for the same subject
+	identity, err := p.identity(tokens, "nonce")
+	if err != nil {
+		t.Fatalf("identity: %v", err)
+	}
+	if identity.Email != "grace@userinfo.example.com" || !identity.EmailVerified {
+		t.Errorf("identity = %+v", identity)
+	}
+}
+
+func TestLoadSSOProvider(t *testing.T) {
+	if p := loadSSOProvider("mock", &ssoProvider{}); p != nil {
+		t.Error("provider enabled without a client ID")
+	}
+
+	t.Setenv("GITHUB_CLIENT_ID", "legacy-id")
+	t.Setenv("GITHUB_CLIENT_SECRET", "legacy-secret")
+	github := loadSSOProvider("github", ssoPresets["github"])
+	if github == nil || github.ClientID != "legacy-id" || github.isOIDC() {
+		t.Errorf("github = %+v, want the legacy settings and plain OAuth", github)
+	}
+
+	t.Setenv("SSO_ENTRA_CLIENT_ID", "entra-app")
+	t.Setenv("SSO_ENTRA_TENANT", "contoso")
+	t.Setenv("SSO_ENTRA_SCOPES", "openid, email")
+	t.Setenv("SSO_ENTRA_TRUST_EMAIL", "TRUE")
+	entra := loadSSOProvider("entra", ssoPresets["entra"])
+	if entra == nil || entra.Issuer != "https://login.microsoftonline.com/contoso/v2.0" {
+		t.Fatalf("entra = %+v", entra)
+	}
+	if strings.Join(entra.Scopes, " ") != "openid email" || !entra.TrustEmail {
+		t.Errorf("entra scopes = %v, trust email = %v", entra.Scopes, entra.TrustEmail)
+	}
+}
+
+// useSSOProvider makes p the only configured provider for the test
+func useSSOProvider(t *testing.T, p *ssoProvider) {
+	t.Helper()
+	getSSOProviders()
+	saved := ssoProviders
+	ssoProviders = map[string]*ssoProvider{p.Name: p}
+	t.Cleanup(func() { ssoProviders = saved })
+}
+
+func TestSSORequestValidation(t *testing.T) {
+	idp := newMockIdP(t)
+	useSSOProvider(t, idp.provider(t))
+	t.Setenv("SSO_REDIRECT_URIS", mockRedirectURI)
+	h := Auth{}
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		target  string
+		status  int
+	}{
+		{"unknown provider", h.SSOAuthorize, "/auth/sso/other/authorize", http.StatusNotFound},
+		{"redirect URI not allowed", h.SSOAuthorize, "/auth/sso/mock/authorize?redirect_uri=https://evil.example.com", http.StatusBadRequest},
+		{"callback for unknown provider", h.SSOCallback, "/auth/sso/other/callback?code=c&state=s", http.StatusNotFound},
+		{"provider error", h.SSOCallback, "/auth/sso/mock/callback?error=access_denied&state=s", http.StatusBadRequest},
+		{"missing state", h.SSOCallback, "/auth/sso/mock/callback?code=c", http.StatusBadRequest},
+		{"missing code", h.SSOCallback, "/auth/sso/mock/callback?state=s", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.target, nil)
+			r = mux.SetURLVars(r, map[string]string{"provider": strings.Split(tt.target, "/")[3]})
+			w := httptest.NewRecorder()
+			tt.handler(w, r)
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body.String())
+			}
+		})
+	}
+}
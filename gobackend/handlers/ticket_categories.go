@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"stuff/models"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// TicketCategories holds DB for ticket category handlers
+type TicketCategories struct {
+	DB *gorm.DB
+}
+
+// TicketCategoryRequest is the body for creating or updating a ticket category
+type TicketCategoryRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// ticketCategoryListSpec controls filtering and sorting for GET /ticket-categories
+var ticketCategoryListSpec = listSpec{
+	filters: map[string]filterFunc{
+		"q": searchFilter("name", "description"),
+	},
+	sorts: map[string]string{
+		"name":       "name",
+		"created_at": "created_at",
+	},
+	defaultSort: "name",
+}
+
+// List godoc
+// @Summary      Get all ticket categories
+// @Description  Paged with limit/offset or cursor. See X-Total-Count, X-Next-Cursor and Link.
+// @Tags         tickets
+// @Produce      json
+// @Param        q       query     string  false  "Search in name and description"
+// @Param        sort    query     string  false  "name or created_at; prefix - for descending (default name)"
+// @Param        fields  query     string  false  "Fields to return, e.g. id,name"
+// @Param        limit   query     int     false  "Page size (default 50, max 200)"
+// @Param        offset  query     int     false  "Rows to skip"
+// @Param        cursor  query     string  false  "X-Next-Cursor of the previous page"
+// @Success      200  {array}   models.TicketCategory
+// @Failure      400  {object}  Problem  "invalid filter, sort or cursor"
+// @Security     BearerAuth
+// @Router       /ticket-categories [get]
+func (h TicketCategories) List(w http.ResponseWriter, r *http.Request) {
+	serveList[models.TicketCategory](w, r, h.DB, ticketCategoryListSpec)
+}
+
+// Create godoc
+// @Summary      Create a ticket category
+// @Tags         tickets
+// @Accept       json
+// @Produce      json
+// @Param        category  body      TicketCategoryRequest  true  "Category"
+// @Success      201  {object}  models.TicketCategory
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      409  {object}  Problem  "a category with the name exists"
+// @Failure      422  {object}  Problem  "invalid fields"
+// @Security     BearerAuth
+// @Router       /ticket-categories [post]
+func (h TicketCategories) Create(w http.ResponseWriter, r *http.Request) {
+	var req TicketCategoryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+
+	c := models.TicketCategory{Id: uuid.New()}
+	if !req.apply(w, r, &c) {
+		return
+	}
+
+	if err := h.DB.Create(&c).Error; err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(c)
+}
+
+// Update godoc
+// @Summary      Update a ticket category
+// @Tags         tickets
+// @Accept       json
+// @Produce      json
+// @Param        id        path      string                 true  "Category ID"
+// @Param        category  body      TicketCategoryRequest  true  "Category"
+// @Success      200  {object}  models.TicketCategory
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      404  {object}  Problem  "category not found"
+// @Failure      409  {object}  Problem  "a category with the name exists"
+// @Failure      422  {object}  Problem  "invalid fields"
+// @Security     BearerAuth
+// @Router       /ticket-categories/{id} [put]
+func (h TicketCategories) Update(w http.ResponseWriter, r *http.Request) {
+	id, ok := uuidParam(w, r, "id")
+	if !ok {
+		return
+	}
+
+	var c models.TicketCategory
+	if err := h.DB.First(&c, "id = ?", id).Error; err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	var req TicketCategoryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+	if !req.apply(w, r, &c) {
+		return
+	}
+
+	if err := h.DB.Save(&c).Error; err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
+
+// Delete godoc
+// @Summary      Delete a ticket category
+// @Description  Categories still used by tickets or SLA policies cannot be deleted.
+// @Tags         tickets
+// @Param        id  path  string  true  "Category ID"
+// @Success      204  "No Content"
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      404  {object}  Problem  "category not found"
+// @Failure      409  {object}  Problem  "the category is in use"
+// @Security     BearerAuth
+// @Router       /ticket-categories/{id} [delete]
+func (h TicketCategories) Delete(w http.ResponseWriter, r *http.Request) {
+	id, ok := uuidParam(w, r, "id")
+	if !ok {
+		return
+	}
+
+	result := h.DB.Delete(&models.TicketCategory{}, "id = ?", id)
+	if result.Error != nil {
+		writeDBError(w, r, result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		writeError(w, r, "category not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apply validates the request and copies it onto c, writing 422 on invalid fields
+func (req TicketCategoryRequest) apply(w http.ResponseWriter, r *http.Request, c *models.TicketCategory) bool {
+	name := SanitizeInput(req.Name)
+	if name == "" {
+		writeValidation(w, r, FieldError{Field: "name", Code: FieldRequired, Message: "is required"})
+		return false
+	}
+	if len(name) > 100 {
+		writeValidation(w, r, FieldError{Field: "name", Code: FieldTooLong, Message: "may be at most 100 characters"})
+		return false
+	}
+
+	c.Name = name
+	c.Description = strings.TrimSpace(req.Description)
+	return true
+}
+
+func categoryExists(db *gorm.DB, id uuid.UUID) bool {
+	var count int64
+	db.Model(&models.TicketCategory{}).Where("id = ?", id).Count(&count)
+	return count > 0
+}
+
+// RegisterTicketCategories adds ticket category routes
+func RegisterTicketCategories(router *mux.Router, h TicketCategories, prefix string) {
+	router.HandleFunc(prefix, AuthorizeScoped(h.List, AnyRole, ScopeTicketsRead)).Methods("GET")
+	router.HandleFunc(prefix, Authorize(h.Create, AdminRoles)).Methods("POST")
+	router.HandleFunc(prefix+"/{id}", Authorize(h.Update, AdminRoles)).Methods("PUT")
+	router.HandleFunc(prefix+"/{id}", Authorize(h.Delete, AdminRoles)).Methods("DELETE")
+}
@@ -2,55 +2,85 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 
+	"stuff/events"
 	"stuff/models"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // TicketComments holds DB for ticket comment handlers
 type TicketComments struct {
-	DB *gorm.DB
+	DB     *gorm.DB
+	Events *events.Bus
+}
+
+// commentListSpec controls sorting and includes for the comment lists
+var commentListSpec = listSpec{
+	filters: map[string]filterFunc{
+		"user_id":    uuidFilter("user_id"),
+		"visibility": enumFilter("visibility", func(s string) bool { return models.CommentVisibility(s).Valid() }),
+	},
+	sorts: map[string]string{
+		"created_at": "created_at",
+	},
+	defaultSort: "created_at",
+	includes: map[string]listInclude{
+		"user": {preload: "User", columns: []string{"user_id"}},
+	},
+	defaultInclude: []string{"user"},
 }
 
 // ListByTicket godoc
 // @Summary      Get all comments for a ticket
+// @Description  Oldest first. Internal notes are left out unless the caller is staff or the assignee, and always for the ticket's creator.
+// @Description  Paged with limit/offset or cursor. See X-Total-Count, X-Next-Cursor and Link.
 // @Tags         ticket-comments
 // @Produce      json
 // @Param        ticketId   path      string  true  "Ticket ID"
+// @Param        user_id    query     string  false  "Author ID, or me"
+// @Param        visibility query     string  false  "PUBLIC or INTERNAL"
+// @Param        sort       query     string  false  "created_at; prefix - for descending (default created_at)"
+// @Param        include    query     string  false  "user (default user)"
+// @Param        fields     query     string  false  "Fields to return, e.g. id,content"
+// @Param        limit      query     int     false  "Page size (default 50, max 200)"
+// @Param        offset     query     int     false  "Rows to skip"
+// @Param        cursor     query     string  false  "X-Next-Cursor of the previous page"
 // @Success      200  {array}   models.TicketComment
+// @Failure      400  {object}  Problem  "invalid filter, sort, include or cursor"
+// @Failure      404  {object}  Problem  "ticket not found"
 // @Security     BearerAuth
 // @Router       /tickets/{ticketId}/comments [get]
 func (h TicketComments) ListByTicket(w http.ResponseWriter, r *http.Request) {
 	ticketId, ok := uuidParam(w, r, "ticketId")
 
-	if !ok {
+	if !ok || !ticketVisible(w, r, h.DB, ticketId) {
 		return
 	}
 	
-	var list []models.TicketComment
+	visible, args := visibleCommentsCondition(r)
 	
-	if err := h.DB.Preload("User").Where("ticket_id = ?", ticketId).Find(&list).Error; err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(list)
+	serveList[models.TicketComment](w, r, h.DB.Where("ticket_id = ?", ticketId).Where(visible, args...), commentListSpec)
 }
 
 // CreateOnTicket godoc
 // @Summary      Create a comment on a ticket
+// @Description  visibility defaults to PUBLIC. INTERNAL notes can be written by staff and the assignee, and are never shown to the ticket's creator.
 // @Tags         ticket-comments
 // @Accept       json
 // @Produce      json
 // @Param        ticketId   path      string  true  "Ticket ID"
 // @Param        comment  body      models.TicketComment  true  "Ticket Comment"
 // @Success      201  {object}  models.TicketComment
-// @Failure      400  {string}  string  "Bad request"
+// @Failure      400  {object}  Problem  "Bad request"
+// @Failure      403  {object}  Problem  "not allowed to write internal notes"
+// @Failure      404  {object}  Problem  "ticket not found"
+// @Failure      422  {object}  Problem  "invalid visibility"
 // @Security     BearerAuth
 // @Router       /tickets/{ticketId}/comments [post]
 func (h TicketComments) CreateOnTicket(w http.ResponseWriter, r *http.Request) {
@@ -63,15 +93,64 @@ func (h TicketComments) CreateOnTicket(w http.ResponseWriter, r *http.Request) {
 	var c models.TicketComment
 	
 	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeBodyError(w, r, err)
+		return
+	}
+	
+	if c.Visibility == "" {
+		c.Visibility = models.CommentVisibilityPublic
+	}
+	
+	if !c.Visibility.Valid() {
+		writeValidation(w, r, FieldError{Field: "visibility", Code: FieldInvalid, Message: "must be PUBLIC or INTERNAL"})
 		return
 	}
 	
 	c.Id = uuid.New()
+	c.UserId, _ = currentUserID(r)
 	c.TicketId = ticketId
+	c.Ticket = models.Ticket{}
+	c.User = models.User{}
+	c.Attachments = nil // uploaded through the attachments endpoint, where they are sniffed and scanned
 	
-	if err := h.DB.Create(&c).Error; err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		var t models.Ticket
+		
+		if err := tx.First(&t, "id = ?", ticketId).Error; err != nil {
+			return err
+		}
+		
+		// Tickets the caller cannot see look the same as missing ones
+		if visible, err := canViewTicket(tx, r, t); err != nil || !visible {
+			if err == nil {
+				err = gorm.ErrRecordNotFound
+			}
+			return err
+		}
+		
+		if c.Visibility == models.CommentVisibilityInternal && !canReadInternalNotes(r, t) {
+			return errInternalNotes
+		}
+		
+		if err := tx.Omit(clause.Associations).Create(&c).Error; err != nil {
+			return err
+		}
+		
+		return h.Events.Publish(tx, events.TicketCommentedEvent{ActorID: c.UserId, Ticket: t, Comment: c})
+	})
+	
+	if err == gorm.ErrRecordNotFound {
+		writeError(w, r, "ticket not found", http.StatusNotFound)
+		return
+	}
+	
+	if errors.Is(err, errInternalNotes) {
+		writeError(w, r, "only staff and the assignee can write internal notes", http.StatusForbidden)
+		return
+	}
+	
+	if err != nil {
+		writeDBError(w, r, err)
 		return
 	}
 	
@@ -87,7 +166,7 @@ func (h TicketComments) CreateOnTicket(w http.ResponseWriter, r *http.Request) {
 // @Produce      json
 // @Param        id   path      string  true  "Ticket Comment ID"
 // @Success      200  {object}  models.TicketComment
-// @Failure      404  {string}  string  "ticket comment not found"
+// @Failure      404  {object}  Problem  "ticket comment not found"
 // @Security     BearerAuth
 // @Router       /ticket-comments/{id} [get]
 func (h TicketComments) GetByID(w http.ResponseWriter, r *http.Request) {
@@ -101,11 +180,23 @@ func (h TicketComments) GetByID(w http.ResponseWriter, r *http.Request) {
 	
 	if err := h.DB.Preload("User").Preload("Ticket").First(&c, "id = ?", id).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
-			http.Error(w, "ticket comment not found", http.StatusNotFound)
+			writeError(w, r, "ticket comment not found", http.StatusNotFound)
 			return
 		}
 	
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDBError(w, r, err)
+		return
+	}
+	
+	visible, err := canViewTicket(h.DB, r, c.Ticket)
+	
+	if err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+	
+	if !visible || c.Visibility == models.CommentVisibilityInternal && !canReadInternalNotes(r, c.Ticket) {
+		writeError(w, r, "ticket comment not found", http.StatusNotFound)
 		return
 	}
 	
@@ -115,13 +206,15 @@ func (h TicketComments) GetByID(w http.ResponseWriter, r *http.Request) {
 
 // Update godoc
 // @Summary      Update ticket comment by ID
+// @Description  Only the content can be changed; the visibility is set when the comment is written.
 // @Tags         ticket-comments
 // @Accept       json
 // @Produce      json
 // @Param        id   path      string  true  "Ticket Comment ID"
 // @Param        comment  body      models.TicketComment  true  "Ticket Comment"
 // @Success      200  {object}  models.TicketComment
-// @Failure      404  {string}  string  "ticket comment not found"
+// @Failure      404  {object}  Problem  "ticket comment not found"
+// @Failure      403  {object}  Problem  "forbidden"
 // @Security     BearerAuth
 // @Router       /ticket-comments/{id} [put]
 func (h TicketComments) Update(w http.ResponseWriter, r *http.Request) {
@@ -134,20 +227,25 @@ func (h TicketComments) Update(w http.ResponseWriter, r *http.Request) {
 	var c models.TicketComment
 	
 	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeBodyError(w, r, err)
 		return
 	}
 	
 	c.Id = id
+	
+	if !h.authorizeAuthor(w, r, id) {
+		return
+	}
+	
 	result := h.DB.Model(&models.TicketComment{}).Where("id = ?", id).Update("content", c.Content)
 	
 	if result.Error != nil {
-		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		writeDBError(w, r, result.Error)
 		return
 	}
 	
 	if result.RowsAffected == 0 {
-		http.Error(w, "ticket comment not found", http.StatusNotFound)
+		writeError(w, r, "ticket comment not found", http.StatusNotFound)
 		return
 	}
 	
@@ -161,7 +259,8 @@ func (h TicketComments) Update(w http.ResponseWriter, r *http.Request) {
 // @Tags         ticket-comments
 // @Param        id   path      string  true  "Ticket Comment ID"
 // @Success      204  "No Content"
-// @Failure      404  {string}  string  "ticket comment not found"
+// @Failure      404  {object}  Problem  "ticket comment not found"
+// @Failure      403  {object}  Problem  "forbidden"
 // @Security     BearerAuth
 // @Router       /ticket-comments/{id} [delete]
 func (h TicketComments) Delete(w http.ResponseWriter, r *http.Request) {
@@ -171,26 +270,75 @@ func (h TicketComments) Delete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
+	if !h.authorizeAuthor(w, r, id) {
+		return
+	}
+	
 	result := h.DB.Delete(&models.TicketComment{}, "id = ?", id)
 	
 	if result.Error != nil {
-		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		writeDBError(w, r, result.Error)
 		return
 	}
 	
 	if result.RowsAffected == 0 {
-		http.Error(w, "ticket comment not found", http.StatusNotFound)
+		writeError(w, r, "ticket comment not found", http.StatusNotFound)
 		return
 	}
 	
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// authorizeAuthor writes 403 unless the caller wrote the comment or is an admin.
+// A missing comment is let through so the caller reports 404 as before.
+func (h TicketComments) authorizeAuthor(w http.ResponseWriter, r *http.Request, id uuid.UUID) bool {
+	var c models.TicketComment
+	
+	if err := h.DB.Select("user_id").First(&c, "id = ?", id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return true
+		}
+	
+		writeDBError(w, r, err)
+		return false
+	}
+	
+	if userID, _ := currentUserID(r); c.UserId != userID && !hasRole(r, models.RoleAdmin) {
+		writeError(w, r, "forbidden", http.StatusForbidden)
+		return false
+	}
+	
+	return true
+}
+
+// errInternalNotes is returned when the caller may not write internal notes on the ticket
+var errInternalNotes = errors.New("internal notes not allowed")
+
+// canReadInternalNotes reports whether the caller may read and write internal notes on t
+func canReadInternalNotes(r *http.Request, t models.Ticket) bool {
+	userID, _ := currentUserID(r)
+	role, _ := GetRoleFromContext(r.Context())
+	return t.InternalNotesVisibleTo(userID, role)
+}
+
+// visibleCommentsCondition limits ticket comments to those the caller may read. It is the
+// SQL form of models.Ticket.InternalNotesVisibleTo: internal notes are for staff and the
+// assignee, and never for the ticket's creator.
+func visibleCommentsCondition(r *http.Request) (string, []interface{}) {
+	userID, _ := currentUserID(r)
+	if hasRole(r, StaffRoles...) {
+		return "(visibility = ? OR ticket_id IN (SELECT id FROM tickets WHERE created_by_user_id <> ?))",
+			[]interface{}{models.CommentVisibilityPublic, userID}
+	}
+	return "(visibility = ? OR ticket_id IN (SELECT id FROM tickets WHERE assigned_to_user_id = ? AND created_by_user_id <> ?))",
+		[]interface{}{models.CommentVisibilityPublic, userID, userID}
+}
+
 // RegisterTicketComments adds ticket comment routes (nested under tickets + standalone by id)
 func RegisterTicketComments(router *mux.Router, h TicketComments, ticketsPrefix, commentsPrefix string) {
-	router.HandleFunc(ticketsPrefix+"/{ticketId}/comments", h.ListByTicket).Methods("GET")
-	router.HandleFunc(ticketsPrefix+"/{ticketId}/comments", h.CreateOnTicket).Methods("POST")
-	router.HandleFunc(commentsPrefix+"/{id}", h.GetByID).Methods("GET")
-	router.HandleFunc(commentsPrefix+"/{id}", h.Update).Methods("PUT")
-	router.HandleFunc(commentsPrefix+"/{id}", h.Delete).Methods("DELETE")
+	router.HandleFunc(ticketsPrefix+"/{ticketId}/comments", AuthorizeScoped(h.ListByTicket, AnyRole, ScopeTicketsRead)).Methods("GET")
+	router.HandleFunc(ticketsPrefix+"/{ticketId}/comments", AuthorizeScoped(h.CreateOnTicket, AnyRole, ScopeTicketsWrite)).Methods("POST")
+	router.HandleFunc(commentsPrefix+"/{id}", AuthorizeScoped(h.GetByID, AnyRole, ScopeTicketsRead)).Methods("GET")
+	router.HandleFunc(commentsPrefix+"/{id}", AuthorizeScoped(h.Update, AnyRole, ScopeTicketsWrite)).Methods("PUT")
+	router.HandleFunc(commentsPrefix+"/{id}", AuthorizeScoped(h.Delete, AnyRole, ScopeTicketsWrite)).Methods("DELETE")
 }
@@ -0,0 +1,528 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"stuff/events"
+	"stuff/models"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// maxMergeTickets bounds how many duplicates are merged at once
+const maxMergeTickets = 50
+
+// maxParentDepth bounds how far up the parent chain a new parent link is checked for loops
+const maxParentDepth = 100
+
+// TicketLinks holds DB and the event bus for ticket link and merge handlers
+type TicketLinks struct {
+	DB     *gorm.DB
+	Events *events.Bus
+}
+
+// TicketLinkRequest is the body for linking two tickets
+type TicketLinkRequest struct {
+	Type     models.TicketLinkType `json:"type"`      // seen from the ticket in the path, e.g. BLOCKED_BY
+	TicketId uuid.UUID             `json:"ticket_id"` // the other ticket
+}
+
+// TicketMergeRequest is the body for merging duplicates into a ticket
+type TicketMergeRequest struct {
+	TicketIds []uuid.UUID `json:"ticket_ids"` // the duplicates
+	Reason    string      `json:"reason"`     // optional, recorded in the history
+}
+
+var (
+	errLinkExists  = errors.New("link exists")
+	errLinkLoop    = errors.New("link loop")
+	errParentTaken = errors.New("parent taken")
+)
+
+// List godoc
+// @Summary      List a ticket's links
+// @Description  Each link is seen from this ticket: a ticket that blocks it is listed as BLOCKED_BY. Oldest first.
+// @Tags         tickets
+// @Produce      json
+// @Param        id  path      string  true  "Ticket ID"
+// @Success      200  {array}   models.TicketRelation
+// @Failure      404  {object}  Problem  "ticket not found"
+// @Security     BearerAuth
+// @Router       /tickets/{id}/links [get]
+func (h TicketLinks) List(w http.ResponseWriter, r *http.Request) {
+	id, ok := uuidParam(w, r, "id")
+	if !ok || !ticketVisible(w, r, h.DB, id) {
+		return
+	}
+
+	relations, err := ticketRelations(h.DB, id)
+	if err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(relations)
+}
+
+// Link godoc
+// @Summary      Link two tickets
+// @Description  DUPLICATES, BLOCKS, RELATED or PARENT_OF the other ticket, or the inverse DUPLICATED_BY, BLOCKED_BY or CHILD_OF.
+// @Description  A ticket has at most one parent, and links may not go round in a circle. RELATED needs edit rights on this ticket,
+// @Description  the other types on both tickets.
+// @Tags         tickets
+// @Accept       json
+// @Produce      json
+// @Param        id    path      string             true  "Ticket ID"
+// @Param        link  body      TicketLinkRequest  true  "Link"
+// @Success      201  {object}  models.TicketRelation
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      404  {object}  Problem  "ticket not found"
+// @Failure      409  {object}  Problem  "the tickets are already linked, or the link would make a loop"
+// @Failure      422  {object}  Problem  "invalid fields"
+// @Security     BearerAuth
+// @Router       /tickets/{id}/links [post]
+func (h TicketLinks) Link(w http.ResponseWriter, r *http.Request) {
+	id, ok := uuidParam(w, r, "id")
+	if !ok {
+		return
+	}
+
+	var req TicketLinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+
+	var errs []FieldError
+	if !req.Type.Valid() {
+		errs = append(errs, FieldError{Field: "type", Code: FieldInvalid, Message: "must be DUPLICATES, DUPLICATED_BY, BLOCKS, BLOCKED_BY, RELATED, PARENT_OF or CHILD_OF"})
+	}
+	if req.TicketId == uuid.Nil {
+		errs = append(errs, FieldError{Field: "ticket_id", Code: FieldRequired, Message: "is required"})
+	} else if req.TicketId == id {
+		errs = append(errs, FieldError{Field: "ticket_id", Code: FieldInvalid, Message: "a ticket cannot be linked to itself"})
+	}
+	if len(errs) > 0 {
+		writeValidation(w, r, errs...)
+		return
+	}
+
+	var t models.Ticket
+	if err := h.DB.First(&t, "id = ?", id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			writeError(w, r, "ticket not found", http.StatusNotFound)
+			return
+		}
+		writeDBError(w, r, err)
+		return
+	}
+
+	if !canEditTicket(r, t) {
+		writeError(w, r, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	var other models.Ticket
+	if err := h.DB.First(&other, "id = ?", req.TicketId).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			writeValidation(w, r, FieldError{Field: "ticket_id", Code: FieldUnknown, Message: "unknown ticket"})
+			return
+		}
+		writeDBError(w, r, err)
+		return
+	}
+
+	// Other links change how the other ticket is handled too, and PARENT_OF takes its only parent slot
+	if req.Type != models.TicketLinkRelated && !canEditTicket(r, other) {
+		writeError(w, r, "you can only link tickets you can edit this way", http.StatusForbidden)
+		return
+	}
+
+	link := newTicketLink(id, other.Id, req.Type)
+	actorID, _ := currentUserID(r)
+	link.CreatedByUserId = &actorID
+
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		if err := checkTicketLink(tx, link); err != nil {
+			return err
+		}
+		return tx.Create(&link).Error
+	})
+	if writeLinkError(w, r, err) {
+		return
+	}
+
+	link.SourceTicket, link.TargetTicket = &t, &other
+	if link.SourceTicketId == other.Id {
+		link.SourceTicket, link.TargetTicket = &other, &t
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(link.RelationFrom(id))
+}
+
+// Unlink godoc
+// @Summary      Remove a link between two tickets
+// @Description  RELATED needs edit rights on this ticket, the other types on both tickets.
+// @Tags         tickets
+// @Param        id      path  string  true  "Ticket ID"
+// @Param        linkId  path  string  true  "Link ID"
+// @Success      204  "No Content"
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      404  {object}  Problem  "link not found"
+// @Security     BearerAuth
+// @Router       /tickets/{id}/links/{linkId} [delete]
+func (h TicketLinks) Unlink(w http.ResponseWriter, r *http.Request) {
+	id, ok := uuidParam(w, r, "id")
+	if !ok {
+		return
+	}
+	linkID, ok := uuidParam(w, r, "linkId")
+	if !ok {
+		return
+	}
+
+	var link models.TicketLink
+	err := h.DB.Preload("SourceTicket").Preload("TargetTicket").
+		First(&link, "id = ? AND (source_ticket_id = ? OR target_ticket_id = ?)", linkID, id, id).Error
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			writeError(w, r, "link not found", http.StatusNotFound)
+			return
+		}
+		writeDBError(w, r, err)
+		return
+	}
+
+	t, other := link.TargetTicket, link.SourceTicket
+	if link.SourceTicketId == id {
+		t, other = link.SourceTicket, link.TargetTicket
+	}
+	if t == nil || !canEditTicket(r, *t) {
+		writeError(w, r, "forbidden", http.StatusForbidden)
+		return
+	}
+	if link.Type != models.TicketLinkRelated && (other == nil || !canEditTicket(r, *other)) {
+		writeError(w, r, "you can only unlink tickets you can edit this way", http.StatusForbidden)
+		return
+	}
+
+	if err := h.DB.Delete(&models.TicketLink{}, "id = ?", link.Id).Error; err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Merge godoc
+// @Summary      Merge duplicates into a ticket
+// @Description  Moves the duplicates' comments, attachments and watchers to this ticket, copies their descriptions in as comments,
+// @Description  links them as DUPLICATES of this ticket and closes them with a reference to it. Their creators start watching this ticket.
+// @Tags         tickets
+// @Accept       json
+// @Produce      json
+// @Param        id    path      string              true  "Primary ticket ID"
+// @Param        body  body      TicketMergeRequest  true  "Duplicates"
+// @Success      200  {object}  models.Ticket
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      404  {object}  Problem  "ticket not found"
+// @Failure      409  {object}  Problem  "a ticket is cancelled, or changed meanwhile"
+// @Failure      422  {object}  Problem  "invalid fields"
+// @Security     BearerAuth
+// @Router       /tickets/{id}/merge [post]
+func (h TicketLinks) Merge(w http.ResponseWriter, r *http.Request) {
+	id, ok := uuidParam(w, r, "id")
+	if !ok {
+		return
+	}
+
+	var req TicketMergeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+
+	req.Reason = SanitizeInput(req.Reason)
+	ids := uniqueIDs(req.TicketIds)
+
+	var errs []FieldError
+	switch {
+	case len(ids) == 0:
+		errs = append(errs, FieldError{Field: "ticket_ids", Code: FieldRequired, Message: "is required"})
+	case len(ids) > maxMergeTickets:
+		errs = append(errs, FieldError{Field: "ticket_ids", Code: FieldInvalid, Message: fmt.Sprintf("may contain at most %d tickets", maxMergeTickets)})
+	}
+	for _, dupID := range ids {
+		if dupID == id {
+			errs = append(errs, FieldError{Field: "ticket_ids", Code: FieldInvalid, Message: "cannot contain the ticket merged into"})
+			break
+		}
+	}
+	if len(req.Reason) > maxTransitionReason {
+		errs = append(errs, FieldError{Field: "reason", Code: FieldTooLong, Message: fmt.Sprintf("may be at most %d characters", maxTransitionReason)})
+	}
+	if len(errs) > 0 {
+		writeValidation(w, r, errs...)
+		return
+	}
+
+	var primary models.Ticket
+	if err := h.DB.First(&primary, "id = ?", id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			writeError(w, r, "ticket not found", http.StatusNotFound)
+			return
+		}
+		writeDBError(w, r, err)
+		return
+	}
+	if primary.Status == models.TicketStatusCancelled {
+		writeErrorCode(w, r, CodeInvalidTransition, "tickets cannot be merged into a cancelled ticket", http.StatusConflict)
+		return
+	}
+
+	var duplicates []models.Ticket
+	if err := h.DB.Where("id IN ?", ids).Order("created_at").Find(&duplicates).Error; err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+	if len(duplicates) != len(ids) {
+		writeValidation(w, r, FieldError{Field: "ticket_ids", Code: FieldUnknown, Message: "contains an unknown ticket"})
+		return
+	}
+	for _, d := range duplicates {
+		if d.Status == models.TicketStatusCancelled {
+			writeErrorCode(w, r, CodeInvalidTransition, fmt.Sprintf("the ticket %q is cancelled and cannot be merged", d.Title), http.StatusConflict)
+			return
+		}
+	}
+
+	actorID, _ := currentUserID(r)
+	reason := fmt.Sprintf("Merged into %q [#%s]", primary.Title, primary.Id)
+	if req.Reason != "" {
+		reason += ": " + req.Reason
+	}
+
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		for _, d := range duplicates {
+			if err := mergeTicket(tx, h.Events, actorID, primary, d, reason); err != nil {
+				return err
+			}
+		}
+		return h.Events.Publish(tx, events.TicketMergedEvent{ActorID: actorID, Primary: primary, Duplicates: duplicates, Reason: req.Reason})
+	})
+	if err == errTicketChanged {
+		writeError(w, r, "a ticket was changed by someone else; reload and try again", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	t, err := loadTicket(h.DB, r, id)
+	if err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// mergeTicket moves one duplicate's comments, attachments, emails and watchers to the
+// primary ticket, links it as a duplicate and closes it
+func mergeTicket(tx *gorm.DB, bus *events.Bus, actorID uuid.UUID, primary, d models.Ticket, reason string) error {
+	for _, model := range []interface{}{&models.TicketComment{}, &models.Attachment{}, &models.InboundEmail{}} {
+		if err := tx.Model(model).Where("ticket_id = ?", d.Id).Update("ticket_id", primary.Id).Error; err != nil {
+			return err
+		}
+	}
+
+	// Keep what the duplicate said, dated when it was said
+	description := models.TicketComment{
+		Id:         uuid.New(),
+		TicketId:   primary.Id,
+		UserId:     d.CreatedByUserId,
+		Content:    fmt.Sprintf("Merged from %q [#%s]:\n\n%s", d.Title, d.Id, d.Description),
+		Visibility: models.CommentVisibilityPublic,
+		CreatedAt:  d.CreatedAt,
+	}
+	if err := tx.Create(&description).Error; err != nil {
+		return err
+	}
+
+	// Replace a link the other way round, which would now make a loop
+	err := tx.Where("source_ticket_id = ? AND target_ticket_id = ? AND type = ?", primary.Id, d.Id, models.TicketLinkDuplicates).
+		Delete(&models.TicketLink{}).Error
+	if err != nil {
+		return err
+	}
+	link := newTicketLink(d.Id, primary.Id, models.TicketLinkDuplicates)
+	link.CreatedByUserId = &actorID
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&link).Error; err != nil {
+		return err
+	}
+
+	if d.Status != models.TicketStatusClosed {
+		updates := map[string]interface{}{"status": models.TicketStatusClosed}
+		if !d.Status.IsResolved() {
+			updates["resolved_at"] = time.Now()
+		}
+		result := tx.Model(&models.Ticket{}).Where("id = ? AND status = ?", d.Id, d.Status).Updates(updates)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errTicketChanged
+		}
+
+		var closed models.Ticket
+		if err := tx.First(&closed, "id = ?", d.Id).Error; err != nil {
+			return err
+		}
+		// Published before the watchers move, so they hear where the ticket went
+		if err := bus.Publish(tx, events.TicketUpdatedEvent{ActorID: actorID, Before: d, After: closed, Reason: reason}); err != nil {
+			return err
+		}
+	}
+
+	var watchers []uuid.UUID
+	if err := tx.Model(&models.TicketWatcher{}).Where("ticket_id = ?", d.Id).Pluck("user_id", &watchers).Error; err != nil {
+		return err
+	}
+	for _, userID := range append(watchers, d.CreatedByUserId) {
+		if err := events.Watch(tx, primary.Id, userID); err != nil {
+			return err
+		}
+	}
+	return tx.Where("ticket_id = ?", d.Id).Delete(&models.TicketWatcher{}).Error
+}
+
+// newTicketLink builds the stored form of "ticketID <lt> otherID"
+func newTicketLink(ticketID, otherID uuid.UUID, lt models.TicketLinkType) models.TicketLink {
+	source, target := ticketID, otherID
+	if lt.IsInverse() {
+		lt = lt.Inverse()
+		source, target = otherID, ticketID
+	}
+	if lt == models.TicketLinkRelated && target.String() < source.String() {
+		source, target = target, source
+	}
+	return models.TicketLink{Id: uuid.New(), SourceTicketId: source, TargetTicketId: target, Type: lt}
+}
+
+// checkTicketLink returns errLinkExists, errLinkLoop or errParentTaken if the link may not be added
+func checkTicketLink(tx *gorm.DB, link models.TicketLink) error {
+	var count int64
+	err := tx.Model(&models.TicketLink{}).
+		Where("source_ticket_id = ? AND target_ticket_id = ? AND type = ?", link.SourceTicketId, link.TargetTicketId, link.Type).
+		Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return errLinkExists
+	}
+
+	if link.Type == models.TicketLinkRelated {
+		return nil
+	}
+
+	// A ticket cannot duplicate, block or be the parent of a ticket that does the same to it
+	err = tx.Model(&models.TicketLink{}).
+		Where("source_ticket_id = ? AND target_ticket_id = ? AND type = ?", link.TargetTicketId, link.SourceTicketId, link.Type).
+		Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return errLinkLoop
+	}
+
+	if link.Type != models.TicketLinkParentOf {
+		return nil
+	}
+
+	err = tx.Model(&models.TicketLink{}).
+		Where("target_ticket_id = ? AND type = ?", link.TargetTicketId, models.TicketLinkParentOf).
+		Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return errParentTaken
+	}
+
+	// The new child may not be an ancestor of its parent
+	current := link.SourceTicketId
+	for i := 0; i < maxParentDepth; i++ {
+		var parents []uuid.UUID
+		err := tx.Model(&models.TicketLink{}).
+			Where("target_ticket_id = ? AND type = ?", current, models.TicketLinkParentOf).
+			Limit(1).Pluck("source_ticket_id", &parents).Error
+		if err != nil {
+			return err
+		}
+		if len(parents) == 0 {
+			return nil
+		}
+		if parents[0] == link.TargetTicketId {
+			return errLinkLoop
+		}
+		current = parents[0]
+	}
+	return nil
+}
+
+// writeLinkError answers a failed link and returns true, or returns false if err is nil
+func writeLinkError(w http.ResponseWriter, r *http.Request, err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, errLinkExists):
+		writeErrorCode(w, r, CodeAlreadyExists, "the tickets are already linked this way", http.StatusConflict)
+	case errors.Is(err, errLinkLoop):
+		writeError(w, r, "the link would make a loop", http.StatusConflict)
+	case errors.Is(err, errParentTaken):
+		writeError(w, r, "the child ticket already has a parent", http.StatusConflict)
+	default:
+		writeDBError(w, r, err)
+	}
+	return true
+}
+
+// ticketRelations returns a ticket's links as seen from it, with the other tickets, oldest first
+func ticketRelations(db *gorm.DB, ticketID uuid.UUID) ([]models.TicketRelation, error) {
+	var links []models.TicketLink
+	err := db.Preload("SourceTicket").Preload("TargetTicket").
+		Where("source_ticket_id = ? OR target_ticket_id = ?", ticketID, ticketID).
+		Order("created_at").
+		Find(&links).Error
+	if err != nil {
+		return nil, err
+	}
+
+	relations := make([]models.TicketRelation, len(links))
+	for i, link := range links {
+		relations[i] = link.RelationFrom(ticketID)
+	}
+	return relations, nil
+}
+
+// RegisterTicketLinks adds ticket link and merge routes under the tickets prefix
+func RegisterTicketLinks(router *mux.Router, h TicketLinks, ticketsPrefix string) {
+	router.HandleFunc(ticketsPrefix+"/{id}/links", AuthorizeScoped(h.List, AnyRole, ScopeTicketsRead)).Methods("GET")
+	router.HandleFunc(ticketsPrefix+"/{id}/links", AuthorizeScoped(h.Link, AnyRole, ScopeTicketsWrite)).Methods("POST")
+	router.HandleFunc(ticketsPrefix+"/{id}/links/{linkId}", AuthorizeScoped(h.Unlink, AnyRole, ScopeTicketsWrite)).Methods("DELETE")
+	router.HandleFunc(ticketsPrefix+"/{id}/merge", AuthorizeScoped(h.Merge, StaffRoles, ScopeTicketsWrite)).Methods("POST")
+}
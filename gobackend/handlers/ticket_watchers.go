@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"stuff/events"
+	"stuff/models"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+// TicketWatchers holds DB for ticket watcher handlers
+type TicketWatchers struct {
+	DB *gorm.DB
+}
+
+// WatchRequest is the body for adding a watcher
+type WatchRequest struct {
+	UserId *uuid.UUID `json:"user_id"` // defaults to the caller
+}
+
+// watcherListSpec controls sorting and includes for GET /tickets/{id}/watchers
+var watcherListSpec = listSpec{
+	sorts: map[string]string{
+		"created_at": "created_at",
+	},
+	defaultSort: "created_at",
+	includes: map[string]listInclude{
+		"user": {preload: "User", columns: []string{"user_id"}},
+	},
+	defaultInclude: []string{"user"},
+}
+
+// List godoc
+// @Summary      List the watchers of a ticket
+// @Description  Watchers are notified about comments and changes, in addition to the creator and assignee.
+// @Description  Paged with limit/offset or cursor. See X-Total-Count, X-Next-Cursor and Link.
+// @Tags         tickets
+// @Produce      json
+// @Param        id       path      string  true   "Ticket ID"
+// @Param        sort     query     string  false  "created_at; prefix - for descending (default created_at)"
+// @Param        include  query     string  false  "user (default user)"
+// @Param        limit    query     int     false  "Page size (default 50, max 200)"
+// @Param        offset   query     int     false  "Rows to skip"
+// @Param        cursor   query     string  false  "X-Next-Cursor of the previous page"
+// @Success      200  {array}   models.TicketWatcher
+// @Failure      400  {object}  Problem  "invalid sort, include or cursor"
+// @Failure      404  {object}  Problem  "ticket not found"
+// @Security     BearerAuth
+// @Router       /tickets/{id}/watchers [get]
+func (h TicketWatchers) List(w http.ResponseWriter, r *http.Request) {
+	ticketID, ok := uuidParam(w, r, "id")
+	if !ok || !ticketVisible(w, r, h.DB, ticketID) {
+		return
+	}
+
+	serveList[models.TicketWatcher](w, r, h.DB.Where("ticket_id = ?", ticketID), watcherListSpec)
+}
+
+// Watch godoc
+// @Summary      Watch a ticket
+// @Description  Subscribes the caller, or with user_id another user (staff only). Watching twice is not an error.
+// @Description  Only tickets the caller can see may be watched.
+// @Description  Commenting on a ticket also subscribes the commenter.
+// @Tags         tickets
+// @Accept       json
+// @Produce      json
+// @Param        id    path      string        true   "Ticket ID"
+// @Param        body  body      WatchRequest  false  "User to subscribe"
+// @Success      200  {object}  models.TicketWatcher
+// @Failure      403  {object}  Problem  "only staff can subscribe other users"
+// @Failure      404  {object}  Problem  "ticket not found"
+// @Failure      422  {object}  Problem  "unknown user"
+// @Security     BearerAuth
+// @Router       /tickets/{id}/watchers [post]
+func (h TicketWatchers) Watch(w http.ResponseWriter, r *http.Request) {
+	ticketID, ok := uuidParam(w, r, "id")
+	if !ok {
+		return
+	}
+
+	var req WatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeBodyError(w, r, err)
+		return
+	}
+
+	callerID, _ := currentUserID(r)
+	userID := callerID
+	if req.UserId != nil {
+		userID = *req.UserId
+	}
+	if userID != callerID && !hasRole(r, StaffRoles...) {
+		writeError(w, r, "only staff can subscribe other users", http.StatusForbidden)
+		return
+	}
+
+	// Only tickets the caller can already see may be watched, as watching grants read access
+	if !ticketVisible(w, r, h.DB, ticketID) {
+		return
+	}
+
+	var count int64
+	if err := h.DB.Model(&models.User{}).Where("id = ?", userID).Count(&count).Error; err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+	if count == 0 {
+		writeValidation(w, r, FieldError{Field: "user_id", Code: FieldUnknown, Message: "unknown user"})
+		return
+	}
+
+	if err := events.Watch(h.DB, ticketID, userID); err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	var watcher models.TicketWatcher
+	if err := h.DB.Preload("User").First(&watcher, "ticket_id = ? AND user_id = ?", ticketID, userID).Error; err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(watcher)
+}
+
+// Unwatch godoc
+// @Summary      Stop watching a ticket
+// @Description  Users can unsubscribe themselves; staff can unsubscribe anyone.
+// @Description  The creator and assignee are notified regardless.
+// @Tags         tickets
+// @Param        id      path      string  true  "Ticket ID"
+// @Param        userId  path      string  true  "User ID"
+// @Success      204  "No Content"
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      404  {object}  Problem  "not watching"
+// @Security     BearerAuth
+// @Router       /tickets/{id}/watchers/{userId} [delete]
+func (h TicketWatchers) Unwatch(w http.ResponseWriter, r *http.Request) {
+	ticketID, ok := uuidParam(w, r, "id")
+	if !ok {
+		return
+	}
+	userID, ok := uuidParam(w, r, "userId")
+	if !ok {
+		return
+	}
+
+	callerID, _ := currentUserID(r)
+	if userID != callerID && !hasRole(r, StaffRoles...) {
+		writeError(w, r, "only staff can unsubscribe other users", http.StatusForbidden)
+		return
+	}
+
+	result := h.DB.Delete(&models.TicketWatcher{}, "ticket_id = ? AND user_id = ?", ticketID, userID)
+	if result.Error != nil {
+		writeDBError(w, r, result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		writeError(w, r, "the user is not watching the ticket", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RegisterTicketWatchers adds ticket watcher routes under the tickets prefix
+func RegisterTicketWatchers(router *mux.Router, h TicketWatchers, ticketsPrefix string) {
+	router.HandleFunc(ticketsPrefix+"/{id}/watchers", AuthorizeScoped(h.List, AnyRole, ScopeTicketsRead)).Methods("GET")
+	router.HandleFunc(ticketsPrefix+"/{id}/watchers", AuthorizeScoped(h.Watch, AnyRole, ScopeTicketsWrite)).Methods("POST")
+	router.HandleFunc(ticketsPrefix+"/{id}/watchers/{userId}", AuthorizeScoped(h.Unwatch, AnyRole, ScopeTicketsWrite)).Methods("DELETE")
+}
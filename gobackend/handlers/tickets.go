@@ -2,48 +2,152 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"strings"
 	"time"
 
+	"stuff/events"
 	"stuff/models"
+	"stuff/routing"
+	"stuff/sla"
+	"stuff/storage"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // Tickets holds DB for ticket handlers
 type Tickets struct {
-	DB *gorm.DB
+	DB     *gorm.DB
+	Events *events.Bus
+	Store  storage.Store // attachment files are removed with the ticket
+}
+
+// ticketListSpec controls filtering, sorting and includes for GET /tickets
+var ticketListSpec = listSpec{
+	filters: map[string]filterFunc{
+		"status":        enumFilter("status", func(s string) bool { return models.TicketStatus(s).Valid() }),
+		"created_by":    uuidFilter("created_by_user_id"),
+		"assigned_to":   uuidFilter("assigned_to_user_id"),
+		"created_from":  fromFilter("created_at"),
+		"created_to":    toFilter("created_at"),
+		"resolved_from": fromFilter("resolved_at"),
+		"resolved_to":   toFilter("resolved_at"),
+		"priority":      enumFilter("priority", func(s string) bool { return models.TicketPriority(s).Valid() }),
+		"category_id":   uuidFilter("category_id"),
+		"sla_status":    slaStatusFilter,
+	},
+	sorts: map[string]string{
+		"created_at":            "created_at",
+		"updated_at":            "updated_at",
+		"title":                 "title",
+		"status":                "status",
+		"first_response_due_at": "first_response_due_at",
+		"resolution_due_at":     "resolution_due_at",
+	},
+	defaultSort: "-created_at",
+	includes: map[string]listInclude{
+		"created_by_user":  {preload: "CreatedByUser", columns: []string{"created_by_user_id"}},
+		"assigned_to_user": {preload: "AssignedToUser", columns: []string{"assigned_to_user_id"}},
+		"category":         {preload: "Category", columns: []string{"category_id"}},
+		"sla_policy":       {preload: "SLAPolicy", columns: []string{"sla_policy_id"}},
+		"comments":         {preload: "Comments", where: visibleCommentsCondition},
+	},
+	defaultInclude: []string{"created_by_user", "assigned_to_user", "category"},
+	computed:       []string{"sla_status"},
+	computedFrom: map[string][]string{
+		"sla_status": {"status", "created_at", "resolved_at", "sla_policy_id", "first_response_due_at", "resolution_due_at",
+			"first_responded_at", "first_response_breached_at", "resolution_breached_at"},
+	},
+}
+
+// slaStatusConditions mirror models.Ticket.ComputeSLAStatus in SQL, with @now for the current time
+var slaStatusConditions = func() map[models.SLAStatus]string {
+	tracked := "sla_policy_id IS NOT NULL"
+	marked := "(first_response_breached_at IS NOT NULL OR resolution_breached_at IS NOT NULL)"
+	open := "(resolved_at IS NULL AND status <> 'CANCELLED')"
+	overdue := "((first_responded_at IS NULL AND first_response_due_at < @now) OR resolution_due_at < @now)"
+	atRisk := fmt.Sprintf("((first_responded_at IS NULL AND first_response_due_at - (first_response_due_at - created_at) * %[1]g < @now)"+
+		" OR resolution_due_at - (resolution_due_at - created_at) * %[1]g < @now)", models.SLAAtRiskShare)
+	unmarked := tracked + " AND NOT " + marked
+
+	return map[models.SLAStatus]string{
+		models.SLAStatusNone:     "(NOT (" + tracked + ") OR (NOT " + marked + " AND status = 'CANCELLED'))",
+		models.SLAStatusBreached: "(" + tracked + " AND (" + marked + " OR (" + open + " AND " + overdue + ")))",
+		models.SLAStatusMet:      "(" + unmarked + " AND resolved_at IS NOT NULL AND status <> 'CANCELLED')",
+		models.SLAStatusAtRisk:   "(" + unmarked + " AND " + open + " AND NOT " + overdue + " AND " + atRisk + ")",
+		models.SLAStatusOnTrack:  "(" + unmarked + " AND " + open + " AND NOT " + overdue + " AND NOT " + atRisk + ")",
+	}
+}()
+
+// slaStatusFilter filters on the computed SLA status; comma-separated values match any
+func slaStatusFilter(r *http.Request, value string) (string, []interface{}, error) {
+	var ors []string
+	for _, v := range splitList(value) {
+		cond, ok := slaStatusConditions[models.SLAStatus(v)]
+		if !ok {
+			return "", nil, fmt.Errorf("unknown value %q", v)
+		}
+		ors = append(ors, cond)
+	}
+	if len(ors) == 0 {
+		return "", nil, errors.New("no value given")
+	}
+	return "(" + strings.Join(ors, " OR ") + ")", []interface{}{map[string]interface{}{"now": time.Now()}}, nil
 }
 
 // List godoc
 // @Summary      Get all tickets
+// @Description  Staff see every ticket; others only tickets they created, are assigned to or watch.
+// @Description  Paged with limit/offset or cursor. See X-Total-Count, X-Next-Cursor and Link.
 // @Tags         tickets
 // @Produce      json
+// @Param        status        query     string  false  "OPEN, IN_PROGRESS, RESOLVED, CLOSED or CANCELLED; comma-separated for several"
+// @Param        created_by    query     string  false  "User ID, or me"
+// @Param        assigned_to   query     string  false  "User ID, me, or none for unassigned"
+// @Param        created_from  query     string  false  "Created at or after (date or RFC 3339)"
+// @Param        created_to    query     string  false  "Created at or before (date or RFC 3339)"
+// @Param        resolved_from query     string  false  "Resolved at or after (date or RFC 3339)"
+// @Param        resolved_to   query     string  false  "Resolved at or before (date or RFC 3339)"
+// @Param        priority      query     string  false  "LOW, NORMAL, HIGH or URGENT; comma-separated for several"
+// @Param        category_id   query     string  false  "Category ID, or none for uncategorized"
+// @Param        sla_status    query     string  false  "NONE, ON_TRACK, AT_RISK, BREACHED or MET; comma-separated for several"
+// @Param        sort          query     string  false  "created_at, updated_at, title, status, first_response_due_at or resolution_due_at; prefix - for descending (default -created_at). Due date sorts page by offset only."
+// @Param        include       query     string  false  "created_by_user, assigned_to_user, category, sla_policy, comments (default created_by_user,assigned_to_user,category)"
+// @Param        fields        query     string  false  "Fields to return, e.g. id,title,status"
+// @Param        limit         query     int     false  "Page size (default 50, max 200)"
+// @Param        offset        query     int     false  "Rows to skip"
+// @Param        cursor        query     string  false  "X-Next-Cursor of the previous page"
 // @Success      200  {array}   models.Ticket
+// @Failure      400  {object}  Problem  "invalid filter, sort, include or cursor"
 // @Security     BearerAuth
 // @Security     BearerAuth
 // @Router       /tickets [get]
 func (h Tickets) List(w http.ResponseWriter, r *http.Request) {
-	var list []models.Ticket
+	query := h.DB
 	
-	if err := h.DB.Preload("CreatedByUser").Preload("AssignedToUser").Preload("Comments").Find(&list).Error; err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	if !hasRole(r, StaffRoles...) {
+		userID, _ := currentUserID(r)
+		query = query.Where("(created_by_user_id = ? OR assigned_to_user_id = ? OR id IN (?))", userID, userID,
+			h.DB.Model(&models.TicketWatcher{}).Select("ticket_id").Where("user_id = ?", userID))
 	}
 	
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(list)
+	serveList[models.Ticket](w, r, query, ticketListSpec)
 }
 
 // GetByID godoc
 // @Summary      Get ticket by ID
+// @Description  Employees see the tickets they created, are assigned to or watch; staff see all.
 // @Tags         tickets
 // @Produce      json
 // @Param        id   path      string  true  "Ticket ID"
 // @Success      200  {object}  models.Ticket
-// @Failure      404  {string}  string  "ticket not found"
+// @Failure      404  {object}  Problem  "ticket not found"
 // @Security     BearerAuth
 // @Security     BearerAuth
 // @Router       /tickets/{id} [get]
@@ -54,15 +158,19 @@ func (h Tickets) GetByID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	var t models.Ticket
+	if !ticketVisible(w, r, h.DB, id) {
+		return
+	}
+	
+	t, err := loadTicket(h.DB, r, id)
 	
-	if err := h.DB.Preload("CreatedByUser").Preload("AssignedToUser").Preload("Comments").First(&t, "id = ?", id).Error; err != nil {
+	if err != nil {
 		if err == gorm.ErrRecordNotFound {
-			http.Error(w, "ticket not found", http.StatusNotFound)
+			writeError(w, r, "ticket not found", http.StatusNotFound)
 			return
 		}
 	
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDBError(w, r, err)
 		return
 	}
 	
@@ -70,14 +178,31 @@ func (h Tickets) GetByID(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(t)
 }
 
+// loadTicket returns a ticket with its people, category, the comments the caller may see and its links
+func loadTicket(db *gorm.DB, r *http.Request, id uuid.UUID) (models.Ticket, error) {
+	var t models.Ticket
+	if err := db.Preload("CreatedByUser").Preload("AssignedToUser").Preload("Category").Preload("Comments", conditionArgs(visibleCommentsCondition(r))...).First(&t, "id = ?", id).Error; err != nil {
+		return t, err
+	}
+
+	relations, err := ticketRelations(db, id)
+	if err != nil {
+		return t, err
+	}
+	t.Relations = relations
+	return t, nil
+}
+
 // Create godoc
 // @Summary      Create a new ticket
+// @Description  Tickets created without an assignee are handed to an available agent by the first matching routing rule.
 // @Tags         tickets
 // @Accept       json
 // @Produce      json
 // @Param        ticket  body      models.Ticket  true  "Ticket"
 // @Success      201  {object}  models.Ticket
-// @Failure      400  {string}  string  "Bad request"
+// @Failure      400  {object}  Problem  "Bad request"
+// @Failure      422  {object}  Problem  "invalid fields; new tickets start OPEN"
 // @Security     BearerAuth
 // @Security     BearerAuth
 // @Router       /tickets [post]
@@ -85,18 +210,67 @@ func (h Tickets) Create(w http.ResponseWriter, r *http.Request) {
 	var t models.Ticket
 	
 	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeBodyError(w, r, err)
 		return
 	}
 	
+	userID, _ := currentUserID(r)
 	t.Id = uuid.New()
+	t.CreatedByUserId = userID
+	t.CreatedAt = time.Now()
 	
 	if t.Status == "" {
 		t.Status = models.TicketStatusOpen
 	}
 	
-	if err := h.DB.Create(&t).Error; err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if t.Priority == "" {
+		t.Priority = models.TicketPriorityNormal
+	}
+	
+	errs := ticketFieldErrors(h.DB, t)
+	
+	if t.Status.Valid() && t.Status != models.TicketStatusOpen {
+		errs = append(errs, FieldError{Field: "status", Code: FieldInvalid, Message: "new tickets start OPEN"})
+	}
+	
+	if len(errs) > 0 {
+		writeValidation(w, r, errs...)
+		return
+	}
+	
+	// Timestamps and SLA fields are maintained by the server, and related rows are not
+	// created through the ticket
+	t.ResolvedAt = nil
+	t.FirstRespondedAt = nil
+	t.CreatedByUser = models.User{}
+	t.AssignedToUser = nil
+	t.Category = nil
+	t.SLAPolicy = nil
+	t.Comments = nil
+	t.Events = nil
+	t.Attachments = nil
+	t.Watchers = nil
+	
+	if err := sla.Apply(h.DB, &t); err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+	
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		rule, err := routing.Assign(tx, &t, time.Now())
+		if err != nil {
+			return err
+		}
+		
+		if err := tx.Omit(clause.Associations).Create(&t).Error; err != nil {
+			return err
+		}
+		
+		return h.Events.Publish(tx, events.TicketCreatedEvent{ActorID: userID, Ticket: t, Reason: routing.Reason(rule)})
+	})
+	
+	if err != nil {
+		writeDBError(w, r, err)
 		return
 	}
 	
@@ -107,13 +281,18 @@ func (h Tickets) Create(w http.ResponseWriter, r *http.Request) {
 
 // Update godoc
 // @Summary      Update ticket by ID
+// @Description  Only the fields in the body are changed. Status changes follow the same rules as the transition endpoints.
+// @Description  Cancelled tickets cannot be changed, and closed tickets only reopened (by staff), optionally with other changes.
 // @Tags         tickets
 // @Accept       json
 // @Produce      json
 // @Param        id   path      string  true  "Ticket ID"
 // @Param        ticket  body      models.Ticket  true  "Ticket"
 // @Success      200  {object}  models.Ticket
-// @Failure      404  {string}  string  "ticket not found"
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      404  {object}  Problem  "ticket not found"
+// @Failure      409  {object}  Problem  "invalid_transition, or the ticket changed meanwhile"
+// @Failure      422  {object}  Problem  "invalid fields"
 // @Security     BearerAuth
 // @Security     BearerAuth
 // @Router       /tickets/{id} [put]
@@ -124,50 +303,438 @@ func (h Tickets) Update(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	var t models.Ticket
+	var existing models.Ticket
 	
-	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if err := h.DB.First(&existing, "id = ?", id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			writeError(w, r, "ticket not found", http.StatusNotFound)
+			return
+		}
+	
+		writeDBError(w, r, err)
+		return
+	}
+	
+	if !canEditTicket(r, existing) {
+		writeError(w, r, "forbidden", http.StatusForbidden)
+		return
+	}
+	
+	if existing.Status == models.TicketStatusCancelled {
+		writeErrorCode(w, r, CodeInvalidTransition, "a cancelled ticket cannot be changed", http.StatusConflict)
 		return
 	}
 	
-	t.Id = id
+	// Only the fields in the body are changed, so a client may send a partial ticket
+	var fields map[string]json.RawMessage
 	
-	updates := map[string]interface{}{
-		"title":                 t.Title,
-		"description":           t.Description,
-		"status":                t.Status,
-		"assigned_to_user_id":   t.AssignedToUserId,
+	if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
+		writeBodyError(w, r, err)
+		return
 	}
 	
-	if t.Status == models.TicketStatusResolved || t.Status == models.TicketStatusClosed {
-		now := time.Now()
-		updates["resolved_at"] = &now
+	t := existing
+	raw, _ := json.Marshal(fields)
+	
+	if err := json.Unmarshal(raw, &t); err != nil {
+		writeBodyError(w, r, err)
+		return
 	}
 	
-	result := h.DB.Model(&models.Ticket{}).Where("id = ?", id).Updates(updates)
+	if t.Priority == "" {
+		t.Priority = existing.Priority
+	}
 	
-	if result.Error != nil {
-		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+	if t.Status == "" {
+		t.Status = existing.Status
+	}
+	
+	errs := ticketFieldErrors(h.DB, t)
+	
+	if _, ok := fields["title"]; ok && strings.TrimSpace(t.Title) == "" {
+		errs = append(errs, FieldError{Field: "title", Code: FieldRequired, Message: "is required"})
+	}
+	
+	if len(errs) > 0 {
+		writeValidation(w, r, errs...)
 		return
 	}
 	
-	if result.RowsAffected == 0 {
-		http.Error(w, "ticket not found", http.StatusNotFound)
+	if t.Status != existing.Status && !checkTransition(w, r, existing, t.Status) {
 		return
 	}
 	
-	h.DB.Preload("CreatedByUser").Preload("AssignedToUser").Preload("Comments").First(&t, "id = ?", id)
+	updates := map[string]interface{}{}
+	columns := map[string]interface{}{
+		"title":               t.Title,
+		"description":         t.Description,
+		"priority":            t.Priority,
+		"category_id":         t.CategoryId,
+		"assigned_to_user_id": t.AssignedToUserId,
+	}
+	
+	for column, value := range columns {
+		if _, ok := fields[column]; ok {
+			updates[column] = value
+		}
+	}
+	
+	// A closed ticket is kept as it was closed; reopen it, in this request or before, to change it
+	if existing.Status == models.TicketStatusClosed && t.Status == models.TicketStatusClosed && ticketFieldsChanged(existing, t, updates) {
+		writeErrorCode(w, r, CodeInvalidTransition, "a closed ticket must be reopened before it is changed", http.StatusConflict)
+		return
+	}
+	
+	updates["status"] = t.Status
+	
+	h.saveTicket(w, r, existing, updates, "")
+}
+
+// TicketTransitionRequest is the optional body of the status transition endpoints
+type TicketTransitionRequest struct {
+	Reason string `json:"reason"`
+}
+
+// Start godoc
+// @Summary      Start work on a ticket
+// @Description  OPEN → IN_PROGRESS
+// @Tags         tickets
+// @Accept       json
+// @Produce      json
+// @Param        id    path      string                   true   "Ticket ID"
+// @Param        body  body      TicketTransitionRequest  false  "Reason"
+// @Success      200  {object}  models.Ticket
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      404  {object}  Problem  "ticket not found"
+// @Failure      409  {object}  Problem  "invalid_transition, or the ticket changed meanwhile"
+// @Security     BearerAuth
+// @Router       /tickets/{id}/start [post]
+func (h Tickets) Start(w http.ResponseWriter, r *http.Request) {
+	h.transition(w, r, models.TicketStatusInProgress)
+}
+
+// Resolve godoc
+// @Summary      Resolve a ticket
+// @Description  OPEN or IN_PROGRESS → RESOLVED
+// @Tags         tickets
+// @Accept       json
+// @Produce      json
+// @Param        id    path      string                   true   "Ticket ID"
+// @Param        body  body      TicketTransitionRequest  false  "Reason"
+// @Success      200  {object}  models.Ticket
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      404  {object}  Problem  "ticket not found"
+// @Failure      409  {object}  Problem  "invalid_transition, or the ticket changed meanwhile"
+// @Security     BearerAuth
+// @Router       /tickets/{id}/resolve [post]
+func (h Tickets) Resolve(w http.ResponseWriter, r *http.Request) {
+	h.transition(w, r, models.TicketStatusResolved)
+}
+
+// Close godoc
+// @Summary      Close a resolved ticket
+// @Description  RESOLVED → CLOSED
+// @Tags         tickets
+// @Accept       json
+// @Produce      json
+// @Param        id    path      string                   true   "Ticket ID"
+// @Param        body  body      TicketTransitionRequest  false  "Reason"
+// @Success      200  {object}  models.Ticket
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      404  {object}  Problem  "ticket not found"
+// @Failure      409  {object}  Problem  "invalid_transition, or the ticket changed meanwhile"
+// @Security     BearerAuth
+// @Router       /tickets/{id}/close [post]
+func (h Tickets) Close(w http.ResponseWriter, r *http.Request) {
+	h.transition(w, r, models.TicketStatusClosed)
+}
+
+// Reopen godoc
+// @Summary      Reopen a ticket
+// @Description  IN_PROGRESS, RESOLVED or CLOSED → OPEN. Only staff can reopen closed tickets.
+// @Tags         tickets
+// @Accept       json
+// @Produce      json
+// @Param        id    path      string                   true   "Ticket ID"
+// @Param        body  body      TicketTransitionRequest  false  "Reason"
+// @Success      200  {object}  models.Ticket
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      404  {object}  Problem  "ticket not found"
+// @Failure      409  {object}  Problem  "invalid_transition, or the ticket changed meanwhile"
+// @Security     BearerAuth
+// @Router       /tickets/{id}/reopen [post]
+func (h Tickets) Reopen(w http.ResponseWriter, r *http.Request) {
+	h.transition(w, r, models.TicketStatusOpen)
+}
+
+// Cancel godoc
+// @Summary      Cancel a ticket
+// @Description  OPEN or IN_PROGRESS → CANCELLED. Cancelled tickets cannot be changed.
+// @Tags         tickets
+// @Accept       json
+// @Produce      json
+// @Param        id    path      string                   true   "Ticket ID"
+// @Param        body  body      TicketTransitionRequest  false  "Reason"
+// @Success      200  {object}  models.Ticket
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      404  {object}  Problem  "ticket not found"
+// @Failure      409  {object}  Problem  "invalid_transition, or the ticket changed meanwhile"
+// @Security     BearerAuth
+// @Router       /tickets/{id}/cancel [post]
+func (h Tickets) Cancel(w http.ResponseWriter, r *http.Request) {
+	h.transition(w, r, models.TicketStatusCancelled)
+}
+
+// maxTransitionReason bounds the reason given with a status transition
+const maxTransitionReason = 2000
+
+// transition moves a ticket to the given status
+func (h Tickets) transition(w http.ResponseWriter, r *http.Request, to models.TicketStatus) {
+	id, ok := uuidParam(w, r, "id")
+	if !ok {
+		return
+	}
+
+	var req TicketTransitionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		writeBodyError(w, r, err)
+		return
+	}
+
+	req.Reason = SanitizeInput(req.Reason)
+	if len(req.Reason) > maxTransitionReason {
+		writeValidation(w, r, FieldError{Field: "reason", Code: FieldTooLong, Message: fmt.Sprintf("may be at most %d characters", maxTransitionReason)})
+		return
+	}
+
+	var existing models.Ticket
+	if err := h.DB.First(&existing, "id = ?", id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			writeError(w, r, "ticket not found", http.StatusNotFound)
+			return
+		}
+		writeDBError(w, r, err)
+		return
+	}
+
+	if !canEditTicket(r, existing) {
+		writeError(w, r, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	if !checkTransition(w, r, existing, to) {
+		return
+	}
+
+	h.saveTicket(w, r, existing, map[string]interface{}{"status": to}, req.Reason)
+}
+
+// checkTransition writes 409 or 403 and returns false unless the caller may move t to the given status
+func checkTransition(w http.ResponseWriter, r *http.Request, t models.Ticket, to models.TicketStatus) bool {
+	if !t.Status.CanTransitionTo(to) {
+		detail := fmt.Sprintf("a %s ticket cannot become %s", humanizeStatus(t.Status), humanizeStatus(to))
+		if t.Status == to {
+			detail = fmt.Sprintf("the ticket is already %s", humanizeStatus(to))
+		}
+		writeErrorCode(w, r, CodeInvalidTransition, detail, http.StatusConflict)
+		return false
+	}
+
+	if t.Status == models.TicketStatusClosed && !hasRole(r, StaffRoles...) {
+		writeError(w, r, "only staff can reopen a closed ticket", http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+// humanizeStatus turns a status like IN_PROGRESS into "in progress"
+func humanizeStatus(s models.TicketStatus) string {
+	return strings.ToLower(strings.ReplaceAll(s.String(), "_", " "))
+}
+
+// errTicketChanged means the ticket's status changed between reading and saving it
+var errTicketChanged = errors.New("ticket changed")
+
+// errNoAgent means nobody in the routed-to group is available
+var errNoAgent = errors.New("no agent available")
+
+// saveTicket applies updates to existing in a transaction and writes the saved ticket.
+// The update only applies if the status is still the one the caller checked.
+func (h Tickets) saveTicket(w http.ResponseWriter, r *http.Request, existing models.Ticket, updates map[string]interface{}, reason string) {
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		return h.updateTicket(tx, r, existing, updates, reason)
+	})
+	h.writeSavedTicket(w, r, existing.Id, err)
+}
+
+// updateTicket applies updates to existing within tx, keeps resolved_at in step with the
+// status and publishes TicketUpdated. It returns errTicketChanged if the status moved on.
+func (h Tickets) updateTicket(tx *gorm.DB, r *http.Request, existing models.Ticket, updates map[string]interface{}, reason string) error {
+	if to, ok := updates["status"].(models.TicketStatus); ok && to != existing.Status {
+		if to.IsResolved() && !existing.Status.IsResolved() {
+			now := time.Now()
+			updates["resolved_at"] = &now
+		} else if !to.IsResolved() && existing.Status.IsResolved() {
+			updates["resolved_at"] = nil
+		}
+	}
+
+	actorID, _ := currentUserID(r)
+
+	result := tx.Model(&models.Ticket{}).Where("id = ? AND status = ?", existing.Id, existing.Status).Updates(updates)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errTicketChanged
+	}
+
+	var updated models.Ticket
+	if err := tx.First(&updated, "id = ?", existing.Id).Error; err != nil {
+		return err
+	}
+
+	return h.Events.Publish(tx, events.TicketUpdatedEvent{ActorID: actorID, Before: existing, After: updated, Reason: reason})
+}
+
+// writeSavedTicket answers a save with the error, or with the saved ticket
+func (h Tickets) writeSavedTicket(w http.ResponseWriter, r *http.Request, id uuid.UUID, err error) {
+	if err == errTicketChanged {
+		writeError(w, r, "the ticket was changed by someone else; reload it and try again", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+
+	t, err := loadTicket(h.DB, r, id)
+	if err != nil {
+		writeDBError(w, r, err)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(t)
 }
 
+// Route godoc
+// @Summary      Re-route a ticket
+// @Description  Runs the routing rules again and hands the ticket to an available agent of the matching group, replacing the assignee.
+// @Tags         tickets
+// @Produce      json
+// @Param        id  path      string  true  "Ticket ID"
+// @Success      200  {object}  models.Ticket
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      404  {object}  Problem  "ticket not found"
+// @Failure      409  {object}  Problem  "the ticket is closed, no rule matches, or nobody in the group is available"
+// @Security     BearerAuth
+// @Router       /tickets/{id}/route [post]
+func (h Tickets) Route(w http.ResponseWriter, r *http.Request) {
+	id, ok := uuidParam(w, r, "id")
+	if !ok {
+		return
+	}
+
+	var existing models.Ticket
+	if err := h.DB.First(&existing, "id = ?", id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			writeError(w, r, "ticket not found", http.StatusNotFound)
+			return
+		}
+		writeDBError(w, r, err)
+		return
+	}
+
+	if existing.Status.IsResolved() || existing.Status == models.TicketStatusCancelled {
+		writeError(w, r, fmt.Sprintf("a %s ticket cannot be routed", humanizeStatus(existing.Status)), http.StatusConflict)
+		return
+	}
+
+	rule, err := routing.Match(h.DB, existing)
+	if err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+	if rule == nil {
+		writeError(w, r, "no routing rule matches the ticket", http.StatusConflict)
+		return
+	}
+
+	// Pick and assign in one transaction, so the group stays locked until the ticket is
+	// saved and its turn order only moves on if the assignment sticks
+	err = h.DB.Transaction(func(tx *gorm.DB) error {
+		agent, err := routing.PickAgent(tx, rule.GroupId, time.Now())
+		if err != nil {
+			return err
+		}
+		if agent == nil {
+			return errNoAgent
+		}
+		return h.updateTicket(tx, r, existing, map[string]interface{}{"assigned_to_user_id": agent}, routing.Reason(rule))
+	})
+	if err == errNoAgent {
+		writeError(w, r, fmt.Sprintf("nobody routed to by %q is available", rule.Name), http.StatusConflict)
+		return
+	}
+
+	h.writeSavedTicket(w, r, existing.Id, err)
+}
+
+// ticketEventListSpec controls filtering and includes for GET /tickets/{id}/events
+var ticketEventListSpec = listSpec{
+	filters: map[string]filterFunc{
+		"type":  enumFilter("type", func(s string) bool { return models.TicketEventType(s).Valid() }),
+		"field": eqFilter("field"),
+		"actor": uuidFilter("actor_user_id"),
+	},
+	sorts: map[string]string{
+		"created_at": "created_at",
+	},
+	defaultSort: "created_at",
+	includes: map[string]listInclude{
+		"actor_user": {preload: "ActorUser", columns: []string{"actor_user_id"}},
+	},
+	defaultInclude: []string{"actor_user"},
+}
+
+// History godoc
+// @Summary      Get a ticket's history
+// @Description  Who changed what and when, oldest first. Only for people who can see the ticket.
+// @Description  Paged with limit/offset or cursor. See X-Total-Count, X-Next-Cursor and Link.
+// @Tags         tickets
+// @Produce      json
+// @Param        id       path      string  true   "Ticket ID"
+// @Param        type     query     string  false  "CREATED, STATUS_CHANGED, FIELD_CHANGED, SLA_BREACHED or MERGED; comma-separated for several"
+// @Param        field    query     string  false  "Changed field, e.g. status or assigned_to_user_id"
+// @Param        actor    query     string  false  "User ID, me, or none for system changes"
+// @Param        sort     query     string  false  "created_at; prefix - for descending (default created_at)"
+// @Param        include  query     string  false  "actor_user (default actor_user)"
+// @Param        fields   query     string  false  "Fields to return, e.g. type,field,new_value"
+// @Param        limit    query     int     false  "Page size (default 50, max 200)"
+// @Param        offset   query     int     false  "Rows to skip"
+// @Param        cursor   query     string  false  "X-Next-Cursor of the previous page"
+// @Success      200  {array}   models.TicketEvent
+// @Failure      400  {object}  Problem  "invalid filter, sort, include or cursor"
+// @Failure      404  {object}  Problem  "ticket not found"
+// @Security     BearerAuth
+// @Router       /tickets/{id}/events [get]
+func (h Tickets) History(w http.ResponseWriter, r *http.Request) {
+	id, ok := uuidParam(w, r, "id")
+	if !ok || !ticketVisible(w, r, h.DB, id) {
+		return
+	}
+
+	serveList[models.TicketEvent](w, r, h.DB.Where("ticket_id = ?", id), ticketEventListSpec)
+}
+
 // Delete godoc
 // @Summary      Delete ticket by ID
 // @Tags         tickets
 // @Param        id   path      string  true  "Ticket ID"
 // @Success      204  "No Content"
-// @Failure      404  {string}  string  "ticket not found"
+// @Failure      404  {object}  Problem  "ticket not found"
+// @Failure      403  {object}  Problem  "forbidden"
 // @Security     BearerAuth
 // @Security     BearerAuth
 // @Router       /tickets/{id} [delete]
@@ -178,26 +745,155 @@ func (h Tickets) Delete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
+	var attachments []models.Attachment
+	
+	if err := h.DB.Find(&attachments, "ticket_id = ?", id).Error; err != nil {
+		writeDBError(w, r, err)
+		return
+	}
+	
 	result := h.DB.Delete(&models.Ticket{}, "id = ?", id)
 	
 	if result.Error != nil {
-		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		writeDBError(w, r, result.Error)
 		return
 	}
 	
 	if result.RowsAffected == 0 {
-		http.Error(w, "ticket not found", http.StatusNotFound)
+		writeError(w, r, "ticket not found", http.StatusNotFound)
 		return
 	}
 	
+	if h.Store != nil {
+		deleteAttachmentBlobs(r, h.Store, attachments)
+	}
+	
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// ticketFieldErrors checks the status, priority and category of a ticket being saved
+func ticketFieldErrors(db *gorm.DB, t models.Ticket) []FieldError {
+	var errs []FieldError
+	
+	if !t.Status.Valid() {
+		errs = append(errs, FieldError{Field: "status", Code: FieldInvalid, Message: "must be OPEN, IN_PROGRESS, RESOLVED, CLOSED or CANCELLED"})
+	}
+	
+	if !t.Priority.Valid() {
+		errs = append(errs, FieldError{Field: "priority", Code: FieldInvalid, Message: "must be LOW, NORMAL, HIGH or URGENT"})
+	}
+	
+	if t.CategoryId != nil && !categoryExists(db, *t.CategoryId) {
+		errs = append(errs, FieldError{Field: "category_id", Code: FieldUnknown, Message: "unknown category"})
+	}
+	
+	return errs
+}
+
+// ticketFieldsChanged reports whether any of the updated columns differs from the existing ticket
+func ticketFieldsChanged(existing, t models.Ticket, updates map[string]interface{}) bool {
+	for column := range updates {
+		switch column {
+		case "title":
+			if t.Title != existing.Title {
+				return true
+			}
+		case "description":
+			if t.Description != existing.Description {
+				return true
+			}
+		case "priority":
+			if t.Priority != existing.Priority {
+				return true
+			}
+		case "category_id":
+			if !sameID(t.CategoryId, existing.CategoryId) {
+				return true
+			}
+		case "assigned_to_user_id":
+			if !sameID(t.AssignedToUserId, existing.AssignedToUserId) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sameID reports whether two optional IDs are equal
+func sameID(a, b *uuid.UUID) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// ticketVisible writes 404 and returns false if the ticket does not exist or the caller
+// may not see it, so tickets outside the caller's reach look the same as missing ones
+func ticketVisible(w http.ResponseWriter, r *http.Request, db *gorm.DB, id uuid.UUID) bool {
+	var t models.Ticket
+	if err := db.Select("id", "created_by_user_id", "assigned_to_user_id").First(&t, "id = ?", id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			writeError(w, r, "ticket not found", http.StatusNotFound)
+			return false
+		}
+		writeDBError(w, r, err)
+		return false
+	}
+
+	visible, err := canViewTicket(db, r, t)
+	if err != nil {
+		writeDBError(w, r, err)
+		return false
+	}
+	if !visible {
+		writeError(w, r, "ticket not found", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// canViewTicket reports whether the caller is the creator, the assignee, a watcher or staff
+func canViewTicket(db *gorm.DB, r *http.Request, t models.Ticket) (bool, error) {
+	if canEditTicket(r, t) {
+		return true, nil
+	}
+
+	userID, ok := currentUserID(r)
+	if !ok {
+		return false, nil
+	}
+
+	var count int64
+	err := db.Model(&models.TicketWatcher{}).Where("ticket_id = ? AND user_id = ?", t.Id, userID).Count(&count).Error
+	return count > 0, err
+}
+
+// canEditTicket reports whether the caller is the creator, the assignee or staff
+func canEditTicket(r *http.Request, t models.Ticket) bool {
+	userID, ok := currentUserID(r)
+	if !ok {
+		return false
+	}
+
+	if t.CreatedByUserId == userID || (t.AssignedToUserId != nil && *t.AssignedToUserId == userID) {
+		return true
+	}
+
+	return hasRole(r, StaffRoles...)
+}
+
 // RegisterTickets adds ticket routes
 func RegisterTickets(router *mux.Router, h Tickets, prefix string) {
-	router.HandleFunc(prefix, h.List).Methods("GET")
-	router.HandleFunc(prefix, h.Create).Methods("POST")
-	router.HandleFunc(prefix+"/{id}", h.GetByID).Methods("GET")
-	router.HandleFunc(prefix+"/{id}", h.Update).Methods("PUT")
-	router.HandleFunc(prefix+"/{id}", h.Delete).Methods("DELETE")
+	router.HandleFunc(prefix, AuthorizeScoped(h.List, AnyRole, ScopeTicketsRead)).Methods("GET")
+	router.HandleFunc(prefix, AuthorizeScoped(h.Create, AnyRole, ScopeTicketsWrite)).Methods("POST")
+	router.HandleFunc(prefix+"/{id}", AuthorizeScoped(h.GetByID, AnyRole, ScopeTicketsRead)).Methods("GET")
+	router.HandleFunc(prefix+"/{id}", AuthorizeScoped(h.Update, AnyRole, ScopeTicketsWrite)).Methods("PUT")
+	router.HandleFunc(prefix+"/{id}", AuthorizeScoped(h.Delete, AdminRoles, ScopeTicketsWrite)).Methods("DELETE")
+	router.HandleFunc(prefix+"/{id}/start", AuthorizeScoped(h.Start, AnyRole, ScopeTicketsWrite)).Methods("POST")
+	router.HandleFunc(prefix+"/{id}/resolve", AuthorizeScoped(h.Resolve, AnyRole, ScopeTicketsWrite)).Methods("POST")
+	router.HandleFunc(prefix+"/{id}/close", AuthorizeScoped(h.Close, AnyRole, ScopeTicketsWrite)).Methods("POST")
+	router.HandleFunc(prefix+"/{id}/reopen", AuthorizeScoped(h.Reopen, AnyRole, ScopeTicketsWrite)).Methods("POST")
+	router.HandleFunc(prefix+"/{id}/cancel", AuthorizeScoped(h.Cancel, AnyRole, ScopeTicketsWrite)).Methods("POST")
+	router.HandleFunc(prefix+"/{id}/route", AuthorizeScoped(h.Route, StaffRoles, ScopeTicketsWrite)).Methods("POST")
+	router.HandleFunc(prefix+"/{id}/events", AuthorizeScoped(h.History, AnyRole, ScopeTicketsRead)).Methods("GET")
 }
@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"testing"
+
+	"stuff/models"
+
+	"github.com/google/uuid"
+)
+
+func TestTicketFieldsChanged(t *testing.T) {
+	category, other := uuid.New(), uuid.New()
+	existing := models.Ticket{Title: "Printer", Description: "Offline", Priority: models.TicketPriorityNormal, CategoryId: &category}
+
+	tests := []struct {
+		name    string
+		change  func(t *models.Ticket)
+		columns []string
+		want    bool
+	}{
+		{"nothing sent", func(t *models.Ticket) {}, nil, false},
+		{"same values sent back", func(t *models.Ticket) {}, []string{"title", "description", "priority", "category_id", "assigned_to_user_id"}, false},
+		{"same category, new pointer", func(t *models.Ticket) { id := category; t.CategoryId = &id }, []string{"category_id"}, false},
+		{"title", func(t *models.Ticket) { t.Title = "Scanner" }, []string{"title"}, true},
+		{"priority", func(t *models.Ticket) { t.Priority = models.TicketPriorityHigh }, []string{"priority"}, true},
+		{"category", func(t *models.Ticket) { t.CategoryId = &other }, []string{"category_id"}, true},
+		{"category cleared", func(t *models.Ticket) { t.CategoryId = nil }, []string{"category_id"}, true},
+		{"assignee set", func(t *models.Ticket) { t.AssignedToUserId = &other }, []string{"assigned_to_user_id"}, true},
+		{"changed but not sent", func(t *models.Ticket) { t.Title = "Scanner" }, []string{"description"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changed := existing
+			tt.change(&changed)
+			updates := map[string]interface{}{}
+			for _, c := range tt.columns {
+				updates[c] = nil
+			}
+			if got := ticketFieldsChanged(existing, changed, updates); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHumanizeStatus(t *testing.T) {
+	if got := humanizeStatus(models.TicketStatusInProgress); got != "in progress" {
+		t.Errorf("got %q", got)
+	}
+}
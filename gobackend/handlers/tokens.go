@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+
+	"stuff/models"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	// accessTokenTTL is how long a JWT access token is accepted
+	accessTokenTTL = 15 * time.Minute
+	// refreshTokenTTL is how long an unused refresh token can be exchanged
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// generateToken creates a short-lived JWT access token for the user
+func generateToken(user models.User) (string, time.Time, error) {
+	role := user.Role
+	if role == "" {
+		role = models.RoleEmployee
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(accessTokenTTL)
+
+	claims := Claims{
+		UserID:       user.Id.String(),
+		Email:        user.Email,
+		Role:         role.String(),
+		DepartmentID: user.DepartmentId.String(),
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+
+	signed, err := signToken(claims)
+	return signed, expiresAt, err
+}
+
+// issueTokens creates an access token and a refresh token in the given family
+func issueTokens(db *gorm.DB, user models.User, familyID uuid.UUID) (LoginResponse, models.RefreshToken, error) {
+	accessToken, expiresAt, err := generateToken(user)
+	if err != nil {
+		return LoginResponse{}, models.RefreshToken{}, err
+	}
+
+	refreshToken, err := newOpaqueToken()
+	if err != nil {
+		return LoginResponse{}, models.RefreshToken{}, err
+	}
+
+	rt := models.RefreshToken{
+		Id:        uuid.New(),
+		UserId:    user.Id,
+		FamilyId:  familyID,
+		TokenHash: hashToken(refreshToken),
+		ExpiresAt: time.Now().Add(refreshTokenTTL),
+	}
+
+	if err := db.Create(&rt).Error; err != nil {
+		return LoginResponse{}, models.RefreshToken{}, err
+	}
+
+	return LoginResponse{
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+		ExpiresAt:    expiresAt,
+		User:         user,
+	}, rt, nil
+}
+
+// newSession issues the first token pair of a new refresh token family
+func newSession(db *gorm.DB, user models.User) (LoginResponse, error) {
+	resp, _, err := issueTokens(db, user, uuid.New())
+	return resp, err
+}
+
+// revokeTokenFamily revokes every refresh token rotated from the same login
+func revokeTokenFamily(db *gorm.DB, familyID uuid.UUID) error {
+	return db.Model(&models.RefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NULL", familyID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// revokeAccessToken blocks an access token by its jti until it expires
+func revokeAccessToken(db *gorm.DB, claims *Claims) error {
+	userID, _ := uuid.Parse(claims.UserID)
+
+	expiresAt := time.Now().Add(accessTokenTTL)
+	if claims.ExpiresAt != nil {
+		expiresAt = claims.ExpiresAt.Time
+	}
+
+	return db.Where("jti = ?", claims.ID).FirstOrCreate(&models.RevokedToken{
+		Jti:       claims.ID,
+		UserId:    userID,
+		ExpiresAt: expiresAt,
+	}).Error
+}
+
+// isTokenRevoked reports whether an access token ID has been revoked
+func isTokenRevoked(db *gorm.DB, jti string) (bool, error) {
+	var count int64
+	if err := db.Model(&models.RevokedToken{}).Where("jti = ?", jti).Count(&count).Error; err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// newOpaqueToken returns a random URL-safe token
+func newOpaqueToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the hex SHA-256 of a token; only hashes are stored
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CleanupTokens periodically removes expired refresh tokens, revocation records and SSO login states
+func (h Auth) CleanupTokens() {
+	ticker := time.NewTicker(1 * time.Hour)
+	go func() {
+		for range ticker.C {
+			now := time.Now()
+			h.DB.Where("expires_at < ?", now).Delete(&models.RevokedToken{})
+			h.DB.Where("expires_at < ?", now).Delete(&models.RefreshToken{})
+			h.DB.Where("expires_at < ?", now).Delete(&models.OAuthState{})
+			h.DB.Where("expires_at < ?", now).Delete(&models.SSONonce{})
+		}
+	}()
+}
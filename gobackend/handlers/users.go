@@ -3,6 +3,7 @@ package handlers
 import (
 	"encoding/json"
 	"net/http"
+	"strings"
 
 	"stuff/models"
 
@@ -17,23 +18,48 @@ type Users struct {
 	DB *gorm.DB
 }
 
+// userListSpec controls filtering, sorting and includes for GET /users
+var userListSpec = listSpec{
+	filters: map[string]filterFunc{
+		"q":             searchFilter("name", "email"),
+		"department_id": uuidFilter("department_id"),
+		"role":          enumFilter("role", func(s string) bool { return models.Role(s).Valid() }),
+		"mfa_enabled":   boolFilter("mfa_enabled"),
+	},
+	sorts: map[string]string{
+		"name":       "name",
+		"email":      "email",
+		"role":       "role",
+		"created_at": "created_at",
+	},
+	defaultSort: "name",
+	includes: map[string]listInclude{
+		"department": {preload: "Department", columns: []string{"department_id"}},
+	},
+	defaultInclude: []string{"department"},
+}
+
 // List godoc
 // @Summary      Get all users
+// @Description  Paged with limit/offset or cursor. See X-Total-Count, X-Next-Cursor and Link.
 // @Tags         users
 // @Produce      json
+// @Param        q              query     string  false  "Search in name and email"
+// @Param        department_id  query     string  false  "Department ID"
+// @Param        role           query     string  false  "Role; comma-separated for several"
+// @Param        mfa_enabled    query     bool    false  "Only users with or without MFA"
+// @Param        sort           query     string  false  "name, email, role or created_at; prefix - for descending (default name)"
+// @Param        include        query     string  false  "department (default department)"
+// @Param        fields         query     string  false  "Fields to return, e.g. id,name,email"
+// @Param        limit          query     int     false  "Page size (default 50, max 200)"
+// @Param        offset         query     int     false  "Rows to skip"
+// @Param        cursor         query     string  false  "X-Next-Cursor of the previous page"
 // @Success      200  {array}   models.User
+// @Failure      400  {object}  Problem  "invalid filter, sort, include or cursor"
 // @Security     BearerAuth
 // @Router       /users [get]
 func (h Users) List(w http.ResponseWriter, r *http.Request) {
-	var list []models.User
-
-	if err := h.DB.Preload("Department").Find(&list).Error; err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(list)
+	serveList[models.User](w, r, h.DB, userListSpec)
 }
 
 // GetByID godoc
@@ -42,7 +68,7 @@ func (h Users) List(w http.ResponseWriter, r *http.Request) {
 // @Produce      json
 // @Param        id   path      string  true  "User ID"
 // @Success      200  {object}  models.User
-// @Failure      404  {string}  string  "user not found"
+// @Failure      404  {object}  Problem  "user not found"
 // @Security     BearerAuth
 // @Router       /users/{id} [get]
 func (h Users) GetByID(w http.ResponseWriter, r *http.Request) {
@@ -56,11 +82,11 @@ func (h Users) GetByID(w http.ResponseWriter, r *http.Request) {
 	
 	if err := h.DB.Preload("Department").First(&u, "id = ?", id).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
-			http.Error(w, "user not found", http.StatusNotFound)
+			writeError(w, r, "user not found", http.StatusNotFound)
 			return
 		}
 	
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDBError(w, r, err)
 		return
 	}
 	
@@ -75,7 +101,9 @@ func (h Users) GetByID(w http.ResponseWriter, r *http.Request) {
 // @Produce      json
 // @Param        user  body      models.User  true  "User"
 // @Success      201  {object}  models.User
-// @Failure      400  {string}  string  "Bad request"
+// @Failure      400  {object}  Problem  "Bad request"
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      422  {object}  Problem  "invalid fields, e.g. an invalid name or email or a weak password"
 // @Security     BearerAuth
 // @Router       /users [post]
 func (h Users) Create(w http.ResponseWriter, r *http.Request) {
@@ -83,18 +111,56 @@ func (h Users) Create(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		Name         string    `json:"name"`
 		Email        string    `json:"email"`
-		Password     string    `json:"password"`
-		DepartmentId uuid.UUID `json:"department_id"`
+		Password     string      `json:"password"`
+		DepartmentId uuid.UUID   `json:"department_id"`
+		Role         models.Role `json:"role"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeBodyError(w, r, err)
+		return
+	}
+
+	if req.Role == "" {
+		req.Role = models.RoleEmployee
+	}
+
+	if !req.Role.Valid() {
+		writeValidation(w, r, FieldError{Field: "role", Code: FieldInvalid, Message: "invalid role"})
+		return
+	}
+
+	// Only admins may hand out roles other than employee
+	if req.Role != models.RoleEmployee && !hasRole(r, models.RoleAdmin) {
+		writeError(w, r, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	// Same rules as self-registration
+	req.Name = SanitizeInput(req.Name)
+	req.Email = SanitizeInput(req.Email)
+	var errs []FieldError
+
+	if !ValidateName(req.Name) {
+		errs = append(errs, FieldError{Field: "name", Code: FieldInvalid, Message: "Name must be 2-100 characters and contain only letters, spaces, hyphens, or apostrophes"})
+	}
+
+	if !ValidateEmail(req.Email) {
+		errs = append(errs, FieldError{Field: "email", Code: FieldInvalid, Message: "Invalid email format"})
+	}
+
+	if valid, msg := ValidatePassword(req.Password); !valid {
+		errs = append(errs, FieldError{Field: "password", Code: FieldInvalid, Message: msg})
+	}
+
+	if len(errs) > 0 {
+		writeValidation(w, r, errs...)
 		return
 	}
 
 	hashed, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
 	if err != nil {
-		http.Error(w, "failed to hash password", http.StatusInternalServerError)
+		writeError(w, r, "failed to hash password", http.StatusInternalServerError)
 		return
 	}
 
@@ -104,10 +170,11 @@ func (h Users) Create(w http.ResponseWriter, r *http.Request) {
 		Email:        req.Email,
 		PasswordHash: string(hashed),
 		DepartmentId: req.DepartmentId,
+		Role:         req.Role,
 	}
 
 	if err := h.DB.Create(&u).Error; err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeDBError(w, r, err)
 		return
 	}
 
@@ -116,15 +183,28 @@ func (h Users) Create(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(u)
 }
 
+// UserUpdateRequest is the body for updating a user. Omitted fields are left unchanged.
+type UserUpdateRequest struct {
+	Name           *string      `json:"name"`
+	Email          *string      `json:"email"`           // HR and admins only, since it is where password resets go
+	DepartmentId   *uuid.UUID   `json:"department_id"`   // HR and admins only
+	Role           *models.Role `json:"role"`            // admins only
+	FeedbackRating *int         `json:"feedback_rating"` // managers, HR and admins, not on themselves
+}
+
 // Update godoc
 // @Summary      Update user by ID
+// @Description  Users may edit themselves; managers, HR and admins may edit the users they manage whose role is below their own.
+// @Description  Admins may edit anyone. Omitted fields are left unchanged, and restricted fields may be sent back unchanged.
 // @Tags         users
 // @Accept       json
 // @Produce      json
 // @Param        id   path      string  true  "User ID"
-// @Param        user  body      models.User  true  "User"
+// @Param        user  body      UserUpdateRequest  true  "User"
 // @Success      200  {object}  models.User
-// @Failure      404  {string}  string  "user not found"
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      404  {object}  Problem  "user not found"
+// @Failure      422  {object}  Problem  "invalid fields"
 // @Security     BearerAuth
 // @Router       /users/{id} [put]
 func (h Users) Update(w http.ResponseWriter, r *http.Request) {
@@ -134,34 +214,132 @@ func (h Users) Update(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	var u models.User
+	allowed, err := canManageUser(h.DB, r, id)
 	
-	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if err != nil {
+		writeDBError(w, r, err)
 		return
 	}
 	
-	u.Id = id
+	if !allowed {
+		writeError(w, r, "forbidden", http.StatusForbidden)
+		return
+	}
 	
-	result := h.DB.Model(&models.User{}).Where("id = ?", id).Updates(map[string]interface{}{
-		"name":            u.Name,
-		"email":           u.Email,
-		"password_hash":   u.PasswordHash,
-		"department_id":   u.DepartmentId,
-		"feedback_rating": u.FeedbackRating,
-	})
+	var current models.User
 	
-	if result.Error != nil {
-		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+	if err := h.DB.First(&current, "id = ?", id).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			writeError(w, r, "user not found", http.StatusNotFound)
+			return
+		}
+	
+		writeDBError(w, r, err)
 		return
 	}
 	
-	if result.RowsAffected == 0 {
-		http.Error(w, "user not found", http.StatusNotFound)
+	callerID, _ := currentUserID(r)
+	callerRole, _ := GetRoleFromContext(r.Context())
+	self := callerID == id
+	
+	// Nobody but an admin edits someone of their own rank or above
+	if !self && callerRole != models.RoleAdmin && !callerRole.Outranks(current.Role) {
+		writeError(w, r, "forbidden", http.StatusForbidden)
+		return
+	}
+	
+	var req UserUpdateRequest
+	
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+	
+	// Passwords are never written here
+	updates := map[string]interface{}{}
+	var errs []FieldError
+	
+	if req.Name != nil {
+		name := SanitizeInput(*req.Name)
+	
+		if !ValidateName(name) {
+			errs = append(errs, FieldError{Field: "name", Code: FieldInvalid, Message: "Name must be 2-100 characters and contain only letters, spaces, hyphens, or apostrophes"})
+		} else {
+			updates["name"] = name
+		}
+	}
+	
+	if req.Email != nil && *req.Email != current.Email {
+		if !hasRole(r, PeopleRoles...) {
+			writeError(w, r, "only HR and admins can change email addresses", http.StatusForbidden)
+			return
+		}
+	
+		email := strings.TrimSpace(*req.Email)
+	
+		if !ValidateEmail(email) {
+			errs = append(errs, FieldError{Field: "email", Code: FieldInvalid, Message: "Invalid email format"})
+		} else {
+			updates["email"] = email
+			updates["email_verified_at"] = nil
+		}
+	}
+	
+	if req.DepartmentId != nil && *req.DepartmentId != current.DepartmentId {
+		if !hasRole(r, PeopleRoles...) {
+			writeError(w, r, "only HR and admins can change departments", http.StatusForbidden)
+			return
+		}
+	
+		if !departmentExists(h.DB, *req.DepartmentId) {
+			errs = append(errs, FieldError{Field: "department_id", Code: FieldUnknown, Message: "unknown department"})
+		} else {
+			updates["department_id"] = *req.DepartmentId
+		}
+	}
+	
+	if req.Role != nil && *req.Role != current.Role {
+		if !req.Role.Valid() {
+			writeValidation(w, r, FieldError{Field: "role", Code: FieldInvalid, Message: "invalid role"})
+			return
+		}
+	
+		if !hasRole(r, models.RoleAdmin) {
+			writeError(w, r, "only admins can change roles", http.StatusForbidden)
+			return
+		}
+	
+		updates["role"] = *req.Role
+	}
+	
+	if req.FeedbackRating != nil && *req.FeedbackRating != current.FeedbackRating {
+		if self || !hasRole(r, StaffRoles...) {
+			writeError(w, r, "only a manager, HR or an admin can rate a user", http.StatusForbidden)
+			return
+		}
+	
+		updates["feedback_rating"] = *req.FeedbackRating
+	}
+	
+	if len(errs) > 0 {
+		writeValidation(w, r, errs...)
+		return
+	}
+	
+	if len(updates) > 0 {
+		if err := h.DB.Model(&models.User{}).Where("id = ?", id).Updates(updates).Error; err != nil {
+			writeDBError(w, r, err)
+			return
+		}
+	}
+	
+	var u models.User
+	
+	if err := h.DB.First(&u, "id = ?", id).Error; err != nil {
+		writeDBError(w, r, err)
 		return
 	}
 	
-	h.DB.First(&u, "id = ?", id)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(u)
 }
@@ -171,7 +349,8 @@ func (h Users) Update(w http.ResponseWriter, r *http.Request) {
 // @Tags         users
 // @Param        id   path      string  true  "User ID"
 // @Success      204  "No Content"
-// @Failure      404  {string}  string  "user not found"
+// @Failure      404  {object}  Problem  "user not found"
+// @Failure      403  {object}  Problem  "forbidden"
 // @Security     BearerAuth
 // @Router       /users/{id} [delete]
 func (h Users) Delete(w http.ResponseWriter, r *http.Request) {
@@ -184,12 +363,48 @@ func (h Users) Delete(w http.ResponseWriter, r *http.Request) {
 	result := h.DB.Delete(&models.User{}, "id = ?", id)
 	
 	if result.Error != nil {
-		http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+		writeDBError(w, r, result.Error)
+		return
+	}
+	
+	if result.RowsAffected == 0 {
+		writeError(w, r, "user not found", http.StatusNotFound)
+		return
+	}
+	
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Unlock godoc
+// @Summary      Unlock a user's login
+// @Description  Clear failed login attempts and any temporary lockout
+// @Tags         users
+// @Param        id   path      string  true  "User ID"
+// @Success      204  "No Content"
+// @Failure      403  {object}  Problem  "forbidden"
+// @Failure      404  {object}  Problem  "user not found"
+// @Security     BearerAuth
+// @Router       /users/{id}/unlock [post]
+func (h Users) Unlock(w http.ResponseWriter, r *http.Request) {
+	id, ok := uuidParam(w, r, "id")
+	
+	if !ok {
+		return
+	}
+	
+	result := h.DB.Model(&models.User{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"failed_login_count":   0,
+		"last_failed_login_at": nil,
+		"locked_until":         nil,
+	})
+	
+	if result.Error != nil {
+		writeDBError(w, r, result.Error)
 		return
 	}
 	
 	if result.RowsAffected == 0 {
-		http.Error(w, "user not found", http.StatusNotFound)
+		writeError(w, r, "user not found", http.StatusNotFound)
 		return
 	}
 	
@@ -198,9 +413,10 @@ func (h Users) Delete(w http.ResponseWriter, r *http.Request) {
 
 // RegisterUsers adds user routes
 func RegisterUsers(router *mux.Router, h Users, prefix string) {
-	router.HandleFunc(prefix, h.List).Methods("GET")
-	router.HandleFunc(prefix, h.Create).Methods("POST")
-	router.HandleFunc(prefix+"/{id}", h.GetByID).Methods("GET")
-	router.HandleFunc(prefix+"/{id}", h.Update).Methods("PUT")
-	router.HandleFunc(prefix+"/{id}", h.Delete).Methods("DELETE")
+	router.HandleFunc(prefix, AuthorizeScoped(h.List, AnyRole, ScopeUsersRead)).Methods("GET")
+	router.HandleFunc(prefix, AuthorizeScoped(h.Create, PeopleRoles, ScopeUsersWrite)).Methods("POST")
+	router.HandleFunc(prefix+"/{id}", AuthorizeScoped(h.GetByID, AnyRole, ScopeUsersRead)).Methods("GET")
+	router.HandleFunc(prefix+"/{id}", AuthorizeScoped(h.Update, AnyRole, ScopeUsersWrite)).Methods("PUT")
+	router.HandleFunc(prefix+"/{id}", AuthorizeScoped(h.Delete, AdminRoles, ScopeUsersWrite)).Methods("DELETE")
+	router.HandleFunc(prefix+"/{id}/unlock", Authorize(h.Unlock, AdminRoles)).Methods("POST")
 }
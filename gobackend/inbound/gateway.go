@@ -0,0 +1,276 @@
+package inbound
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"stuff/events"
+	"stuff/models"
+	"stuff/routing"
+	"stuff/sla"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrUnknownSender means the From address does not belong to a user
+	ErrUnknownSender = errors.New("inbound: the sender is not a user")
+
+	// ErrNoText means nothing is left of the message once quotes and signatures are stripped
+	ErrNoText = errors.New("inbound: the message has no text")
+
+	// ErrNotParticipant means the sender replied to a ticket they may not comment on
+	ErrNotParticipant = errors.New("inbound: the sender is not involved in the ticket")
+
+	// ErrTicketClosed means the sender replied to a closed or cancelled ticket
+	ErrTicketClosed = errors.New("inbound: the ticket is closed")
+)
+
+// Rejected reports whether err means the message itself is unacceptable, so sending it
+// again will not help
+func Rejected(err error) bool {
+	for _, rejected := range []error{ErrMalformed, ErrUnknownSender, ErrUnverifiedSender, ErrNoText, ErrNotParticipant, ErrTicketClosed} {
+		if errors.Is(err, rejected) {
+			return true
+		}
+	}
+	return false
+}
+
+// Result is what became of a message
+type Result struct {
+	Ticket    models.Ticket
+	Comment   *models.TicketComment // set when the message was a reply to an existing ticket
+	Duplicate bool                  // the message was received before and nothing changed
+}
+
+// maxTitle is the length of a ticket title
+const maxTitle = 255
+
+// maxMergeHops bounds how far DUPLICATES links are followed from a merged ticket
+const maxMergeHops = 10
+
+var (
+	// ticketRefPattern finds a ticket reference such as [#1b4e28ba-2fa1-11d2-883f-0016d3cca427] in a subject
+	ticketRefPattern = regexp.MustCompile(`(?i)\[(?:ticket\s*)?#([0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})\]`)
+
+	// replyPrefixPattern matches the Re: and Fwd: prefixes mail clients add to subjects
+	replyPrefixPattern = regexp.MustCompile(`(?i)^((re|fw|fwd|sv|vs|aw|wg)\s*(\[\d+\])?:\s*)+`)
+)
+
+// Process turns a message into a new ticket, or into a comment on the ticket it refers
+// to. The sender must be a user. A message whose Message-ID was seen before is not
+// processed again, so redeliveries are harmless.
+func Process(db *gorm.DB, bus *events.Bus, msg Message, now time.Time) (Result, error) {
+	var sender models.User
+	err := db.First(&sender, "LOWER(email) = ?", strings.ToLower(msg.From.Address)).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return Result{}, ErrUnknownSender
+	}
+	if err != nil {
+		return Result{}, err
+	}
+
+	if msg.MessageID != "" {
+		var seen models.InboundEmail
+		err := db.Preload("Ticket").Preload("Comment").First(&seen, "message_id = ?", msg.MessageID).Error
+		if err == nil {
+			return Result{Ticket: *seen.Ticket, Comment: seen.Comment, Duplicate: true}, nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return Result{}, err
+		}
+	}
+
+	ticketID, err := findThread(db, msg)
+	if err != nil {
+		return Result{}, err
+	}
+
+	text := StripReply(msg.Text)
+
+	var result Result
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if ticketID != nil {
+			result, err = reply(tx, bus, sender, *ticketID, text)
+		} else {
+			result, err = open(tx, bus, sender, msg.Subject, text, now)
+		}
+		if err != nil || msg.MessageID == "" {
+			return err
+		}
+
+		record := models.InboundEmail{MessageId: msg.MessageID, TicketId: result.Ticket.Id, FromAddress: msg.From.Address}
+		if result.Comment != nil {
+			record.CommentId = &result.Comment.Id
+		}
+		return tx.Create(&record).Error
+	})
+	if err != nil {
+		return Result{}, err
+	}
+	return result, nil
+}
+
+// findThread returns the ticket a message refers to, or nil for a new ticket. A ticket
+// reference in the subject wins over the reply headers.
+func findThread(db *gorm.DB, msg Message) (*uuid.UUID, error) {
+	if m := ticketRefPattern.FindStringSubmatch(msg.Subject); m != nil {
+		id := uuid.MustParse(m[1])
+		var count int64
+		if err := db.Model(&models.Ticket{}).Where("id = ?", id).Count(&count).Error; err != nil {
+			return nil, err
+		}
+		if count > 0 {
+			return &id, nil
+		}
+	}
+
+	ids := append(append([]string{}, msg.InReplyTo...), msg.References...)
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	var earlier []models.InboundEmail
+	if err := db.Select("ticket_id").Where("message_id IN ?", ids).Limit(1).Find(&earlier).Error; err != nil {
+		return nil, err
+	}
+	if len(earlier) == 0 {
+		return nil, nil
+	}
+	return &earlier[0].TicketId, nil
+}
+
+// open creates a ticket from a new message, routed and under SLA like tickets created
+// in the app
+func open(tx *gorm.DB, bus *events.Bus, sender models.User, subject, text string, now time.Time) (Result, error) {
+	title := strings.TrimSpace(ticketRefPattern.ReplaceAllString(subject, ""))
+	title = strings.TrimSpace(replyPrefixPattern.ReplaceAllString(title, ""))
+	if title == "" {
+		title, _, _ = strings.Cut(text, "\n")
+	}
+	title = truncate(strings.Join(strings.Fields(title), " "), maxTitle)
+	if title == "" {
+		return Result{}, ErrNoText
+	}
+
+	t := models.Ticket{
+		Id:              uuid.New(),
+		Title:           title,
+		Description:     text,
+		Status:          models.TicketStatusOpen,
+		Priority:        models.TicketPriorityNormal,
+		CreatedByUserId: sender.Id,
+		CreatedAt:       now,
+	}
+
+	if err := sla.Apply(tx, &t); err != nil {
+		return Result{}, err
+	}
+
+	rule, err := routing.Assign(tx, &t, now)
+	if err != nil {
+		return Result{}, err
+	}
+
+	if err := tx.Create(&t).Error; err != nil {
+		return Result{}, err
+	}
+
+	reason := "Received by email"
+	if rule != nil {
+		reason += ". " + routing.Reason(rule)
+	}
+	if err := bus.Publish(tx, events.TicketCreatedEvent{ActorID: sender.Id, Ticket: t, Reason: reason}); err != nil {
+		return Result{}, err
+	}
+	return Result{Ticket: t}, nil
+}
+
+// reply adds a message to an existing ticket as a public comment. Replies to a ticket
+// merged into another go to that one. The sender must be allowed to edit the ticket, as in
+// the app, or watch it, and the ticket must not be closed or cancelled.
+func reply(tx *gorm.DB, bus *events.Bus, sender models.User, ticketID uuid.UUID, text string) (Result, error) {
+	if text == "" {
+		return Result{}, ErrNoText
+	}
+
+	t, err := mergedInto(tx, ticketID)
+	if err != nil {
+		return Result{}, err
+	}
+
+	involved, err := participant(tx, sender, t)
+	if err != nil {
+		return Result{}, err
+	}
+	if !involved {
+		return Result{}, ErrNotParticipant
+	}
+	if t.Status == models.TicketStatusClosed || t.Status == models.TicketStatusCancelled {
+		return Result{}, ErrTicketClosed
+	}
+
+	c := models.TicketComment{
+		Id:         uuid.New(),
+		TicketId:   t.Id,
+		UserId:     sender.Id,
+		Content:    text,
+		Visibility: models.CommentVisibilityPublic,
+	}
+	if err := tx.Create(&c).Error; err != nil {
+		return Result{}, err
+	}
+
+	if err := bus.Publish(tx, events.TicketCommentedEvent{ActorID: sender.Id, Ticket: t, Comment: c}); err != nil {
+		return Result{}, err
+	}
+	return Result{Ticket: t, Comment: &c}, nil
+}
+
+// mergedInto returns the ticket, or for a closed ticket merged as a duplicate, the ticket
+// it was merged into
+func mergedInto(tx *gorm.DB, ticketID uuid.UUID) (models.Ticket, error) {
+	var t models.Ticket
+	if err := tx.First(&t, "id = ?", ticketID).Error; err != nil {
+		return t, err
+	}
+
+	for i := 0; i < maxMergeHops && t.Status == models.TicketStatusClosed; i++ {
+		var primary []models.Ticket
+		err := tx.Joins("JOIN ticket_links ON ticket_links.target_ticket_id = tickets.id").
+			Where("ticket_links.source_ticket_id = ? AND ticket_links.type = ?", t.Id, models.TicketLinkDuplicates).
+			Order("ticket_links.created_at").Limit(1).Find(&primary).Error
+		if err != nil {
+			return t, err
+		}
+		if len(primary) == 0 {
+			break
+		}
+		t = primary[0]
+	}
+	return t, nil
+}
+
+// participant reports whether the sender created, is assigned to or watches the ticket, or is staff
+func participant(tx *gorm.DB, sender models.User, t models.Ticket) (bool, error) {
+	if sender.Role.IsStaff() || t.CreatedByUserId == sender.Id || (t.AssignedToUserId != nil && *t.AssignedToUserId == sender.Id) {
+		return true, nil
+	}
+
+	var count int64
+	err := tx.Model(&models.TicketWatcher{}).Where("ticket_id = ? AND user_id = ?", t.Id, sender.Id).Count(&count).Error
+	return count > 0, err
+}
+
+// truncate shortens s to at most max characters
+func truncate(s string, max int) string {
+	if runes := []rune(s); len(runes) > max {
+		return strings.TrimSpace(string(runes[:max]))
+	}
+	return s
+}
@@ -0,0 +1,47 @@
+package inbound
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestRejected(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{ErrMalformed, true},
+		{fmt.Errorf("%w: no valid From address", ErrMalformed), true},
+		{ErrUnknownSender, true},
+		{ErrUnverifiedSender, true},
+		{ErrNoText, true},
+		{ErrNotParticipant, true},
+		{ErrTicketClosed, true},
+		{errors.New("connection refused"), false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := Rejected(tt.err); got != tt.want {
+			t.Errorf("Rejected(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		in   string
+		max  int
+		want string
+	}{
+		{"short", 10, "short"},
+		{"exactly", 7, "exactly"},
+		{"Printer is broken", 8, "Printer"},
+		{"Æbleskiver på 2. sal", 6, "Æblesk"},
+	}
+	for _, tt := range tests {
+		if got := truncate(tt.in, tt.max); got != tt.want {
+			t.Errorf("truncate(%q, %d) = %q, want %q", tt.in, tt.max, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+// Package inbound turns emails sent to the helpdesk into tickets.
+//
+// Raw RFC 5322 messages arrive through the SMTP listener in this package or the
+// webhook in the handlers package. A message from a known user opens a new ticket,
+// unless it refers to an existing one, either with a reference like [#<ticket ID>]
+// in the subject or by replying to an earlier message (In-Reply-To or References).
+// Replies become comments. Quoted text and signatures are stripped first.
+package inbound
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Message is an inbound email reduced to what the gateway needs
+type Message struct {
+	From       mail.Address
+	Subject    string
+	MessageID  string   // without angle brackets; empty if the sender left it out
+	InReplyTo  []string // message IDs, without angle brackets
+	References []string
+	Text       string // the plain-text body, or the HTML body converted to text
+
+	AuthResults []string // Authentication-Results headers, topmost first
+}
+
+// ErrMalformed means the message could not be parsed
+var ErrMalformed = errors.New("inbound: malformed message")
+
+// maxParts bounds how many MIME parts are inspected for a text body
+const maxParts = 100
+
+// maxDepth bounds how deeply multiparts may be nested
+const maxDepth = 5
+
+// Parse reads a raw RFC 5322 message
+func Parse(r io.Reader) (Message, error) {
+	m, err := mail.ReadMessage(r)
+	if err != nil {
+		return Message{}, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+
+	from, err := m.Header.AddressList("From")
+	if err != nil || len(from) == 0 {
+		return Message{}, fmt.Errorf("%w: no valid From address", ErrMalformed)
+	}
+
+	dec := mime.WordDecoder{CharsetReader: charsetReader}
+	subject, err := dec.DecodeHeader(m.Header.Get("Subject"))
+	if err != nil {
+		subject = m.Header.Get("Subject")
+	}
+
+	msg := Message{
+		From:       *from[0],
+		Subject:    strings.TrimSpace(subject),
+		InReplyTo:  messageIDs(m.Header.Get("In-Reply-To")),
+		References: messageIDs(m.Header.Get("References")),
+
+		AuthResults: m.Header["Authentication-Results"],
+	}
+	if ids := messageIDs(m.Header.Get("Message-Id")); len(ids) > 0 {
+		msg.MessageID = ids[0]
+	}
+
+	parts := 0
+	plain, rich, err := bodyText(textproto.MIMEHeader(m.Header), m.Body, 0, &parts)
+	if err != nil {
+		return Message{}, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	msg.Text = plain
+	if msg.Text == "" && rich != "" {
+		msg.Text = htmlToText(rich)
+	}
+	msg.Text = strings.ReplaceAll(msg.Text, "\r\n", "\n")
+	return msg, nil
+}
+
+// messageIDPattern finds <id> tokens in Message-ID, In-Reply-To and References
+var messageIDPattern = regexp.MustCompile(`<([^<>\s]+)>`)
+
+// messageIDs returns the message IDs in a header, without angle brackets
+func messageIDs(value string) []string {
+	var ids []string
+	for _, m := range messageIDPattern.FindAllStringSubmatch(value, -1) {
+		ids = append(ids, m[1])
+	}
+	return ids
+}
+
+// bodyText returns the first inline text/plain and text/html bodies of an entity
+func bodyText(header textproto.MIMEHeader, body io.Reader, depth int, parts *int) (plain, rich string, err error) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if disposition, _, _ := mime.ParseMediaType(header.Get("Content-Disposition")); disposition == "attachment" {
+		return "", "", nil
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth >= maxDepth {
+			return "", "", nil
+		}
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return plain, rich, nil
+			}
+			if err != nil {
+				return "", "", err
+			}
+
+			*parts++
+			if *parts > maxParts {
+				return plain, rich, nil
+			}
+
+			p, h, err := bodyText(part.Header, part, depth+1, parts)
+			if err != nil {
+				return "", "", err
+			}
+			if plain == "" {
+				plain = p
+			}
+			if rich == "" {
+				rich = h
+			}
+		}
+	}
+
+	if mediaType != "text/plain" && mediaType != "text/html" {
+		return "", "", nil
+	}
+
+	// multipart.Reader already decodes quoted-printable parts
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		return "", "", err
+	}
+	text := decodeCharset(raw, params["charset"])
+
+	if mediaType == "text/html" {
+		return "", text, nil
+	}
+	return text, "", nil
+}
+
+// charsetReader lets mime.WordDecoder read the charsets decodeCharset knows
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	raw, err := io.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+	return strings.NewReader(decodeCharset(raw, charset)), nil
+}
+
+// windows1252 maps the bytes 0x80-0x9F, where Windows-1252 differs from ISO 8859-1
+var windows1252 = [32]rune{
+	'€', '\ufffd', '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', '\ufffd', 'Ž', '\ufffd',
+	'\ufffd', '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', '\ufffd', 'ž', 'Ÿ',
+}
+
+// decodeCharset converts text to UTF-8. UTF-8, US-ASCII, ISO 8859-1 and Windows-1252
+// are understood; anything else is read as UTF-8 with invalid bytes replaced.
+func decodeCharset(raw []byte, charset string) string {
+	switch strings.ToLower(strings.TrimSpace(charset)) {
+	case "iso-8859-1", "iso8859-1", "latin1", "windows-1252", "cp1252":
+		var b strings.Builder
+		for _, c := range raw {
+			if c >= 0x80 && c < 0xA0 {
+				b.WriteRune(windows1252[c-0x80])
+			} else {
+				b.WriteRune(rune(c))
+			}
+		}
+		return b.String()
+	default:
+		if utf8.Valid(raw) {
+			return string(raw)
+		}
+		return string(bytes.ToValidUTF8(raw, []byte("\ufffd")))
+	}
+}
+
+var (
+	// htmlDropPattern removes elements whose content is not message text
+	htmlDropPattern = regexp.MustCompile(`(?is)<(script|style|head)\b.*?</(script|style|head)>`)
+	// htmlQuotePattern removes quoted messages, which mail clients wrap in blockquotes,
+	// from the first blockquote to the last so nested quotes go too
+	htmlQuotePattern  = regexp.MustCompile(`(?is)<blockquote\b.*</blockquote>`)
+	htmlBreakPattern  = regexp.MustCompile(`(?i)<br\s*/?>|</(p|div|li|tr|h[1-6])>`)
+	htmlTagPattern    = regexp.MustCompile(`(?s)<[^>]*>`)
+	blankLinesPattern = regexp.MustCompile(`\n{3,}`)
+)
+
+// htmlToText reduces an HTML body to its text
+func htmlToText(s string) string {
+	s = htmlDropPattern.ReplaceAllString(s, "")
+	s = htmlQuotePattern.ReplaceAllString(s, "")
+	s = htmlBreakPattern.ReplaceAllString(s, "\n")
+	s = htmlTagPattern.ReplaceAllString(s, "")
+	s = html.UnescapeString(s)
+
+	lines := strings.Split(strings.ReplaceAll(s, "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(strings.ReplaceAll(line, "\u00a0", " "))
+	}
+	return strings.TrimSpace(blankLinesPattern.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"))
+}
@@ -0,0 +1,166 @@
+package inbound
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// crlf turns a message written with \n line endings into one with \r\n, as on the wire
+func crlf(s string) string {
+	return strings.ReplaceAll(s, "\n", "\r\n")
+}
+
+func TestParse(t *testing.T) {
+	raw := crlf(`From: Anna Andersen <anna@example.com>
+To: helpdesk@example.com
+Subject: =?utf-8?q?Printer_p=C3=A5_2=2E_sal?=
+Message-ID: <abc@example.com>
+In-Reply-To: <one@example.com>
+References: <zero@example.com> <one@example.com>
+Authentication-Results: mx.example.net; dkim=pass header.d=example.com
+Authentication-Results: other.example.org; spf=fail
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="outer"
+
+--outer
+Content-Type: multipart/alternative; boundary="inner"
+
+--inner
+Content-Type: text/plain; charset=utf-8
+Content-Transfer-Encoding: quoted-printable
+
+Den st=C3=A5r stille.
+--inner
+Content-Type: text/html; charset=utf-8
+
+<p>Den står stille.</p>
+--inner--
+--outer
+Content-Type: text/plain
+Content-Disposition: attachment; filename="log.txt"
+
+not the body
+--outer--
+`)
+
+	msg, err := Parse(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.From.Address != "anna@example.com" || msg.From.Name != "Anna Andersen" {
+		t.Errorf("From = %v", msg.From)
+	}
+	if msg.Subject != "Printer på 2. sal" {
+		t.Errorf("Subject = %q", msg.Subject)
+	}
+	if msg.MessageID != "abc@example.com" {
+		t.Errorf("MessageID = %q", msg.MessageID)
+	}
+	if !slices.Equal(msg.InReplyTo, []string{"one@example.com"}) {
+		t.Errorf("InReplyTo = %q", msg.InReplyTo)
+	}
+	if !slices.Equal(msg.References, []string{"zero@example.com", "one@example.com"}) {
+		t.Errorf("References = %q", msg.References)
+	}
+	wantAuth := []string{"mx.example.net; dkim=pass header.d=example.com", "other.example.org; spf=fail"}
+	if !slices.Equal(msg.AuthResults, wantAuth) {
+		t.Errorf("AuthResults = %q", msg.AuthResults)
+	}
+	if msg.Text != "Den står stille." {
+		t.Errorf("Text = %q", msg.Text)
+	}
+}
+
+func TestParseBody(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{
+			name: "no content type",
+			raw:  "From: a@example.com\n\nLine one\nLine two\n",
+			want: "Line one\nLine two\n",
+		},
+		{
+			name: "html only",
+			raw: "From: a@example.com\nContent-Type: text/html\n\n" +
+				"<html><head><style>p{}</style></head><body><p>Hello&nbsp;there</p><div>Second</div>" +
+				"<blockquote>Old <blockquote>older</blockquote></blockquote></body></html>\n",
+			want: "Hello there\nSecond",
+		},
+		{
+			name: "base64",
+			raw:  "From: a@example.com\nContent-Type: text/plain; charset=utf-8\nContent-Transfer-Encoding: base64\n\nSMO4amVy\n",
+			want: "Højer",
+		},
+		{
+			name: "latin1",
+			raw:  "From: a@example.com\nContent-Type: text/plain; charset=iso-8859-1\nContent-Transfer-Encoding: quoted-printable\n\nK=F8benhavn\n",
+			want: "København\n",
+		},
+		{
+			name: "windows-1252",
+			raw:  "From: a@example.com\nContent-Type: text/plain; charset=windows-1252\nContent-Transfer-Encoding: quoted-printable\n\n=93Hi=94 =80\n",
+			want: "“Hi” €\n",
+		},
+		{
+			name: "invalid utf-8",
+			raw:  "From: a@example.com\nContent-Type: text/plain; charset=utf-8\n\nbad \xff byte\n",
+			want: "bad � byte\n",
+		},
+		{
+			name: "only an attachment",
+			raw:  "From: a@example.com\nContent-Type: application/pdf\n\n%PDF\n",
+			want: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := Parse(strings.NewReader(crlf(tt.raw)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Text != tt.want {
+				t.Errorf("Text = %q, want %q", msg.Text, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	tests := map[string]string{
+		"no headers":       "just text",
+		"no from":          "Subject: hi\r\n\r\nbody\r\n",
+		"invalid from":     "From: not an address\r\n\r\nbody\r\n",
+		"broken multipart": "From: a@example.com\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\nContent-Type: text/plain\r\n\r\nunterminated",
+	}
+	for name, raw := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Parse(strings.NewReader(raw)); !errors.Is(err, ErrMalformed) {
+				t.Errorf("err = %v, want ErrMalformed", err)
+			}
+		})
+	}
+}
+
+func TestMessageIDs(t *testing.T) {
+	tests := map[string][]string{
+		"":                        nil,
+		"<a@x>":                   {"a@x"},
+		"<a@x> <b@y>":             {"a@x", "b@y"},
+		"<a@x>\r\n\t<b@y>":        {"a@x", "b@y"},
+		"garbage <a@x> (comment)": {"a@x"},
+		"<with space@x> <ok@x>":   {"ok@x"},
+		"no brackets@x":           nil,
+	}
+	for in, want := range tests {
+		if got := messageIDs(in); !slices.Equal(got, want) {
+			t.Errorf("messageIDs(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package inbound
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	// replyHeaderPattern matches the line mail clients put above a quoted message,
+	// e.g. "On Mon, 5 Oct 2026 at 10:00, Anna <anna@example.com> wrote:" or the Danish
+	// "Den man. 5. okt. 2026 kl. 10.00 skrev Anna <anna@example.com>:"
+	replyHeaderPattern = regexp.MustCompile(`(?i)^(on|den)\b.*\b(wrote|skrev)\b.*:$`)
+
+	// separatorPattern matches the lines Outlook and others put above a quoted message
+	separatorPattern = regexp.MustCompile(`(?i)^(-{2,}\s*(original message|oprindelig meddelelse)\s*-{2,}|_{10,})$`)
+
+	// headerBlockPattern matches the first line of a quoted Outlook header block,
+	// which is followed by a Sent or Date line
+	headerBlockPattern = regexp.MustCompile(`(?i)^\*?(from|fra):\*?\s`)
+	headerDatePattern  = regexp.MustCompile(`(?i)^\*?(sent|sendt|date|dato):\*?\s`)
+
+	// signaturePattern matches the signature delimiter "-- " and the lines mobile clients append
+	signaturePattern = regexp.MustCompile(`(?i)^(--\s?|(sent from my|sendt fra min|get outlook for|hent outlook til)\s.*)$`)
+)
+
+// StripReply removes quoted text and signatures from a message body, leaving what the
+// sender wrote. Everything from a reply header, separator or signature on is dropped, as
+// are quoted lines starting with ">".
+func StripReply(text string) string {
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+
+	var kept []string
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+
+		if replyHeaderPattern.MatchString(line) || separatorPattern.MatchString(line) || signaturePattern.MatchString(line) {
+			break
+		}
+
+		// Some clients wrap a long reply header over two lines
+		if i+1 < len(lines) {
+			next := strings.TrimSpace(lines[i+1])
+			if !replyHeaderPattern.MatchString(next) && replyHeaderPattern.MatchString(line+" "+next) {
+				break
+			}
+		}
+		if headerBlockPattern.MatchString(line) && quotedHeaderBlock(lines[i+1:]) {
+			break
+		}
+		if strings.HasPrefix(line, ">") {
+			continue
+		}
+
+		kept = append(kept, strings.TrimRight(lines[i], " \t"))
+	}
+
+	return strings.TrimSpace(blankLinesPattern.ReplaceAllString(strings.Join(kept, "\n"), "\n\n"))
+}
+
+// quotedHeaderBlock reports whether a Sent or Date line follows within the next few lines
+func quotedHeaderBlock(lines []string) bool {
+	for i := 0; i < len(lines) && i < 4; i++ {
+		if headerDatePattern.MatchString(strings.TrimSpace(lines[i])) {
+			return true
+		}
+	}
+	return false
+}
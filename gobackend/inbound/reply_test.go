@@ -0,0 +1,100 @@
+package inbound
+
+import "testing"
+
+func TestStripReply(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{
+			name: "plain",
+			text: "The printer is out of toner.\n",
+			want: "The printer is out of toner.",
+		},
+		{
+			name: "english reply header",
+			text: "Still broken.\n\nOn Mon, 5 Oct 2026 at 10:00, Anna <anna@example.com> wrote:\n> Try turning it off and on.\n",
+			want: "Still broken.",
+		},
+		{
+			name: "danish reply header",
+			text: "Det virker nu.\n\nDen man. 5. okt. 2026 kl. 10.00 skrev Anna <anna@example.com>:\n> Prøv igen.\n",
+			want: "Det virker nu.",
+		},
+		{
+			name: "reply header wrapped over two lines",
+			text: "Thanks!\n\nOn Mon, 5 Oct 2026 at 10:00, Anna Andersen\n<anna@example.com> wrote:\n> Fixed.\n",
+			want: "Thanks!",
+		},
+		{
+			name: "outlook separator",
+			text: "See below.\r\n\r\n-----Original Message-----\r\nFrom: Anna\r\nSent: Monday\r\n",
+			want: "See below.",
+		},
+		{
+			name: "danish outlook separator",
+			text: "Se nedenfor.\n\n-----Oprindelig meddelelse-----\nFra: Anna\n",
+			want: "Se nedenfor.",
+		},
+		{
+			name: "underscore separator",
+			text: "Done.\n\n________________________________\nFrom: Anna\n",
+			want: "Done.",
+		},
+		{
+			name: "outlook header block",
+			text: "Agreed.\n\nFrom: Anna <anna@example.com>\nSent: Monday, 5 October 2026 10:00\nSubject: Printer\n\nOld text\n",
+			want: "Agreed.",
+		},
+		{
+			name: "bold danish header block",
+			text: "Enig.\n\n*Fra:* Anna\n*Til:* Helpdesk\n*Dato:* 5. oktober 2026\n",
+			want: "Enig.",
+		},
+		{
+			name: "from line without a date is kept",
+			text: "From: the second floor\nthe printer jams.",
+			want: "From: the second floor\nthe printer jams.",
+		},
+		{
+			name: "signature",
+			text: "Please call me.\n\n-- \nAnna Andersen\nReception\n",
+			want: "Please call me.",
+		},
+		{
+			name: "mobile signature",
+			text: "On my way.\n\nSent from my iPhone\n",
+			want: "On my way.",
+		},
+		{
+			name: "danish mobile signature",
+			text: "På vej.\n\nSendt fra min iPhone\n",
+			want: "På vej.",
+		},
+		{
+			name: "interleaved quotes",
+			text: "> Which floor?\nSecond.\n> Which printer?\nThe big one.\n",
+			want: "Second.\nThe big one.",
+		},
+		{
+			name: "blank lines collapsed",
+			text: "First.\n\n\n\n\nSecond.   \n",
+			want: "First.\n\nSecond.",
+		},
+		{
+			name: "only a quote",
+			text: "On Mon, 5 Oct 2026, Anna wrote:\n> Hello\n",
+			want: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := StripReply(tt.text); got != tt.want {
+				t.Errorf("StripReply = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
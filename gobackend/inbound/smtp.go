@@ -0,0 +1,358 @@
+package inbound
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Server is a small SMTP server that accepts mail for the helpdesk and hands each
+// message to Handler. It neither relays nor authenticates senders and offers no TLS, so
+// it only talks to the mail relay in front of it: connections from other addresses than
+// loopback and Relays are turned away.
+type Server struct {
+	Addr       string       // host:port to listen on, e.g. ":2525"
+	Domain     string       // announced in the greeting
+	MaxSize    int64        // largest accepted message in bytes
+	Recipients []string     // accepted recipient addresses in lower case; empty accepts any
+	Relays     []*net.IPNet // networks besides loopback that may connect
+	Timeout    time.Duration
+
+	// Handler processes a received message. Errors for which Rejected is true are
+	// answered with a permanent failure, others with a temporary one so the sender retries.
+	Handler func(raw []byte) error
+}
+
+// maxRecipients bounds the recipients of one message
+const maxRecipients = 100
+
+// errTooBig means a message is larger than MaxSize
+var errTooBig = errors.New("message too big")
+
+// ListenAndServe listens on Addr and serves connections until the listener fails
+func (s *Server) ListenAndServe() error {
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l, each in its own goroutine
+func (s *Server) Serve(l net.Listener) error {
+	defer l.Close()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go s.serve(conn)
+	}
+}
+
+// session is the state of one SMTP conversation
+type session struct {
+	greeted    bool
+	from       *string
+	recipients []string
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	var st session
+
+	s.deadline(conn)
+	if !s.allowed(conn.RemoteAddr()) {
+		tp.PrintfLine("554 Access denied")
+		return
+	}
+	tp.PrintfLine("220 %s ESMTP ready", s.Domain)
+
+	for {
+		s.deadline(conn)
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+
+		verb, arg, _ := strings.Cut(line, " ")
+		arg = strings.TrimSpace(arg)
+
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			st = session{greeted: true}
+			tp.PrintfLine("250 %s", s.Domain)
+		case "EHLO":
+			st = session{greeted: true}
+			tp.PrintfLine("250-%s", s.Domain)
+			tp.PrintfLine("250-8BITMIME")
+			tp.PrintfLine("250-PIPELINING")
+			tp.PrintfLine("250 SIZE %d", s.MaxSize)
+		case "MAIL":
+			s.mail(tp, &st, arg)
+		case "RCPT":
+			s.rcpt(tp, &st, arg)
+		case "DATA":
+			if !s.data(conn, tp, &st) {
+				return
+			}
+		case "RSET":
+			st = session{greeted: st.greeted}
+			tp.PrintfLine("250 OK")
+		case "NOOP":
+			tp.PrintfLine("250 OK")
+		case "VRFY":
+			tp.PrintfLine("252 Cannot verify users")
+		case "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("502 Command not implemented")
+		}
+	}
+}
+
+func (s *Server) mail(tp *textproto.Conn, st *session, arg string) {
+	if !st.greeted {
+		tp.PrintfLine("503 Say HELO or EHLO first")
+		return
+	}
+	if st.from != nil {
+		tp.PrintfLine("503 Sender already given")
+		return
+	}
+
+	path, params, ok := parsePath(arg, "FROM:")
+	if !ok {
+		tp.PrintfLine("501 Syntax: MAIL FROM:<address>")
+		return
+	}
+	for _, p := range params {
+		if k, v, _ := strings.Cut(p, "="); strings.EqualFold(k, "SIZE") {
+			if size, err := strconv.ParseInt(v, 10, 64); err == nil && size > s.MaxSize {
+				tp.PrintfLine("552 Message size exceeds the limit of %d bytes", s.MaxSize)
+				return
+			}
+		}
+	}
+
+	st.from = &path
+	tp.PrintfLine("250 OK")
+}
+
+func (s *Server) rcpt(tp *textproto.Conn, st *session, arg string) {
+	if st.from == nil {
+		tp.PrintfLine("503 Need MAIL first")
+		return
+	}
+
+	path, _, ok := parsePath(arg, "TO:")
+	if !ok || path == "" {
+		tp.PrintfLine("501 Syntax: RCPT TO:<address>")
+		return
+	}
+	if len(st.recipients) >= maxRecipients {
+		tp.PrintfLine("452 Too many recipients")
+		return
+	}
+	if !s.accepts(path) {
+		tp.PrintfLine("550 No such mailbox here")
+		return
+	}
+
+	st.recipients = append(st.recipients, path)
+	tp.PrintfLine("250 OK")
+}
+
+// data reads the message and hands it to Handler. It returns false if the connection
+// must be closed.
+func (s *Server) data(conn net.Conn, tp *textproto.Conn, st *session) bool {
+	if len(st.recipients) == 0 {
+		tp.PrintfLine("503 Need RCPT first")
+		return true
+	}
+
+	tp.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+	raw, err := s.readData(conn, tp)
+	*st = session{greeted: true}
+
+	switch {
+	case errors.Is(err, errTooBig):
+		tp.PrintfLine("552 Message size exceeds the limit of %d bytes", s.MaxSize)
+		return true
+	case err != nil:
+		return false
+	}
+
+	err = s.Handler(raw)
+	switch {
+	case err == nil:
+		tp.PrintfLine("250 OK: queued")
+	case errors.Is(err, ErrUnknownSender):
+		tp.PrintfLine("550 The sender is not a user of this helpdesk")
+	case errors.Is(err, ErrUnverifiedSender):
+		tp.PrintfLine("550 The sender could not be verified")
+	case Rejected(err):
+		tp.PrintfLine("554 %s", strings.TrimPrefix(err.Error(), "inbound: "))
+	default:
+		log.Printf("inbound: %v", err)
+		tp.PrintfLine("451 Temporary failure, try again later")
+	}
+	return true
+}
+
+// readData reads the dot-terminated message, reading past MaxSize so the conversation
+// can go on after a too large message
+func (s *Server) readData(conn net.Conn, tp *textproto.Conn) ([]byte, error) {
+	dr := tp.DotReader()
+	var buf bytes.Buffer
+
+	for {
+		s.deadline(conn)
+		_, err := io.CopyN(&buf, dr, 64<<10)
+		if int64(buf.Len()) > s.MaxSize {
+			if _, err := io.Copy(io.Discard, dr); err != nil {
+				return nil, err
+			}
+			return nil, errTooBig
+		}
+		if err == io.EOF {
+			return buf.Bytes(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// deadline extends the connection's deadline for the next exchange
+func (s *Server) deadline(conn net.Conn) {
+	if s.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.Timeout))
+	}
+}
+
+// allowed reports whether a peer may connect: loopback or one of the relays
+func (s *Server) allowed(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	if tcp.IP.IsLoopback() {
+		return true
+	}
+	for _, network := range s.Relays {
+		if network.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// accepts reports whether mail for the address is accepted
+func (s *Server) accepts(address string) bool {
+	if len(s.Recipients) == 0 {
+		return true
+	}
+	address = strings.ToLower(address)
+	for _, r := range s.Recipients {
+		if r == address {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePath parses the argument of MAIL FROM:<path> and RCPT TO:<path>, returning the
+// address and any ESMTP parameters after it
+func parsePath(arg, prefix string) (string, []string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", nil, false
+	}
+	rest := strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(rest, "<") {
+		return "", nil, false
+	}
+	end := strings.IndexByte(rest, '>')
+	if end < 0 {
+		return "", nil, false
+	}
+
+	path := rest[1:end]
+	// Source routes (<@a,@b:user@c>) are obsolete; keep only the mailbox
+	if i := strings.LastIndexByte(path, ':'); i >= 0 && strings.HasPrefix(path, "@") {
+		path = path[i+1:]
+	}
+	if path != "" {
+		if _, err := mail.ParseAddress(path); err != nil {
+			return "", nil, false
+		}
+	}
+	return path, strings.Fields(rest[end+1:]), true
+}
+
+// ServerFromEnv builds the SMTP listener from INBOUND_SMTP_ADDR, INBOUND_ADDRESSES,
+// INBOUND_SMTP_RELAYS and INBOUND_MAX_MB. It returns nil when INBOUND_SMTP_ADDR is not set.
+func ServerFromEnv(handler func(raw []byte) error) (*Server, error) {
+	addr := os.Getenv("INBOUND_SMTP_ADDR")
+	if addr == "" {
+		return nil, nil
+	}
+
+	var recipients []string
+	for _, a := range strings.Split(os.Getenv("INBOUND_ADDRESSES"), ",") {
+		if a = strings.TrimSpace(a); a == "" {
+			continue
+		}
+		if _, err := mail.ParseAddress(a); err != nil {
+			return nil, fmt.Errorf("invalid INBOUND_ADDRESSES entry %q: %w", a, err)
+		}
+		recipients = append(recipients, strings.ToLower(a))
+	}
+
+	relays, err := parseNetworks(os.Getenv("INBOUND_SMTP_RELAYS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid INBOUND_SMTP_RELAYS: %w", err)
+	}
+
+	domain, err := os.Hostname()
+	if err != nil {
+		domain = "localhost"
+	}
+
+	return &Server{
+		Addr:       addr,
+		Domain:     domain,
+		MaxSize:    MaxSize(),
+		Recipients: recipients,
+		Relays:     relays,
+		Timeout:    5 * time.Minute,
+		Handler:    handler,
+	}, nil
+}
+
+// defaultMaxMB is the default INBOUND_MAX_MB
+const defaultMaxMB = 25
+
+// MaxSize returns the largest accepted message in bytes, from INBOUND_MAX_MB
+func MaxSize() int64 {
+	if n, err := strconv.Atoi(os.Getenv("INBOUND_MAX_MB")); err == nil && n > 0 {
+		return int64(n) << 20
+	}
+	return defaultMaxMB << 20
+}
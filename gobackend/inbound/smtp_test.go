@@ -0,0 +1,270 @@
+package inbound
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startServer serves s on a loopback port for the duration of the test and returns its address
+func startServer(t *testing.T, s *Server) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go s.Serve(l)
+	return l.Addr().String()
+}
+
+func newTestServer(handler func(raw []byte) error) *Server {
+	return &Server{
+		Domain:     "helpdesk.test",
+		MaxSize:    1 << 10,
+		Recipients: []string{"helpdesk@example.com"},
+		Timeout:    5 * time.Second,
+		Handler:    handler,
+	}
+}
+
+// smtpCode returns the reply code of an SMTP client error, or 0
+func smtpCode(err error) int {
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		return tpErr.Code
+	}
+	return 0
+}
+
+func TestServerSendMail(t *testing.T) {
+	received := make(chan []byte, 1)
+	addr := startServer(t, newTestServer(func(raw []byte) error {
+		received <- raw
+		return nil
+	}))
+
+	body := "From: anna@example.com\r\nSubject: Printer\r\n\r\nIt is broken.\r\n.hidden dot\r\n"
+	err := smtp.SendMail(addr, nil, "anna@example.com", []string{"Helpdesk@Example.com"}, []byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case raw := <-received:
+		// The dot reader unstuffs dots and turns CRLF into LF
+		if want := strings.ReplaceAll(body, "\r\n", "\n"); string(raw) != want {
+			t.Errorf("received %q, want %q", raw, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler was not called")
+	}
+}
+
+func TestServerHandlerErrors(t *testing.T) {
+	tests := []struct {
+		err  error
+		code int
+	}{
+		{err: nil, code: 250},
+		{err: ErrUnknownSender, code: 550},
+		{err: ErrUnverifiedSender, code: 550},
+		{err: fmt.Errorf("%w: no valid From address", ErrMalformed), code: 554},
+		{err: ErrNoText, code: 554},
+		{err: ErrNotParticipant, code: 554},
+		{err: ErrTicketClosed, code: 554},
+		{err: errors.New("database is down"), code: 451},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.err), func(t *testing.T) {
+			addr := startServer(t, newTestServer(func([]byte) error { return tt.err }))
+
+			c, err := smtp.Dial(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			if err := c.Mail("anna@example.com"); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Rcpt("helpdesk@example.com"); err != nil {
+				t.Fatal(err)
+			}
+			w, err := c.Data()
+			if err != nil {
+				t.Fatal(err)
+			}
+			fmt.Fprint(w, "From: anna@example.com\r\n\r\nHello\r\n")
+
+			err = w.Close()
+			if tt.code == 250 && err != nil || tt.code != 250 && smtpCode(err) != tt.code {
+				t.Errorf("DATA = %v, want %d", err, tt.code)
+			}
+
+			// The session goes on after a rejected message
+			if err := c.Mail("anna@example.com"); err != nil {
+				t.Errorf("MAIL after DATA: %v", err)
+			}
+		})
+	}
+}
+
+func TestServerRecipients(t *testing.T) {
+	addr := startServer(t, newTestServer(func([]byte) error { return nil }))
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Mail("anna@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("someone@example.com"); smtpCode(err) != 550 {
+		t.Errorf("unknown recipient: %v, want 550", err)
+	}
+	if _, err := c.Data(); smtpCode(err) != 503 {
+		t.Errorf("DATA without recipients: %v, want 503", err)
+	}
+	if err := c.Rcpt("helpdesk@example.com"); err != nil {
+		t.Errorf("known recipient: %v", err)
+	}
+}
+
+func TestServerTooBig(t *testing.T) {
+	var called atomic.Bool
+	s := newTestServer(func([]byte) error {
+		called.Store(true)
+		return nil
+	})
+	addr := startServer(t, s)
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Mail("anna@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Rcpt("helpdesk@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(w, "From: anna@example.com\r\n\r\n"+strings.Repeat("x", int(s.MaxSize)))
+	if err := w.Close(); smtpCode(err) != 552 {
+		t.Errorf("DATA = %v, want 552", err)
+	}
+	if called.Load() {
+		t.Error("handler was called for a message over the limit")
+	}
+	if err := c.Noop(); err != nil {
+		t.Errorf("NOOP after a message over the limit: %v", err)
+	}
+}
+
+func TestServerCommands(t *testing.T) {
+	addr := startServer(t, newTestServer(func([]byte) error { return nil }))
+
+	conn, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, _, err := conn.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each command in turn, with the reply code it should get
+	steps := []struct {
+		cmd  string
+		code int
+	}{
+		{"MAIL FROM:<anna@example.com>", 503},
+		{"RCPT TO:<helpdesk@example.com>", 503},
+		{"HELO client.test", 250},
+		{"RCPT TO:<helpdesk@example.com>", 503},
+		{"DATA", 503},
+		{"MAIL FROM:anna@example.com", 501},
+		{"MAIL FROM:<not an address>", 501},
+		{"MAIL FROM:<anna@example.com> SIZE=2048", 552},
+		{"MAIL FROM:<anna@example.com> SIZE=512", 250},
+		{"MAIL FROM:<anna@example.com>", 503},
+		{"RCPT TO:<>", 501},
+		{"RCPT TO:<@relay.test:helpdesk@example.com>", 250},
+		{"RSET", 250},
+		{"RCPT TO:<helpdesk@example.com>", 503},
+		{"MAIL FROM:<>", 250},
+		{"VRFY anna", 252},
+		{"NOOP", 250},
+		{"TURN", 502},
+		{"QUIT", 221},
+	}
+
+	for _, step := range steps {
+		id, err := conn.Cmd("%s", step.cmd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.StartResponse(id)
+		code, msg, err := conn.ReadResponse(step.code)
+		conn.EndResponse(id)
+		if err != nil {
+			t.Errorf("%s: %d %s, want %d", step.cmd, code, msg, step.code)
+		}
+	}
+}
+
+func TestServerAllowed(t *testing.T) {
+	_, relays, err := net.ParseCIDR("172.28.0.0/30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Relays: []*net.IPNet{relays}}
+
+	tests := []struct {
+		addr net.Addr
+		want bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, true},
+		{&net.TCPAddr{IP: net.ParseIP("127.0.0.2")}, true},
+		{&net.TCPAddr{IP: net.ParseIP("::1")}, true},
+		{&net.TCPAddr{IP: net.ParseIP("172.28.0.1")}, true},
+		{&net.TCPAddr{IP: net.ParseIP("172.28.0.4")}, false},
+		{&net.TCPAddr{IP: net.ParseIP("203.0.113.7")}, false},
+		{&net.UnixAddr{Name: "/tmp/smtp.sock", Net: "unix"}, false},
+	}
+	for _, tt := range tests {
+		if got := s.allowed(tt.addr); got != tt.want {
+			t.Errorf("allowed(%v) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+
+	if (&Server{}).allowed(&net.TCPAddr{IP: net.ParseIP("172.28.0.1")}) {
+		t.Error("a relay was allowed without Relays")
+	}
+}
+
+func TestServerAccepts(t *testing.T) {
+	s := &Server{Recipients: []string{"helpdesk@example.com"}}
+	if !s.accepts("HelpDesk@Example.com") || s.accepts("other@example.com") {
+		t.Error("recipients are not matched case-insensitively and exactly")
+	}
+	if !(&Server{}).accepts("anyone@example.com") {
+		t.Error("a server without recipients should accept any")
+	}
+}
@@ -0,0 +1,145 @@
+package inbound
+
+import (
+	"errors"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// ErrUnverifiedSender means the relay did not vouch for the From address
+var ErrUnverifiedSender = errors.New("inbound: the sender could not be verified")
+
+// commentPattern matches the innermost parenthesised comments in a header
+var commentPattern = regexp.MustCompile(`\([^()]*\)`)
+
+// authResult is one method's verdict in an Authentication-Results header,
+// e.g. dkim=pass header.d=example.com
+type authResult struct {
+	method string
+	result string
+	props  map[string]string // e.g. header.d -> example.com
+}
+
+// Verify checks that the relay identified by authservID vouched for the domain of the
+// From address in its Authentication-Results header (RFC 8601): DMARC passed for it, DKIM
+// passed for a signature by it, or SPF passed for an envelope sender in it. Subdomains
+// count as the same domain, as in DMARC's relaxed alignment.
+//
+// Only the topmost header from the relay counts. The relay must remove headers carrying
+// its authserv-id from incoming messages, or senders could forge them.
+func Verify(msg Message, authservID string) error {
+	domain := domainOf(msg.From.Address)
+	if domain == "" {
+		return ErrUnverifiedSender
+	}
+
+	for _, header := range msg.AuthResults {
+		id, results := parseAuthResults(header)
+		if !strings.EqualFold(id, authservID) {
+			continue
+		}
+
+		for _, res := range results {
+			if res.result != "pass" {
+				continue
+			}
+			var d string
+			switch res.method {
+			case "dmarc":
+				d = res.props["header.from"]
+			case "dkim":
+				d = res.props["header.d"]
+			case "spf":
+				d = domainOf(res.props["smtp.mailfrom"])
+			}
+			if aligned(d, domain) {
+				return nil
+			}
+		}
+		return ErrUnverifiedSender
+	}
+	return ErrUnverifiedSender
+}
+
+// parseAuthResults splits an Authentication-Results header into the authserv-id and the
+// results. Comments are dropped and methods, results and property names are lower-cased.
+func parseAuthResults(header string) (string, []authResult) {
+	for prev := ""; prev != header; {
+		prev, header = header, commentPattern.ReplaceAllString(header, " ")
+	}
+
+	segments := strings.Split(header, ";")
+	fields := strings.Fields(segments[0])
+	if len(fields) == 0 {
+		return "", nil
+	}
+
+	var results []authResult
+	for _, segment := range segments[1:] {
+		fields := strings.Fields(segment)
+		if len(fields) == 0 {
+			continue
+		}
+		method, result, ok := strings.Cut(fields[0], "=")
+		if !ok {
+			continue
+		}
+		method, _, _ = strings.Cut(method, "/") // drop a method version, e.g. dkim/1
+
+		res := authResult{method: strings.ToLower(method), result: strings.ToLower(result), props: map[string]string{}}
+		for _, p := range fields[1:] {
+			if k, v, ok := strings.Cut(p, "="); ok {
+				res.props[strings.ToLower(k)] = strings.Trim(v, `"`)
+			}
+		}
+		results = append(results, res)
+	}
+	return fields[0], results
+}
+
+// domainOf returns the lower-cased domain of an address, or of a bare domain
+func domainOf(address string) string {
+	if i := strings.LastIndexByte(address, '@'); i >= 0 {
+		address = address[i+1:]
+	}
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(address), "."))
+}
+
+// aligned reports whether d is domain, or one is a subdomain of the other
+func aligned(d, domain string) bool {
+	d = domainOf(d)
+	if d == "" || !strings.Contains(d, ".") {
+		return false
+	}
+	return d == domain || strings.HasSuffix(domain, "."+d) || strings.HasSuffix(d, "."+domain)
+}
+
+// parseNetworks parses a comma-separated list of IPs and CIDRs
+func parseNetworks(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: entry}
+			}
+			bits := 128
+			if v4 := ip.To4(); v4 != nil {
+				ip, bits = v4, 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
@@ -0,0 +1,108 @@
+package inbound
+
+import (
+	"errors"
+	"net"
+	"net/mail"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	const relay = "mx.example.net"
+
+	tests := []struct {
+		name    string
+		from    string
+		headers []string
+		wantErr bool
+	}{
+		{name: "dmarc", from: "anna@example.com", headers: []string{"mx.example.net; dmarc=pass header.from=example.com"}},
+		{name: "dkim", from: "anna@example.com", headers: []string{"mx.example.net; dkim=pass header.d=example.com header.s=sel"}},
+		{name: "spf", from: "anna@example.com", headers: []string{"mx.example.net; spf=pass smtp.mailfrom=bounce@example.com"}},
+		{name: "dkim by parent domain", from: "anna@mail.example.com", headers: []string{"mx.example.net; dkim=pass header.d=example.com"}},
+		{name: "dkim by subdomain", from: "anna@example.com", headers: []string{"mx.example.net; dkim=pass header.d=mail.example.com"}},
+		{name: "case and comments", from: "Anna@Example.COM", headers: []string{"MX.example.net (v=1); DKIM=Pass (good) header.d=\"example.com\""}},
+		{name: "versioned method", from: "anna@example.com", headers: []string{"mx.example.net 1; dkim/1=pass header.d=example.com"}},
+		{name: "one of several results", from: "anna@example.com", headers: []string{"mx.example.net; spf=fail smtp.mailfrom=x@example.com; dkim=pass header.d=example.com"}},
+		{name: "dkim fail", from: "anna@example.com", headers: []string{"mx.example.net; dkim=fail header.d=example.com"}, wantErr: true},
+		{name: "dkim for another domain", from: "anna@example.com", headers: []string{"mx.example.net; dkim=pass header.d=evil.com"}, wantErr: true},
+		{name: "lookalike domain", from: "anna@example.com", headers: []string{"mx.example.net; dkim=pass header.d=notexample.com"}, wantErr: true},
+		{name: "top-level domain only", from: "anna@example.com", headers: []string{"mx.example.net; dkim=pass header.d=com"}, wantErr: true},
+		{name: "other relay", from: "anna@example.com", headers: []string{"evil.example.org; dkim=pass header.d=example.com"}, wantErr: true},
+		{name: "no headers", from: "anna@example.com", wantErr: true},
+		{name: "no results", from: "anna@example.com", headers: []string{"mx.example.net; none"}, wantErr: true},
+		{
+			name:    "only the topmost header from the relay counts",
+			from:    "anna@example.com",
+			headers: []string{"mx.example.net; dkim=fail header.d=example.com", "mx.example.net; dkim=pass header.d=example.com"},
+			wantErr: true,
+		},
+		{
+			name:    "headers from other relays are skipped",
+			from:    "anna@example.com",
+			headers: []string{"other.example.org; dkim=fail", "mx.example.net; dkim=pass header.d=example.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := Message{From: mail.Address{Address: tt.from}, AuthResults: tt.headers}
+			err := Verify(msg, relay)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("Verify = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrUnverifiedSender) {
+				t.Errorf("err = %v, want ErrUnverifiedSender", err)
+			}
+		})
+	}
+}
+
+func TestParseAuthResults(t *testing.T) {
+	id, results := parseAuthResults("mx.example.net (Postfix (nested)); dkim=pass (2048-bit) header.d=Example.com header.s=sel; spf=softfail smtp.mailfrom=a@b.c")
+	if id != "mx.example.net" {
+		t.Errorf("id = %q", id)
+	}
+	if len(results) != 2 {
+		t.Fatalf("results = %+v", results)
+	}
+	if r := results[0]; r.method != "dkim" || r.result != "pass" || r.props["header.d"] != "Example.com" || r.props["header.s"] != "sel" {
+		t.Errorf("results[0] = %+v", r)
+	}
+	if r := results[1]; r.method != "spf" || r.result != "softfail" || r.props["smtp.mailfrom"] != "a@b.c" {
+		t.Errorf("results[1] = %+v", r)
+	}
+
+	if id, results := parseAuthResults("  "); id != "" || results != nil {
+		t.Errorf("empty header = %q, %+v", id, results)
+	}
+}
+
+func TestParseNetworks(t *testing.T) {
+	networks, err := parseNetworks(" 172.28.0.1, 10.0.0.0/8,,::1 ")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"172.28.0.1/32", "10.0.0.0/8", "::1/128"}
+	if len(networks) != len(want) {
+		t.Fatalf("networks = %v, want %v", networks, want)
+	}
+	for i, n := range networks {
+		if n.String() != want[i] {
+			t.Errorf("networks[%d] = %v, want %v", i, n, want[i])
+		}
+	}
+	if !networks[0].Contains(net.ParseIP("172.28.0.1")) || networks[0].Contains(net.ParseIP("172.28.0.2")) {
+		t.Error("a single address matched the wrong hosts")
+	}
+
+	if networks, err := parseNetworks(""); err != nil || networks != nil {
+		t.Errorf("empty list = %v, %v", networks, err)
+	}
+	for _, bad := range []string{"nope", "10.0.0.0/33", "10.0.0.1,x"} {
+		if _, err := parseNetworks(bad); err == nil {
+			t.Errorf("parseNetworks(%q) succeeded", bad)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// Package mailer sends transactional email through a pluggable backend.
+//
+// The backend is chosen with MAIL_DRIVER:
+//   - "log" (default) prints messages to the server log
+//   - "file" writes each message as an .eml file into MAIL_DIR (default ./mail)
+//   - "smtp" sends through SMTP_HOST:SMTP_PORT, e.g. a relay or a local SMTP sink like Mailpit
+package mailer
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Message is a plain-text email
+type Message struct {
+	From    string // optional; the SMTP mailer fills in MAIL_FROM
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// FromEnv builds the mailer configured by MAIL_DRIVER
+func FromEnv() (Mailer, error) {
+	switch driver := os.Getenv("MAIL_DRIVER"); driver {
+	case "", "log":
+		return LogMailer{}, nil
+	case "file":
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			dir = "./mail"
+		}
+		return NewFileMailer(dir)
+	case "smtp":
+		return smtpFromEnv()
+	default:
+		return nil, fmt.Errorf("unknown MAIL_DRIVER %q", driver)
+	}
+}
+
+// LogMailer prints messages to the log instead of sending them (development only)
+type LogMailer struct{}
+
+// Send logs the message
+func (LogMailer) Send(msg Message) error {
+	log.Printf("mail to=%s subject=%q\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+// FileMailer writes every message as an RFC 5322 file into a directory (development only)
+type FileMailer struct {
+	Dir string
+}
+
+// NewFileMailer creates the target directory and returns a FileMailer writing into it
+func NewFileMailer(dir string) (FileMailer, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return FileMailer{}, err
+	}
+	return FileMailer{Dir: dir}, nil
+}
+
+// Send writes the message to <Dir>/<timestamp>-<id>.eml
+func (m FileMailer) Send(msg Message) error {
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405"), uuid.NewString())
+	return os.WriteFile(filepath.Join(m.Dir, name), Format(msg), 0o644)
+}
+
+// Format renders a message with minimal RFC 5322 headers
+func Format(msg Message) []byte {
+	var b strings.Builder
+	if msg.From != "" {
+		fmt.Fprintf(&b, "From: %s\r\n", msg.From)
+	}
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// SMTPMailer sends messages through an SMTP server. STARTTLS is used when the server offers it.
+type SMTPMailer struct {
+	Addr string    // host:port
+	From string    // header sender, e.g. "YourOffice <no-reply@example.com>"
+	Auth smtp.Auth // nil for servers without authentication, such as a local sink
+}
+
+// smtpFromEnv builds an SMTPMailer from SMTP_HOST, SMTP_PORT, SMTP_USERNAME, SMTP_PASSWORD and MAIL_FROM
+func smtpFromEnv() (SMTPMailer, error) {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return SMTPMailer{}, fmt.Errorf("SMTP_HOST is required for the smtp mail driver")
+	}
+
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "YourOffice <no-reply@localhost>"
+	}
+	if _, err := mail.ParseAddress(from); err != nil {
+		return SMTPMailer{}, fmt.Errorf("invalid MAIL_FROM: %w", err)
+	}
+
+	m := SMTPMailer{Addr: net.JoinHostPort(host, port), From: from}
+	if user := os.Getenv("SMTP_USERNAME"); user != "" {
+		m.Auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	return m, nil
+}
+
+// Send delivers the message
+func (m SMTPMailer) Send(msg Message) error {
+	if msg.From == "" {
+		msg.From = m.From
+	}
+
+	sender, err := mail.ParseAddress(msg.From)
+	if err != nil {
+		return err
+	}
+
+	return smtp.SendMail(m.Addr, m.Auth, sender.Address, []string{msg.To}, Format(msg))
+}
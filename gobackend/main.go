@@ -1,12 +1,21 @@
 package main
 
 import (
+	"context"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
+	_ "time/tzdata" // quiet hours need time zones; the runtime image has no tzdata
 
+	"stuff/events"
 	"stuff/handlers"
+	"stuff/mailer"
 	"stuff/models"
+	"stuff/realtime"
+	"stuff/sla"
+	"stuff/storage"
 
 	_ "stuff/docs"
 
@@ -38,6 +47,33 @@ func runMigrations(db *gorm.DB) error {
 		&models.AbsenceRequest{},
 		&models.AbsenceRequestComment{},
 		&models.Notification{},
+		&models.RefreshToken{},
+		&models.RevokedToken{},
+		&models.PasswordResetToken{},
+		&models.MfaRecoveryCode{},
+		&models.LoginAttempt{},
+		&models.OAuthState{},
+		&models.SSONonce{},
+		&models.Identity{},
+		&models.SSOSettings{},
+		&models.SSOSignup{},
+		&models.APIToken{},
+		&models.NotificationPreference{},
+		&models.NotificationSettings{},
+		&models.Announcement{},
+		&models.AnnouncementReceipt{},
+		&models.TicketCategory{},
+		&models.BusinessCalendar{},
+		&models.BusinessHoliday{},
+		&models.SLAPolicy{},
+		&models.TicketEvent{},
+		&models.Attachment{},
+		&models.TicketWatcher{},
+		&models.AssignmentGroup{},
+		&models.AssignmentGroupMember{},
+		&models.RoutingRule{},
+		&models.InboundEmail{},
+		&models.TicketLink{},
 	)
 }
 
@@ -45,7 +81,8 @@ func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Last-Event-ID, X-Request-ID")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Total-Count, X-Next-Cursor, Link, X-Request-ID")
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusNoContent)
 			return
@@ -73,7 +110,24 @@ func main() {
 
 	println("Migrations applied successfully")
 
+	if err := handlers.LoadSigningKeys(); err != nil {
+		panic("failed to load JWT signing keys: " + err.Error())
+	}
+
+	// Reload JWT keys on SIGHUP so rotated keys are picked up without a restart
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			if err := handlers.LoadSigningKeys(); err != nil {
+				println("failed to reload JWT signing keys: " + err.Error())
+			}
+		}
+	}()
+
 	router := mux.NewRouter()
+	router.NotFoundHandler = http.HandlerFunc(handlers.NotFound)
+	router.MethodNotAllowedHandler = http.HandlerFunc(handlers.MethodNotAllowed)
 
 	// Rate limiter - 100 requests per minute per IP
 	rateLimiter := handlers.NewRateLimiter(100, 1*time.Minute)
@@ -82,48 +136,129 @@ func main() {
 	// Public routes (no auth required)
 	publicRouter := router.PathPrefix("").Subrouter()
 	publicRouter.HandleFunc("/health", handlers.Health).Methods("GET")
+	publicRouter.HandleFunc("/.well-known/jwks.json", handlers.JWKS).Methods("GET")
 	publicRouter.PathPrefix("/swagger/").Handler(httpSwagger.WrapHandler)
 	publicRouter.HandleFunc("/swagger/doc.json", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		http.ServeFile(w, r, "./docs/swagger.json")
 	}).Methods("GET")
 
-	// Feedback CRUD
-	handlers.RegisterFeedback(router, handlers.Feedback{DB: db}, "/feedback")
+	// Domain events; notifications are written in the same transaction as the change
+	bus := events.NewBus()
+	events.SubscribeNotifications(bus)
+	events.SubscribeHistory(bus)
+	events.SubscribeWatchers(bus)
+	sla.Subscribe(bus)
 
-	// Users CRUD
-	handlers.RegisterUsers(router, handlers.Users{DB: db}, "/users")
 	// Auth routes with rate limiting
 	authRouter := router.PathPrefix("/auth").Subrouter()
 	authRouter.Use(rateLimiter.RateLimitMiddleware)
-	handlers.RegisterAuth(authRouter, handlers.Auth{DB: db}, "")
+	mail, err := mailer.FromEnv()
+	if err != nil {
+		panic("failed to configure mailer: " + err.Error())
+	}
+
+	auth := handlers.Auth{DB: db, Mailer: mail}
+	auth.CleanupTokens() // Start cleanup routine
+	handlers.RegisterAuth(authRouter, auth, "")
 
 	// Protected routes (require authentication)
 	protectedRouter := router.PathPrefix("").Subrouter()
-	protectedRouter.Use(handlers.AuthMiddleware)
+	protectedRouter.Use(handlers.AuthMiddleware(db))
 
 	// Departments (protected)
 	handlers.RegisterDepartments(protectedRouter, handlers.Departments{DB: db}, "/departments")
 
+	// Feedback; given anonymously, read and managed by staff (protected)
+	handlers.RegisterFeedback(protectedRouter, publicRouter, handlers.Feedback{DB: db, Events: bus}, "/feedback")
+
 	// Users CRUD (protected)
 	handlers.RegisterUsers(protectedRouter, handlers.Users{DB: db}, "/users")
 
+	// Blob storage and virus scanning for attachments
+	store, err := storage.FromEnv()
+	if err != nil {
+		panic("failed to configure storage: " + err.Error())
+	}
+	scanner, err := storage.ScannerFromEnv()
+	if err != nil {
+		panic("failed to configure virus scanner: " + err.Error())
+	}
+	downloadKey, err := handlers.DownloadSigningKey()
+	if err != nil {
+		panic("failed to configure download links: " + err.Error())
+	}
+
 	// Tickets CRUD (protected)
-	handlers.RegisterTickets(protectedRouter, handlers.Tickets{DB: db}, "/tickets")
+	handlers.RegisterTickets(protectedRouter, handlers.Tickets{DB: db, Events: bus, Store: store}, "/tickets")
+
+	// Ticket attachments (protected); downloads use signed links on the public router
+	attachments := handlers.Attachments{DB: db, Store: store, Scanner: scanner, SigningKey: downloadKey}
+	handlers.RegisterAttachments(protectedRouter, publicRouter, attachments, "/tickets", "/attachments")
+
+	// Ticket categories (protected)
+	handlers.RegisterTicketCategories(protectedRouter, handlers.TicketCategories{DB: db}, "/ticket-categories")
+
+	// SLA policies and business calendars (protected)
+	slaHandler := handlers.SLA{DB: db, Events: bus}
+	slaHandler.DetectBreaches() // Start SLA breach detection routine
+	handlers.RegisterSLA(protectedRouter, slaHandler, "/sla")
+
+	// Routing rules and assignment groups (protected)
+	handlers.RegisterRouting(protectedRouter, handlers.Routing{DB: db}, "/routing")
+
+	// Inbound email to tickets: SMTP listener, and a webhook on the public router with its own secret
+	inboundMail := handlers.InboundMail{
+		DB:         db,
+		Events:     bus,
+		Secret:     os.Getenv("INBOUND_WEBHOOK_SECRET"),
+		AuthservID: os.Getenv("INBOUND_AUTHSERV_ID"),
+	}
+	if err := inboundMail.ListenSMTP(); err != nil { // Start inbound SMTP listener
+		panic("failed to start inbound mail listener: " + err.Error())
+	}
+	handlers.RegisterInboundMail(publicRouter, inboundMail, "/inbound")
 
 	// Shifts CRUD (protected)
-	handlers.RegisterShifts(protectedRouter, handlers.Shifts{DB: db}, "/shifts")
+	handlers.RegisterShifts(protectedRouter, handlers.Shifts{DB: db, Events: bus}, "/shifts")
 
 	// Absence requests CRUD (protected)
-	handlers.RegisterAbsenceRequests(protectedRouter, handlers.AbsenceRequests{DB: db}, "/absence-requests")
+	handlers.RegisterAbsenceRequests(protectedRouter, handlers.AbsenceRequests{DB: db, Events: bus}, "/absence-requests")
+
+	// Ticket watchers (protected)
+	handlers.RegisterTicketWatchers(protectedRouter, handlers.TicketWatchers{DB: db}, "/tickets")
+
+	// Ticket links and merging (protected)
+	handlers.RegisterTicketLinks(protectedRouter, handlers.TicketLinks{DB: db, Events: bus}, "/tickets")
 
 	// Ticket comments (protected)
-	handlers.RegisterTicketComments(protectedRouter, handlers.TicketComments{DB: db}, "/tickets", "/ticket-comments")
+	handlers.RegisterTicketComments(protectedRouter, handlers.TicketComments{DB: db, Events: bus}, "/tickets", "/ticket-comments")
 
 	// Absence request comments (protected)
 	handlers.RegisterAbsenceRequestComments(protectedRouter, handlers.AbsenceRequestComments{DB: db}, "/absence-requests", "/absence-request-comments")
 
-	handler := corsMiddleware(router)
+	// Login attempt audit (protected)
+	handlers.RegisterLoginAttempts(protectedRouter, handlers.LoginAttempts{DB: db}, "/login-attempts")
+
+	// Notifications (protected); new ones are pushed to open streams on every replica
+	hub := realtime.NewHub()
+	go hub.Listen(context.Background(), dsn, db)
+	notifications := handlers.Notifications{DB: db, Hub: hub, Mailer: mail}
+	notifications.SendDigests() // Start email digest routine
+	handlers.RegisterNotifications(protectedRouter, notifications, "/notifications")
+
+	// Announcements (protected)
+	announcements := handlers.Announcements{DB: db, Events: bus}
+	announcements.PublishScheduled() // Start scheduled publishing routine
+	handlers.RegisterAnnouncements(protectedRouter, announcements, "/announcements")
+
+	// API tokens (protected)
+	handlers.RegisterAPITokens(protectedRouter, handlers.APITokens{DB: db}, "/api-tokens")
+
+	// SSO settings and onboarding queue (protected)
+	handlers.RegisterSSOAdmin(protectedRouter, handlers.SSOAdmin{DB: db}, "/sso")
+
+	handler := corsMiddleware(handlers.RequestID(router))
 
 	// Bind to 0.0.0.0 to accept connections from both localhost and 127.0.0.1
 	addr := "0.0.0.0:8080"
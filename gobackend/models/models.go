@@ -2,9 +2,14 @@ package models
 
 import (
 	"database/sql/driver"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"gorm.io/gorm"
 )
 
 // TicketStatus enumeration
@@ -22,6 +27,199 @@ func (ts TicketStatus) String() string {
 	return string(ts)
 }
 
+// Valid reports whether ts is one of the known ticket statuses
+func (ts TicketStatus) Valid() bool {
+	switch ts {
+	case TicketStatusOpen, TicketStatusInProgress, TicketStatusResolved, TicketStatusClosed, TicketStatusCancelled:
+		return true
+	}
+	return false
+}
+
+// ticketTransitions lists the statuses a ticket may move to from each status.
+// Cancelled tickets cannot be changed.
+var ticketTransitions = map[TicketStatus][]TicketStatus{
+	TicketStatusOpen:       {TicketStatusInProgress, TicketStatusResolved, TicketStatusCancelled},
+	TicketStatusInProgress: {TicketStatusOpen, TicketStatusResolved, TicketStatusCancelled},
+	TicketStatusResolved:   {TicketStatusClosed, TicketStatusOpen},
+	TicketStatusClosed:     {TicketStatusOpen},
+}
+
+// CanTransitionTo reports whether a ticket may move from ts to next
+func (ts TicketStatus) CanTransitionTo(next TicketStatus) bool {
+	return slices.Contains(ticketTransitions[ts], next)
+}
+
+// IsResolved reports whether ts counts as resolved
+func (ts TicketStatus) IsResolved() bool {
+	return ts == TicketStatusResolved || ts == TicketStatusClosed
+}
+
+// TicketEventType enumeration
+type TicketEventType string
+
+const (
+	TicketEventCreated       TicketEventType = "CREATED"
+	TicketEventStatusChanged TicketEventType = "STATUS_CHANGED"
+	TicketEventFieldChanged  TicketEventType = "FIELD_CHANGED"
+	TicketEventSLABreached   TicketEventType = "SLA_BREACHED"
+	TicketEventMerged        TicketEventType = "MERGED" // another ticket was merged into this one
+)
+
+func (te TicketEventType) String() string {
+	return string(te)
+}
+
+// Valid reports whether te is one of the known ticket event types
+func (te TicketEventType) Valid() bool {
+	switch te {
+	case TicketEventCreated, TicketEventStatusChanged, TicketEventFieldChanged, TicketEventSLABreached, TicketEventMerged:
+		return true
+	}
+	return false
+}
+
+// CommentVisibility enumeration
+type CommentVisibility string
+
+const (
+	CommentVisibilityPublic   CommentVisibility = "PUBLIC"   // everyone who can see the ticket or request
+	CommentVisibilityInternal CommentVisibility = "INTERNAL" // staff only, never the requester
+)
+
+func (cv CommentVisibility) String() string {
+	return string(cv)
+}
+
+// Valid reports whether cv is one of the known visibilities
+func (cv CommentVisibility) Valid() bool {
+	switch cv {
+	case CommentVisibilityPublic, CommentVisibilityInternal:
+		return true
+	}
+	return false
+}
+
+// TicketLinkType enumeration. Links are stored with the forward types; the inverse
+// types describe a link as seen from its target ticket.
+type TicketLinkType string
+
+const (
+	TicketLinkDuplicates   TicketLinkType = "DUPLICATES"    // the source is a duplicate of the target
+	TicketLinkDuplicatedBy TicketLinkType = "DUPLICATED_BY" // inverse of DUPLICATES
+	TicketLinkBlocks       TicketLinkType = "BLOCKS"        // the target cannot go on until the source is done
+	TicketLinkBlockedBy    TicketLinkType = "BLOCKED_BY"    // inverse of BLOCKS
+	TicketLinkRelated      TicketLinkType = "RELATED"       // the same both ways
+	TicketLinkParentOf     TicketLinkType = "PARENT_OF"     // the target is part of the source
+	TicketLinkChildOf      TicketLinkType = "CHILD_OF"      // inverse of PARENT_OF
+)
+
+func (lt TicketLinkType) String() string {
+	return string(lt)
+}
+
+// Valid reports whether lt is one of the known link types, forward or inverse
+func (lt TicketLinkType) Valid() bool {
+	switch lt {
+	case TicketLinkDuplicates, TicketLinkDuplicatedBy, TicketLinkBlocks, TicketLinkBlockedBy,
+		TicketLinkRelated, TicketLinkParentOf, TicketLinkChildOf:
+		return true
+	}
+	return false
+}
+
+// Inverse returns the type of the same link seen from the other ticket
+func (lt TicketLinkType) Inverse() TicketLinkType {
+	switch lt {
+	case TicketLinkDuplicates:
+		return TicketLinkDuplicatedBy
+	case TicketLinkDuplicatedBy:
+		return TicketLinkDuplicates
+	case TicketLinkBlocks:
+		return TicketLinkBlockedBy
+	case TicketLinkBlockedBy:
+		return TicketLinkBlocks
+	case TicketLinkParentOf:
+		return TicketLinkChildOf
+	case TicketLinkChildOf:
+		return TicketLinkParentOf
+	}
+	return lt
+}
+
+// IsInverse reports whether lt is one of the types links are not stored with
+func (lt TicketLinkType) IsInverse() bool {
+	return lt == TicketLinkDuplicatedBy || lt == TicketLinkBlockedBy || lt == TicketLinkChildOf
+}
+
+// TicketPriority enumeration
+type TicketPriority string
+
+const (
+	TicketPriorityLow    TicketPriority = "LOW"
+	TicketPriorityNormal TicketPriority = "NORMAL"
+	TicketPriorityHigh   TicketPriority = "HIGH"
+	TicketPriorityUrgent TicketPriority = "URGENT"
+)
+
+func (tp TicketPriority) String() string {
+	return string(tp)
+}
+
+// Valid reports whether tp is one of the known ticket priorities
+func (tp TicketPriority) Valid() bool {
+	switch tp {
+	case TicketPriorityLow, TicketPriorityNormal, TicketPriorityHigh, TicketPriorityUrgent:
+		return true
+	}
+	return false
+}
+
+// SLAStatus enumeration
+type SLAStatus string
+
+const (
+	SLAStatusNone     SLAStatus = "NONE" // no policy applies, or the ticket was cancelled
+	SLAStatusOnTrack  SLAStatus = "ON_TRACK"
+	SLAStatusAtRisk   SLAStatus = "AT_RISK"
+	SLAStatusBreached SLAStatus = "BREACHED"
+	SLAStatusMet      SLAStatus = "MET"
+)
+
+func (ss SLAStatus) String() string {
+	return string(ss)
+}
+
+// Valid reports whether ss is one of the known SLA statuses
+func (ss SLAStatus) Valid() bool {
+	switch ss {
+	case SLAStatusNone, SLAStatusOnTrack, SLAStatusAtRisk, SLAStatusBreached, SLAStatusMet:
+		return true
+	}
+	return false
+}
+
+// AssignmentStrategy enumeration
+type AssignmentStrategy string
+
+const (
+	AssignmentRoundRobin AssignmentStrategy = "ROUND_ROBIN" // take turns
+	AssignmentLeastOpen  AssignmentStrategy = "LEAST_OPEN"  // the agent with the fewest open tickets
+)
+
+func (as AssignmentStrategy) String() string {
+	return string(as)
+}
+
+// Valid reports whether as is one of the known assignment strategies
+func (as AssignmentStrategy) Valid() bool {
+	switch as {
+	case AssignmentRoundRobin, AssignmentLeastOpen:
+		return true
+	}
+	return false
+}
+
 // AbsenceType enumeration
 type AbsenceType string
 
@@ -36,6 +234,15 @@ func (at AbsenceType) String() string {
 	return string(at)
 }
 
+// Valid reports whether at is one of the known absence types
+func (at AbsenceType) Valid() bool {
+	switch at {
+	case AbsenceTypeSickLeave, AbsenceTypeVacation, AbsenceTypePersonal, AbsenceTypeOther:
+		return true
+	}
+	return false
+}
+
 // RequestStatus enumeration
 type RequestStatus string
 
@@ -49,6 +256,15 @@ func (rs RequestStatus) String() string {
 	return string(rs)
 }
 
+// Valid reports whether rs is one of the known request statuses
+func (rs RequestStatus) Valid() bool {
+	switch rs {
+	case RequestStatusPending, RequestStatusApproved, RequestStatusRejected:
+		return true
+	}
+	return false
+}
+
 // NotificationType enumeration
 type NotificationType string
 
@@ -63,18 +279,128 @@ const (
 	NotificationTypeShiftCancelled     NotificationType = "SHIFT_CANCELLED"
 	NotificationTypeFeedbackReceived   NotificationType = "FEEDBACK_RECEIVED"
 	NotificationTypeSystemAnnouncement NotificationType = "SYSTEM_ANNOUNCEMENT"
+	NotificationTypeTicketSLABreached  NotificationType = "TICKET_SLA_BREACHED"
+	NotificationTypeTicketMentioned    NotificationType = "TICKET_MENTIONED"
 )
 
 func (nt NotificationType) String() string {
 	return string(nt)
 }
 
+// Valid reports whether nt is one of the known notification types
+func (nt NotificationType) Valid() bool {
+	switch nt {
+	case NotificationTypeTicketAssigned, NotificationTypeTicketUpdated, NotificationTypeTicketCommented,
+		NotificationTypeAbsenceApproved, NotificationTypeAbsenceRejected, NotificationTypeAbsenceCommented,
+		NotificationTypeShiftCreated, NotificationTypeShiftCancelled, NotificationTypeFeedbackReceived,
+		NotificationTypeSystemAnnouncement, NotificationTypeTicketSLABreached, NotificationTypeTicketMentioned:
+		return true
+	}
+	return false
+}
+
+// NotificationChannel enumeration
+type NotificationChannel string
+
+const (
+	NotificationChannelInApp NotificationChannel = "IN_APP"
+	NotificationChannelEmail NotificationChannel = "EMAIL"
+	NotificationChannelPush  NotificationChannel = "PUSH"
+)
+
+func (nc NotificationChannel) String() string {
+	return string(nc)
+}
+
+// Valid reports whether nc is one of the known channels
+func (nc NotificationChannel) Valid() bool {
+	switch nc {
+	case NotificationChannelInApp, NotificationChannelEmail, NotificationChannelPush:
+		return true
+	}
+	return false
+}
+
+// DefaultEnabled reports whether the channel is on when a user has no preference for it.
+// Email is opt-in; in-app and push are opt-out.
+func (nc NotificationChannel) DefaultEnabled() bool {
+	return nc != NotificationChannelEmail
+}
+
+// AnnouncementAudience enumeration
+type AnnouncementAudience string
+
+const (
+	AnnouncementAudienceEveryone    AnnouncementAudience = "EVERYONE"
+	AnnouncementAudienceDepartments AnnouncementAudience = "DEPARTMENTS"
+	AnnouncementAudienceRole        AnnouncementAudience = "ROLE"
+)
+
+func (aa AnnouncementAudience) String() string {
+	return string(aa)
+}
+
+// Valid reports whether aa is one of the known audiences
+func (aa AnnouncementAudience) Valid() bool {
+	switch aa {
+	case AnnouncementAudienceEveryone, AnnouncementAudienceDepartments, AnnouncementAudienceRole:
+		return true
+	}
+	return false
+}
+
+// Role enumeration
+type Role string
+
+const (
+	RoleEmployee Role = "EMPLOYEE"
+	RoleManager  Role = "MANAGER"
+	RoleHR       Role = "HR"
+	RoleAdmin    Role = "ADMIN"
+)
+
+func (r Role) String() string {
+	return string(r)
+}
+
+// Valid reports whether r is one of the known roles
+func (r Role) Valid() bool {
+	switch r {
+	case RoleEmployee, RoleManager, RoleHR, RoleAdmin:
+		return true
+	}
+	return false
+}
+
+// IsStaff reports whether r manages other people (manager, HR or admin)
+func (r Role) IsStaff() bool {
+	return r == RoleManager || r == RoleHR || r == RoleAdmin
+}
+
+// Outranks reports whether r is above o in the order employee, manager, HR, admin
+func (r Role) Outranks(o Role) bool {
+	return r.rank() > o.rank()
+}
+
+func (r Role) rank() int {
+	switch r {
+	case RoleManager:
+		return 1
+	case RoleHR:
+		return 2
+	case RoleAdmin:
+		return 3
+	}
+	return 0
+}
+
 // Department represents a department in the system
 type Department struct {
-	Id        uuid.UUID `gorm:"type:uuid;primaryKey" json:"id"`
-	Name      string    `gorm:"type:varchar(255);not null" json:"name"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	Id         uuid.UUID `gorm:"type:uuid;primaryKey" json:"id"`
+	Name       string    `gorm:"type:varchar(255);not null" json:"name"`
+	RequireMfa bool      `gorm:"not null;default:false" json:"require_mfa"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
 
 	// Relations
 	Users     []User     `gorm:"foreignKey:DepartmentId" json:"users,omitempty"`
@@ -88,10 +414,23 @@ type User struct {
 	Email          string    `gorm:"type:varchar(255);not null;uniqueIndex" json:"email"`
 	PasswordHash   string    `gorm:"type:varchar(255);not null" json:"-"`
 	DepartmentId   uuid.UUID `gorm:"type:uuid;not null" json:"department_id"`
+	Role           Role      `gorm:"type:varchar(50);not null;default:'EMPLOYEE'" json:"role"`
 	FeedbackRating int       `gorm:"default:0" json:"feedback_rating"`
+	MfaEnabled     bool      `gorm:"not null;default:false" json:"mfa_enabled"`
+	MfaSecret      string    `gorm:"type:varchar(64)" json:"-"`
+	MfaLastStep    int64     `gorm:"not null;default:0" json:"-"`
 	CreatedAt      time.Time `json:"created_at"`
 	UpdatedAt      time.Time `json:"updated_at"`
 
+	// Set once the user has shown they receive mail at Email, through a password reset link
+	// or a provider that verified it. Cleared when the email changes.
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+
+	// Login throttling
+	FailedLoginCount  int        `gorm:"not null;default:0" json:"-"`
+	LastFailedLoginAt *time.Time `json:"-"`
+	LockedUntil       *time.Time `json:"locked_until"`
+
 	// Relations
 	Department       Department              `gorm:"foreignKey:DepartmentId" json:"department,omitempty"`
 	CreatedTickets   []Ticket                `gorm:"foreignKey:CreatedByUserId" json:"created_tickets,omitempty"`
@@ -106,34 +445,405 @@ type User struct {
 
 // Ticket represents a support ticket
 type Ticket struct {
-	Id               uuid.UUID    `gorm:"type:uuid;primaryKey" json:"id"`
-	Title            string       `gorm:"type:varchar(255);not null" json:"title"`
-	Description      string       `gorm:"type:text;not null" json:"description"`
-	Status           TicketStatus `gorm:"type:varchar(50);default:'OPEN'" json:"status"`
-	CreatedByUserId  uuid.UUID    `gorm:"type:uuid;not null" json:"created_by_user_id"`
-	AssignedToUserId *uuid.UUID   `gorm:"type:uuid" json:"assigned_to_user_id"`
-	CreatedAt        time.Time    `json:"created_at"`
-	UpdatedAt        time.Time    `json:"updated_at"`
-	ResolvedAt       *time.Time   `json:"resolved_at"`
+	Id               uuid.UUID      `gorm:"type:uuid;primaryKey" json:"id"`
+	Title            string         `gorm:"type:varchar(255);not null" json:"title"`
+	Description      string         `gorm:"type:text;not null" json:"description"`
+	Status           TicketStatus   `gorm:"type:varchar(50);default:'OPEN'" json:"status"`
+	Priority         TicketPriority `gorm:"type:varchar(20);not null;default:'NORMAL';index" json:"priority"`
+	CategoryId       *uuid.UUID     `gorm:"type:uuid;index" json:"category_id"`
+	CreatedByUserId  uuid.UUID      `gorm:"type:uuid;not null" json:"created_by_user_id"`
+	AssignedToUserId *uuid.UUID     `gorm:"type:uuid" json:"assigned_to_user_id"`
+	CreatedAt        time.Time      `json:"created_at"`
+	UpdatedAt        time.Time      `json:"updated_at"`
+	ResolvedAt       *time.Time     `json:"resolved_at"`
+
+	// SLA tracking, maintained by the sla package
+	SLAPolicyId             *uuid.UUID       `gorm:"type:uuid" json:"sla_policy_id"`
+	FirstResponseDueAt      *time.Time       `gorm:"index" json:"first_response_due_at"`
+	ResolutionDueAt         *time.Time       `gorm:"index" json:"resolution_due_at"`
+	FirstRespondedAt        *time.Time       `json:"first_responded_at"`
+	FirstResponseBreachedAt *time.Time       `json:"first_response_breached_at"` // set once the breach has been reported
+	ResolutionBreachedAt    *time.Time       `json:"resolution_breached_at"`     // set once the breach has been reported
+	SLAStatus               SLAStatus        `gorm:"-" json:"sla_status"`
+	Relations               []TicketRelation `gorm:"-" json:"relations,omitempty"` // links to other tickets, set by GetByID
 
 	// Relations
 	CreatedByUser  User            `gorm:"foreignKey:CreatedByUserId" json:"created_by_user,omitempty"`
 	AssignedToUser *User           `gorm:"foreignKey:AssignedToUserId" json:"assigned_to_user,omitempty"`
+	Category       *TicketCategory `gorm:"foreignKey:CategoryId" json:"category,omitempty"`
+	SLAPolicy      *SLAPolicy      `gorm:"foreignKey:SLAPolicyId;constraint:OnDelete:SET NULL" json:"sla_policy,omitempty"`
 	Comments       []TicketComment `gorm:"foreignKey:TicketId" json:"comments,omitempty"`
+	Events         []TicketEvent   `gorm:"foreignKey:TicketId;constraint:OnDelete:CASCADE" json:"events,omitempty"`
+	Attachments    []Attachment    `gorm:"foreignKey:TicketId;constraint:OnDelete:CASCADE" json:"attachments,omitempty"`
+	Watchers       []TicketWatcher `gorm:"foreignKey:TicketId;constraint:OnDelete:CASCADE" json:"watchers,omitempty"`
 }
 
-// TicketComment represents a comment on a ticket
-type TicketComment struct {
+// ErrTicketEventImmutable is returned when something tries to change ticket history
+var ErrTicketEventImmutable = errors.New("ticket events cannot be changed")
+
+// TicketEvent is an entry in a ticket's history: who changed what, and when.
+// Entries are never changed or deleted; they go when the ticket does.
+type TicketEvent struct {
+	Id          uuid.UUID       `gorm:"type:uuid;primaryKey" json:"id"`
+	TicketId    uuid.UUID       `gorm:"type:uuid;not null;index:idx_ticket_event_ticket" json:"ticket_id"`
+	ActorUserId *uuid.UUID      `gorm:"type:uuid" json:"actor_user_id"` // nil for changes made by the system
+	Type        TicketEventType `gorm:"type:varchar(30);not null" json:"type"`
+	Field       string          `gorm:"type:varchar(50)" json:"field,omitempty"` // the field that changed, e.g. status
+	OldValue    *string         `gorm:"type:text" json:"old_value"`
+	NewValue    *string         `gorm:"type:text" json:"new_value"`
+	Reason      string          `gorm:"type:text" json:"reason,omitempty"`
+	CreatedAt   time.Time       `gorm:"index:idx_ticket_event_ticket" json:"created_at"`
+
+	// Relations
+	ActorUser *User `gorm:"foreignKey:ActorUserId" json:"actor_user,omitempty"`
+}
+
+// BeforeUpdate keeps ticket history immutable
+func (TicketEvent) BeforeUpdate(tx *gorm.DB) error {
+	return ErrTicketEventImmutable
+}
+
+// BeforeDelete keeps ticket history immutable
+func (TicketEvent) BeforeDelete(tx *gorm.DB) error {
+	return ErrTicketEventImmutable
+}
+
+// InternalNotesVisibleTo reports whether a user may read internal comments on t.
+// Staff and the assignee can; the requester who created the ticket never can.
+func (t Ticket) InternalNotesVisibleTo(userID uuid.UUID, role Role) bool {
+	if userID == t.CreatedByUserId {
+		return false
+	}
+	if t.AssignedToUserId != nil && *t.AssignedToUserId == userID {
+		return true
+	}
+	return role.IsStaff()
+}
+
+// SLAAtRiskShare is the share of a target's window that, once all that is left,
+// makes an open ticket count as at risk
+const SLAAtRiskShare = 0.2
+
+// AfterFind fills in SLAStatus
+func (t *Ticket) AfterFind(tx *gorm.DB) error {
+	t.SLAStatus = t.ComputeSLAStatus(time.Now())
+	return nil
+}
+
+// AfterSave fills in SLAStatus
+func (t *Ticket) AfterSave(tx *gorm.DB) error {
+	t.SLAStatus = t.ComputeSLAStatus(time.Now())
+	return nil
+}
+
+// ComputeSLAStatus reports where the ticket stands against its SLA at now.
+// The ticket list filter on sla_status mirrors this in SQL.
+func (t Ticket) ComputeSLAStatus(now time.Time) SLAStatus {
+	if t.SLAPolicyId == nil || t.FirstResponseDueAt == nil || t.ResolutionDueAt == nil {
+		return SLAStatusNone
+	}
+	if t.FirstResponseBreachedAt != nil || t.ResolutionBreachedAt != nil {
+		return SLAStatusBreached
+	}
+	if t.Status == TicketStatusCancelled {
+		return SLAStatusNone
+	}
+	if t.ResolvedAt != nil {
+		return SLAStatusMet
+	}
+
+	awaitingResponse := t.FirstRespondedAt == nil
+	if (awaitingResponse && now.After(*t.FirstResponseDueAt)) || now.After(*t.ResolutionDueAt) {
+		return SLAStatusBreached
+	}
+	if (awaitingResponse && slaAtRisk(t.CreatedAt, *t.FirstResponseDueAt, now)) || slaAtRisk(t.CreatedAt, *t.ResolutionDueAt, now) {
+		return SLAStatusAtRisk
+	}
+	return SLAStatusOnTrack
+}
+
+func slaAtRisk(start, due, now time.Time) bool {
+	window := due.Sub(start)
+	return now.After(due.Add(-time.Duration(float64(window) * SLAAtRiskShare)))
+}
+
+// TicketCategory groups tickets by what they are about, e.g. "Hardware" or "Network"
+type TicketCategory struct {
+	Id          uuid.UUID `gorm:"type:uuid;primaryKey" json:"id"`
+	Name        string    `gorm:"type:varchar(100);not null;uniqueIndex" json:"name"`
+	Description string    `gorm:"type:text" json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// SLAPolicy sets the response and resolution targets for tickets. A policy may be
+// limited to a category, a priority or both; the most specific match applies.
+type SLAPolicy struct {
+	Id                   uuid.UUID       `gorm:"type:uuid;primaryKey" json:"id"`
+	Name                 string          `gorm:"type:varchar(255);not null" json:"name"`
+	CategoryId           *uuid.UUID      `gorm:"type:uuid" json:"category_id"`     // nil matches every category
+	Priority             *TicketPriority `gorm:"type:varchar(20)" json:"priority"` // nil matches every priority
+	FirstResponseMinutes int             `gorm:"not null" json:"first_response_minutes"`
+	ResolutionMinutes    int             `gorm:"not null" json:"resolution_minutes"`
+	CalendarId           *uuid.UUID      `gorm:"type:uuid" json:"calendar_id"` // nil counts round the clock
+	CreatedAt            time.Time       `json:"created_at"`
+	UpdatedAt            time.Time       `json:"updated_at"`
+
+	// Relations
+	Category *TicketCategory   `gorm:"foreignKey:CategoryId" json:"category,omitempty"`
+	Calendar *BusinessCalendar `gorm:"foreignKey:CalendarId" json:"calendar,omitempty"`
+}
+
+// BusinessCalendar defines the working hours SLA targets are counted in
+type BusinessCalendar struct {
 	Id        uuid.UUID `gorm:"type:uuid;primaryKey" json:"id"`
-	TicketId  uuid.UUID `gorm:"type:uuid;not null" json:"ticket_id"`
-	UserId    uuid.UUID `gorm:"type:uuid;not null" json:"user_id"`
-	Content   string    `gorm:"type:text;not null" json:"content"`
+	Name      string    `gorm:"type:varchar(255);not null" json:"name"`
+	TimeZone  string    `gorm:"type:varchar(64);not null;default:'Europe/Copenhagen'" json:"time_zone"`
+	Workdays  string    `gorm:"type:varchar(20);not null;default:'1,2,3,4,5'" json:"workdays"` // ISO weekdays, 1 is Monday
+	DayStart  string    `gorm:"type:varchar(5);not null;default:'08:00'" json:"day_start"`
+	DayEnd    string    `gorm:"type:varchar(5);not null;default:'16:00'" json:"day_end"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 
 	// Relations
-	Ticket Ticket `gorm:"foreignKey:TicketId" json:"ticket,omitempty"`
-	User   User   `gorm:"foreignKey:UserId" json:"user,omitempty"`
+	Holidays []BusinessHoliday `gorm:"foreignKey:CalendarId;constraint:OnDelete:CASCADE" json:"holidays,omitempty"`
+}
+
+// BusinessHoliday is a day a business calendar does not count
+type BusinessHoliday struct {
+	Id         uuid.UUID `gorm:"type:uuid;primaryKey" json:"id"`
+	CalendarId uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_business_holiday" json:"calendar_id"`
+	Date       time.Time `gorm:"type:date;not null;uniqueIndex:idx_business_holiday" json:"date"`
+	Name       string    `gorm:"type:varchar(255)" json:"name"`
+}
+
+// Weekdays returns the days of the week the calendar works
+func (c BusinessCalendar) Weekdays() map[time.Weekday]bool {
+	days := make(map[time.Weekday]bool)
+	for _, part := range strings.Split(c.Workdays, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || n < 1 || n > 7 {
+			continue
+		}
+		days[time.Weekday(n%7)] = true
+	}
+	return days
+}
+
+// maxCalendarDays bounds the search for working time, so a calendar with
+// every workday marked as a holiday cannot loop forever
+const maxCalendarDays = 3660
+
+// AddWorkingTime returns the moment d of working time after start. Holidays must be loaded.
+// A calendar without usable hours or workdays counts round the clock.
+func (c BusinessCalendar) AddWorkingTime(start time.Time, d time.Duration) time.Time {
+	open, err1 := time.Parse("15:04", c.DayStart)
+	end, err2 := time.Parse("15:04", c.DayEnd)
+	workdays := c.Weekdays()
+	if err1 != nil || err2 != nil || !open.Before(end) || len(workdays) == 0 {
+		return start.Add(d)
+	}
+
+	loc, err := time.LoadLocation(c.TimeZone)
+	if err != nil {
+		loc = time.UTC
+	}
+
+	holidays := make(map[string]bool, len(c.Holidays))
+	for _, h := range c.Holidays {
+		holidays[h.Date.Format("2006-01-02")] = true
+	}
+
+	t := start.In(loc)
+	for i := 0; i < maxCalendarDays; i++ {
+		y, m, day := t.Date()
+		dayOpen := time.Date(y, m, day, open.Hour(), open.Minute(), 0, 0, loc)
+		dayEnd := time.Date(y, m, day, end.Hour(), end.Minute(), 0, 0, loc)
+
+		if workdays[t.Weekday()] && !holidays[t.Format("2006-01-02")] && t.Before(dayEnd) {
+			if t.Before(dayOpen) {
+				t = dayOpen
+			}
+			left := dayEnd.Sub(t)
+			if d <= left {
+				return t.Add(d)
+			}
+			d -= left
+		}
+
+		t = time.Date(y, m, day+1, 0, 0, 0, 0, loc)
+	}
+	return t
+}
+
+// AssignmentGroup is a team that routed tickets are shared out among
+type AssignmentGroup struct {
+	Id                 uuid.UUID          `gorm:"type:uuid;primaryKey" json:"id"`
+	Name               string             `gorm:"type:varchar(255);not null;uniqueIndex" json:"name"`
+	Description        string             `gorm:"type:text" json:"description"`
+	Strategy           AssignmentStrategy `gorm:"type:varchar(20);not null;default:'ROUND_ROBIN'" json:"strategy"`
+	LastAssignedUserId *uuid.UUID         `gorm:"type:uuid" json:"last_assigned_user_id"` // round-robin continues after this member
+	CreatedAt          time.Time          `json:"created_at"`
+	UpdatedAt          time.Time          `json:"updated_at"`
+
+	// Relations
+	Members []AssignmentGroupMember `gorm:"foreignKey:GroupId;constraint:OnDelete:CASCADE" json:"members,omitempty"`
+}
+
+// AssignmentGroupMember is an agent in an assignment group
+type AssignmentGroupMember struct {
+	GroupId   uuid.UUID `gorm:"type:uuid;primaryKey" json:"group_id"`
+	UserId    uuid.UUID `gorm:"type:uuid;primaryKey;index" json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// Relations
+	User *User `gorm:"foreignKey:UserId;constraint:OnDelete:CASCADE" json:"user,omitempty"`
+}
+
+// RoutingRule sends new tickets that match it to an assignment group. Conditions that
+// are left empty match every ticket; the enabled rule with the lowest position wins.
+type RoutingRule struct {
+	Id           uuid.UUID  `gorm:"type:uuid;primaryKey" json:"id"`
+	Name         string     `gorm:"type:varchar(255);not null" json:"name"`
+	Position     int        `gorm:"not null;default:0;index" json:"position"`
+	Enabled      bool       `gorm:"not null;default:true" json:"enabled"`
+	CategoryId   *uuid.UUID `gorm:"type:uuid" json:"category_id"`
+	Keywords     string     `gorm:"type:varchar(500)" json:"keywords"`        // comma-separated; any of them in the title or description
+	DepartmentId *uuid.UUID `gorm:"type:uuid" json:"department_id"`           // the requester's department
+	GroupId      uuid.UUID  `gorm:"type:uuid;not null;index" json:"group_id"` // groups in use by a rule cannot be deleted
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+
+	// Relations
+	Category   *TicketCategory  `gorm:"foreignKey:CategoryId" json:"category,omitempty"`
+	Department *Department      `gorm:"foreignKey:DepartmentId" json:"department,omitempty"`
+	Group      *AssignmentGroup `gorm:"foreignKey:GroupId" json:"group,omitempty"`
+}
+
+// KeywordList returns the rule's keywords in lower case
+func (rr RoutingRule) KeywordList() []string {
+	var keywords []string
+	for _, k := range strings.Split(rr.Keywords, ",") {
+		if k = strings.ToLower(strings.TrimSpace(k)); k != "" {
+			keywords = append(keywords, k)
+		}
+	}
+	return keywords
+}
+
+// TicketComment represents a comment on a ticket
+type TicketComment struct {
+	Id         uuid.UUID         `gorm:"type:uuid;primaryKey" json:"id"`
+	TicketId   uuid.UUID         `gorm:"type:uuid;not null" json:"ticket_id"`
+	UserId     uuid.UUID         `gorm:"type:uuid;not null" json:"user_id"`
+	Content    string            `gorm:"type:text;not null" json:"content"`
+	Visibility CommentVisibility `gorm:"type:varchar(20);not null;default:'PUBLIC'" json:"visibility"` // INTERNAL notes are hidden from the requester
+	CreatedAt  time.Time         `json:"created_at"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+
+	// Relations
+	Ticket      Ticket       `gorm:"foreignKey:TicketId" json:"ticket,omitempty"`
+	User        User         `gorm:"foreignKey:UserId" json:"user,omitempty"`
+	Attachments []Attachment `gorm:"foreignKey:CommentId;constraint:OnDelete:SET NULL" json:"attachments,omitempty"` // kept on the ticket if the comment goes
+}
+
+// TicketWatcher subscribes a user to notifications about a ticket they neither created
+// nor are assigned to. Commenting on a ticket subscribes the commenter.
+type TicketWatcher struct {
+	TicketId  uuid.UUID `gorm:"type:uuid;primaryKey" json:"ticket_id"`
+	UserId    uuid.UUID `gorm:"type:uuid;primaryKey;index" json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// Relations
+	User *User `gorm:"foreignKey:UserId;constraint:OnDelete:CASCADE" json:"user,omitempty"`
+}
+
+// InboundEmail is a message received by the inbound mail gateway. Its Message-ID lets
+// replies that quote it in In-Reply-To or References be threaded into the same ticket.
+type InboundEmail struct {
+	MessageId   string     `gorm:"type:varchar(998);primaryKey" json:"message_id"`
+	TicketId    uuid.UUID  `gorm:"type:uuid;not null;index" json:"ticket_id"`
+	CommentId   *uuid.UUID `gorm:"type:uuid" json:"comment_id"` // nil for the message that opened the ticket
+	FromAddress string     `gorm:"type:varchar(255);not null" json:"from_address"`
+	CreatedAt   time.Time  `json:"created_at"`
+
+	// Relations
+	Ticket  *Ticket        `gorm:"foreignKey:TicketId;constraint:OnDelete:CASCADE" json:"-"`
+	Comment *TicketComment `gorm:"foreignKey:CommentId;constraint:OnDelete:SET NULL" json:"-"`
+}
+
+// TicketLink is a typed relation from one ticket to another. RELATED links are stored
+// once, with the lower ticket ID as the source.
+type TicketLink struct {
+	Id              uuid.UUID      `gorm:"type:uuid;primaryKey" json:"id"`
+	SourceTicketId  uuid.UUID      `gorm:"type:uuid;not null;uniqueIndex:idx_ticket_link" json:"source_ticket_id"`
+	TargetTicketId  uuid.UUID      `gorm:"type:uuid;not null;uniqueIndex:idx_ticket_link;index" json:"target_ticket_id"`
+	Type            TicketLinkType `gorm:"type:varchar(20);not null;uniqueIndex:idx_ticket_link" json:"type"`
+	CreatedByUserId *uuid.UUID     `gorm:"type:uuid" json:"created_by_user_id"`
+	CreatedAt       time.Time      `json:"created_at"`
+
+	// Relations
+	SourceTicket  *Ticket `gorm:"foreignKey:SourceTicketId;constraint:OnDelete:CASCADE" json:"source_ticket,omitempty"`
+	TargetTicket  *Ticket `gorm:"foreignKey:TargetTicketId;constraint:OnDelete:CASCADE" json:"target_ticket,omitempty"`
+	CreatedByUser *User   `gorm:"foreignKey:CreatedByUserId;constraint:OnDelete:SET NULL" json:"created_by_user,omitempty"`
+}
+
+// RelationFrom returns the link as seen from the given ticket, which must be its source or target
+func (tl TicketLink) RelationFrom(ticketID uuid.UUID) TicketRelation {
+	if tl.SourceTicketId == ticketID {
+		return TicketRelation{LinkId: tl.Id, Type: tl.Type, TicketId: tl.TargetTicketId, Ticket: tl.TargetTicket.Summary(), CreatedAt: tl.CreatedAt}
+	}
+	return TicketRelation{LinkId: tl.Id, Type: tl.Type.Inverse(), TicketId: tl.SourceTicketId, Ticket: tl.SourceTicket.Summary(), CreatedAt: tl.CreatedAt}
+}
+
+// TicketRelation is a link as seen from one of its tickets, e.g. BLOCKED_BY the other ticket
+type TicketRelation struct {
+	LinkId    uuid.UUID      `json:"link_id"`
+	Type      TicketLinkType `json:"type"`
+	TicketId  uuid.UUID      `json:"ticket_id"` // the other ticket
+	Ticket    *TicketSummary `json:"ticket,omitempty"`
+	CreatedAt time.Time      `json:"created_at"`
+}
+
+// TicketSummary is what a relation shows of the other ticket, which the caller may not
+// otherwise be allowed to see
+type TicketSummary struct {
+	Id       uuid.UUID      `json:"id"`
+	Title    string         `json:"title"`
+	Status   TicketStatus   `json:"status"`
+	Priority TicketPriority `json:"priority"`
+}
+
+// Summary returns the ticket's summary, or nil for a ticket that was not loaded
+func (t *Ticket) Summary() *TicketSummary {
+	if t == nil {
+		return nil
+	}
+	return &TicketSummary{Id: t.Id, Title: t.Title, Status: t.Status, Priority: t.Priority}
+}
+
+// Attachment is a file uploaded to a ticket, optionally to one of its comments.
+// The file itself lives in the blob store under StorageKey.
+type Attachment struct {
+	Id               uuid.UUID  `gorm:"type:uuid;primaryKey" json:"id"`
+	TicketId         uuid.UUID  `gorm:"type:uuid;not null;index" json:"ticket_id"`
+	CommentId        *uuid.UUID `gorm:"type:uuid;index" json:"comment_id"`
+	UploadedByUserId uuid.UUID  `gorm:"type:uuid;not null" json:"uploaded_by_user_id"`
+	FileName         string     `gorm:"type:varchar(255);not null" json:"file_name"`
+	ContentType      string     `gorm:"type:varchar(100);not null" json:"content_type"` // sniffed from the content, not taken from the client
+	Size             int64      `gorm:"not null" json:"size"`
+	Sha256           string     `gorm:"type:varchar(64);not null" json:"sha256"`
+	StorageKey       string     `gorm:"type:varchar(255);not null" json:"-"`
+	ThumbnailKey     *string    `gorm:"type:varchar(255)" json:"-"`
+	Scanned          bool       `gorm:"not null;default:false" json:"scanned"` // false when no virus scanner is configured
+	CreatedAt        time.Time  `json:"created_at"`
+
+	// Signed links for the caller, filled in by the API
+	DownloadURL  string `gorm:"-" json:"download_url,omitempty"`
+	ThumbnailURL string `gorm:"-" json:"thumbnail_url,omitempty"`
+
+	// Relations
+	UploadedByUser *User `gorm:"foreignKey:UploadedByUserId" json:"uploaded_by_user,omitempty"`
 }
 
 // Feedback represents feedback from users
@@ -181,12 +891,13 @@ type AbsenceRequest struct {
 
 // AbsenceRequestComment represents a comment on an absence request
 type AbsenceRequestComment struct {
-	Id               uuid.UUID `gorm:"type:uuid;primaryKey" json:"id"`
-	AbsenceRequestId uuid.UUID `gorm:"type:uuid;not null" json:"absence_request_id"`
-	UserId           uuid.UUID `gorm:"type:uuid;not null" json:"user_id"`
-	Content          string    `gorm:"type:text;not null" json:"content"`
-	CreatedAt        time.Time `json:"created_at"`
-	UpdatedAt        time.Time `json:"updated_at"`
+	Id               uuid.UUID         `gorm:"type:uuid;primaryKey" json:"id"`
+	AbsenceRequestId uuid.UUID         `gorm:"type:uuid;not null" json:"absence_request_id"`
+	UserId           uuid.UUID         `gorm:"type:uuid;not null" json:"user_id"`
+	Content          string            `gorm:"type:text;not null" json:"content"`
+	Visibility       CommentVisibility `gorm:"type:varchar(20);not null;default:'PUBLIC'" json:"visibility"` // INTERNAL notes are for reviewers, not the requester
+	CreatedAt        time.Time         `json:"created_at"`
+	UpdatedAt        time.Time         `json:"updated_at"`
 
 	// Relations
 	AbsenceRequest AbsenceRequest `gorm:"foreignKey:AbsenceRequestId" json:"absence_request,omitempty"`
@@ -204,11 +915,226 @@ type Notification struct {
 	ReadAt            *time.Time       `json:"read_at"`
 	RelatedEntityId   *uuid.UUID       `gorm:"type:uuid" json:"related_entity_id"`
 	RelatedEntityType *string          `gorm:"type:varchar(50)" json:"related_entity_type"`
+	EmailedAt         *time.Time       `json:"emailed_at"` // set once included in an email digest
+
+	// Relations
+	User User `gorm:"foreignKey:UserId" json:"user,omitempty"`
+}
+
+// RefreshToken is a single-use token that can be exchanged for a new access token.
+// Tokens rotated from the same login share a FamilyId so reuse can revoke them all.
+type RefreshToken struct {
+	Id           uuid.UUID  `gorm:"type:uuid;primaryKey" json:"id"`
+	UserId       uuid.UUID  `gorm:"type:uuid;not null;index" json:"user_id"`
+	FamilyId     uuid.UUID  `gorm:"type:uuid;not null;index" json:"family_id"`
+	TokenHash    string     `gorm:"type:varchar(64);not null;uniqueIndex" json:"-"`
+	ExpiresAt    time.Time  `gorm:"not null" json:"expires_at"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UsedAt       *time.Time `json:"used_at"`
+	RevokedAt    *time.Time `json:"revoked_at"`
+	ReplacedById *uuid.UUID `gorm:"type:uuid" json:"replaced_by_id"`
+
+	// Relations
+	User User `gorm:"foreignKey:UserId" json:"user,omitempty"`
+}
+
+// RevokedToken records an access token (by its jti) that must no longer be accepted
+type RevokedToken struct {
+	Jti       string    `gorm:"type:varchar(64);primaryKey" json:"jti"`
+	UserId    uuid.UUID `gorm:"type:uuid;not null" json:"user_id"`
+	ExpiresAt time.Time `gorm:"not null;index" json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// PasswordResetToken is a single-use, expiring token that lets a user set a new password
+type PasswordResetToken struct {
+	Id        uuid.UUID  `gorm:"type:uuid;primaryKey" json:"id"`
+	UserId    uuid.UUID  `gorm:"type:uuid;not null;index" json:"user_id"`
+	TokenHash string     `gorm:"type:varchar(64);not null;uniqueIndex" json:"-"`
+	ExpiresAt time.Time  `gorm:"not null" json:"expires_at"`
+	CreatedAt time.Time  `json:"created_at"`
+	UsedAt    *time.Time `json:"used_at"`
+
+	// Relations
+	User User `gorm:"foreignKey:UserId" json:"user,omitempty"`
+}
+
+// MfaRecoveryCode is a hashed single-use code that can replace a TOTP code
+type MfaRecoveryCode struct {
+	Id        uuid.UUID  `gorm:"type:uuid;primaryKey" json:"id"`
+	UserId    uuid.UUID  `gorm:"type:uuid;not null;index" json:"user_id"`
+	CodeHash  string     `gorm:"type:varchar(64);not null" json:"-"`
+	CreatedAt time.Time  `json:"created_at"`
+	UsedAt    *time.Time `json:"used_at"`
+}
+
+// LoginAttempt records a single login attempt for auditing
+type LoginAttempt struct {
+	Id        uuid.UUID  `gorm:"type:uuid;primaryKey" json:"id"`
+	UserId    *uuid.UUID `gorm:"type:uuid;index" json:"user_id"`
+	Email     string     `gorm:"type:varchar(255);not null;index" json:"email"`
+	IPAddress string     `gorm:"type:varchar(64);not null;index" json:"ip_address"`
+	UserAgent string     `gorm:"type:varchar(512)" json:"user_agent"`
+	Success   bool       `gorm:"not null" json:"success"`
+	Reason    string     `gorm:"type:varchar(50)" json:"reason"`
+	CreatedAt time.Time  `gorm:"index" json:"created_at"`
+}
+
+// OAuthState is a pending browser SSO login: the state, PKCE verifier and nonce sent to
+// the provider, checked and deleted when the provider redirects back
+type OAuthState struct {
+	Id           uuid.UUID `gorm:"type:uuid;primaryKey" json:"id"`
+	StateHash    string    `gorm:"type:varchar(64);not null;uniqueIndex" json:"-"`
+	Provider     string    `gorm:"type:varchar(50);not null" json:"provider"`
+	CodeVerifier string    `gorm:"type:varchar(128);not null" json:"-"`
+	Nonce        string    `gorm:"type:varchar(128);not null" json:"-"`
+	RedirectURI  string    `gorm:"type:varchar(512);not null" json:"redirect_uri"`
+	ExpiresAt    time.Time `gorm:"not null;index" json:"expires_at"`
+	CreatedAt    time.Time `json:"created_at"`
+	// LinkUserId is set when an authenticated user is linking the provider to their account
+	LinkUserId *uuid.UUID `gorm:"type:uuid" json:"link_user_id"`
+}
+
+// SSONonce is a single-use nonce for an ID token login. The client sends it in its sign-in
+// request to the provider, which copies it into the ID token.
+type SSONonce struct {
+	Id        uuid.UUID `gorm:"type:uuid;primaryKey" json:"id"`
+	NonceHash string    `gorm:"type:varchar(64);not null;uniqueIndex" json:"-"`
+	ExpiresAt time.Time `gorm:"not null;index" json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Identity links a user to an account at an SSO provider, by the provider's subject
+type Identity struct {
+	Id         uuid.UUID  `gorm:"type:uuid;primaryKey" json:"id"`
+	UserId     uuid.UUID  `gorm:"type:uuid;not null;index" json:"user_id"`
+	Provider   string     `gorm:"type:varchar(50);not null;uniqueIndex:idx_identity_provider_subject" json:"provider"`
+	Subject    string     `gorm:"type:varchar(255);not null;uniqueIndex:idx_identity_provider_subject" json:"subject"`
+	Email      string     `gorm:"type:varchar(255)" json:"email"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
 
 	// Relations
 	User User `gorm:"foreignKey:UserId" json:"user,omitempty"`
 }
 
+// SSOSettings is the single row of SSO signup settings
+type SSOSettings struct {
+	Id                  int        `gorm:"primaryKey" json:"-"`
+	DefaultDepartmentId *uuid.UUID `gorm:"type:uuid" json:"default_department_id"`
+	OnboardingQueue     bool       `gorm:"not null;default:true" json:"onboarding_queue"`
+	UpdatedAt           time.Time  `json:"updated_at"`
+}
+
+// SSOSignup is a first-time SSO login waiting for approval while the onboarding queue is on
+type SSOSignup struct {
+	Id               uuid.UUID     `gorm:"type:uuid;primaryKey" json:"id"`
+	Provider         string        `gorm:"type:varchar(50);not null;uniqueIndex:idx_sso_signup_provider_subject" json:"provider"`
+	Subject          string        `gorm:"type:varchar(255);not null;uniqueIndex:idx_sso_signup_provider_subject" json:"subject"`
+	Email            string        `gorm:"type:varchar(255);not null" json:"email"`
+	Name             string        `gorm:"type:varchar(255);not null" json:"name"`
+	Status           RequestStatus `gorm:"type:varchar(50);not null;default:'PENDING'" json:"status"`
+	UserId           *uuid.UUID    `gorm:"type:uuid" json:"user_id"`
+	ReviewedByUserId *uuid.UUID    `gorm:"type:uuid" json:"reviewed_by_user_id"`
+	CreatedAt        time.Time     `json:"created_at"`
+	UpdatedAt        time.Time     `json:"updated_at"`
+}
+
+// APIToken is a long-lived, scoped bearer token for scripts and integrations. Only the hash
+// of the secret is stored; Prefix identifies the token in listings.
+type APIToken struct {
+	Id              uuid.UUID  `gorm:"type:uuid;primaryKey" json:"id"`
+	UserId          uuid.UUID  `gorm:"type:uuid;not null;index" json:"user_id"`
+	Name            string     `gorm:"type:varchar(255);not null" json:"name"`
+	Prefix          string     `gorm:"type:varchar(16);not null" json:"prefix"`
+	TokenHash       string     `gorm:"type:varchar(64);not null;uniqueIndex" json:"-"`
+	Scopes          string     `gorm:"type:text;not null" json:"scopes"` // space separated, e.g. "tickets:read shifts:write"
+	ExpiresAt       time.Time  `gorm:"not null" json:"expires_at"`
+	LastUsedAt      *time.Time `json:"last_used_at"`
+	LastUsedIP      string     `gorm:"type:varchar(45)" json:"last_used_ip"`
+	CreatedByUserId uuid.UUID  `gorm:"type:uuid;not null" json:"created_by_user_id"`
+	RevokedAt       *time.Time `json:"revoked_at"`
+	CreatedAt       time.Time  `json:"created_at"`
+
+	// Relations
+	User User `gorm:"foreignKey:UserId" json:"user,omitempty"`
+}
+
+// NotificationPreference turns one channel on or off for one notification type.
+// Without a row the channel's default applies. Turning IN_APP off mutes the type entirely.
+type NotificationPreference struct {
+	Id        uuid.UUID           `gorm:"type:uuid;primaryKey" json:"id"`
+	UserId    uuid.UUID           `gorm:"type:uuid;not null;uniqueIndex:idx_notification_preference" json:"user_id"`
+	Type      NotificationType    `gorm:"type:varchar(50);not null;uniqueIndex:idx_notification_preference" json:"type"`
+	Channel   NotificationChannel `gorm:"type:varchar(20);not null;uniqueIndex:idx_notification_preference" json:"channel"`
+	Enabled   bool                `gorm:"not null" json:"enabled"`
+	UpdatedAt time.Time           `json:"updated_at"`
+}
+
+// NotificationSettings holds a user's quiet hours. During quiet hours nothing is pushed
+// and digests wait; notifications are still stored.
+type NotificationSettings struct {
+	UserId          uuid.UUID `gorm:"type:uuid;primaryKey" json:"user_id"`
+	QuietHoursStart string    `gorm:"type:varchar(5)" json:"quiet_hours_start"` // "22:00", empty for none
+	QuietHoursEnd   string    `gorm:"type:varchar(5)" json:"quiet_hours_end"`   // "07:00"
+	TimeZone        string    `gorm:"type:varchar(64);not null;default:'Europe/Copenhagen'" json:"time_zone"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// InQuietHours reports whether t falls within the user's quiet hours.
+// Quiet hours may wrap midnight, e.g. 22:00 to 07:00.
+func (s NotificationSettings) InQuietHours(t time.Time) bool {
+	start, err1 := time.Parse("15:04", s.QuietHoursStart)
+	end, err2 := time.Parse("15:04", s.QuietHoursEnd)
+	if err1 != nil || err2 != nil || start.Equal(end) {
+		return false
+	}
+
+	if loc, err := time.LoadLocation(s.TimeZone); err == nil {
+		t = t.In(loc)
+	}
+
+	now := t.Hour()*60 + t.Minute()
+	from := start.Hour()*60 + start.Minute()
+	to := end.Hour()*60 + end.Minute()
+
+	if from < to {
+		return now >= from && now < to
+	}
+	return now >= from || now < to
+}
+
+// Announcement is a message to everyone, to some departments or to a role.
+// It is delivered as notifications when PublishAt is reached.
+type Announcement struct {
+	Id              uuid.UUID            `gorm:"type:uuid;primaryKey" json:"id"`
+	Title           string               `gorm:"type:varchar(255);not null" json:"title"`
+	Body            string               `gorm:"type:text;not null" json:"body"` // markdown
+	Audience        AnnouncementAudience `gorm:"type:varchar(20);not null" json:"audience"`
+	AudienceRole    *Role                `gorm:"type:varchar(50)" json:"audience_role"` // set when Audience is ROLE
+	Pinned          bool                 `gorm:"not null;default:false" json:"pinned"`
+	PublishAt       time.Time            `gorm:"not null;index" json:"publish_at"`
+	ExpiresAt       *time.Time           `json:"expires_at"`
+	PublishedAt     *time.Time           `json:"published_at"` // set once notifications have been sent
+	CreatedByUserId uuid.UUID            `gorm:"type:uuid;not null" json:"created_by_user_id"`
+	CreatedAt       time.Time            `json:"created_at"`
+	UpdatedAt       time.Time            `json:"updated_at"`
+
+	// Relations
+	CreatedByUser User         `gorm:"foreignKey:CreatedByUserId" json:"created_by_user,omitempty"`
+	Departments   []Department `gorm:"many2many:announcement_departments" json:"departments,omitempty"` // set when Audience is DEPARTMENTS
+}
+
+// AnnouncementReceipt records that an announcement was delivered to a user and when they read it.
+// DepartmentId is the user's department at delivery, for acknowledgement rates per department.
+type AnnouncementReceipt struct {
+	AnnouncementId uuid.UUID  `gorm:"type:uuid;primaryKey" json:"announcement_id"`
+	UserId         uuid.UUID  `gorm:"type:uuid;primaryKey;index" json:"user_id"`
+	DepartmentId   uuid.UUID  `gorm:"type:uuid;not null" json:"department_id"`
+	CreatedAt      time.Time  `json:"created_at"`
+	ReadAt         *time.Time `json:"read_at"`
+}
+
 // Implement GORM scanner and valuer interfaces for enumerations
 
 // Scan for TicketStatus
@@ -225,6 +1151,20 @@ func (ts TicketStatus) Value() (driver.Value, error) {
 	return string(ts), nil
 }
 
+// Scan for Role
+func (r *Role) Scan(value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	*r = Role(value.(string))
+	return nil
+}
+
+// Value for Role
+func (r Role) Value() (driver.Value, error) {
+	return string(r), nil
+}
+
 // Scan for AbsenceType
 func (at *AbsenceType) Scan(value interface{}) error {
 	if value == nil {
@@ -266,3 +1206,101 @@ func (nt *NotificationType) Scan(value interface{}) error {
 func (nt NotificationType) Value() (driver.Value, error) {
 	return string(nt), nil
 }
+
+// Scan for NotificationChannel
+func (nc *NotificationChannel) Scan(value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	*nc = NotificationChannel(value.(string))
+	return nil
+}
+
+// Value for NotificationChannel
+func (nc NotificationChannel) Value() (driver.Value, error) {
+	return string(nc), nil
+}
+
+// Scan for AnnouncementAudience
+func (aa *AnnouncementAudience) Scan(value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	*aa = AnnouncementAudience(value.(string))
+	return nil
+}
+
+// Value for AnnouncementAudience
+func (aa AnnouncementAudience) Value() (driver.Value, error) {
+	return string(aa), nil
+}
+
+// Scan for TicketPriority
+func (tp *TicketPriority) Scan(value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	*tp = TicketPriority(value.(string))
+	return nil
+}
+
+// Value for TicketPriority
+func (tp TicketPriority) Value() (driver.Value, error) {
+	return string(tp), nil
+}
+
+// Scan for TicketEventType
+func (te *TicketEventType) Scan(value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	*te = TicketEventType(value.(string))
+	return nil
+}
+
+// Value for TicketEventType
+func (te TicketEventType) Value() (driver.Value, error) {
+	return string(te), nil
+}
+
+// Scan for CommentVisibility
+func (cv *CommentVisibility) Scan(value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	*cv = CommentVisibility(value.(string))
+	return nil
+}
+
+// Value for CommentVisibility
+func (cv CommentVisibility) Value() (driver.Value, error) {
+	return string(cv), nil
+}
+
+// Scan for AssignmentStrategy
+func (as *AssignmentStrategy) Scan(value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	*as = AssignmentStrategy(value.(string))
+	return nil
+}
+
+// Value for AssignmentStrategy
+func (as AssignmentStrategy) Value() (driver.Value, error) {
+	return string(as), nil
+}
+
+// Scan for TicketLinkType
+func (lt *TicketLinkType) Scan(value interface{}) error {
+	if value == nil {
+		return nil
+	}
+	*lt = TicketLinkType(value.(string))
+	return nil
+}
+
+// Value for TicketLinkType
+func (lt TicketLinkType) Value() (driver.Value, error) {
+	return string(lt), nil
+}
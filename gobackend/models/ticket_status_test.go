@@ -0,0 +1,51 @@
+package models
+
+import "testing"
+
+func TestTicketStatusTransitions(t *testing.T) {
+	statuses := []TicketStatus{TicketStatusOpen, TicketStatusInProgress, TicketStatusResolved, TicketStatusClosed, TicketStatusCancelled}
+
+	// allowed[from] lists every status from may move to; all other moves are refused
+	allowed := map[TicketStatus][]TicketStatus{
+		TicketStatusOpen:       {TicketStatusInProgress, TicketStatusResolved, TicketStatusCancelled},
+		TicketStatusInProgress: {TicketStatusOpen, TicketStatusResolved, TicketStatusCancelled},
+		TicketStatusResolved:   {TicketStatusOpen, TicketStatusClosed},
+		TicketStatusClosed:     {TicketStatusOpen},
+		TicketStatusCancelled:  nil,
+	}
+
+	for _, from := range statuses {
+		for _, to := range statuses {
+			want := false
+			for _, s := range allowed[from] {
+				want = want || s == to
+			}
+			if got := from.CanTransitionTo(to); got != want {
+				t.Errorf("%s -> %s: got %v, want %v", from, to, got, want)
+			}
+		}
+	}
+}
+
+func TestTicketStatusIsResolved(t *testing.T) {
+	tests := map[TicketStatus]bool{
+		TicketStatusOpen:       false,
+		TicketStatusInProgress: false,
+		TicketStatusResolved:   true,
+		TicketStatusClosed:     true,
+		TicketStatusCancelled:  false,
+	}
+	for status, want := range tests {
+		if got := status.IsResolved(); got != want {
+			t.Errorf("%s.IsResolved() = %v, want %v", status, got, want)
+		}
+	}
+}
+
+func TestTicketStatusValid(t *testing.T) {
+	for _, s := range []TicketStatus{"", "open", "DONE"} {
+		if s.Valid() {
+			t.Errorf("%q.Valid() = true", s)
+		}
+	}
+}
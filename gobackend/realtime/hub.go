@@ -0,0 +1,108 @@
+// Package realtime pushes new notifications to connected clients.
+//
+// Notifications are announced with Postgres NOTIFY in the transaction that creates them.
+// Every backend replica LISTENs on the channel and fans the notification out to the
+// streams its own users have open, so it does not matter which replica a client hit.
+package realtime
+
+import (
+	"sync"
+
+	"stuff/models"
+
+	"github.com/google/uuid"
+)
+
+// subscriptionBuffer is how many notifications may queue for a slow client
+// before it is disconnected and has to resume with Last-Event-ID
+const subscriptionBuffer = 64
+
+// Hub fans notifications out to the subscriptions of each user
+type Hub struct {
+	mu   sync.Mutex
+	subs map[uuid.UUID]map[*Subscription]struct{}
+}
+
+// Subscription receives a user's notifications on C.
+// C is closed when the subscription ends, either by Close or because the client fell behind.
+type Subscription struct {
+	C      <-chan models.Notification
+	c      chan models.Notification
+	userID uuid.UUID
+	hub    *Hub
+}
+
+// NewHub returns an empty hub
+func NewHub() *Hub {
+	return &Hub{subs: make(map[uuid.UUID]map[*Subscription]struct{})}
+}
+
+// Subscribe starts receiving the user's notifications
+func (h *Hub) Subscribe(userID uuid.UUID) *Subscription {
+	c := make(chan models.Notification, subscriptionBuffer)
+	s := &Subscription{C: c, c: c, userID: userID, hub: h}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.subs[userID] == nil {
+		h.subs[userID] = make(map[*Subscription]struct{})
+	}
+	h.subs[userID][s] = struct{}{}
+	return s
+}
+
+// Close ends the subscription. It is safe to call more than once.
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.hub.remove(s)
+}
+
+// HasSubscribers reports whether anyone on this replica is listening for the user
+func (h *Hub) HasSubscribers(userID uuid.UUID) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs[userID]) > 0
+}
+
+// Publish delivers a notification to every subscription of its user without blocking.
+// Subscriptions whose buffer is full are dropped; the client reconnects and catches up from the database.
+func (h *Hub) Publish(n models.Notification) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for s := range h.subs[n.UserId] {
+		select {
+		case s.c <- n:
+		default:
+			h.remove(s)
+		}
+	}
+}
+
+// CloseAll drops every subscription, making clients reconnect and resume
+func (h *Hub) CloseAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, subs := range h.subs {
+		for s := range subs {
+			h.remove(s)
+		}
+	}
+}
+
+// remove unregisters and closes a subscription; h.mu must be held
+func (h *Hub) remove(s *Subscription) {
+	subs := h.subs[s.userID]
+	if _, ok := subs[s]; !ok {
+		return
+	}
+
+	delete(subs, s)
+	if len(subs) == 0 {
+		delete(h.subs, s.userID)
+	}
+	close(s.c)
+}
@@ -0,0 +1,103 @@
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"stuff/models"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"gorm.io/gorm"
+)
+
+// Channel is the Postgres NOTIFY channel new notifications are announced on
+const Channel = "notifications"
+
+// listenRetryDelay is how long to wait before reconnecting a dropped LISTEN connection
+const listenRetryDelay = 5 * time.Second
+
+// announcement is the NOTIFY payload. The notification itself is loaded by ID,
+// which keeps the payload well under the 8000 byte limit.
+type announcement struct {
+	Id     uuid.UUID `json:"id"`
+	UserId uuid.UUID `json:"user_id"`
+}
+
+// Announce queues a NOTIFY for the notification. Postgres delivers it when tx commits,
+// and drops it if tx rolls back.
+func Announce(tx *gorm.DB, n models.Notification) error {
+	payload, err := json.Marshal(announcement{Id: n.Id, UserId: n.UserId})
+	if err != nil {
+		return err
+	}
+	return tx.Exec("SELECT pg_notify(?, ?)", Channel, string(payload)).Error
+}
+
+// Listen relays announced notifications to the hub until ctx is cancelled.
+// It holds its own connection to dsn and reconnects when it drops; clients are
+// disconnected after a reconnect so they resume anything sent in between.
+func (h *Hub) Listen(ctx context.Context, dsn string, db *gorm.DB) {
+	connected := false
+
+	for ctx.Err() == nil {
+		err := h.listen(ctx, dsn, db, func() {
+			if connected {
+				h.CloseAll()
+			}
+			connected = true
+		})
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Printf("notification listener: %v; reconnecting in %s", err, listenRetryDelay)
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(listenRetryDelay):
+		}
+	}
+}
+
+func (h *Hub) listen(ctx context.Context, dsn string, db *gorm.DB, onConnect func()) error {
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{Channel}.Sanitize()); err != nil {
+		return err
+	}
+	onConnect()
+
+	for {
+		msg, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		var a announcement
+		if err := json.Unmarshal([]byte(msg.Payload), &a); err != nil {
+			log.Printf("notification listener: bad payload %q", msg.Payload)
+			continue
+		}
+
+		// Most users are not connected to this replica
+		if !h.HasSubscribers(a.UserId) {
+			continue
+		}
+
+		var n models.Notification
+		if err := db.WithContext(ctx).First(&n, "id = ?", a.Id).Error; err != nil {
+			log.Printf("notification listener: load %s: %v", a.Id, err)
+			continue
+		}
+
+		h.Publish(n)
+	}
+}
@@ -0,0 +1,203 @@
+// Package routing assigns new tickets automatically.
+//
+// Routing rules are tried in position order; the first enabled rule whose conditions all
+// match the ticket names an assignment group. Within the group an agent is picked in turn
+// (ROUND_ROBIN) or by fewest open tickets (LEAST_OPEN). Agents with approved absence
+// today, or without a shift covering the current time, are skipped. When nobody is
+// available the ticket stays unassigned.
+package routing
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"stuff/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Match returns the first enabled rule that matches the ticket, or nil when none does
+func Match(tx *gorm.DB, t models.Ticket) (*models.RoutingRule, error) {
+	var rules []models.RoutingRule
+	if err := tx.Where("enabled = ?", true).Order("position, created_at").Find(&rules).Error; err != nil {
+		return nil, err
+	}
+
+	text := strings.ToLower(t.Title + "\n" + t.Description)
+	var department *uuid.UUID
+
+	for i, rule := range rules {
+		if rule.CategoryId != nil && (t.CategoryId == nil || *t.CategoryId != *rule.CategoryId) {
+			continue
+		}
+
+		if keywords := rule.KeywordList(); len(keywords) > 0 &&
+			!slices.ContainsFunc(keywords, func(k string) bool { return strings.Contains(text, k) }) {
+			continue
+		}
+
+		if rule.DepartmentId != nil {
+			// Only looked up once a rule needs it
+			if department == nil {
+				var requester models.User
+				if err := tx.Select("department_id").First(&requester, "id = ?", t.CreatedByUserId).Error; err != nil {
+					return nil, err
+				}
+				department = &requester.DepartmentId
+			}
+			if *department != *rule.DepartmentId {
+				continue
+			}
+		}
+
+		return &rules[i], nil
+	}
+	return nil, nil
+}
+
+// Assign sets the assignee of an unassigned ticket from the matching rule's group. It
+// returns the rule, or nil when the ticket already has an assignee, no rule matched or
+// nobody in the group is available. It does not save the ticket. Run it in the transaction that saves the ticket, as the group row stays locked
+// until then so concurrent tickets take turns correctly.
+func Assign(tx *gorm.DB, t *models.Ticket, now time.Time) (*models.RoutingRule, error) {
+	if t.AssignedToUserId != nil {
+		return nil, nil
+	}
+
+	rule, err := Match(tx, *t)
+	if err != nil || rule == nil {
+		return nil, err
+	}
+
+	agent, err := PickAgent(tx, rule.GroupId, now)
+	if err != nil || agent == nil {
+		return nil, err
+	}
+
+	t.AssignedToUserId = agent
+	t.AssignedToUser = nil
+	return rule, nil
+}
+
+// PickAgent chooses an available member of the group by the group's strategy and
+// remembers the choice for the next round-robin turn. It returns nil when nobody is available.
+func PickAgent(tx *gorm.DB, groupID uuid.UUID, now time.Time) (*uuid.UUID, error) {
+	var group models.AssignmentGroup
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&group, "id = ?", groupID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	agents, err := availableMembers(tx, groupID, now)
+	if err != nil || len(agents) == 0 {
+		return nil, err
+	}
+
+	order := turnOrder(agents, group.LastAssignedUserId)
+	chosen := order[0]
+	if group.Strategy == models.AssignmentLeastOpen {
+		open, err := openTickets(tx, agents)
+		if err != nil {
+			return nil, err
+		}
+		chosen = leastOpen(order, open)
+	}
+
+	err = tx.Model(&models.AssignmentGroup{}).Where("id = ?", groupID).Update("last_assigned_user_id", chosen).Error
+	if err != nil {
+		return nil, err
+	}
+	return &chosen, nil
+}
+
+// turnOrder returns agents, sorted by ID, rotated to start with the one after last. last
+// need not be among them, e.g. when that agent is off shift.
+func turnOrder(agents []uuid.UUID, last *uuid.UUID) []uuid.UUID {
+	start := 0
+	if last != nil {
+		if i, found := slices.BinarySearchFunc(agents, *last, compareIDs); found {
+			start = i + 1
+		} else {
+			start = i
+		}
+	}
+	return append(agents[start:len(agents):len(agents)], agents[:start]...)
+}
+
+// leastOpen returns the agent with the fewest open tickets, the earliest in order on a tie
+func leastOpen(order []uuid.UUID, open map[uuid.UUID]int64) uuid.UUID {
+	chosen := order[0]
+	for _, id := range order[1:] {
+		if open[id] < open[chosen] {
+			chosen = id
+		}
+	}
+	return chosen
+}
+
+// availableMembers returns the group's members, sorted by ID, who are on a shift now and
+// not on approved absence today
+func availableMembers(tx *gorm.DB, groupID uuid.UUID, now time.Time) ([]uuid.UUID, error) {
+	today := now.Format("2006-01-02")
+
+	var ids []uuid.UUID
+	err := tx.Model(&models.AssignmentGroupMember{}).
+		Where("group_id = ?", groupID).
+		Where("user_id IN (?)", tx.Model(&models.Shift{}).Select("user_id").
+			Where("start_time <= ? AND end_time > ?", now, now)).
+		Where("user_id NOT IN (?)", tx.Model(&models.AbsenceRequest{}).Select("user_id").
+			Where("status = ? AND start_date <= ? AND end_date >= ?", models.RequestStatusApproved, today, today)).
+		Order("user_id").
+		Pluck("user_id", &ids).Error
+	if err != nil {
+		return nil, err
+	}
+
+	// Sort the same way as Go compares IDs, whatever the database collation
+	slices.SortFunc(ids, compareIDs)
+	return ids, nil
+}
+
+// openTickets counts the open and in-progress tickets assigned to each agent
+func openTickets(tx *gorm.DB, agents []uuid.UUID) (map[uuid.UUID]int64, error) {
+	var rows []struct {
+		AssignedToUserId uuid.UUID
+		Count            int64
+	}
+	err := tx.Model(&models.Ticket{}).
+		Select("assigned_to_user_id, COUNT(*) AS count").
+		Where("assigned_to_user_id IN ?", agents).
+		Where("status IN ?", []models.TicketStatus{models.TicketStatusOpen, models.TicketStatusInProgress}).
+		Group("assigned_to_user_id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	open := make(map[uuid.UUID]int64, len(rows))
+	for _, row := range rows {
+		open[row.AssignedToUserId] = row.Count
+	}
+	return open, nil
+}
+
+// Reason describes an assignment made by rule, for the ticket's history. It is empty
+// when rule is nil.
+func Reason(rule *models.RoutingRule) string {
+	if rule == nil {
+		return ""
+	}
+	return fmt.Sprintf("Assigned by routing rule %q", rule.Name)
+}
+
+func compareIDs(a, b uuid.UUID) int {
+	return strings.Compare(a.String(), b.String())
+}
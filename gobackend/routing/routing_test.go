@@ -0,0 +1,94 @@
+package routing
+
+import (
+	"slices"
+	"testing"
+
+	"stuff/models"
+
+	"github.com/google/uuid"
+)
+
+var (
+	agentA = uuid.MustParse("10000000-0000-0000-0000-000000000000")
+	agentB = uuid.MustParse("20000000-0000-0000-0000-000000000000")
+	agentC = uuid.MustParse("30000000-0000-0000-0000-000000000000")
+)
+
+func TestTurnOrder(t *testing.T) {
+	// Between B and C, for an agent who has since gone off shift
+	offShift := uuid.MustParse("25000000-0000-0000-0000-000000000000")
+	afterAll := uuid.MustParse("ffffffff-0000-0000-0000-000000000000")
+
+	tests := []struct {
+		name string
+		last *uuid.UUID
+		want []uuid.UUID
+	}{
+		{name: "first turn", last: nil, want: []uuid.UUID{agentA, agentB, agentC}},
+		{name: "after first", last: &agentA, want: []uuid.UUID{agentB, agentC, agentA}},
+		{name: "after middle", last: &agentB, want: []uuid.UUID{agentC, agentA, agentB}},
+		{name: "wraps around", last: &agentC, want: []uuid.UUID{agentA, agentB, agentC}},
+		{name: "last agent unavailable", last: &offShift, want: []uuid.UUID{agentC, agentA, agentB}},
+		{name: "last agent sorts after everyone", last: &afterAll, want: []uuid.UUID{agentA, agentB, agentC}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agents := []uuid.UUID{agentA, agentB, agentC}
+			if got := turnOrder(agents, tt.last); !slices.Equal(got, tt.want) {
+				t.Errorf("turnOrder = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTurnOrderTakesTurns(t *testing.T) {
+	agents := []uuid.UUID{agentA, agentB, agentC}
+
+	var last *uuid.UUID
+	var got []uuid.UUID
+	for range 7 {
+		chosen := turnOrder(slices.Clone(agents), last)[0]
+		got = append(got, chosen)
+		last = &chosen
+	}
+
+	want := []uuid.UUID{agentA, agentB, agentC, agentA, agentB, agentC, agentA}
+	if !slices.Equal(got, want) {
+		t.Errorf("turns = %v, want %v", got, want)
+	}
+}
+
+func TestLeastOpen(t *testing.T) {
+	tests := []struct {
+		name  string
+		order []uuid.UUID
+		open  map[uuid.UUID]int64
+		want  uuid.UUID
+	}{
+		{name: "fewest", order: []uuid.UUID{agentA, agentB, agentC}, open: map[uuid.UUID]int64{agentA: 3, agentB: 1, agentC: 2}, want: agentB},
+		{name: "no tickets counts as zero", order: []uuid.UUID{agentA, agentB, agentC}, open: map[uuid.UUID]int64{agentA: 1, agentC: 1}, want: agentB},
+		{name: "tie goes to the next turn", order: []uuid.UUID{agentC, agentA, agentB}, open: map[uuid.UUID]int64{agentA: 1, agentB: 1, agentC: 1}, want: agentC},
+		{name: "tie after the fewest", order: []uuid.UUID{agentB, agentC, agentA}, open: map[uuid.UUID]int64{agentB: 2}, want: agentC},
+		{name: "only one", order: []uuid.UUID{agentA}, open: nil, want: agentA},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := leastOpen(tt.order, tt.open); got != tt.want {
+				t.Errorf("leastOpen = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReason(t *testing.T) {
+	if got := Reason(nil); got != "" {
+		t.Errorf("Reason(nil) = %q", got)
+	}
+	rule := &models.RoutingRule{Name: "Printers"}
+	if got, want := Reason(rule), `Assigned by routing rule "Printers"`; got != want {
+		t.Errorf("Reason = %q, want %q", got, want)
+	}
+}
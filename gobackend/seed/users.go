@@ -46,11 +46,12 @@ func SeedUsers(db *gorm.DB) error {
 		name   string
 		email  string
 		deptID uuid.UUID
+		role   models.Role
 	}{
-		{"Alice Admin", "alice@seed.example.com", deptIT.Id},
-		{"Bob Developer", "bob@seed.example.com", deptIT.Id},
-		{"Carol Manager", "carol@seed.example.com", deptHR.Id},
-		{"Dave Sales", "dave@seed.example.com", deptSales.Id},
+		{"Alice Admin", "alice@seed.example.com", deptIT.Id, models.RoleAdmin},
+		{"Bob Developer", "bob@seed.example.com", deptIT.Id, models.RoleEmployee},
+		{"Carol Manager", "carol@seed.example.com", deptHR.Id, models.RoleManager},
+		{"Dave Sales", "dave@seed.example.com", deptSales.Id, models.RoleEmployee},
 	}
 
 	for _, u := range users {
@@ -66,6 +67,7 @@ func SeedUsers(db *gorm.DB) error {
 			Email:        u.email,
 			PasswordHash: string(hashedPassword),
 			DepartmentId: u.deptID,
+			Role:         u.role,
 		}
 		
 		if err := db.Create(&user).Error; err != nil {
@@ -0,0 +1,231 @@
+// Package sla keeps tickets' SLA due dates, first responses and breaches up to date.
+//
+// Due dates are set when a ticket is created and recalculated when its priority or
+// category changes. Breaches of tickets that are still open are found by a background
+// job; a ticket resolved or answered late is marked as breached right away.
+package sla
+
+import (
+	"errors"
+	"time"
+
+	"stuff/events"
+	"stuff/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// FindPolicy returns the policy for a category and priority, or nil when none applies.
+// A policy for both wins over one for the category, which wins over one for the
+// priority, which wins over a default policy for neither.
+func FindPolicy(tx *gorm.DB, categoryID *uuid.UUID, priority models.TicketPriority) (*models.SLAPolicy, error) {
+	query := tx.Preload("Calendar.Holidays").
+		Where("category_id IS NULL OR category_id = ?", categoryID).
+		Where("priority IS NULL OR priority = ?", priority).
+		Order("category_id IS NULL, priority IS NULL, created_at")
+
+	var policy models.SLAPolicy
+	err := query.First(&policy).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// Apply sets the ticket's policy and due dates, counted from when the ticket was created.
+// It does not save the ticket. Breaches are measured again against the new targets.
+func Apply(tx *gorm.DB, t *models.Ticket) error {
+	policy, err := FindPolicy(tx, t.CategoryId, t.Priority)
+	if err != nil {
+		return err
+	}
+
+	t.FirstResponseBreachedAt = nil
+	t.ResolutionBreachedAt = nil
+	if policy == nil {
+		t.SLAPolicyId = nil
+		t.FirstResponseDueAt = nil
+		t.ResolutionDueAt = nil
+		return nil
+	}
+
+	created := t.CreatedAt
+	if created.IsZero() {
+		created = time.Now()
+	}
+
+	firstResponse := dueAt(policy, created, policy.FirstResponseMinutes)
+	resolution := dueAt(policy, created, policy.ResolutionMinutes)
+	t.SLAPolicyId = &policy.Id
+	t.FirstResponseDueAt = &firstResponse
+	t.ResolutionDueAt = &resolution
+
+	// Targets already reached late stay breached; open ones are left to DetectBreaches
+	if t.FirstRespondedAt != nil && t.FirstRespondedAt.After(firstResponse) {
+		t.FirstResponseBreachedAt = &firstResponse
+	}
+	if t.ResolvedAt != nil && t.ResolvedAt.After(resolution) {
+		t.ResolutionBreachedAt = &resolution
+	}
+	return nil
+}
+
+// dueAt counts minutes from start in the policy's calendar, or round the clock without one
+func dueAt(policy *models.SLAPolicy, start time.Time, minutes int) time.Time {
+	d := time.Duration(minutes) * time.Minute
+	if policy.Calendar == nil {
+		return start.Add(d)
+	}
+	return policy.Calendar.AddWorkingTime(start, d)
+}
+
+// Subscribe makes the bus keep SLA tracking in step with ticket changes
+func Subscribe(b *events.Bus) {
+	b.Subscribe(events.TicketUpdated, ticketUpdated)
+	b.Subscribe(events.TicketCommented, ticketCommented)
+}
+
+// ticketUpdated recalculates due dates when the priority or category changes and records
+// the first response and a late resolution
+func ticketUpdated(tx *gorm.DB, e events.Event) error {
+	ev := e.(events.TicketUpdatedEvent)
+	t := ev.After
+
+	if t.Priority != ev.Before.Priority || !sameID(t.CategoryId, ev.Before.CategoryId) {
+		if err := Apply(tx, &t); err != nil {
+			return err
+		}
+		err := tx.Model(&models.Ticket{}).Where("id = ?", t.Id).Updates(map[string]interface{}{
+			"sla_policy_id":              t.SLAPolicyId,
+			"first_response_due_at":      t.FirstResponseDueAt,
+			"resolution_due_at":          t.ResolutionDueAt,
+			"first_response_breached_at": t.FirstResponseBreachedAt,
+			"resolution_breached_at":     t.ResolutionBreachedAt,
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	// Changing the status of someone else's ticket answers it
+	if t.Status != ev.Before.Status && ev.ActorID != t.CreatedByUserId {
+		if err := recordFirstResponse(tx, t, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	if t.ResolvedAt != nil && ev.Before.ResolvedAt == nil && t.ResolutionDueAt != nil && t.ResolvedAt.After(*t.ResolutionDueAt) {
+		return tx.Model(&models.Ticket{}).
+			Where("id = ? AND resolution_breached_at IS NULL", t.Id).
+			Update("resolution_breached_at", *t.ResolutionDueAt).Error
+	}
+	return nil
+}
+
+// ticketCommented records the first response when someone other than the creator writes
+// a public comment; internal notes do not answer the requester
+func ticketCommented(tx *gorm.DB, e events.Event) error {
+	ev := e.(events.TicketCommentedEvent)
+	if ev.ActorID == ev.Ticket.CreatedByUserId || ev.Comment.Visibility == models.CommentVisibilityInternal {
+		return nil
+	}
+
+	at := ev.Comment.CreatedAt
+	if at.IsZero() {
+		at = time.Now()
+	}
+	return recordFirstResponse(tx, ev.Ticket, at)
+}
+
+// recordFirstResponse sets first_responded_at unless the ticket was already answered,
+// marking the first response target as breached when the answer came too late
+func recordFirstResponse(tx *gorm.DB, t models.Ticket, at time.Time) error {
+	updates := map[string]interface{}{"first_responded_at": at}
+
+	var due models.Ticket
+	err := tx.Select("first_response_due_at", "first_response_breached_at").Where("id = ?", t.Id).First(&due).Error
+	if err != nil {
+		return err
+	}
+	if due.FirstResponseDueAt != nil && due.FirstResponseBreachedAt == nil && at.After(*due.FirstResponseDueAt) {
+		updates["first_response_breached_at"] = *due.FirstResponseDueAt
+	}
+
+	return tx.Model(&models.Ticket{}).
+		Where("id = ? AND first_responded_at IS NULL", t.Id).
+		Updates(updates).Error
+}
+
+func sameID(a, b *uuid.UUID) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// breachBatchSize bounds the tickets handled per target in one detection run
+const breachBatchSize = 500
+
+// DetectBreaches marks open tickets that are past a due date as breached and publishes
+// TicketSLABreached for each, once per ticket and target. Each ticket is claimed in its
+// own transaction, so several instances can run it side by side.
+func DetectBreaches(db *gorm.DB, bus *events.Bus, now time.Time) (int, error) {
+	targets := []struct {
+		name    string
+		due     string
+		marker  string
+		pending string
+	}{
+		{events.SLATargetFirstResponse, "first_response_due_at", "first_response_breached_at", "first_responded_at IS NULL"},
+		{events.SLATargetResolution, "resolution_due_at", "resolution_breached_at", "TRUE"},
+	}
+
+	breached := 0
+	for _, target := range targets {
+		// overdue is checked again when claiming, in case the ticket changed meanwhile
+		overdue := func(q *gorm.DB) *gorm.DB {
+			return q.Where("sla_policy_id IS NOT NULL AND resolved_at IS NULL AND status <> ?", models.TicketStatusCancelled).
+				Where(target.marker+" IS NULL").
+				Where(target.pending).
+				Where(target.due+" < ?", now)
+		}
+
+		var tickets []models.Ticket
+		err := db.Scopes(overdue).
+			Order(target.due).
+			Limit(breachBatchSize).
+			Find(&tickets).Error
+		if err != nil {
+			return breached, err
+		}
+
+		for _, t := range tickets {
+			claimed := false
+			err := db.Transaction(func(tx *gorm.DB) error {
+				res := tx.Model(&models.Ticket{}).Scopes(overdue).
+					Where("id = ?", t.Id).
+					Update(target.marker, gorm.Expr(target.due))
+				if res.Error != nil || res.RowsAffected == 0 {
+					return res.Error
+				}
+				claimed = true
+
+				if err := tx.First(&t, "id = ?", t.Id).Error; err != nil {
+					return err
+				}
+				return bus.Publish(tx, events.TicketSLABreachedEvent{Ticket: t, Target: target.name})
+			})
+			if err != nil {
+				return breached, err
+			}
+			if claimed {
+				breached++
+			}
+		}
+	}
+	return breached, nil
+}
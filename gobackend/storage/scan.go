@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// ScanResult is what a virus scanner found
+type ScanResult struct {
+	Scanned   bool   // false when no scanner is configured
+	Infected  bool   // true when the file must be rejected
+	Signature string // what was found, e.g. "Eicar-Test-Signature"
+}
+
+// Scanner checks uploads for malware before they are stored
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) (ScanResult, error)
+}
+
+// ScannerFromEnv builds the scanner configured by SCAN_DRIVER:
+//   - "none" (default) accepts every file without scanning it
+//   - "clamd" streams files to a ClamAV daemon at CLAMD_ADDR (default localhost:3310)
+func ScannerFromEnv() (Scanner, error) {
+	switch driver := os.Getenv("SCAN_DRIVER"); driver {
+	case "", "none":
+		return NoScanner{}, nil
+	case "clamd":
+		addr := os.Getenv("CLAMD_ADDR")
+		if addr == "" {
+			addr = "localhost:3310"
+		}
+		return ClamdScanner{Addr: addr, Timeout: 2 * time.Minute}, nil
+	default:
+		return nil, fmt.Errorf("unknown SCAN_DRIVER %q", driver)
+	}
+}
+
+// NoScanner accepts everything
+type NoScanner struct{}
+
+// Scan reports the file as not scanned
+func (NoScanner) Scan(ctx context.Context, r io.Reader) (ScanResult, error) {
+	return ScanResult{}, nil
+}
+
+// ClamdScanner scans with clamd's INSTREAM command
+type ClamdScanner struct {
+	Addr    string // host:port of clamd's TCP socket
+	Timeout time.Duration
+}
+
+// clamdChunkSize is the size of the chunks streamed to clamd; it must stay below StreamMaxLength
+const clamdChunkSize = 64 << 10
+
+// Scan streams r to clamd and reads the verdict
+func (s ClamdScanner) Scan(ctx context.Context, r io.Reader) (ScanResult, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return ScanResult{}, fmt.Errorf("clamd: %w", err)
+	}
+	defer conn.Close()
+
+	if s.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.Timeout))
+	}
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return ScanResult{}, fmt.Errorf("clamd: %w", err)
+	}
+
+	buf := make([]byte, clamdChunkSize)
+	size := make([]byte, 4)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, werr := conn.Write(size); werr != nil {
+				return ScanResult{}, fmt.Errorf("clamd: %w", werr)
+			}
+			if _, werr := conn.Write(buf[:n]); werr != nil {
+				return ScanResult{}, fmt.Errorf("clamd: %w", werr)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return ScanResult{}, err
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return ScanResult{}, fmt.Errorf("clamd: %w", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return ScanResult{}, fmt.Errorf("clamd: %w", err)
+	}
+	reply = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(reply, "stream:"), "\x00"))
+
+	switch {
+	case reply == "OK":
+		return ScanResult{Scanned: true}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return ScanResult{Scanned: true, Infected: true, Signature: strings.TrimSuffix(reply, " FOUND")}, nil
+	default:
+		return ScanResult{}, fmt.Errorf("clamd: %s", reply)
+	}
+}
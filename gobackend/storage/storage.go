@@ -0,0 +1,115 @@
+// Package storage keeps uploaded files in a pluggable blob store.
+//
+// The backend is chosen with STORAGE_DRIVER:
+//   - "local" (default) writes files under STORAGE_DIR (default ./uploads)
+//   - "s3" stores them in S3_BUCKET on an S3-compatible service such as AWS S3 or MinIO
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNotFound is returned when a key does not exist
+var ErrNotFound = errors.New("storage: object not found")
+
+// Store keeps blobs by key. Keys are slash-separated, e.g. "tickets/<id>/<id>".
+type Store interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// FromEnv builds the store configured by STORAGE_DRIVER
+func FromEnv() (Store, error) {
+	switch driver := os.Getenv("STORAGE_DRIVER"); driver {
+	case "", "local":
+		dir := os.Getenv("STORAGE_DIR")
+		if dir == "" {
+			dir = "./uploads"
+		}
+		return NewLocalStore(dir)
+	case "s3":
+		return s3FromEnv()
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_DRIVER %q", driver)
+	}
+}
+
+// LocalStore keeps blobs as files in a directory
+type LocalStore struct {
+	Dir string
+}
+
+// NewLocalStore creates the directory and returns a LocalStore writing into it
+func NewLocalStore(dir string) (LocalStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return LocalStore{}, err
+	}
+	return LocalStore{Dir: dir}, nil
+}
+
+// path maps a key to a file inside Dir, refusing keys that would escape it
+func (s LocalStore) path(key string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(key))
+	if key == "" || filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("storage: invalid key %q", key)
+	}
+	return filepath.Join(s.Dir, clean), nil
+}
+
+// Put writes the blob through a temporary file, so readers never see a partial file
+func (s LocalStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Get opens the blob
+func (s LocalStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+// Delete removes the blob; deleting a missing blob is not an error
+func (s LocalStore) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
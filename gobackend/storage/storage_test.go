@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalStorePath(t *testing.T) {
+	s := LocalStore{Dir: "/data/uploads"}
+
+	tests := []struct {
+		key  string
+		want string // empty when the key is refused
+	}{
+		{"tickets/a/b", "/data/uploads/tickets/a/b"},
+		{"tickets/./a/../b", "/data/uploads/tickets/b"},
+		{"a/../../b", ""},
+		{"../outside", ""},
+		{"..", ""},
+		{"/etc/passwd", ""},
+		{"", ""},
+		{"..foo", "/data/uploads/..foo"},
+	}
+
+	for _, tt := range tests {
+		got, err := s.path(tt.key)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("path(%q) = %q, want an error", tt.key, got)
+			}
+			continue
+		}
+		if err != nil || got != filepath.FromSlash(tt.want) {
+			t.Errorf("path(%q) = %q, %v, want %q", tt.key, got, err, tt.want)
+		}
+	}
+}
+
+func TestLocalStoreRoundTrip(t *testing.T) {
+	s, err := NewLocalStore(filepath.Join(t.TempDir(), "uploads"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	key := "tickets/1/2"
+
+	if _, err := s.Get(ctx, key); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get before Put: %v, want ErrNotFound", err)
+	}
+
+	if err := s.Put(ctx, key, strings.NewReader("hello"), 5, "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	blob, err := s.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(blob)
+	blob.Close()
+	if string(data) != "hello" {
+		t.Errorf("Get = %q", data)
+	}
+
+	if err := s.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, key); err != nil {
+		t.Errorf("deleting a missing blob: %v", err)
+	}
+	if _, err := s.Get(ctx, key); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get after Delete: %v, want ErrNotFound", err)
+	}
+
+	if err := s.Put(ctx, "../escape", strings.NewReader("x"), 1, "text/plain"); err == nil {
+		t.Error("Put outside the directory succeeded")
+	}
+}
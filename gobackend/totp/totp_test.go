@@ -0,0 +1,126 @@
+package totp
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 key from RFC 6238 appendix B, "12345678901234567890", in base32
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCodeAt(t *testing.T) {
+	// RFC 6238 appendix B vectors, cut to the last six digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		got, err := CodeAt(rfcSecret, Step(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("CodeAt(%d) = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+
+	if _, err := CodeAt("not base32!", 1); err == nil {
+		t.Error("CodeAt accepted an invalid secret")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := Step(now)
+
+	codeAt := func(step int64) string {
+		code, err := CodeAt(rfcSecret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		wantStep int64
+		wantOK   bool
+	}{
+		{name: "current", secret: rfcSecret, code: codeAt(step), wantStep: step, wantOK: true},
+		{name: "previous", secret: rfcSecret, code: codeAt(step - 1), wantStep: step - 1, wantOK: true},
+		{name: "next", secret: rfcSecret, code: codeAt(step + 1), wantStep: step + 1, wantOK: true},
+		{name: "too old", secret: rfcSecret, code: codeAt(step - 2)},
+		{name: "too new", secret: rfcSecret, code: codeAt(step + 2)},
+		{name: "spaces", secret: rfcSecret, code: " 050 471 ", wantStep: step, wantOK: true},
+		{name: "lower-case secret", secret: "gezdgnbvgy3tqojqgezdgnbvgy3tqojq", code: "050471", wantStep: step, wantOK: true},
+		{name: "short", secret: rfcSecret, code: "05047"},
+		{name: "long", secret: rfcSecret, code: "0504710"},
+		{name: "wrong", secret: rfcSecret, code: "000000"},
+		{name: "bad secret", secret: "not base32!", code: "050471"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Validate(tt.secret, tt.code, now)
+			if ok != tt.wantOK || got != tt.wantStep {
+				t.Errorf("Validate = %d, %v, want %d, %v", got, ok, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	a, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(a) != 32 {
+		t.Errorf("secret %q is %d characters, want 32", a, len(a))
+	}
+	if a == b {
+		t.Error("two secrets were the same")
+	}
+	if _, err := CodeAt(a, 1); err != nil {
+		t.Errorf("generated secret cannot be used: %v", err)
+	}
+}
+
+func TestURI(t *testing.T) {
+	u, err := url.Parse(URI("Your Office", "ann@example.com", rfcSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/Your Office:ann@example.com" {
+		t.Errorf("URI = %s", u)
+	}
+	q := u.Query()
+	want := map[string]string{
+		"secret":    rfcSecret,
+		"issuer":    "Your Office",
+		"algorithm": "SHA1",
+		"digits":    "6",
+		"period":    "30",
+	}
+	for k, v := range want {
+		if q.Get(k) != v {
+			t.Errorf("%s = %q, want %q", k, q.Get(k), v)
+		}
+	}
+}